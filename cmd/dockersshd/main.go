@@ -27,10 +27,65 @@
 //
 // All configuration is performed using command line flags.
 //
-//	-port hostname:port
+//	-config file
+//
+// All flags can also be set using a configuration file in yaml or json format.
+// It consists of a mapping from flag names (without the leading '-') to their values.
+// Flags that can be passed multiple times take a list of values.
+// Flags passed on the command line take precedence over the configuration file.
+// For example:
+//
+//	port: ":2222"
+//	unsafe: true
+//	acceptenv:
+//	  - LANG
+//	  - LC_*
+//
+// When receiving a hangup signal, the daemon re-reads all flags from the command line and the configuration file.
+// The new configuration applies to new connections only, existing sessions continue unaffected.
+// The listening address, host keys and whether or not authentication is enabled can not be changed this way.
+// The connection to docker or podman is kept.
+// When the new configuration is invalid, an error is logged and the old configuration is kept.
+//
+//	-port hostname:port, -listen address
 //
 // By default connections on any interface on port 2222 will be accepted.
-// This can be changed using this argument.
+// This can be changed using the '-port' flag, and additional addresses to listen on can be given using the '-listen' flag.
+// The '-listen' flag can be passed multiple times, for example to listen on both an IPv4 and an IPv6 address.
+//
+// Both flags also accept 'unix:path' to listen on a unix socket, and 'systemd' to use the sockets passed via systemd socket activation.
+// To only use some of the sockets passed via systemd, use 'systemd:name', where name is the 'FileDescriptorName=' of the socket.
+// To not listen on port 2222 at all, pass an empty '-port' flag.
+// For example, a socket-activated service could be started using:
+//
+//	dockersshd -port systemd
+//
+//	-proxyprotocol cidr
+//
+// By default, the address of the client is taken from the incoming connection.
+// When running behind a load balancer, such as HAProxy, this is the address of the load balancer instead.
+// This flag can be used to accept the PROXY protocol (version 1 or 2) from the provided source addresses, for example '10.0.0.0/8'.
+// Connections from these addresses must then start with a PROXY protocol header, and the client address it contains is used for logging and all other purposes.
+// Connections from other addresses are used as is.
+// The flag can be passed multiple times.
+//
+//	-allowfrom cidr
+//	-denyfrom cidr
+//
+// By default, connections are accepted from any source address.
+// These flags restrict the source addresses connections are accepted from, and can each be passed multiple times.
+// Connections from addresses matching -denyfrom are always closed.
+// When -allowfrom is given, only connections from matching addresses are accepted.
+// Closed connections are logged together with the reason.
+//
+//	-userallowfrom user=cidr
+//	-userdenyfrom user=cidr
+//
+// These flags work like -allowfrom and -denyfrom, but only apply to a single user.
+// They are checked before the user authenticates.
+// For example, to only accept the user 'deploy' from '10.1.0.0/16':
+//
+//	dockersshd -userallowfrom deploy=10.1.0.0/16
 //
 //	-userlabel label
 //
@@ -47,6 +102,20 @@
 // Connections are accepted if any of the public key signatures match the incoming ssh key.
 // This argument can be used to use a different label instead.
 //
+//	-podman
+//
+// By default, containers are managed by the docker daemon, which is configured using the standard 'DOCKER_*' environment variables.
+// This flag can be used to use podman instead.
+// For this purpose, the docker-compatible api of the podman service is used.
+// The podman service must be running, for example using 'podman system service'.
+//
+//	-podmansocket path
+//
+// By default, the podman service is expected to listen on '/run/podman/podman.sock' when running as root,
+// and on '$XDG_RUNTIME_DIR/podman/podman.sock' otherwise.
+// This flag can be used to use a different socket instead.
+// It has no effect unless the '-podman' flag is also given.
+//
 //	-unsafe
 //
 // This flag can be used to turn off authentication completly.
@@ -67,6 +136,40 @@
 //
 // No escaping is performed on the user-provided shell command.
 //
+//	-scp
+//
+// By default, scp commands are executed within the docker container like any other command, requiring an scp executable inside the container.
+// When this flag is given, the legacy scp protocol (used by 'scp -O') is instead implemented by dockersshd itself.
+// Files are then transferred using the docker archive api, independently of the executables inside the container.
+// Note that in this case files are read and written as the root user of the container, and relative paths are interpreted relative to the root directory.
+//
+//	-sftpserver path
+//
+// By default, the sftp subsystem is not available.
+// This flag enables it by executing the sftp server at the provided path inside the docker container.
+// For example, OpenSSH installs its server at '/usr/lib/openssh/sftp-server' on Debian-based images, and at '/usr/lib/ssh/sftp-server' on Alpine-based images.
+//
+//	-maxauthtries number, -bantime time, -authdelay time, -maxstartups number, -banusers
+//
+// To protect against brute-force attacks, failed authentication attempts are tracked by source address.
+// A connection that does not authenticate using its public keys counts as a single failed attempt, no matter how many keys it offered.
+// After 10 failed attempts within 10 minutes, the source address is banned for 10 minutes.
+// Every following ban of the same source address takes twice as long, up to one day.
+// Failed password attempts are furthermore delayed by half a second, doubled for every recent failure from the same address; public keys are never delayed.
+// At most 10 connections may be unauthenticated at the same time, further connections are closed immediately.
+// These limits can be changed using these flags, a value of 0 disables the respective protection.
+// Note that this protection is enabled by default; clients behind a shared address, such as a NAT, may be banned together.
+// The '-banusers' flag additionally tracks failed attempts, and bans, by username.
+// It is disabled by default, because anyone can then lock out a known user by failing to authenticate as them.
+//
+//	-maxconns number, -maxuserconns number, -maxsessions number, -maxusersessions number, -maxduration time
+//
+// By default, the number of concurrent connections and sessions is not limited.
+// These flags can be used to limit the number of concurrent connections and sessions, both in total and per user.
+// Connections are counted once they have authenticated, including connections only used for port forwarding.
+// Connections exceeding a limit are closed, and sessions exceeding a limit are rejected with an error message.
+// Furthermore, sessions can be limited to a maximum duration, after which they are terminated.
+//
 //	-L host:port, -R host:port
 //
 // To configure the ports to allow traffic to and from certain hosts in the local network via the ssh server, the '-L' and '-R' flags can be used.
@@ -74,6 +177,61 @@
 // '-R' enables the reverse, enabling the ssh client to accept connections at the provided host and port.
 // Both flags can be passed multiple times.
 //
+//	-acceptenv pattern
+//
+// By default, environment variables sent by the ssh client (for example using OpenSSH's 'SendEnv' option) are ignored.
+// This flag can be used to accept variables matching the provided pattern, similar to OpenSSH's 'AcceptEnv' option.
+// Patterns may contain wildcards, for example 'LC_*' accepts all variables starting with 'LC_'.
+// The flag can be passed multiple times.
+//
+// Independent of this flag, the standard 'SSH_CONNECTION', 'SSH_CLIENT' and 'USER' variables are always set.
+//
+//	-allowagent pattern, -agentdir directory, -agentmount path
+//
+// By default, agents forwarded by ssh clients (for example using 'ssh -A') are ignored.
+// The '-allowagent' flag allows users matching the provided pattern to forward their agent, it can be passed multiple times.
+// Patterns may contain wildcards, for example '*' allows all users.
+//
+// Agents are made available inside the container using a unix socket, which is passed to the shell using the 'SSH_AUTH_SOCK' variable.
+// The sockets of a user are created inside the subdirectory of the '-agentdir' directory named after the user.
+// Only this subdirectory must be mounted into the container of the user, never the '-agentdir' directory itself.
+// By default, it is assumed to be mounted at the same path, use '-agentmount' to change this.
+// For example, containers could be started using:
+//
+//	docker run -v /run/proxyssh-agents/alice:/run/proxyssh-agent --label de.tkw1536.proxyssh.user=alice ...
+//
+// and the daemon with '-allowagent alice -agentdir /run/proxyssh-agents -agentmount /run/proxyssh-agent'.
+// Afterwards 'git clone' over ssh works inside of the sessions of 'alice'.
+// Inside of the container, the sockets can be used by root and by any user that knows their random path.
+//
+//	-banner file, -motd file
+//
+// These flags show a banner before authentication and a message of the day after login.
+// Both files are templates in the syntax of the 'text/template' package.
+// They may use the variables '{{.User}}' and '{{.RemoteAddr}}' for the user and address of the client.
+// In the message of the day, '{{.Container}}' is the id of the container the user was matched to.
+// The message of the day is only shown to interactive sessions.
+//
+//	-record directory
+//
+// By default, sessions are not recorded.
+// This flag can be used to record all sessions into files inside the provided directory, which is created if it does not exist.
+// Sessions with a pty are recorded in the asciicast v2 format, and can be replayed using 'asciinema play'.
+// Other sessions are recorded as three files, containing their standard input, output and error respectively.
+// Files are named by the time, user, remote address and id of the session.
+//
+//	-metrics hostname:port
+//
+// By default, no metrics are exposed.
+// This flag can be used to serve prometheus metrics via http on the path '/metrics' of the provided address, for example ':9100'.
+// Metrics include the number of active connections and sessions, authentication attempts, finished sessions by exit code, port forwarding requests and bytes, the latency of docker api calls and memory leak detector results.
+//
+//	-logformat format
+//
+// By default, log messages are written to standard error as free-form text.
+// When format is 'json', each log message is instead written as a single json object per line.
+// Events related to sessions then include fields such as the event type, session id, user, remote address, container id and exit code.
+//
 //	-hostkey prefix
 //
 // The daemon supports two kinds of ssh host keys, an RSA and an ED25519 key.
@@ -83,6 +241,13 @@
 // It is possible to customize where these files are stored.
 // Using this argument their prefix (by default 'hostkey.pem') can be set.
 //
+//	-drain time, -shutdownmessage message
+//
+// When receiving an interrupt or terminate signal, the daemon stops accepting new connections and sends a warning message to all active sessions.
+// It then waits for clients to disconnect, by default for up to 5 seconds.
+// Sessions that are still active afterwards are terminated, and their processes inside of containers are killed.
+// The message and the time to wait can be customized using these flags.
+//
 //	-timeout time
 //
 // By default, SSH connections are terminated after one hour of inactivity.
@@ -95,20 +260,28 @@ package main
 import (
 	"context"
 	"flag"
+	"io"
 	"log"
 	"os"
 	"time"
 
 	"github.com/tkw1536/proxyssh"
 	"github.com/tkw1536/proxyssh/config/dockerexec"
+	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/internal/legal"
+	"github.com/tkw1536/proxyssh/logging"
 
 	"github.com/docker/docker/client"
 )
 
-var logger = log.New(os.Stderr, "", log.LstdFlags)
+var logFormat = logging.FormatText
 
 func main() {
+	logger, err := logging.NewLogger(os.Stderr, logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	sshserver, err := proxyssh.NewServer(
 		logger,
 		options,
@@ -116,44 +289,107 @@ func main() {
 	)
 
 	if err != nil {
-		logger.Fatalf("Failed to initialize server: %s", err)
+		log.Fatalf("Failed to initialize server: %s", err)
 	}
 
-	logger.Printf("Listening on %s", options.ListenAddress)
-	logger.Fatal(sshserver.ListenAndServe())
+	server := proxyssh.NewReloadableServer(logger, sshserver, options, reload)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-var options = &proxyssh.Options{
-	ListenAddress: ":2222",
-	IdleTimeout:   time.Hour,
+var options = newOptions()
+
+// newOptions returns the default options
+func newOptions() *proxyssh.Options {
+	return &proxyssh.Options{
+		ListenAddress: ":2222",
+		IdleTimeout:   time.Hour,
+
+		DisableAuthentication: false,
 
-	DisableAuthentication: false,
+		ForwardAddresses: nil,
+		ReverseAddresses: nil,
 
-	ForwardAddresses: nil,
-	ReverseAddresses: nil,
+		HostKeyPath: "hostkey.pem",
 
-	HostKeyPath: "hostkey.pem",
+		BruteForce: feature.BruteForceProtection{
+			MaxFailures:  10,
+			BanTime:      10 * time.Minute,
+			FailureDelay: time.Second / 2,
+			MaxStartups:  10,
+		},
+
+		ShutdownMessage: "Server is shutting down",
+		DrainTimeout:    5 * time.Second,
+	}
 }
 
-var config = &dockerexec.ContainerExecConfig{
-	Client: nil, // see below
+var config = newConfig()
 
-	DockerLabelUser:     "de.tkw1536.proxyssh.user",
-	DockerLabelAuthFile: "de.tkw1536.proxyssh.authfile",
+// newConfig returns the default configuration
+func newConfig() *dockerexec.ContainerExecConfig {
+	return &dockerexec.ContainerExecConfig{
+		Client:  nil, // see below
+		Runtime: nil, // see below
 
-	ContainerShell: "/bin/sh",
+		DockerLabelUser:     "de.tkw1536.proxyssh.user",
+		DockerLabelAuthFile: "de.tkw1536.proxyssh.authfile",
+
+		ContainerShell: "/bin/sh",
+	}
 }
 
+var podman bool
+var podmanSocket string
+
 func init() {
-	defer flag.Parse()
+	defer proxyssh.ParseFlags(nil, os.Args[1:])
+	registerFlags(flag.CommandLine, &logFormat, options, config, &podman, &podmanSocket)
+}
+
+// registerFlags registers all flags of this command with flagset
+func registerFlags(flagset *flag.FlagSet, logFormat *string, options *proxyssh.Options, config *dockerexec.ContainerExecConfig, podman *bool, podmanSocket *string) {
+	legal.RegisterFlag(flagset)
+	flagset.StringVar(logFormat, "logformat", *logFormat, "Format of log messages, either 'text' or 'json'")
+	options.RegisterFlags(flagset, true)
+	config.RegisterFlags(flagset)
+
+	flagset.BoolVar(podman, "podman", *podman, "Use podman instead of docker")
+	flagset.StringVar(podmanSocket, "podmansocket", *podmanSocket, "Path to the podman socket")
+}
+
+// reload re-reads the configuration from the command line and configuration file.
+// It is called when the server receives a hangup signal.
+func reload() (*proxyssh.Options, []proxyssh.Configuration, error) {
+	dockerClient, dockerRuntime := config.Client, config.Runtime
+	options, config := newOptions(), newConfig()
+
+	flagset := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flagset.SetOutput(io.Discard)
+
+	var logFormat string
+	registerFlags(flagset, &logFormat, options, config, new(bool), new(string))
+	if err := proxyssh.ParseFlags(flagset, os.Args[1:]); err != nil {
+		return nil, nil, err
+	}
+
+	// the connection to docker can not be changed, so keep using the global one
+	config.Client, config.Runtime = dockerClient, dockerRuntime
 
-	legal.RegisterFlag(nil)
-	options.RegisterFlags(nil, true)
-	config.RegisterFlags(nil)
+	return options, []proxyssh.Configuration{config}, nil
 }
 
 func init() {
 	var err error
+	if podman {
+		config.Runtime, err = dockerexec.NewPodmanRuntime(podmanSocket)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	config.Client, err = client.NewEnvClient()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/config/terminal"
+	"github.com/tkw1536/proxyssh/feature"
+)
+
+// console implements the commands available in the sessions of exposshed.
+// They allow users to inspect and close the tunnels of their connection.
+type console struct {
+	// PublicHost is the hostname that reverse tunnels can be reached at from the outside.
+	// When empty, the address that the tunnel listens on, or the hostname of this machine, is used.
+	PublicHost string
+}
+
+// RegisterFlags registers flags representing the console to the provided flagset.
+func (c *console) RegisterFlags(flagset *flag.FlagSet) {
+	flagset.StringVar(&c.PublicHost, "publichost", c.PublicHost, "Hostname that reverse tunnels can be reached at, used to show their public urls")
+}
+
+// Commands returns the commands of the console.
+func (c *console) Commands() *terminal.Commands {
+	commands := terminal.NewCommands()
+	commands.Register(terminal.Command{
+		Name:        "tunnels",
+		Description: "List the tunnels of this connection along with their traffic",
+		Run:         c.runTunnels,
+	})
+	commands.Register(terminal.Command{
+		Name:        "close",
+		Usage:       "<id>",
+		Description: "Close the tunnel with the provided id",
+		MinArgs:     1,
+		MaxArgs:     1,
+		Run:         c.runClose,
+		Complete: func(session *terminal.CommandSession, args []string) []string {
+			if len(args) != 1 {
+				return nil
+			}
+
+			var ids []string
+			for _, tunnel := range feature.Tunnels(session.Session.Context()) {
+				ids = append(ids, strconv.Itoa(tunnel.ID))
+			}
+			return ids
+		},
+	})
+	commands.Register(terminal.Command{
+		Name:        "whoami",
+		Description: "Show the user and address of this connection",
+		Run: func(session *terminal.CommandSession, args []string) error {
+			fmt.Fprintf(session.Output, "%s@%s\n", session.Session.User(), session.Session.RemoteAddr())
+			return nil
+		},
+	})
+	return commands
+}
+
+// runTunnels implements the 'tunnels' command
+func (c *console) runTunnels(session *terminal.CommandSession, args []string) error {
+	tunnels := feature.Tunnels(session.Session.Context())
+	if len(tunnels) == 0 {
+		fmt.Fprintln(session.Output, "No tunnels, use 'ssh -L' or 'ssh -R' to create some")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(session.Output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDIRECTION\tADDRESS\tCONNECTIONS\tIN\tOUT\tAGE\tURL")
+	for _, tunnel := range tunnels {
+		url := "-"
+		if tunnel.Direction == "reverse" {
+			url = c.publicURL(tunnel.Address)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			tunnel.ID,
+			tunnel.Direction,
+			tunnel.Address,
+			tunnel.Connections(),
+			formatBytes(tunnel.BytesIn()),
+			formatBytes(tunnel.BytesOut()),
+			time.Since(tunnel.Started).Truncate(time.Second),
+			url,
+		)
+	}
+	return w.Flush()
+}
+
+// runClose implements the 'close' command
+func (c *console) runClose(session *terminal.CommandSession, args []string) error {
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.Errorf("Invalid tunnel id %q", args[0])
+	}
+	if err := feature.CloseTunnel(session.Session.Context(), id); err != nil {
+		return errors.Errorf("No tunnel with id %d", id)
+	}
+	fmt.Fprintf(session.Output, "Closed tunnel %d\n", id)
+	return nil
+}
+
+// publicURL returns the url a reverse tunnel listening on address can be reached at from the outside.
+func (c *console) publicURL(address feature.NetworkAddress) string {
+	host := c.PublicHost
+	if host == "" {
+		host = address.Hostname
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if hostname, err := os.Hostname(); err == nil {
+			host = hostname
+		}
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(int(address.Port)))
+}
+
+// formatBytes formats a number of bytes in a human-readable way, e.g. "1.5 KiB"
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return strconv.FormatInt(bytes, 10) + " B"
+	}
+
+	value, exp := float64(bytes)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exp])
+}
@@ -8,14 +8,83 @@
 // When a connection is received no authentication is performed and it is accepted by default.
 // It then permits port forwarding and reverse port forwarding as configured using the '-L' and '-R' flags.
 //
+// Sessions receive a console that lists the tunnels held by the same connection.
+// The 'tunnels' command shows all tunnels along with their traffic, and for reverse tunnels the url they can be reached at.
+// The 'close' command closes a tunnel, along with all of its active connections.
+// Type 'help' for a list of all commands, commands and tunnel ids can be completed using the tab key.
+// For example:
+//
+//	ssh -t -R 8080:localhost:3000 -p 2222 user@host
+//
 // # Configuration
 //
 // All configuration is performed using command line flags.
 //
-//	-port hostname:port
+//	-config file
+//
+// All flags can also be set using a configuration file in yaml or json format.
+// It consists of a mapping from flag names (without the leading '-') to their values.
+// Flags that can be passed multiple times take a list of values.
+// Flags passed on the command line take precedence over the configuration file.
+// For example:
+//
+//	port: ":2222"
+//	R:
+//	  - 0.0.0.0:8080
+//	  - 0.0.0.0:8081
+//
+// When receiving a hangup signal, the daemon re-reads all flags from the command line and the configuration file.
+// The new configuration applies to new connections only, existing sessions continue unaffected.
+// The listening address, host keys and whether or not authentication is enabled can not be changed this way.
+// When the new configuration is invalid, an error is logged and the old configuration is kept.
+//
+//	-port hostname:port, -listen address
 //
 // By default connections on any interface on port 2222 will be accepted.
-// This can be changed using this argument.
+// This can be changed using the '-port' flag, and additional addresses to listen on can be given using the '-listen' flag.
+// The '-listen' flag can be passed multiple times, for example to listen on both an IPv4 and an IPv6 address.
+//
+// Both flags also accept 'unix:path' to listen on a unix socket, and 'systemd' to use the sockets passed via systemd socket activation.
+// To only use some of the sockets passed via systemd, use 'systemd:name', where name is the 'FileDescriptorName=' of the socket.
+// To not listen on port 2222 at all, pass an empty '-port' flag.
+// For example, a socket-activated service could be started using:
+//
+//	exposshed -port systemd
+//
+//	-proxyprotocol cidr
+//
+// By default, the address of the client is taken from the incoming connection.
+// When running behind a load balancer, such as HAProxy, this is the address of the load balancer instead.
+// This flag can be used to accept the PROXY protocol (version 1 or 2) from the provided source addresses, for example '10.0.0.0/8'.
+// Connections from these addresses must then start with a PROXY protocol header, and the client address it contains is used for logging and all other purposes.
+// Connections from other addresses are used as is.
+// The flag can be passed multiple times.
+//
+//	-allowfrom cidr
+//	-denyfrom cidr
+//
+// By default, connections are accepted from any source address.
+// These flags restrict the source addresses connections are accepted from, and can each be passed multiple times.
+// Connections from addresses matching -denyfrom are always closed.
+// When -allowfrom is given, only connections from matching addresses are accepted.
+// Closed connections are logged together with the reason.
+//
+//	-userallowfrom user=cidr
+//	-userdenyfrom user=cidr
+//
+// These flags work like -allowfrom and -denyfrom, but only apply to a single user.
+// They are checked before the user authenticates.
+// For example, to only accept the user 'tunnel' from '10.0.0.0/8':
+//
+//	exposshed -userallowfrom tunnel=10.0.0.0/8
+//
+//	-maxconns number, -maxuserconns number, -maxsessions number, -maxusersessions number, -maxduration time
+//
+// By default, the number of concurrent connections and sessions is not limited.
+// These flags can be used to limit the number of concurrent connections and sessions, both in total and per user.
+// Connections are counted once they have authenticated, including connections only used for port forwarding.
+// Connections exceeding a limit are closed, and sessions exceeding a limit are rejected with an error message.
+// Furthermore, sessions can be limited to a maximum duration, after which they are terminated.
 //
 //	-L host:port, -R host:port
 //
@@ -24,6 +93,38 @@
 // '-R' enables the reverse, enabling the ssh client to accept connections at the provided host and port.
 // Both flags can be passed multiple times.
 //
+//	-publichost hostname
+//
+// By default, the urls of reverse tunnels use the address the tunnel listens on, or the hostname of this machine.
+// This flag sets the hostname used instead, for example when the daemon runs behind a load balancer.
+//
+//	-banner file, -motd file
+//
+// These flags show a banner before authentication and a message of the day after login.
+// Both files are templates in the syntax of the 'text/template' package.
+// They may use the variables '{{.User}}' and '{{.RemoteAddr}}' for the user and address of the client.
+// The message of the day is only shown to interactive sessions.
+//
+//	-record directory
+//
+// By default, sessions are not recorded.
+// This flag can be used to record all sessions into files inside the provided directory, which is created if it does not exist.
+// Sessions with a pty are recorded in the asciicast v2 format, and can be replayed using 'asciinema play'.
+// Other sessions are recorded as three files, containing their standard input, output and error respectively.
+// Files are named by the time, user, remote address and id of the session.
+//
+//	-metrics hostname:port
+//
+// By default, no metrics are exposed.
+// This flag can be used to serve prometheus metrics via http on the path '/metrics' of the provided address, for example ':9100'.
+// Metrics include the number of active connections and sessions, authentication attempts, finished sessions by exit code, port forwarding requests and bytes and memory leak detector results.
+//
+//	-logformat format
+//
+// By default, log messages are written to standard error as free-form text.
+// When format is 'json', each log message is instead written as a single json object per line.
+// Events related to sessions then include fields such as the event type, session id, user, remote address and exit code.
+//
 //	-hostkey prefix
 //
 // Te daemon supports two kinds of ssh host keys, an RSA and an ED25519 key.
@@ -33,6 +134,13 @@
 // It is possible to customize where these files are stored.
 // Using this argument their prefix (by default 'hostkey.pem') can be set.
 //
+//	-drain time, -shutdownmessage message
+//
+// When receiving an interrupt or terminate signal, the daemon stops accepting new connections and sends a warning message to all active sessions.
+// It then waits for clients to disconnect, by default for up to 5 seconds.
+// Sessions that are still active afterwards are terminated, and their connections are closed.
+// The message and the time to wait can be customized using these flags.
+//
 //	-timeout time
 //
 // By default, SSH connections are terminated after twelve hours of inactivity.
@@ -44,6 +152,7 @@ package main
 
 import (
 	"flag"
+	"io"
 	"log"
 	"os"
 	"time"
@@ -51,11 +160,17 @@ import (
 	"github.com/tkw1536/proxyssh"
 	"github.com/tkw1536/proxyssh/config/terminal"
 	"github.com/tkw1536/proxyssh/internal/legal"
+	"github.com/tkw1536/proxyssh/logging"
 )
 
-var logger = log.New(os.Stderr, "", log.LstdFlags)
+var logFormat = logging.FormatText
 
 func main() {
+	logger, err := logging.NewLogger(os.Stderr, logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	sshserver, err := proxyssh.NewServer(
 		logger,
 		options,
@@ -63,32 +178,75 @@ func main() {
 	)
 
 	if err != nil {
-		logger.Fatalf("Failed to initialize server: %s", err)
+		log.Fatalf("Failed to initialize server: %s", err)
 	}
 
 	// and run
-	logger.Printf("Listening on %s", options.ListenAddress)
-	logger.Fatal(sshserver.ListenAndServe())
+	server := proxyssh.NewReloadableServer(logger, sshserver, options, reload)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-var options = &proxyssh.Options{
-	ListenAddress: ":2222",
-	IdleTimeout:   12 * time.Hour,
+var options = newOptions()
 
-	DisableAuthentication: true,
+// newOptions returns the default options
+func newOptions() *proxyssh.Options {
+	return &proxyssh.Options{
+		ListenAddress: ":2222",
+		IdleTimeout:   12 * time.Hour,
 
-	ForwardAddresses: nil,
-	ReverseAddresses: nil,
+		DisableAuthentication: true,
 
-	HostKeyPath: "hostkey.pem",
+		ForwardAddresses: nil,
+		ReverseAddresses: nil,
+
+		HostKeyPath: "hostkey.pem",
+
+		ShutdownMessage: "Server is shutting down",
+		DrainTimeout:    5 * time.Second,
+	}
 }
 
-var config = &terminal.REPLConfig{}
+var config, configConsole = newConfig()
+
+// newConfig returns the default configuration, along with the console it uses
+func newConfig() (*terminal.REPLConfig, *console) {
+	c := &console{}
+	return &terminal.REPLConfig{
+		WelcomeMessage: "Welcome {{.User}}, type 'help' for a list of commands",
+		Prompt:         "> ",
+		Commands:       c.Commands(),
+	}, c
+}
 
 func init() {
-	defer flag.Parse()
+	defer proxyssh.ParseFlags(nil, os.Args[1:])
+	registerFlags(flag.CommandLine, &logFormat, options, configConsole)
+}
 
-	legal.RegisterFlag(nil)
-	options.RegisterFlags(nil, false)
-	config.RegisterFlags(nil)
+// registerFlags registers all flags of this command with flagset.
+// The flags of the REPLConfig are not registered: they only enable the sftp subsystem, which requires authentication.
+func registerFlags(flagset *flag.FlagSet, logFormat *string, options *proxyssh.Options, console *console) {
+	legal.RegisterFlag(flagset)
+	flagset.StringVar(logFormat, "logformat", *logFormat, "Format of log messages, either 'text' or 'json'")
+	options.RegisterFlags(flagset, false)
+	console.RegisterFlags(flagset)
+}
+
+// reload re-reads the configuration from the command line and configuration file.
+// It is called when the server receives a hangup signal.
+func reload() (*proxyssh.Options, []proxyssh.Configuration, error) {
+	options := newOptions()
+	config, console := newConfig()
+
+	flagset := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flagset.SetOutput(io.Discard)
+
+	var logFormat string
+	registerFlags(flagset, &logFormat, options, console)
+	if err := proxyssh.ParseFlags(flagset, os.Args[1:]); err != nil {
+		return nil, nil, err
+	}
+	return options, []proxyssh.Configuration{config}, nil
 }
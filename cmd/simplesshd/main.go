@@ -23,10 +23,65 @@
 //
 // All configuration is performed using command line flags.
 //
-//	-port hostname:port
+//	-config file
+//
+// All flags can also be set using a configuration file in yaml or json format.
+// It consists of a mapping from flag names (without the leading '-') to their values.
+// Flags that can be passed multiple times take a list of values.
+// Flags passed on the command line take precedence over the configuration file.
+// For example:
+//
+//	port: ":2222"
+//	shell: /bin/zsh
+//	timeout: 1h
+//	L:
+//	  - localhost:8080
+//	  - localhost:8081
+//
+// When receiving a hangup signal, the daemon re-reads all flags from the command line and the configuration file.
+// The new configuration applies to new connections only, existing sessions continue unaffected.
+// The listening address, host keys and whether or not authentication is enabled can not be changed this way.
+// When the new configuration is invalid, an error is logged and the old configuration is kept.
+//
+//	-port hostname:port, -listen address
 //
 // By default connections on any interface on port 2222 will be accepted.
-// This can be changed using this argument.
+// This can be changed using the '-port' flag, and additional addresses to listen on can be given using the '-listen' flag.
+// The '-listen' flag can be passed multiple times, for example to listen on both an IPv4 and an IPv6 address.
+//
+// Both flags also accept 'unix:path' to listen on a unix socket, and 'systemd' to use the sockets passed via systemd socket activation.
+// To only use some of the sockets passed via systemd, use 'systemd:name', where name is the 'FileDescriptorName=' of the socket.
+// To not listen on port 2222 at all, pass an empty '-port' flag.
+// For example, a socket-activated service could be started using:
+//
+//	simplesshd -port systemd
+//
+//	-proxyprotocol cidr
+//
+// By default, the address of the client is taken from the incoming connection.
+// When running behind a load balancer, such as HAProxy, this is the address of the load balancer instead.
+// This flag can be used to accept the PROXY protocol (version 1 or 2) from the provided source addresses, for example '10.0.0.0/8'.
+// Connections from these addresses must then start with a PROXY protocol header, and the client address it contains is used for logging and all other purposes.
+// Connections from other addresses are used as is.
+// The flag can be passed multiple times.
+//
+//	-allowfrom cidr
+//	-denyfrom cidr
+//
+// By default, connections are accepted from any source address.
+// These flags restrict the source addresses connections are accepted from, and can each be passed multiple times.
+// Connections from addresses matching -denyfrom are always closed.
+// When -allowfrom is given, only connections from matching addresses are accepted.
+// Closed connections are logged together with the reason.
+//
+//	-userallowfrom user=cidr
+//	-userdenyfrom user=cidr
+//
+// These flags work like -allowfrom and -denyfrom, but only apply to a single user.
+// They are checked before the user authenticates.
+// For example, to only accept the user 'alice' from '192.168.1.0/24':
+//
+//	simplesshd -userallowfrom alice=192.168.1.0/24
 //
 //	-shell executable
 //
@@ -43,6 +98,60 @@
 //
 // No escaping is performed on the user-provided shell command.
 //
+//	-runasuser
+//
+// By default, all commands are executed as the user running the simplesshd command, and no authentication is performed.
+// When this flag is given, commands are instead executed as the unix account with the same name as the ssh user.
+// The user id, group ids, home directory and login shell are read from '/etc/passwd', and the login shell is used instead of the '-shell' flag.
+// Users are then authenticated using the '.ssh/authorized_keys' file inside the home directory of the account.
+// This requires simplesshd to run as root.
+//
+//	-sandbox-mountns, -sandbox-pidns, -sandbox-netns, -sandbox-userns
+//
+// On Linux, each session can be started inside of fresh namespaces.
+// These flags create a new mount, pid, network and user namespace respectively.
+// A new network namespace only contains a loopback interface.
+// Inside a new user namespace, commands run as root mapped onto the user they would otherwise run as.
+//
+//	-sandbox-root directory, -sandbox-bind source:target[:ro]
+//
+// Together with a new mount namespace, these flags can be used to use a directory as a read-only root filesystem,
+// and to bind mount host directories into it.
+// The '-sandbox-bind' flag can be passed multiple times.
+//
+//	-sandbox-cpus number, -sandbox-memory bytes, -sandbox-pids number
+//
+// On Linux with cgroups v2, each session can be placed into a new cgroup that limits the cpus, memory and number of processes it may use.
+// These cgroups are created inside '/sys/fs/cgroup/proxyssh', which can be changed using the '-sandbox-cgroup' flag.
+//
+//	-sftp, -sftproot directory
+//
+// By default, the sftp subsystem is not available.
+// The '-sftp' flag enables it, serving files from the host filesystem as the same user and inside the same sandbox that commands are executed in.
+// The '-sftproot' flag additionally changes the root directory of sftp sessions to the provided directory.
+// This requires simplesshd to run as root with the '-runasuser' flag, and can not be combined with the '-sandbox-root' flag.
+//
+//	-maxauthtries number, -bantime time, -authdelay time, -maxstartups number, -banusers
+//
+// To protect against brute-force attacks, failed authentication attempts are tracked by source address.
+// A connection that does not authenticate using its public keys counts as a single failed attempt, no matter how many keys it offered.
+// After 10 failed attempts within 10 minutes, the source address is banned for 10 minutes.
+// Every following ban of the same source address takes twice as long, up to one day.
+// Failed password attempts are furthermore delayed by half a second, doubled for every recent failure from the same address; public keys are never delayed.
+// At most 10 connections may be unauthenticated at the same time, further connections are closed immediately.
+// These limits can be changed using these flags, a value of 0 disables the respective protection.
+// Note that this protection is enabled by default; clients behind a shared address, such as a NAT, may be banned together.
+// The '-banusers' flag additionally tracks failed attempts, and bans, by username.
+// It is disabled by default, because anyone can then lock out a known user by failing to authenticate as them.
+//
+//	-maxconns number, -maxuserconns number, -maxsessions number, -maxusersessions number, -maxduration time
+//
+// By default, the number of concurrent connections and sessions is not limited.
+// These flags can be used to limit the number of concurrent connections and sessions, both in total and per user.
+// Connections are counted once they have authenticated, including connections only used for port forwarding.
+// Connections exceeding a limit are closed, and sessions exceeding a limit are rejected with an error message.
+// Furthermore, sessions can be limited to a maximum duration, after which they are terminated.
+//
 //	-L host:port, -R host:port
 //
 // To configure the ports to allow traffic to and from certain hosts in the local network via the ssh server, the '-L' and '-R' flags can be used.
@@ -50,6 +159,52 @@
 // '-R' enables the reverse, enabling the ssh client to accept connections at the provided host and port.
 // Both flags can be passed multiple times.
 //
+//	-acceptenv pattern
+//
+// By default, environment variables sent by the ssh client (for example using OpenSSH's 'SendEnv' option) are ignored.
+// This flag can be used to accept variables matching the provided pattern, similar to OpenSSH's 'AcceptEnv' option.
+// Patterns may contain wildcards, for example 'LC_*' accepts all variables starting with 'LC_'.
+// The flag can be passed multiple times.
+//
+// Independent of this flag, the standard 'SSH_CONNECTION', 'SSH_CLIENT' and 'USER' variables are always set.
+//
+//	-allowagent pattern, -agentdir directory
+//
+// By default, agents forwarded by ssh clients (for example using 'ssh -A') are ignored.
+// The '-allowagent' flag allows users matching the provided pattern to forward their agent, it can be passed multiple times.
+// Patterns may contain wildcards, for example '*' allows all users.
+//
+// Agents are made available using a unix socket, which is passed to the shell using the 'SSH_AUTH_SOCK' variable.
+// The sockets are created inside a new directory in the '-agentdir' directory, or the default directory for temporary files.
+// When running commands as the unix account of the user, the socket is owned by that account.
+//
+//	-banner file, -motd file
+//
+// These flags show a banner before authentication and a message of the day after login.
+// Both files are templates in the syntax of the 'text/template' package.
+// They may use the variables '{{.User}}' and '{{.RemoteAddr}}' for the user and address of the client.
+// The message of the day is only shown to interactive sessions.
+//
+//	-record directory
+//
+// By default, sessions are not recorded.
+// This flag can be used to record all sessions into files inside the provided directory, which is created if it does not exist.
+// Sessions with a pty are recorded in the asciicast v2 format, and can be replayed using 'asciinema play'.
+// Other sessions are recorded as three files, containing their standard input, output and error respectively.
+// Files are named by the time, user, remote address and id of the session.
+//
+//	-metrics hostname:port
+//
+// By default, no metrics are exposed.
+// This flag can be used to serve prometheus metrics via http on the path '/metrics' of the provided address, for example ':9100'.
+// Metrics include the number of active connections and sessions, authentication attempts, finished sessions by exit code, port forwarding requests and bytes and memory leak detector results.
+//
+//	-logformat format
+//
+// By default, log messages are written to standard error as free-form text.
+// When format is 'json', each log message is instead written as a single json object per line.
+// Events related to sessions then include fields such as the event type, session id, user, remote address and exit code.
+//
 //	-hostkey prefix
 //
 // Te daemon supports two kinds of ssh host keys, an RSA and an ED25519 key.
@@ -59,6 +214,13 @@
 // It is possible to customize where these files are stored.
 // Using this argument their prefix (by default 'hostkey.pem') can be set.
 //
+//	-drain time, -shutdownmessage message
+//
+// When receiving an interrupt or terminate signal, the daemon stops accepting new connections and sends a warning message to all active sessions.
+// It then waits for clients to disconnect, by default for up to 5 seconds.
+// Sessions that are still active afterwards are terminated, and their processes are killed.
+// The message and the time to wait can be customized using these flags.
+//
 //	-timeout time
 //
 // By default, SSH connections are terminated after one hour of inactivity.
@@ -70,18 +232,25 @@ package main
 
 import (
 	"flag"
+	"io"
 	"log"
 	"os"
 	"time"
 
 	"github.com/tkw1536/proxyssh"
 	"github.com/tkw1536/proxyssh/config/osexec"
+	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/internal/legal"
+	"github.com/tkw1536/proxyssh/logging"
 )
 
-var logger = log.New(os.Stderr, "", log.LstdFlags)
+var logFormat = logging.FormatText
 
 func main() {
+	logger, err := logging.NewLogger(os.Stderr, logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	sshserver, err := proxyssh.NewServer(
 		logger,
@@ -90,33 +259,76 @@ func main() {
 	)
 
 	if err != nil {
-		logger.Fatalf("Failed to initialize server: %s", err)
+		log.Fatalf("Failed to initialize server: %s", err)
 	}
 
-	logger.Printf("Listening on %s", options.ListenAddress)
-	logger.Fatal(sshserver.ListenAndServe())
+	server := proxyssh.NewReloadableServer(logger, sshserver, options, reload)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-var options = &proxyssh.Options{
-	ListenAddress: ":2222",
-	IdleTimeout:   time.Hour,
+var options = newOptions()
+
+// newOptions returns the default options
+func newOptions() *proxyssh.Options {
+	return &proxyssh.Options{
+		ListenAddress: ":2222",
+		IdleTimeout:   time.Hour,
+
+		DisableAuthentication: false,
 
-	DisableAuthentication: false,
+		ForwardAddresses: nil,
+		ReverseAddresses: nil,
 
-	ForwardAddresses: nil,
-	ReverseAddresses: nil,
+		HostKeyPath: "hostkey.pem",
 
-	HostKeyPath: "hostkey.pem",
+		BruteForce: feature.BruteForceProtection{
+			MaxFailures:  10,
+			BanTime:      10 * time.Minute,
+			FailureDelay: time.Second / 2,
+			MaxStartups:  10,
+		},
+
+		ShutdownMessage: "Server is shutting down",
+		DrainTimeout:    5 * time.Second,
+	}
 }
 
-var config = &osexec.SystemExecConfig{
-	Shell: "/bin/bash",
+var config = newConfig()
+
+// newConfig returns the default configuration
+func newConfig() *osexec.SystemExecConfig {
+	return &osexec.SystemExecConfig{
+		Shell: "/bin/bash",
+	}
 }
 
 func init() {
-	defer flag.Parse()
+	defer proxyssh.ParseFlags(nil, os.Args[1:])
+	registerFlags(flag.CommandLine, &logFormat, options, config)
+}
+
+// registerFlags registers all flags of this command with flagset
+func registerFlags(flagset *flag.FlagSet, logFormat *string, options *proxyssh.Options, config *osexec.SystemExecConfig) {
+	legal.RegisterFlag(flagset)
+	flagset.StringVar(logFormat, "logformat", *logFormat, "Format of log messages, either 'text' or 'json'")
+	options.RegisterFlags(flagset, false)
+	config.RegisterFlags(flagset)
+}
 
-	legal.RegisterFlag(nil)
-	options.RegisterFlags(nil, false)
-	config.RegisterFlags(nil)
+// reload re-reads the configuration from the command line and configuration file.
+// It is called when the server receives a hangup signal.
+func reload() (*proxyssh.Options, []proxyssh.Configuration, error) {
+	options, config := newOptions(), newConfig()
+
+	flagset := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flagset.SetOutput(io.Discard)
+
+	var logFormat string
+	registerFlags(flagset, &logFormat, options, config)
+	if err := proxyssh.ParseFlags(flagset, os.Args[1:]); err != nil {
+		return nil, nil, err
+	}
+	return options, []proxyssh.Configuration{config}, nil
 }
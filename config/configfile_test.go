@@ -0,0 +1,105 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/config/dockerrun"
+)
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		arguments []string
+
+		wantPort    string
+		wantTimeout time.Duration
+		wantForward string
+		wantImages  string
+		wantErr     string
+	}{
+		{
+			name:        "yaml file",
+			content:     "port: \":2222\"\ntimeout: 1h\nL:\n  - localhost:8080\n  - localhost:8081\nuserimage:\n  alice: debian\n",
+			wantPort:    ":2222",
+			wantTimeout: time.Hour,
+			wantForward: "localhost:8080,localhost:8081",
+			wantImages:  "alice=debian",
+		},
+		{
+			name:        "json file",
+			content:     `{"port": ":2222", "L": ["localhost:8080"]}`,
+			wantPort:    ":2222",
+			wantForward: "localhost:8080",
+		},
+		{
+			name:        "flags override file",
+			content:     "port: \":2222\"\nL:\n  - localhost:8080\n",
+			arguments:   []string{"-port", ":3333", "-L", "localhost:9090"},
+			wantPort:    ":3333",
+			wantForward: "localhost:9090",
+		},
+		{
+			name:    "unknown key",
+			content: "port: \":2222\"\nunknown: true\n",
+			wantErr: `:2: Unknown key "unknown"`,
+		},
+		{
+			name:    "invalid value",
+			content: "port: \":2222\"\n\ntimeout: forever\n",
+			wantErr: `:3: Invalid value for key "timeout"`,
+		},
+		{
+			name:    "invalid list element",
+			content: "L:\n  - localhost:8080\n  - [nested]\n",
+			wantErr: `:3: Invalid value for key "L"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			flagset := flag.NewFlagSet("test", flag.ContinueOnError)
+			flagset.SetOutput(io.Discard)
+
+			options := &proxyssh.Options{}
+			options.RegisterFlags(flagset, false)
+			config := &dockerrun.ContainerRunConfig{}
+			config.RegisterFlags(flagset)
+
+			err := proxyssh.ParseFlags(flagset, append([]string{"-config", path}, tt.arguments...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseFlags() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFlags() error = %v", err)
+			}
+
+			if options.ListenAddress != tt.wantPort {
+				t.Errorf("ParseFlags(): ListenAddress = %q, want %q", options.ListenAddress, tt.wantPort)
+			}
+			if options.IdleTimeout != tt.wantTimeout {
+				t.Errorf("ParseFlags(): IdleTimeout = %s, want %s", options.IdleTimeout, tt.wantTimeout)
+			}
+			if got := flagset.Lookup("L").Value.String(); got != tt.wantForward {
+				t.Errorf("ParseFlags(): L = %q, want %q", got, tt.wantForward)
+			}
+			if got := flagset.Lookup("userimage").Value.String(); got != tt.wantImages {
+				t.Errorf("ParseFlags(): userimage = %q, want %q", got, tt.wantImages)
+			}
+		})
+	}
+}
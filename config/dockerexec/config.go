@@ -3,11 +3,14 @@ package dockerexec
 
 import (
 	"flag"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
-	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
 	"github.com/tkw1536/proxyssh"
 	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/logging"
@@ -15,6 +18,7 @@ import (
 
 // ContainerExecConfig implements a proxyssh.Configuration and proxyssh.Handler that execute user processes within running docker containers.
 // For this purpose it makes use of 'docker exec'.
+// Other container runtimes, such as podman, can be used by setting Runtime.
 //
 // The association of incoming user to a docker container happens via the username.
 // To find a docker container, the server looks for a docker container where a specific label
@@ -42,12 +46,21 @@ import (
 // When the ssh user requested a tty, a tty will be allocated within the container.
 // When no tty was requested, none will be allocated.
 //
+// Processes receive the environment variables of feature.Environ, and TERM when a tty was requested.
+// HOME is not set by the server, instead the container runtime sets it according to the user the process runs as inside the container.
+// SSH_TTY is not set either, because the name of the tty is only known inside of the container.
+//
 // Both the shell and labels to be used can be configured via opts.
 type ContainerExecConfig struct {
 
 	// Client is the docker client to be used to the docker daemon.
+	// It is only used when Runtime is nil.
 	Client client.APIClient
 
+	// Runtime is the container runtime to find containers in and execute processes with.
+	// When nil, uses the docker daemon reachable via Client.
+	Runtime Runtime
+
 	// DockerLabelUser is the label to use for associating a user to a container.
 	DockerLabelUser string
 
@@ -59,6 +72,30 @@ type ContainerExecConfig struct {
 
 	// ContainerShell is the executable to run within the container.
 	ContainerShell string
+
+	// SCP indicates if the legacy scp protocol should be implemented by the server, see SCPProcess.
+	// When set, commands of the form 'scp -t target' and 'scp -f path...' do not run within the container.
+	// Instead files are transferred using the archive functionality of the runtime, as the root user of the container.
+	// This allows scp to work even when the container does not contain an scp executable.
+	//
+	// This has no effect unless the runtime implements ArchiveRuntime.
+	SCP bool
+
+	// SFTPServer is the path to an sftp server executable within the container, such as '/usr/lib/openssh/sftp-server'.
+	// When set, enables the sftp subsystem by executing this server inside the container.
+	SFTPServer string
+
+	// AgentDir is a directory to create the sockets of forwarded agents in, see feature.ListenAgent.
+	// Sockets of a user are created inside the subdirectory of AgentDir named after the user, which is created if it does not exist.
+	// This subdirectory must be bind mounted into the container of the user at AgentMount,
+	// for example using 'docker run -v /run/proxyssh-agents/alice:/run/proxyssh-agent --label de.tkw1536.proxyssh.user=alice'.
+	// When AgentMount is empty, the subdirectory is assumed to be mounted at the same path.
+	//
+	// Agents are only forwarded when AgentDir is set, and only for users allowed by feature.AllowAgentForwarding.
+	// AgentDir itself must never be mounted into a container, as it contains the sockets of all users.
+	// Inside of a container, the sockets can be used by any user that knows their (random) path, and by root.
+	AgentDir   string
+	AgentMount string
 }
 
 // execContextKeys represents context keys for this package
@@ -68,18 +105,26 @@ const (
 	containerContextKey execContextKeys = iota
 )
 
-func (cfg *ContainerExecConfig) findContainer(ctx ssh.Context) (types.Container, error) {
+// runtime returns the runtime to use
+func (cfg *ContainerExecConfig) runtime() Runtime {
+	if cfg.Runtime != nil {
+		return cfg.Runtime
+	}
+	return NewDockerRuntime(cfg.Client)
+}
+
+func (cfg *ContainerExecConfig) findContainer(ctx ssh.Context) (Container, error) {
 	// if we previously fetched the container it will be in the context
 	value := ctx.Value(containerContextKey)
-	container, ok := value.(types.Container)
+	container, ok := value.(Container)
 	if ok {
 		return container, nil
 	}
 
 	// find the actual container
-	container, err := FindUniqueContainer(cfg.Client, cfg.DockerLabelUser, ctx.User())
+	container, err := cfg.runtime().FindContainer(ctx, cfg.DockerLabelUser, ctx.User())
 	if err != nil {
-		return types.Container{}, err
+		return Container{}, err
 	}
 
 	// store it in the context and return
@@ -89,6 +134,12 @@ func (cfg *ContainerExecConfig) findContainer(ctx ssh.Context) (types.Container,
 
 // Apply applies this configuration to the server.
 func (cfg *ContainerExecConfig) Apply(logger logging.Logger, sshserver *ssh.Server) error {
+	if cfg.SFTPServer != "" {
+		if err := proxyssh.ApplySubsystem(logger, sshserver, "sftp", proxyssh.HandlerFunc(cfg.HandleSFTP)); err != nil {
+			return err
+		}
+	}
+
 	sshserver.PublicKeyHandler = feature.AuthorizeKeys(logger, func(ctx ssh.Context) ([]ssh.PublicKey, error) {
 		// find the (unique) associated container
 		container, err := cfg.findContainer(ctx)
@@ -97,7 +148,7 @@ func (cfg *ContainerExecConfig) Apply(logger logging.Logger, sshserver *ssh.Serv
 		}
 
 		// find the keys associated to this container
-		keys := FindContainerKeys(cfg.Client, container, SSHAuthOptions{
+		keys := FindRuntimeKeys(ctx, cfg.runtime(), container, SSHAuthOptions{
 			LabelFile: cfg.DockerLabelAuthFile,
 		})
 
@@ -106,6 +157,11 @@ func (cfg *ContainerExecConfig) Apply(logger logging.Logger, sshserver *ssh.Serv
 	return nil
 }
 
+// Backend implements proxyssh.BackendHandler
+func (cfg *ContainerExecConfig) Backend() string {
+	return "dockerexec"
+}
+
 // Handle implements the handler
 func (cfg *ContainerExecConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
 	userCommand := session.Command()
@@ -124,7 +180,72 @@ func (cfg *ContainerExecConfig) Handle(logger logging.Logger, session ssh.Sessio
 	if err != nil {
 		return nil, err
 	}
-	return NewContainerExecProcess(cfg.Client, container.ID, command), nil
+
+	// handle scp ourselves if requested
+	if archive, ok := cfg.runtime().(ArchiveRuntime); ok && cfg.SCP {
+		if scp, ok := ParseSCPCommand(userCommand); ok {
+			return NewSCPProcess(archive, container, scp), nil
+		}
+	}
+
+	process := NewRuntimeExecProcess(cfg.runtime(), container, command)
+	process.Env = feature.Environ(session)
+
+	// forward the agent if requested
+	if cfg.AgentDir != "" && feature.AgentForwarded(logger, session) {
+		agent, err := cfg.listenAgent(logger, session)
+		if err != nil {
+			return nil, err
+		}
+		process.Agent = agent
+		process.Env = append(process.Env, "SSH_AUTH_SOCK="+cfg.agentPath(agent))
+	}
+
+	return process, nil
+}
+
+// listenAgent creates a socket for the forwarded agent of session inside the subdirectory of AgentDir belonging to the user.
+func (cfg *ContainerExecConfig) listenAgent(logger logging.Logger, session ssh.Session) (*feature.AgentListener, error) {
+	user := session.User()
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, `/\`) {
+		return nil, errors.Errorf("Unable to forward agent for user %q", user)
+	}
+
+	dir := filepath.Join(cfg.AgentDir, user)
+	if err := os.MkdirAll(dir, 0711); err != nil {
+		return nil, errors.Wrap(err, "Unable to create agent directory")
+	}
+
+	agent, err := feature.ListenAgent(logger, session, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := agent.Share(); err != nil {
+		agent.Close()
+		return nil, err
+	}
+	return agent, nil
+}
+
+// agentPath returns the path of the socket of agent inside of the container
+func (cfg *ContainerExecConfig) agentPath(agent *feature.AgentListener) string {
+	mount := cfg.AgentMount
+	if mount == "" {
+		mount = filepath.Dir(agent.Dir)
+	}
+	return path.Join(filepath.ToSlash(mount), filepath.Base(agent.Dir), feature.AgentSocketName)
+}
+
+// HandleSFTP handles a session requesting the sftp subsystem.
+// It executes SFTPServer within the associated container.
+func (cfg *ContainerExecConfig) HandleSFTP(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	container, err := cfg.findContainer(session.Context())
+	if err != nil {
+		return nil, err
+	}
+	process := NewRuntimeExecProcess(cfg.runtime(), container, []string{cfg.SFTPServer})
+	process.Env = feature.Environ(session)
+	return process, nil
 }
 
 // RegisterFlags registers flags representing the config to the provided flagset.
@@ -138,4 +259,9 @@ func (cfg *ContainerExecConfig) RegisterFlags(flagset *flag.FlagSet) {
 	flagset.StringVar(&cfg.DockerLabelAuthFile, "keylabel", cfg.DockerLabelAuthFile, "Label to find the authorized_keys file by")
 
 	flagset.StringVar(&cfg.ContainerShell, "shell", cfg.ContainerShell, "Shell to execute within the container")
+	flagset.BoolVar(&cfg.SCP, "scp", cfg.SCP, "Implement the legacy scp protocol without executing scp within the container")
+	flagset.StringVar(&cfg.SFTPServer, "sftpserver", cfg.SFTPServer, "Path to an sftp server to execute within the container for the sftp subsystem")
+
+	flagset.StringVar(&cfg.AgentDir, "agentdir", cfg.AgentDir, "Directory to create the sockets of forwarded agents in, the subdirectory named after a user must be mounted into their container")
+	flagset.StringVar(&cfg.AgentMount, "agentmount", cfg.AgentMount, "Path the agent directory of a user is mounted at inside their container, defaults to the path of the directory")
 }
@@ -0,0 +1,320 @@
+package dockerexec
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/asyncio"
+)
+
+// NewDockerRuntime returns a new Runtime that uses the docker engine reachable via cli.
+// The returned runtime implements ArchiveRuntime and RunRuntime.
+func NewDockerRuntime(cli client.APIClient) Runtime {
+	return dockerRuntime{client: cli}
+}
+
+// NewPodmanRuntime returns a new Runtime that uses the podman service listening on the unix socket at path.
+// It makes use of the docker-compatible api of podman.
+//
+// When path is empty, uses the default path for the current user.
+// This is '/run/podman/podman.sock' for root, and '$XDG_RUNTIME_DIR/podman/podman.sock' for other users.
+func NewPodmanRuntime(path string) (Runtime, error) {
+	if path == "" {
+		path = "/run/podman/podman.sock"
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Getuid() != 0 {
+			path = filepath.Join(dir, "podman", "podman.sock")
+		}
+	}
+
+	cli, err := client.NewClientWithOpts(client.WithHost("unix://"+path), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create podman client")
+	}
+	return NewDockerRuntime(cli), nil
+}
+
+// dockerRuntime implements Runtime using the docker engine api
+type dockerRuntime struct {
+	client client.APIClient
+}
+
+func (dr dockerRuntime) FindContainer(ctx context.Context, key, value string) (Container, error) {
+	defer feature.ObserveDockerAPI("container_list")()
+
+	container, err := FindUniqueContainerContext(ctx, dr.client, key, value)
+	if err != nil {
+		return Container{}, err
+	}
+	return Container{ID: container.ID, Labels: container.Labels}, nil
+}
+
+func (dr dockerRuntime) ReadFile(ctx context.Context, container Container, path string) ([]byte, error) {
+	defer feature.ObserveDockerAPI("container_copy_from")()
+
+	content, _, err := dr.client.CopyFromContainer(ctx, container.ID, path)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	// the content is a tar archive that contains the file as the first entry.
+	archive := tar.NewReader(content)
+	header, err := archive.Next()
+	if err != nil {
+		return nil, err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil, errors.Errorf("%s is not a regular file", path)
+	}
+	return io.ReadAll(archive)
+}
+
+func (dr dockerRuntime) StatPath(ctx context.Context, c Container, path string) (PathStat, error) {
+	defer feature.ObserveDockerAPI("container_stat_path")()
+
+	stat, err := dr.client.ContainerStatPath(ctx, c.ID, path)
+	if client.IsErrNotFound(err) {
+		return PathStat{}, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return PathStat{}, err
+	}
+	return PathStat{Name: stat.Name, Size: stat.Size, Mode: stat.Mode, Mtime: stat.Mtime}, nil
+}
+
+func (dr dockerRuntime) ReadArchive(ctx context.Context, c Container, path string) (io.ReadCloser, error) {
+	defer feature.ObserveDockerAPI("container_copy_from")()
+
+	content, _, err := dr.client.CopyFromContainer(ctx, c.ID, path)
+	return content, err
+}
+
+func (dr dockerRuntime) WriteArchive(ctx context.Context, c Container, dir string, content io.Reader) error {
+	defer feature.ObserveDockerAPI("container_copy_to")()
+
+	return dr.client.CopyToContainer(ctx, c.ID, dir, content, container.CopyToContainerOptions{})
+}
+
+func (dr dockerRuntime) Exec(ctx context.Context, c Container, options ExecOptions) (Exec, error) {
+	// create the exec
+	done := feature.ObserveDockerAPI("exec_create")
+	res, err := dr.client.ContainerExecCreate(ctx, c.ID, container.ExecOptions{
+		AttachStdin:  true,
+		AttachStderr: true,
+		AttachStdout: true,
+		Tty:          options.Tty,
+		Env:          options.Env,
+		Cmd:          options.Cmd,
+	})
+	done()
+	if err != nil {
+		return nil, err
+	}
+
+	// attach to it
+	done = feature.ObserveDockerAPI("exec_attach")
+	conn, err := dr.client.ContainerExecAttach(ctx, res.ID, container.ExecAttachOptions{
+		Detach: false,
+		Tty:    options.Tty,
+	})
+	done()
+	if err != nil {
+		return nil, err
+	}
+
+	return &dockerExec{client: dr.client, execID: res.ID, attachedStreams: attachedStreams{tty: options.Tty, conn: conn}}, nil
+}
+
+// dockerExec implements Exec using the docker engine api
+type dockerExec struct {
+	client client.APIClient
+	execID string
+
+	attachedStreams
+}
+
+// attachedStreams implements the streams of an Exec using a connection attached to the process
+type attachedStreams struct {
+	tty  bool
+	conn types.HijackedResponse
+}
+
+func (as attachedStreams) Stdin() io.WriteCloser {
+	return attachedStdin{as.conn}
+}
+
+// attachedStdin closes the writing half of the connection only
+type attachedStdin struct {
+	conn types.HijackedResponse
+}
+
+func (as attachedStdin) Write(p []byte) (int, error) { return as.conn.Conn.Write(p) }
+func (as attachedStdin) Close() error                { return as.conn.CloseWrite() }
+
+func (as attachedStreams) CopyOutput(ctx context.Context, stdout, stderr io.Writer) (err error) {
+	if as.tty {
+		_, err = asyncio.CopyLeak(ctx, stdout, as.conn.Reader)
+	} else {
+		_, err = asyncio.StdCopyLeak(ctx, stdout, stderr, as.conn.Reader)
+	}
+	return
+}
+
+func (de *dockerExec) Resize(ctx context.Context, size proxyssh.WindowSize) error {
+	defer feature.ObserveDockerAPI("exec_resize")()
+
+	return de.client.ContainerExecResize(ctx, de.execID, container.ResizeOptions{
+		Height: uint(size.Height),
+		Width:  uint(size.Width),
+	})
+}
+
+func (de *dockerExec) ExitCode(ctx context.Context) (int, error) {
+	defer feature.ObserveDockerAPI("exec_inspect")()
+
+	resp, err := de.client.ContainerExecInspect(ctx, de.execID)
+	return resp.ExitCode, err
+}
+
+func (de *dockerExec) Close() error {
+	de.conn.Close()
+	return nil
+}
+
+func (dr dockerRuntime) Run(ctx context.Context, options RunOptions) (Container, Exec, error) {
+	config := &container.Config{
+		Image:  options.Image,
+		Labels: options.Labels,
+
+		AttachStdin:  true,
+		AttachStderr: true,
+		AttachStdout: true,
+		OpenStdin:    true,
+		StdinOnce:    true,
+		Tty:          options.Tty,
+
+		Env:        options.Env,
+		Entrypoint: []string{},
+		Cmd:        options.Cmd,
+	}
+
+	// create the container, pulling the image if needed
+	id, err := dr.create(ctx, config)
+	if client.IsErrNotFound(err) && options.Pull {
+		if err := dr.pull(ctx, options.Image); err != nil {
+			return Container{}, nil, err
+		}
+		id, err = dr.create(ctx, config)
+	}
+	if err != nil {
+		return Container{}, nil, err
+	}
+
+	run := &dockerRun{client: dr.client, containerID: id}
+	if err := run.start(ctx, options.Tty); err != nil {
+		run.Close()
+		return Container{}, nil, err
+	}
+
+	return Container{ID: id, Labels: options.Labels}, run, nil
+}
+
+// create creates a new container and returns its id
+func (dr dockerRuntime) create(ctx context.Context, config *container.Config) (string, error) {
+	defer feature.ObserveDockerAPI("container_create")()
+
+	res, err := dr.client.ContainerCreate(ctx, config, nil, nil, nil, "")
+	return res.ID, err
+}
+
+// pull pulls the image with the given name
+func (dr dockerRuntime) pull(ctx context.Context, name string) error {
+	defer feature.ObserveDockerAPI("image_pull")()
+
+	progress, err := dr.client.ImagePull(ctx, name, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+
+	_, err = io.Copy(io.Discard, progress)
+	return err
+}
+
+// dockerRun implements Exec for the process of a new container using the docker engine api
+type dockerRun struct {
+	client      client.APIClient
+	containerID string
+
+	attachedStreams
+	waitChan    <-chan container.WaitResponse
+	waitErrChan <-chan error
+}
+
+// start attaches to and starts the container
+func (dr *dockerRun) start(ctx context.Context, tty bool) error {
+	done := feature.ObserveDockerAPI("container_attach")
+	conn, err := dr.client.ContainerAttach(ctx, dr.containerID, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	})
+	done()
+	if err != nil {
+		return err
+	}
+	dr.attachedStreams = attachedStreams{tty: tty, conn: conn}
+
+	// wait for the container to exit before starting it, to not miss the exit
+	dr.waitChan, dr.waitErrChan = dr.client.ContainerWait(ctx, dr.containerID, container.WaitConditionNextExit)
+
+	defer feature.ObserveDockerAPI("container_start")()
+	return dr.client.ContainerStart(ctx, dr.containerID, container.StartOptions{})
+}
+
+func (dr *dockerRun) Resize(ctx context.Context, size proxyssh.WindowSize) error {
+	defer feature.ObserveDockerAPI("container_resize")()
+
+	return dr.client.ContainerResize(ctx, dr.containerID, container.ResizeOptions{
+		Height: uint(size.Height),
+		Width:  uint(size.Width),
+	})
+}
+
+func (dr *dockerRun) ExitCode(ctx context.Context) (int, error) {
+	select {
+	case res := <-dr.waitChan:
+		if res.Error != nil {
+			return 0, errors.New(res.Error.Message)
+		}
+		return int(res.StatusCode), nil
+	case err := <-dr.waitErrChan:
+		return 0, err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (dr *dockerRun) Close() error {
+	if dr.conn.Conn != nil {
+		dr.conn.Close()
+	}
+
+	// the context of the process has likely been closed, so use a new context
+	defer feature.ObserveDockerAPI("container_remove")()
+	return dr.client.ContainerRemove(context.Background(), dr.containerID, container.RemoveOptions{
+		Force:         true,
+		RemoveVolumes: true,
+	})
+}
@@ -4,11 +4,12 @@ import (
 	"context"
 	"os"
 	"strings"
+	"sync"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
 	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/internal/asyncio"
 	"github.com/tkw1536/proxyssh/internal/term"
 	"github.com/tkw1536/proxyssh/logging"
@@ -47,62 +48,112 @@ import (
 //
 // The command will not prefix the entrypoint.
 func NewContainerExecProcess(client client.APIClient, containerID string, command []string) *ContainerExecProcess {
-	config := container.ExecOptions{
-		AttachStdin:  true,
-		AttachStderr: true,
-		AttachStdout: true,
-		Cmd:          command,
+	return NewRuntimeExecProcess(NewDockerRuntime(client), Container{ID: containerID}, command)
+}
+
+// NewRuntimeExecProcess creates a process that executes within a container managed by runtime.
+//
+// The command will not prefix the entrypoint.
+func NewRuntimeExecProcess(runtime Runtime, container Container, command []string) *ContainerExecProcess {
+	return &ContainerExecProcess{
+		runtime: runtime,
+
+		container: container,
+		options: ExecOptions{
+			Cmd: command,
+		},
 	}
+}
 
+// NewContainerRunProcess creates a process that runs inside a new docker container.
+// The container is removed when the process is cleaned up.
+//
+// The command in options will not prefix the entrypoint.
+func NewContainerRunProcess(client client.APIClient, options RunOptions) *ContainerExecProcess {
+	return NewRuntimeRunProcess(NewDockerRuntime(client).(RunRuntime), options)
+}
+
+// NewRuntimeRunProcess creates a process that runs inside a new container created by runtime.
+// The container is removed when the process is cleaned up.
+//
+// The command in options will not prefix the entrypoint.
+func NewRuntimeRunProcess(runtime RunRuntime, options RunOptions) *ContainerExecProcess {
 	return &ContainerExecProcess{
-		client: client,
+		runtime: runtime,
 
-		containerID: containerID,
-		config:      config,
+		run:     &options,
+		options: options.ExecOptions,
 	}
 }
 
-// ContainerExecProcess represents a process running inside a docker engine
+// ContainerExecProcess represents a process running inside a container
 type ContainerExecProcess struct {
 
 	// environment
-	client client.APIClient
-	ctx    context.Context
+	runtime Runtime
+	ctx     context.Context
 
 	// parameters
-	containerID string
-	config      container.ExecOptions
+	container Container
+	options   ExecOptions
+	run       *RunOptions // when non-nil, run in a new container instead
+
+	// Env are environment variables to set for the process.
+	// Each entry is of the form "key=value".
+	// Env must be set before Start is called.
+	Env []string
+
+	// Agent relays connections to the agent forwarded by the client.
+	// It should be reachable from within the container, and is closed by Cleanup.
+	Agent *feature.AgentListener
 
 	// internal streams
 	term.Pipes
 	terminal *term.Pair // used in tty mode
 
-	// state
-	execID string
-	conn   *types.HijackedResponse
+	// state, protected by mu as Cleanup may be called concurrently
+	mu      sync.Mutex
+	exec    Exec
+	cleaned bool // Cleanup has been called
+	exited  bool // the exit code has been received
 
 	// for result handling
 	outputErrChan chan error
 	inputDoneChan chan struct{}
-
-	// for cleanup
-	exited bool
 }
 
+// errCleanedUp is returned when a process has been cleaned up before it was started, or before its exit code was received.
+var errCleanedUp = errors.New("Process has been cleaned up")
+
 // String turns EngineProcess into a string
 func (cep *ContainerExecProcess) String() string {
 	if cep == nil {
 		return ""
 	}
 
-	return cep.containerID + " " + strings.Join(cep.config.Cmd, " ")
+	if cep.run != nil {
+		return cep.run.Image + " " + strings.Join(cep.options.Cmd, " ")
+	}
+	return cep.container.ID + " " + strings.Join(cep.options.Cmd, " ")
+}
+
+// ContainerID returns the id of the container the process runs in.
+// When running in a new container, returns the empty string before the container has been created.
+func (cep *ContainerExecProcess) ContainerID() string {
+	return cep.container.ID
+}
+
+func init() {
+	// ensure that ContainerExecProcess and SCPProcess include the container id in log events
+	var _ proxyssh.ContainerProcess = (*ContainerExecProcess)(nil)
+	var _ proxyssh.ContainerProcess = (*SCPProcess)(nil)
 }
 
 // Init initializes this EngineProcess
 func (cep *ContainerExecProcess) Init(ctx context.Context, detector logging.MemoryLeakDetector, isTerm bool) error {
 	cep.ctx = ctx
 	if isTerm {
-		cep.config.Tty = true
+		cep.options.Tty = true
 		return cep.initTerm()
 	}
 
@@ -124,15 +175,9 @@ func (cep *ContainerExecProcess) initTerm() error {
 
 // Start starts this process
 func (cep *ContainerExecProcess) Start(detector logging.MemoryLeakDetector, Term string, resizeChan <-chan proxyssh.WindowSize, isPty bool) (*os.File, error) {
+	cep.options.Env = append(cep.options.Env, cep.Env...)
 	if isPty {
-		cep.config.Env = append(cep.config.Env, "TERM="+Term)
-
-		cep.terminal.HandleWith(resizeChan, func(size proxyssh.WindowSize) {
-			cep.client.ContainerExecResize(cep.ctx, cep.execID, container.ResizeOptions{
-				Height: uint(size.Height),
-				Width:  uint(size.Width),
-			})
-		})
+		cep.options.Env = append(cep.options.Env, "TERM="+Term)
 	}
 
 	// start streaming
@@ -140,25 +185,33 @@ func (cep *ContainerExecProcess) Start(detector logging.MemoryLeakDetector, Term
 		return nil, err
 	}
 
+	if isPty {
+		exec := cep.exec
+		cep.terminal.HandleWith(resizeChan, func(size proxyssh.WindowSize) {
+			exec.Resize(cep.ctx, size)
+		})
+	}
+
 	// and return
 	return cep.terminal.External(), nil
 }
 
 func (cep *ContainerExecProcess) execAndStream(detector logging.MemoryLeakDetector, isPty bool) error {
 
-	// create the exec
-	res, err := cep.client.ContainerExecCreate(cep.ctx, cep.containerID, cep.config)
+	// create the exec and attach to it
+	exec, err := cep.newExec()
 	if err != nil {
 		return err
 	}
-	cep.execID = res.ID
 
-	// attach to it
-	conn, err := cep.client.ContainerExecAttach(cep.ctx, cep.execID, container.ExecAttachOptions{
-		Detach: false,
-		Tty:    isPty,
-	})
-	cep.conn = &conn
+	cep.mu.Lock()
+	if cep.cleaned {
+		cep.mu.Unlock()
+		exec.Close()
+		return errCleanedUp
+	}
+	cep.exec = exec
+	cep.mu.Unlock()
 
 	// setup channels
 	cep.outputErrChan = make(chan error, 1)
@@ -169,11 +222,13 @@ func (cep *ContainerExecProcess) execAndStream(detector logging.MemoryLeakDetect
 	go func() {
 		defer detector.Done("dockerexec: output")
 
+		var err error
 		if isPty {
-			_, err = asyncio.CopyLeak(cep.ctx, cep.terminal.Internal(), conn.Reader)
+			err = exec.CopyOutput(cep.ctx, cep.terminal.Internal(), nil)
 			cep.terminal.RestoreMode()
 		} else {
-			_, err = asyncio.StdCopyLeak(cep.ctx, cep.StdoutPipe, cep.StderrPipe, conn.Reader)
+			err = exec.CopyOutput(cep.ctx, cep.StdoutPipe, cep.StderrPipe)
+			cep.DrainOutput(cep.ctx)
 		}
 
 		// close output and send error (if any)
@@ -185,18 +240,36 @@ func (cep *ContainerExecProcess) execAndStream(detector logging.MemoryLeakDetect
 	go func() {
 		defer detector.Done("dockerexec: input")
 
+		stdin := exec.Stdin()
 		if isPty {
-			asyncio.CopyLeak(cep.ctx, conn.Conn, cep.terminal.Internal())
+			asyncio.CopyLeak(cep.ctx, stdin, cep.terminal.Internal())
 		} else {
-			asyncio.CopyLeak(cep.ctx, conn.Conn, cep.StdinPipe)
+			asyncio.CopyLeak(cep.ctx, stdin, cep.StdinPipe)
 		}
-		conn.CloseWrite()
+		stdin.Close()
 		close(cep.inputDoneChan)
 	}()
 
 	return nil
 }
 
+// newExec starts the process, either in the container or in a new container
+func (cep *ContainerExecProcess) newExec() (Exec, error) {
+	if cep.run == nil {
+		return cep.runtime.Exec(cep.ctx, cep.container, cep.options)
+	}
+
+	options := *cep.run
+	options.ExecOptions = cep.options
+
+	container, exec, err := cep.runtime.(RunRuntime).Run(cep.ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	cep.container = container
+	return exec, nil
+}
+
 // Wait waits for the process and returns the exit code
 func (cep *ContainerExecProcess) Wait(detector logging.MemoryLeakDetector) (code int, err error) {
 
@@ -208,12 +281,21 @@ func (cep *ContainerExecProcess) Wait(detector logging.MemoryLeakDetector) (code
 		return 0, err
 	}
 
+	cep.mu.Lock()
+	exec, cleaned := cep.exec, cep.cleaned
+	cep.mu.Unlock()
+	if cleaned {
+		return 0, errCleanedUp
+	}
+
 	// inspect and get the actual exit code
-	resp, err := cep.client.ContainerExecInspect(cep.ctx, cep.execID)
+	code, err = exec.ExitCode(cep.ctx)
 	if err == nil {
+		cep.mu.Lock()
 		cep.exited = true
+		cep.mu.Unlock()
 	}
-	return resp.ExitCode, err
+	return code, err
 }
 
 // waitStreams waits for the streams to finish
@@ -234,15 +316,30 @@ func (cep *ContainerExecProcess) waitStreams() error {
 }
 
 // Cleanup cleans up this process, typically to kill it.
+// When running in a new container, the container is removed.
 func (cep *ContainerExecProcess) Cleanup() (killed bool) {
 	cep.terminal.UnhangHack()
 	cep.terminal.Close()
 	cep.ClosePipes()
+	cep.Agent.Close()
+
+	cep.mu.Lock()
+	defer cep.mu.Unlock()
 
-	if cep.conn != nil { // cleanup the connection
-		cep.conn.Close()
-		cep.conn = nil
+	// cleanup only once
+	if cep.cleaned {
+		return cep.run != nil || cep.exited
 	}
+	cep.cleaned = true
 
+	// when no container was created, there is nothing to remove
+	removed := true
+	if cep.exec != nil { // cleanup the connection, but keep the handle for a concurrent Wait
+		removed = cep.exec.Close() == nil
+	}
+
+	if cep.run != nil {
+		return removed // return if the container is gone
+	}
 	return cep.exited // return if we exited
 }
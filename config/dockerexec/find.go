@@ -19,13 +19,18 @@ var ErrContainerNotUnique = errors.New("No unique container found")
 // If there is no unique runing container, returns ErrContainerNotUnique.
 // If something goes wrong, other errors may be returned.
 func FindUniqueContainer(cli client.APIClient, key string, value string) (container_ types.Container, err error) {
+	return FindUniqueContainerContext(context.Background(), cli, key, value)
+}
+
+// FindUniqueContainerContext is like FindUniqueContainer, but aborts listing containers when ctx is done.
+func FindUniqueContainerContext(ctx context.Context, cli client.APIClient, key string, value string) (container_ types.Container, err error) {
 	// Setup a filter for a running container with the given key/value label
 	Filters := filters.NewArgs()
 	Filters.Add("label", fmt.Sprintf("%s=%s", key, value))
 	Filters.Add("status", "running")
 
 	// do the list
-	containers, err := cli.ContainerList(context.Background(), container.ListOptions{
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
 		Filters: Filters,
 	})
 	if err != nil {
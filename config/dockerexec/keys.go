@@ -2,7 +2,6 @@ package dockerexec
 
 import (
 	"context"
-	"io"
 	"strings"
 
 	"github.com/docker/docker/api/types"
@@ -20,12 +19,21 @@ type SSHAuthOptions struct {
 	LabelFile string
 }
 
-// FindContainerKeys finds the public keys desired by a particular container and returns them
+// FindContainerKeys finds the public keys desired by a particular docker container and returns them
 //
 // Location of stored credentials is determined by options.
 //
 // This function will ignore all errors and or invalid values.
 func FindContainerKeys(cli client.APIClient, container types.Container, options SSHAuthOptions) (keys []ssh.PublicKey) {
+	return FindRuntimeKeys(context.Background(), NewDockerRuntime(cli), Container{ID: container.ID, Labels: container.Labels}, options)
+}
+
+// FindRuntimeKeys finds the public keys desired by a container managed by runtime and returns them
+//
+// Location of stored credentials is determined by options.
+//
+// This function will ignore all errors and or invalid values.
+func FindRuntimeKeys(ctx context.Context, runtime Runtime, container Container, options SSHAuthOptions) (keys []ssh.PublicKey) {
 
 	// Check the key label of a provided container for ssh public keys
 	// Note that if LabelKey is "", hasKey will return false because a docker label can not be blank.
@@ -45,14 +53,7 @@ func FindContainerKeys(cli client.APIClient, container types.Container, options
 	// iterate over all files listed in the label and try to read the file pointed to by each one.
 	// If something goes wrong, ignore the error and skip ahead to the next one.
 	for _, path := range strings.Split(filePath, ",") {
-
-		content, _, err := cli.CopyFromContainer(context.Background(), container.ID, path)
-		if err != nil {
-			continue
-		}
-		defer content.Close()
-
-		bytes, err := io.ReadAll(content)
+		bytes, err := runtime.ReadFile(ctx, container, path)
 		if err != nil {
 			continue
 		}
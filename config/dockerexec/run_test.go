@@ -0,0 +1,124 @@
+//go:build dockertest
+// +build dockertest
+
+package dockerexec
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const runTestLabel = "de.tkw01536.test.dockerrun"
+
+// runConfig runs the command of every session in a new alpine container
+type runConfig struct {
+	client client.APIClient
+}
+
+func (cfg runConfig) Apply(logger logging.Logger, sshserver *ssh.Server) error {
+	return nil
+}
+
+func (cfg runConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	return NewContainerRunProcess(cfg.client, RunOptions{
+		ExecOptions: ExecOptions{Cmd: []string{"/bin/sh", "-c", session.RawCommand()}},
+
+		Image:  "alpine",
+		Labels: map[string]string{runTestLabel: "true"},
+		Pull:   true,
+	}), nil
+}
+
+func TestContainerRunProcess(t *testing.T) {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		t.Fatalf("Unable to create docker client: %s", err)
+	}
+	cli.NegotiateAPIVersion(context.Background())
+	defer cli.Close()
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, runConfig{client: cli})
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		command string
+		stdin   string
+
+		wantOut  string
+		wantErr  string
+		wantCode int
+	}{
+		{
+			name:     "echo on both",
+			command:  "echo 'stderr' 1>&2 && echo 'stdout'",
+			stdin:    "",
+			wantOut:  "stdout\n",
+			wantErr:  "stderr\n",
+			wantCode: 0,
+		},
+
+		{
+			name:     "exit code != 0",
+			command:  "exit 3",
+			stdin:    "",
+			wantOut:  "",
+			wantErr:  "",
+			wantCode: 3,
+		},
+
+		{
+			name:     "send stdin to stdout",
+			command:  "cat",
+			stdin:    "Hello world",
+			wantOut:  "Hello world",
+			wantErr:  "",
+			wantCode: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOut, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, tt.command, tt.stdin)
+			if err != nil {
+				t.Errorf("Unable to create test server session: %s", err)
+				t.FailNow()
+			}
+
+			if gotOut != tt.wantOut {
+				t.Errorf("Command() got out = %s, want = %s", gotOut, tt.wantOut)
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("Command() got err = %s, want = %s", gotErr, tt.wantErr)
+			}
+			if gotCode != tt.wantCode {
+				t.Errorf("Command() got code = %d, want = %d", gotCode, tt.wantCode)
+			}
+		})
+	}
+
+	integrationtest.AssertLeakDetector(t, len(tests))
+
+	t.Run("containers are removed", func(t *testing.T) {
+		Filters := filters.NewArgs()
+		Filters.Add("label", runTestLabel)
+
+		containers, err := cli.ContainerList(context.Background(), container.ListOptions{All: true, Filters: Filters})
+		if err != nil {
+			t.Fatalf("Unable to list containers: %s", err)
+		}
+		if len(containers) != 0 {
+			t.Errorf("Found %d containers that were not removed", len(containers))
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package dockerexec
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/tkw1536/proxyssh"
+)
+
+// Runtime represents a container runtime that ContainerExecConfig can execute processes in.
+//
+// The default implementation uses the docker engine, see NewDockerRuntime.
+type Runtime interface {
+	// FindContainer finds a unique running container where the label key is equal to value.
+	//
+	// If there is no unique running container, returns ErrContainerNotUnique.
+	// If something goes wrong, other errors may be returned.
+	FindContainer(ctx context.Context, key, value string) (Container, error)
+
+	// ReadFile reads the content of the file at path within container.
+	ReadFile(ctx context.Context, container Container, path string) ([]byte, error)
+
+	// Exec starts a new process within container and attaches to it.
+	Exec(ctx context.Context, container Container, options ExecOptions) (Exec, error)
+}
+
+// ArchiveRuntime is a Runtime that can additionally copy files from and to containers using tar archives.
+// Files are read and written independently of the user that processes run as.
+type ArchiveRuntime interface {
+	Runtime
+
+	// StatPath returns information about the file or directory at path within container.
+	// If path does not exist, the returned error satisfies os.IsNotExist.
+	StatPath(ctx context.Context, container Container, path string) (PathStat, error)
+
+	// ReadArchive returns a tar archive of the file or directory at path within container.
+	// The entries of the archive are named relative to the parent directory of path.
+	ReadArchive(ctx context.Context, container Container, path string) (io.ReadCloser, error)
+
+	// WriteArchive extracts the tar archive content into the existing directory dir within container.
+	WriteArchive(ctx context.Context, container Container, dir string, content io.Reader) error
+}
+
+// RunRuntime is a Runtime that can additionally run processes in new containers.
+type RunRuntime interface {
+	Runtime
+
+	// Run creates a new container, attaches to it and starts it.
+	// The process of the container ignores the entrypoint of the image.
+	// Closing the returned Exec removes the container.
+	Run(ctx context.Context, options RunOptions) (Container, Exec, error)
+}
+
+// RunOptions are options for a process within a new container.
+type RunOptions struct {
+	ExecOptions
+
+	Image  string            // image to create the container from
+	Labels map[string]string // labels to add to the container
+	Pull   bool              // pull the image when it does not exist locally
+}
+
+// PathStat describes a file or directory within a container.
+type PathStat struct {
+	Name  string
+	Size  int64
+	Mode  os.FileMode
+	Mtime time.Time
+}
+
+// Container represents a container managed by a runtime.
+type Container struct {
+	ID     string
+	Labels map[string]string
+}
+
+// ExecOptions are options for a new process within a container.
+type ExecOptions struct {
+	Cmd []string // command to run
+	Env []string // environment variables of the form "key=value"
+	Tty bool     // allocate a tty
+}
+
+// Exec represents a process running within a container.
+type Exec interface {
+	// Stdin returns a writer to the standard input of the process.
+	// Closing it signals the end of input to the process, but keeps the output open.
+	Stdin() io.WriteCloser
+
+	// CopyOutput copies the output of the process to stdout and stderr until the output ends.
+	// When the process was started with a tty, all output is written to stdout and stderr is not used.
+	CopyOutput(ctx context.Context, stdout, stderr io.Writer) error
+
+	// Resize resizes the tty of the process.
+	Resize(ctx context.Context, size proxyssh.WindowSize) error
+
+	// ExitCode returns the exit code of the process.
+	// It should only be called after the output has ended.
+	ExitCode(ctx context.Context) (int, error)
+
+	// Close closes all resources associated with this process.
+	Close() error
+}
@@ -0,0 +1,487 @@
+package dockerexec
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// fakeRuntime is an in-process Runtime used for testing.
+// Commands are executed by calling run.
+type fakeRuntime struct {
+	containers []Container
+	files      map[string]map[string][]byte // container id => path => content
+
+	run func(options ExecOptions, stdin io.Reader, stdout, stderr io.Writer) int
+}
+
+func (fr *fakeRuntime) FindContainer(ctx context.Context, key, value string) (Container, error) {
+	var found []Container
+	for _, container := range fr.containers {
+		if container.Labels[key] == value {
+			found = append(found, container)
+		}
+	}
+	if len(found) != 1 {
+		return Container{}, ErrContainerNotUnique
+	}
+	return found[0], nil
+}
+
+func (fr *fakeRuntime) ReadFile(ctx context.Context, container Container, path string) ([]byte, error) {
+	content, ok := fr.files[container.ID][path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return content, nil
+}
+
+func (fr *fakeRuntime) Exec(ctx context.Context, container Container, options ExecOptions) (Exec, error) {
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	stderrR, stderrW := io.Pipe()
+
+	fe := &fakeExec{stdin: stdinW, stdout: stdoutR, stderr: stderrR, done: make(chan struct{})}
+	go func() {
+		defer close(fe.done)
+		fe.code = fr.run(options, stdinR, stdoutW, stderrW)
+		stdinR.Close()
+		stdoutW.Close()
+		stderrW.Close()
+	}()
+	return fe, nil
+}
+
+type fakeExec struct {
+	stdin          *io.PipeWriter
+	stdout, stderr *io.PipeReader
+
+	done chan struct{}
+	code int
+}
+
+func (fe *fakeExec) Stdin() io.WriteCloser { return fe.stdin }
+
+func (fe *fakeExec) CopyOutput(ctx context.Context, stdout, stderr io.Writer) error {
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stderr, fe.stderr)
+		errChan <- err
+	}()
+	if _, err := io.Copy(stdout, fe.stdout); err != nil {
+		return err
+	}
+	return <-errChan
+}
+
+func (fe *fakeExec) Resize(ctx context.Context, size proxyssh.WindowSize) error { return nil }
+
+func (fe *fakeExec) ExitCode(ctx context.Context) (int, error) {
+	<-fe.done
+	return fe.code, nil
+}
+
+func (fe *fakeExec) Close() error {
+	fe.stdout.Close()
+	fe.stderr.Close()
+	return nil
+}
+
+// runFakeShell runs a tiny subset of '/bin/sh -c command' in process
+func runFakeShell(options ExecOptions, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(options.Cmd) != 3 || options.Cmd[0] != "/bin/sh" || options.Cmd[1] != "-c" {
+		return 127
+	}
+
+	command, arg, _ := strings.Cut(options.Cmd[2], " ")
+	switch command {
+	case "echo":
+		io.WriteString(stdout, arg+"\n")
+	case "warn":
+		io.WriteString(stderr, arg+"\n")
+	case "cat":
+		io.Copy(stdout, stdin)
+	case "exit":
+		code, _ := strconv.Atoi(arg)
+		return code
+	case "detach":
+		// close the output, but keep running
+		stdout.(io.Closer).Close()
+		stderr.(io.Closer).Close()
+		seconds, _ := strconv.Atoi(arg)
+		time.Sleep(time.Duration(seconds) * time.Second)
+	default:
+		return 127
+	}
+	return 0
+}
+
+var testPrivateKeyFake, testPublicKeyFake = testutils.GenerateRSATestKeyPair()
+var testPrivateKeyOther, _ = testutils.GenerateRSATestKeyPair()
+
+func TestRuntimeFake(t *testing.T) {
+	runtime := &fakeRuntime{
+		containers: []Container{
+			{ID: "other", Labels: map[string]string{"de.tkw01536.test.user": "other"}},
+			{ID: "user", Labels: map[string]string{
+				"de.tkw01536.test.user": "user",
+				"de.tkw01536.test.file": "/does/not/exist,/root/.ssh/authorized_keys",
+			}},
+		},
+		files: map[string]map[string][]byte{
+			"user": {
+				"/root/.ssh/authorized_keys": []byte(testutils.AuthorizedKeysString(testPublicKeyFake) + "\n"),
+			},
+		},
+		run: runFakeShell,
+	}
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, &ContainerExecConfig{
+		Runtime: runtime,
+
+		DockerLabelUser:     "de.tkw01536.test.user",
+		DockerLabelAuthFile: "de.tkw01536.test.file",
+
+		ContainerShell: "/bin/sh",
+	})
+	defer cleanup()
+
+	t.Run("unknown key is rejected", func(t *testing.T) {
+		_, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{
+			Auth: []gossh.AuthMethod{
+				gossh.PublicKeys(testPrivateKeyOther),
+			},
+		}, "echo hello", "")
+		if err == nil {
+			t.Error("RunTestServerCommand() got err = nil, want err != nil")
+		}
+	})
+
+	tests := []struct {
+		name    string
+		command string
+		stdin   string
+
+		wantOut  string
+		wantErr  string
+		wantCode int
+	}{
+		{
+			name:     "echo on stdout",
+			command:  "echo Hello world",
+			wantOut:  "Hello world\n",
+			wantCode: 0,
+		},
+		{
+			name:     "echo on stderr",
+			command:  "warn Hello world",
+			wantErr:  "Hello world\n",
+			wantCode: 0,
+		},
+		{
+			name:     "exit code != 0",
+			command:  "exit 42",
+			wantCode: 42,
+		},
+		{
+			name:     "send stdin to stdout",
+			command:  "cat",
+			stdin:    "Hello world",
+			wantOut:  "Hello world",
+			wantCode: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOut, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{
+				Auth: []gossh.AuthMethod{
+					gossh.PublicKeys(testPrivateKeyFake),
+				},
+			}, tt.command, tt.stdin)
+			if err != nil {
+				t.Errorf("Unable to create test server session: %s", err)
+				t.FailNow()
+			}
+
+			if gotOut != tt.wantOut {
+				t.Errorf("Command() got out = %q, want = %q", gotOut, tt.wantOut)
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("Command() got err = %q, want = %q", gotErr, tt.wantErr)
+			}
+			if gotCode != tt.wantCode {
+				t.Errorf("Command() got code = %d, want = %d", gotCode, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestRuntimeFake_cleanup(t *testing.T) {
+	runtime := &fakeRuntime{
+		containers: []Container{
+			{ID: "user", Labels: map[string]string{"de.tkw01536.test.user": "user"}},
+		},
+		run: runFakeShell,
+	}
+
+	// the session is terminated while waiting for the exit code, which cleans up the process during Wait
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{
+		DisableAuthentication: true,
+		Limits:                proxyssh.Limits{MaxSessionDuration: time.Second / 2},
+	}, &ContainerExecConfig{
+		Runtime: runtime,
+
+		DockerLabelUser: "de.tkw01536.test.user",
+		ContainerShell:  "/bin/sh",
+	})
+	defer cleanup()
+
+	_, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{User: "user"}, "detach 2", "")
+	if err != nil || gotCode != 255 || !strings.Contains(gotErr, "Session exceeded maximum duration") {
+		t.Errorf("Command() got code = %d, err = %q, error = %v, want code = 255", gotCode, gotErr, err)
+	}
+}
+
+func TestRuntimeFake_Agent(t *testing.T) {
+	agentDir := t.TempDir()
+
+	// 'agent' lists the comments of the keys in the agent at SSH_AUTH_SOCK.
+	// The socket is found relative to the directory of the user inside agentDir, which is mounted at '/agents'.
+	run := func(options ExecOptions, stdin io.Reader, stdout, stderr io.Writer) int {
+		if options.Cmd[len(options.Cmd)-1] != "agent" {
+			return runFakeShell(options, stdin, stdout, stderr)
+		}
+
+		var socket string
+		for _, env := range options.Env {
+			if value, ok := strings.CutPrefix(env, "SSH_AUTH_SOCK="); ok {
+				socket = value
+			}
+		}
+		rel, ok := strings.CutPrefix(socket, "/agents/")
+		if !ok {
+			io.WriteString(stderr, "SSH_AUTH_SOCK not in /agents\n")
+			return 1
+		}
+
+		conn, err := net.Dial("unix", filepath.Join(agentDir, "user", filepath.FromSlash(rel)))
+		if err != nil {
+			io.WriteString(stderr, err.Error()+"\n")
+			return 1
+		}
+		defer conn.Close()
+
+		keys, err := agent.NewClient(conn).List()
+		if err != nil {
+			io.WriteString(stderr, err.Error()+"\n")
+			return 1
+		}
+		for _, key := range keys {
+			io.WriteString(stdout, key.Comment+"\n")
+		}
+		return 0
+	}
+
+	runtime := &fakeRuntime{
+		containers: []Container{
+			{ID: "user", Labels: map[string]string{"de.tkw01536.test.user": "user"}},
+		},
+		run: run,
+	}
+
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{
+		DisableAuthentication: true,
+		AgentForwarding:       []string{"user"},
+	}, &ContainerExecConfig{
+		Runtime: runtime,
+
+		DockerLabelUser: "de.tkw01536.test.user",
+		ContainerShell:  "/bin/sh",
+
+		AgentDir:   agentDir,
+		AgentMount: "/agents",
+	})
+	defer cleanup()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "test key"}); err != nil {
+		t.Fatalf("Unable to add key to keyring: %s", err)
+	}
+
+	client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	if err := agent.ForwardToAgent(client, keyring); err != nil {
+		t.Fatalf("Unable to forward agent: %s", err)
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		t.Fatalf("Unable to request agent forwarding: %s", err)
+	}
+
+	out, err := session.CombinedOutput("agent")
+	if err != nil || string(out) != "test key\n" {
+		t.Errorf("CombinedOutput() got out = %q, err = %v, want out = %q", out, err, "test key\n")
+	}
+}
+
+// fakeRunRuntime adds support for running processes in new containers to fakeRuntime.
+// New containers are named 'run-1', 'run-2', ... and are tracked until they are removed.
+type fakeRunRuntime struct {
+	*fakeRuntime
+
+	mu      sync.Mutex
+	created int
+	running map[string]RunOptions // container id => options
+}
+
+func (fr *fakeRunRuntime) Run(ctx context.Context, options RunOptions) (Container, Exec, error) {
+	fr.mu.Lock()
+	fr.created++
+	container := Container{ID: "run-" + strconv.Itoa(fr.created), Labels: options.Labels}
+	if fr.running == nil {
+		fr.running = make(map[string]RunOptions)
+	}
+	fr.running[container.ID] = options
+	fr.mu.Unlock()
+
+	exec, err := fr.Exec(ctx, container, options.ExecOptions)
+	if err != nil {
+		return Container{}, nil, err
+	}
+	return container, fakeRunExec{Exec: exec, remove: func() {
+		fr.mu.Lock()
+		defer fr.mu.Unlock()
+		delete(fr.running, container.ID)
+	}}, nil
+}
+
+// Count returns the number of containers that were created, and that have not been removed
+func (fr *fakeRunRuntime) Count() (created, running int) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.created, len(fr.running)
+}
+
+// fakeRunExec removes the container when closed
+type fakeRunExec struct {
+	Exec
+	remove func()
+}
+
+func (fre fakeRunExec) Close() error {
+	fre.remove()
+	return fre.Exec.Close()
+}
+
+// fakeRunConfig runs the command of every session in a new container
+type fakeRunConfig struct {
+	runtime *fakeRunRuntime
+}
+
+func (cfg fakeRunConfig) Apply(logger logging.Logger, sshserver *ssh.Server) error {
+	return nil
+}
+
+func (cfg fakeRunConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	return NewRuntimeRunProcess(cfg.runtime, RunOptions{
+		ExecOptions: ExecOptions{Cmd: []string{"/bin/sh", "-c", session.RawCommand()}},
+		Image:       "image",
+	}), nil
+}
+
+func TestRuntimeFake_Run(t *testing.T) {
+	runtime := &fakeRunRuntime{fakeRuntime: &fakeRuntime{run: runFakeShell}}
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, fakeRunConfig{runtime: runtime})
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		command string
+		stdin   string
+
+		wantOut  string
+		wantErr  string
+		wantCode int
+	}{
+		{
+			name:     "echo on stdout",
+			command:  "echo Hello world",
+			wantOut:  "Hello world\n",
+			wantCode: 0,
+		},
+		{
+			name:     "echo on stderr",
+			command:  "warn Hello world",
+			wantErr:  "Hello world\n",
+			wantCode: 0,
+		},
+		{
+			name:     "exit code != 0",
+			command:  "exit 42",
+			wantCode: 42,
+		},
+		{
+			name:     "send stdin to stdout",
+			command:  "cat",
+			stdin:    "Hello world",
+			wantOut:  "Hello world",
+			wantCode: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOut, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, tt.command, tt.stdin)
+			if err != nil {
+				t.Errorf("Unable to create test server session: %s", err)
+				t.FailNow()
+			}
+
+			if gotOut != tt.wantOut {
+				t.Errorf("Command() got out = %q, want = %q", gotOut, tt.wantOut)
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("Command() got err = %q, want = %q", gotErr, tt.wantErr)
+			}
+			if gotCode != tt.wantCode {
+				t.Errorf("Command() got code = %d, want = %d", gotCode, tt.wantCode)
+			}
+		})
+	}
+
+	integrationtest.AssertLeakDetector(t, len(tests))
+
+	created, running := runtime.Count()
+	if created != len(tests) {
+		t.Errorf("Run() created %d containers, want %d", created, len(tests))
+	}
+	if running != 0 {
+		t.Errorf("Found %d containers that were not removed", running)
+	}
+}
@@ -0,0 +1,492 @@
+package dockerexec
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/internal/term"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// This file implements the server side of the legacy scp protocol.
+// It is used by 'scp -O', and by scp clients before OpenSSH 9.0.
+//
+// A client invokes 'scp -t target' to send files to the server, the server acting as a sink.
+// Or a client invokes 'scp -f path...' to receive files from the server, the server acting as a source.
+// Both sides then exchange messages on standard input and output.
+
+// SCPCommand represents a parsed invocation of scp on the server side.
+type SCPCommand struct {
+	Sink      bool // '-t': receive files from the client
+	Recursive bool // '-r': copy directories
+	Directory bool // '-d': target must be a directory
+	Preserve  bool // '-p': preserve modification and access times
+
+	// Paths are the paths given on the command line.
+	// When Sink is true, there is exactly one path, the target.
+	Paths []string
+}
+
+// ParseSCPCommand parses command as an invocation of 'scp -t target' or 'scp -f path...'.
+// When command is not such an invocation, returns ok = false.
+func ParseSCPCommand(command []string) (cmd SCPCommand, ok bool) {
+	if len(command) == 0 || command[0] != "scp" {
+		return cmd, false
+	}
+
+	var source bool
+	args := command[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		flag := args[0]
+		args = args[1:]
+		if flag == "--" {
+			break
+		}
+
+		for _, c := range flag[1:] {
+			switch c {
+			case 't':
+				cmd.Sink = true
+			case 'f':
+				source = true
+			case 'r':
+				cmd.Recursive = true
+			case 'd':
+				cmd.Directory = true
+			case 'p':
+				cmd.Preserve = true
+			case 'v', 'q':
+				// ignored
+			default:
+				return cmd, false
+			}
+		}
+	}
+	cmd.Paths = args
+
+	if cmd.Sink == source || len(cmd.Paths) == 0 || (cmd.Sink && len(cmd.Paths) != 1) {
+		return cmd, false
+	}
+	return cmd, true
+}
+
+// NewSCPProcess creates a new process that implements command using the archive functionality of runtime.
+func NewSCPProcess(runtime ArchiveRuntime, container Container, command SCPCommand) *SCPProcess {
+	return &SCPProcess{
+		runtime:   runtime,
+		container: container,
+		command:   command,
+	}
+}
+
+// SCPProcess represents an scp process that transfers files from and to a container.
+// Relative paths are interpreted relative to the root directory of the container.
+type SCPProcess struct {
+	runtime   ArchiveRuntime
+	container Container
+	command   SCPCommand
+
+	term.Pipes
+
+	ctx      context.Context
+	exitCode int
+	done     chan struct{} // close()d when the transfer has finished
+}
+
+// String turns SCPProcess into a string
+func (sp *SCPProcess) String() string {
+	if sp == nil {
+		return ""
+	}
+
+	mode := "-f"
+	if sp.command.Sink {
+		mode = "-t"
+	}
+	return sp.container.ID + " scp " + mode + " " + strings.Join(sp.command.Paths, " ")
+}
+
+// ContainerID returns the id of the container files are transferred from and to
+func (sp *SCPProcess) ContainerID() string {
+	return sp.container.ID
+}
+
+var errSCPNotAPipe = errors.New("scp does not support a tty")
+
+// Init initializes this process
+func (sp *SCPProcess) Init(ctx context.Context, detector logging.MemoryLeakDetector, isPty bool) error {
+	if isPty {
+		return errSCPNotAPipe
+	}
+
+	sp.ctx = ctx
+	sp.done = make(chan struct{})
+	return nil
+}
+
+// Start starts this process
+func (sp *SCPProcess) Start(detector logging.MemoryLeakDetector, Term string, resizeChan <-chan proxyssh.WindowSize, isPty bool) (*os.File, error) {
+	detector.Add("dockerexec: scp")
+	go func() {
+		defer detector.Done("dockerexec: scp")
+		defer close(sp.done)
+
+		in := bufio.NewReader(sp.StdinPipe)
+
+		var err error
+		if sp.command.Sink {
+			err = sp.sink(in, sp.StdoutPipe)
+		} else {
+			err = sp.source(in, sp.StdoutPipe)
+		}
+
+		if err != nil {
+			if _, ok := err.(scpWarning); !ok { // warnings have already been sent
+				scpError(sp.StdoutPipe, err)
+			}
+			sp.exitCode = 1
+		}
+		sp.DrainOutput(sp.ctx)
+	}()
+
+	return nil, nil
+}
+
+// Wait waits for the process and returns the exit code
+func (sp *SCPProcess) Wait(detector logging.MemoryLeakDetector) (code int, err error) {
+	detector.Add("dockerexec: scp wait")
+	defer detector.Done("dockerexec: scp wait")
+
+	select {
+	case <-sp.done:
+		return sp.exitCode, nil
+	case <-sp.ctx.Done():
+		return 0, sp.ctx.Err()
+	}
+}
+
+// Cleanup cleans up this process
+func (sp *SCPProcess) Cleanup() (killed bool) {
+	sp.ClosePipes()
+	return true
+}
+
+// resolve resolves a path provided by the user to an absolute path within the container
+func (sp *SCPProcess) resolve(p string) string {
+	return path.Join("/", p)
+}
+
+// sink receives files from the client and writes them into the container
+func (sp *SCPProcess) sink(in *bufio.Reader, out io.Writer) error {
+	target := sp.resolve(sp.command.Paths[0])
+
+	// when the target is not a directory, it is the name of the (only) top-level file
+	dirs := []string{target}
+	var rename string
+	if stat, err := sp.runtime.StatPath(sp.ctx, sp.container, target); err != nil || !stat.Mode.IsDir() {
+		if sp.command.Directory {
+			return errors.Errorf("%s: Not a directory", target)
+		}
+		dirs[0] = path.Dir(target)
+		rename = path.Base(target)
+	}
+
+	var times *scpTimes
+	scpOK(out)
+	for {
+		line, err := in.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("Protocol error: Empty message")
+		}
+
+		switch line[0] {
+		case 'T':
+			times, err = parseSCPTimes(line[1:])
+			if err != nil {
+				return err
+			}
+			scpOK(out)
+		case 'E':
+			if len(dirs) == 1 {
+				return errors.New("Protocol error: Unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+			scpOK(out)
+		case 'C', 'D':
+			mode, size, name, err := parseSCPEntry(line[1:])
+			if err != nil {
+				return err
+			}
+			if rename != "" && len(dirs) == 1 {
+				name = rename
+			}
+
+			header := &tar.Header{Name: name, Mode: int64(mode), Size: size, ModTime: time.Now()}
+			if times != nil {
+				header.ModTime, header.AccessTime = times.mtime, times.atime
+				times = nil
+			}
+
+			dir := dirs[len(dirs)-1]
+			if line[0] == 'D' {
+				if !sp.command.Recursive {
+					return errors.Errorf("%s: Is a directory", path.Join(dir, name))
+				}
+
+				header.Typeflag, header.Name, header.Size = tar.TypeDir, name+"/", 0
+				if err := sp.writeEntry(dir, header, nil); err != nil {
+					return err
+				}
+				dirs = append(dirs, path.Join(dir, name))
+				scpOK(out)
+				continue
+			}
+
+			header.Typeflag = tar.TypeReg
+			scpOK(out)
+			if err := sp.writeEntry(dir, header, in); err != nil {
+				return err
+			}
+			if err := scpReadAck(in); err != nil {
+				return err
+			}
+			scpOK(out)
+		case '\x01', '\x02':
+			return errors.New(line[1:])
+		default:
+			return errors.Errorf("Protocol error: Unexpected message %q", line)
+		}
+	}
+}
+
+// writeEntry writes a single entry into dir within the container.
+// For regular files, the content is read from content.
+func (sp *SCPProcess) writeEntry(dir string, header *tar.Header, content io.Reader) error {
+	pr, pw := io.Pipe()
+
+	copyErr := make(chan error, 1)
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(header)
+		if err == nil && header.Size > 0 {
+			_, err = io.CopyN(tw, content, header.Size)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+		copyErr <- err
+	}()
+
+	err := sp.runtime.WriteArchive(sp.ctx, sp.container, dir, pr)
+	pr.CloseWithError(errors.New("archive closed"))
+
+	if cerr := <-copyErr; err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// source sends files from the container to the client
+func (sp *SCPProcess) source(in *bufio.Reader, out io.Writer) error {
+	if err := scpReadAck(in); err != nil {
+		return err
+	}
+
+	var failed error
+	for _, p := range sp.command.Paths {
+		if err := sp.sourcePath(in, out, sp.resolve(p)); err != nil {
+			if _, ok := err.(scpWarning); !ok {
+				return err
+			}
+			failed = err
+			scpError(out, err)
+		}
+	}
+	return failed
+}
+
+// scpWarning is an error that only affects a single path
+type scpWarning struct{ error }
+
+// sourcePath sends the file or directory at p to the client
+func (sp *SCPProcess) sourcePath(in *bufio.Reader, out io.Writer, p string) error {
+	archive, err := sp.runtime.ReadArchive(sp.ctx, sp.container, p)
+	if err != nil {
+		return scpWarning{errors.Wrap(err, p)}
+	}
+	defer archive.Close()
+
+	tr := tar.NewReader(archive)
+
+	var stack []string // directories that have been entered
+	for first := true; ; first = false {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if first && header.Typeflag == tar.TypeDir && !sp.command.Recursive {
+			return scpWarning{errors.Errorf("%s: not a regular file", p)}
+		}
+
+		// leave all directories that do not contain this entry
+		name := strings.TrimSuffix(header.Name, "/")
+		for path.Join(append([]string{"."}, stack...)...) != path.Dir(name) {
+			if len(stack) == 0 {
+				return errors.Errorf("Unexpected archive entry %q", header.Name)
+			}
+			if err := scpSend(in, out, "E\n"); err != nil {
+				return err
+			}
+			stack = stack[:len(stack)-1]
+		}
+
+		var kind byte
+		switch header.Typeflag {
+		case tar.TypeDir:
+			kind = 'D'
+		case tar.TypeReg:
+			kind = 'C'
+		default:
+			continue // symlinks and special files can not be transferred
+		}
+
+		if sp.command.Preserve {
+			atime := header.AccessTime
+			if atime.IsZero() {
+				atime = header.ModTime
+			}
+			if err := scpSend(in, out, fmt.Sprintf("T%d 0 %d 0\n", header.ModTime.Unix(), atime.Unix())); err != nil {
+				return err
+			}
+		}
+
+		size := header.Size
+		if kind == 'D' {
+			size = 0
+		}
+		if err := scpSend(in, out, fmt.Sprintf("%c%04o %d %s\n", kind, header.Mode&07777, size, path.Base(name))); err != nil {
+			return err
+		}
+
+		if kind == 'D' {
+			stack = append(stack, path.Base(name))
+			continue
+		}
+
+		if _, err := io.CopyN(out, tr, size); err != nil {
+			return err
+		}
+		if err := scpSend(in, out, "\x00"); err != nil {
+			return err
+		}
+	}
+
+	for range stack {
+		if err := scpSend(in, out, "E\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scpTimes represents the times sent by a 'T' message
+type scpTimes struct {
+	mtime, atime time.Time
+}
+
+// parseSCPTimes parses the arguments of a 'T' message of the form 'mtime 0 atime 0'.
+func parseSCPTimes(args string) (*scpTimes, error) {
+	fields := strings.Fields(args)
+	if len(fields) != 4 {
+		return nil, errors.Errorf("Protocol error: Invalid times %q", args)
+	}
+
+	mtime, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("Protocol error: Invalid times %q", args)
+	}
+	atime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("Protocol error: Invalid times %q", args)
+	}
+
+	return &scpTimes{mtime: time.Unix(mtime, 0), atime: time.Unix(atime, 0)}, nil
+}
+
+// parseSCPEntry parses the arguments of a 'C' or 'D' message of the form 'mode size name'.
+func parseSCPEntry(args string) (mode os.FileMode, size int64, name string, err error) {
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", errors.Errorf("Protocol error: Invalid entry %q", args)
+	}
+
+	m, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errors.Errorf("Protocol error: Invalid mode %q", fields[0])
+	}
+	size, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", errors.Errorf("Protocol error: Invalid size %q", fields[1])
+	}
+
+	name = fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", errors.Errorf("Protocol error: Invalid name %q", name)
+	}
+
+	return os.FileMode(m) & os.ModePerm, size, name, nil
+}
+
+// scpSend sends message to the client and waits for it to be acknowledged
+func scpSend(in *bufio.Reader, out io.Writer, message string) error {
+	if _, err := io.WriteString(out, message); err != nil {
+		return err
+	}
+	return scpReadAck(in)
+}
+
+// scpReadAck reads an acknowledgement from the client
+func scpReadAck(in *bufio.Reader) error {
+	code, err := in.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+
+	message, _ := in.ReadString('\n')
+	return errors.New(strings.TrimSuffix(message, "\n"))
+}
+
+// scpOK acknowledges a message sent by the client
+func scpOK(out io.Writer) {
+	out.Write([]byte{0})
+}
+
+// scpError sends err to the client
+func scpError(out io.Writer, err error) {
+	io.WriteString(out, "\x01scp: "+err.Error()+"\n")
+}
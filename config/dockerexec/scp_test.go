@@ -0,0 +1,194 @@
+package dockerexec
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestParseSCPCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		wantCmd SCPCommand
+		wantOk  bool
+	}{
+		{"not scp", []string{"ls", "-t", "/tmp"}, SCPCommand{}, false},
+		{"no mode", []string{"scp", "/tmp"}, SCPCommand{}, false},
+		{"both modes", []string{"scp", "-t", "-f", "/tmp"}, SCPCommand{}, false},
+		{"unknown flag", []string{"scp", "-t", "-x", "/tmp"}, SCPCommand{}, false},
+		{"sink without target", []string{"scp", "-t"}, SCPCommand{}, false},
+		{"sink with two targets", []string{"scp", "-t", "/a", "/b"}, SCPCommand{}, false},
+
+		{"sink", []string{"scp", "-t", "/tmp"}, SCPCommand{Sink: true, Paths: []string{"/tmp"}}, true},
+		{"combined flags", []string{"scp", "-rpdt", "--", "-dir"}, SCPCommand{Sink: true, Recursive: true, Directory: true, Preserve: true, Paths: []string{"-dir"}}, true},
+		{"source", []string{"scp", "-v", "-f", "/a", "/b"}, SCPCommand{Paths: []string{"/a", "/b"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotCmd, gotOk := ParseSCPCommand(tt.command)
+			if gotOk != tt.wantOk {
+				t.Errorf("ParseSCPCommand() got ok = %v, want = %v", gotOk, tt.wantOk)
+			}
+			if gotOk && !reflect.DeepEqual(gotCmd, tt.wantCmd) {
+				t.Errorf("ParseSCPCommand() got cmd = %v, want = %v", gotCmd, tt.wantCmd)
+			}
+		})
+	}
+}
+
+// fakeArchiveRuntime adds archive support to fakeRuntime.
+// Directories are implied by the files within them.
+type fakeArchiveRuntime struct {
+	*fakeRuntime
+}
+
+func (fr fakeArchiveRuntime) StatPath(ctx context.Context, container Container, p string) (PathStat, error) {
+	if content, ok := fr.files[container.ID][p]; ok {
+		return PathStat{Name: path.Base(p), Size: int64(len(content)), Mode: 0644}, nil
+	}
+	for name := range fr.files[container.ID] {
+		if strings.HasPrefix(name, strings.TrimSuffix(p, "/")+"/") {
+			return PathStat{Name: path.Base(p), Mode: os.ModeDir | 0755}, nil
+		}
+	}
+	return PathStat{}, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+}
+
+func (fr fakeArchiveRuntime) ReadArchive(ctx context.Context, container Container, p string) (io.ReadCloser, error) {
+	content, ok := fr.files[container.ID][p]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+
+	var buffer bytes.Buffer
+	tw := tar.NewWriter(&buffer)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: path.Base(p), Mode: 0644, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+	return io.NopCloser(&buffer), nil
+}
+
+func (fr fakeArchiveRuntime) WriteArchive(ctx context.Context, container Container, dir string, content io.Reader) error {
+	tr := tar.NewReader(content)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		fr.files[container.ID][path.Join(dir, header.Name)] = data
+	}
+}
+
+func TestSCP(t *testing.T) {
+	runtime := fakeArchiveRuntime{&fakeRuntime{
+		containers: []Container{
+			{ID: "user", Labels: map[string]string{"de.tkw01536.test.user": "user"}},
+		},
+		files: map[string]map[string][]byte{
+			"user": {
+				"/etc/hostname": []byte("fake\n"),
+				"/tmp/.keep":    nil,
+			},
+		},
+		run: runFakeShell,
+	}}
+
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{DisableAuthentication: true}, &ContainerExecConfig{
+		Runtime: runtime,
+
+		DockerLabelUser: "de.tkw01536.test.user",
+		ContainerShell:  "/bin/sh",
+		SCP:             true,
+	})
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		command string
+		stdin   string
+
+		wantOut   string
+		wantCode  int
+		wantFiles map[string]string
+	}{
+		{
+			name:      "send file into directory",
+			command:   "scp -t /tmp",
+			stdin:     "C0644 6 hello.txt\nhello\n\x00",
+			wantOut:   "\x00\x00\x00",
+			wantFiles: map[string]string{"/tmp/hello.txt": "hello\n"},
+		},
+		{
+			name:      "send file to new name",
+			command:   "scp -t /tmp/renamed.txt",
+			stdin:     "C0644 6 hello.txt\nhello\n\x00",
+			wantOut:   "\x00\x00\x00",
+			wantFiles: map[string]string{"/tmp/renamed.txt": "hello\n"},
+		},
+		{
+			name:     "send file with invalid name",
+			command:  "scp -t /tmp",
+			stdin:    "C0644 6 ../hello.txt\nhello\n\x00",
+			wantOut:  "\x00\x01scp: Protocol error: Invalid name \"../hello.txt\"\n",
+			wantCode: 1,
+		},
+		{
+			name:     "receive file",
+			command:  "scp -f /etc/hostname",
+			stdin:    "\x00\x00\x00",
+			wantOut:  "C0644 5 hostname\nfake\n\x00",
+			wantCode: 0,
+		},
+		{
+			name:     "receive missing file",
+			command:  "scp -f /does/not/exist",
+			stdin:    "\x00",
+			wantOut:  "\x01scp: /does/not/exist: open /does/not/exist: file does not exist\n",
+			wantCode: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOut, _, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, tt.command, tt.stdin)
+			if err != nil {
+				t.Fatalf("Unable to create test server session: %s", err)
+			}
+
+			if gotOut != tt.wantOut {
+				t.Errorf("Command() got out = %q, want = %q", gotOut, tt.wantOut)
+			}
+			if gotCode != tt.wantCode {
+				t.Errorf("Command() got code = %d, want = %d", gotCode, tt.wantCode)
+			}
+			for name, want := range tt.wantFiles {
+				if got := string(runtime.files["user"][name]); got != want {
+					t.Errorf("Command() got file %s = %q, want = %q", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+// Package dockerrun provides ContainerRunConfig.
+package dockerrun
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/config/dockerexec"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// ContainerRunConfig implements a proxyssh.Configuration and proxyssh.Handler that execute user processes within new docker containers.
+// Containers are created using the docker api, see dockerexec.NewContainerRunProcess.
+//
+// For every ssh session, a new container is created from an image.
+// The container is removed once the session ends, making it a throwaway sandbox.
+//
+// The image is determined as follows:
+//
+// When the first word of the command provided by the user is a key in CommandImages, the corresponding image is used.
+// Otherwise, when the username is a key in UserImages, the corresponding image is used.
+// Otherwise, when DockerLabelUser is set and there is exactly one image with this label equal to the username, this image is used.
+// Otherwise, Image is used.
+// If Image is empty, the session fails.
+//
+// Inside the container, a process (called the shell) is started, ignoring any entrypoint of the image.
+// When no arguments are provided, it will run the shell without any arguments.
+// When some arguments are provided by the user, it will run the shell with two arguments, '-c' and a concatination of the arguments provided.
+//
+// When the ssh user requested a tty, a tty will be allocated within the container.
+// When no tty was requested, none will be allocated.
+//
+// Processes receive the environment variables of feature.Environ, and TERM when a tty was requested.
+// HOME is not set by the server, instead the container runtime sets it according to the user the process runs as inside the container.
+// SSH_TTY is not set either, because the name of the tty is only known inside of the container.
+//
+// This configuration does not perform any authentication.
+// Because anyone who can connect can create containers, authentication must be configured before Apply is called,
+// for example by a configuration applied earlier.
+// Apply refuses to run without authentication, unless AllowUnauthenticated is set.
+type ContainerRunConfig struct {
+	// Client is the docker client to be used to the docker daemon.
+	Client client.APIClient
+
+	// Image is the image to use when no other image is selected.
+	Image string
+
+	// UserImages maps usernames to images.
+	UserImages map[string]string
+
+	// CommandImages maps the first word of a command to images.
+	CommandImages map[string]string
+
+	// DockerLabelUser is the label to use for associating a user to an image.
+	DockerLabelUser string
+
+	// PullImages indicates if images that do not exist locally should be pulled.
+	PullImages bool
+
+	// Labels are labels to add to every created container.
+	Labels map[string]string
+
+	// ContainerShell is the executable to run within the container.
+	ContainerShell string
+
+	// AllowUnauthenticated allows running on a server without any authentication handler.
+	AllowUnauthenticated bool
+}
+
+// ErrNoAuthentication is returned by ContainerRunConfig.Apply when the server has no authentication handler, and AllowUnauthenticated is false
+var ErrNoAuthentication = errors.New("ContainerRunConfig: No authentication configured")
+
+// Apply applies this configuration to the server.
+// It only checks that authentication has been configured.
+func (cfg *ContainerRunConfig) Apply(logger logging.Logger, sshserver *ssh.Server) error {
+	if cfg.AllowUnauthenticated {
+		return nil
+	}
+	if sshserver.PublicKeyHandler == nil && sshserver.PasswordHandler == nil && sshserver.KeyboardInteractiveHandler == nil {
+		return ErrNoAuthentication
+	}
+	return nil
+}
+
+// ErrNoImage is returned when no image can be found for a session.
+var ErrNoImage = errors.New("No image found")
+
+// ErrImageNotUnique is returned when an image associated via a label is not unique
+var ErrImageNotUnique = errors.New("No unique image found")
+
+// SelectImage selects the image to use for the provided session.
+//
+// When no image can be selected, returns ErrNoImage or ErrImageNotUnique.
+// If something goes wrong, other errors may be returned.
+func (cfg *ContainerRunConfig) SelectImage(session ssh.Session) (string, error) {
+	if command := session.Command(); len(command) > 0 {
+		if image, ok := cfg.CommandImages[command[0]]; ok {
+			return image, nil
+		}
+	}
+
+	if image, ok := cfg.UserImages[session.User()]; ok {
+		return image, nil
+	}
+
+	if cfg.DockerLabelUser != "" {
+		image, err := FindUniqueImage(cfg.Client, cfg.DockerLabelUser, session.User())
+		if err == nil {
+			return image, nil
+		}
+		if err != ErrImageNotUnique {
+			return "", err
+		}
+	}
+
+	if cfg.Image == "" {
+		return "", ErrNoImage
+	}
+	return cfg.Image, nil
+}
+
+// FindUniqueImage finds a unique local image with the given key and value.
+// It returns the id of the image.
+//
+// If there is no unique image, returns ErrImageNotUnique.
+// If something goes wrong, other errors may be returned.
+func FindUniqueImage(cli client.APIClient, key string, value string) (string, error) {
+	Filters := filters.NewArgs()
+	Filters.Add("label", fmt.Sprintf("%s=%s", key, value))
+
+	images, err := cli.ImageList(context.Background(), image.ListOptions{
+		Filters: Filters,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to list images")
+	}
+
+	if len(images) != 1 {
+		return "", ErrImageNotUnique
+	}
+	return images[0].ID, nil
+}
+
+// Backend implements proxyssh.BackendHandler
+func (cfg *ContainerRunConfig) Backend() string {
+	return "dockerrun"
+}
+
+// Handle implements the handler
+func (cfg *ContainerRunConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	userCommand := session.Command()
+
+	// determine the command to run inside the docker container
+	// when no arguments are given, use the shell.
+	// else use shell -c 'arguments'
+	command := make([]string, 1, 3)
+	command[0] = cfg.ContainerShell
+	if len(userCommand) > 0 {
+		command = append(command, "-c", strings.Join(userCommand, " "))
+	}
+
+	// find the image to use
+	image, err := cfg.SelectImage(session)
+	if err != nil {
+		return nil, err
+	}
+
+	process := dockerexec.NewContainerRunProcess(cfg.Client, dockerexec.RunOptions{
+		ExecOptions: dockerexec.ExecOptions{Cmd: command},
+
+		Image:  image,
+		Labels: cfg.Labels,
+		Pull:   cfg.PullImages,
+	})
+	process.Env = feature.Environ(session)
+	return process, nil
+}
+
+// RegisterFlags registers flags representing the config to the provided flagset.
+// When flagset is nil, uses flag.CommandLine.
+func (cfg *ContainerRunConfig) RegisterFlags(flagset *flag.FlagSet) {
+	if flagset == nil {
+		flagset = flag.CommandLine
+	}
+
+	flagset.StringVar(&cfg.Image, "image", cfg.Image, "Image to run containers from")
+	flagset.Var(&ImageMapVar{Images: &cfg.UserImages}, "userimage", "Image to use for a specific user, of the form 'user=image'")
+	flagset.Var(&ImageMapVar{Images: &cfg.CommandImages}, "commandimage", "Image to use for a specific command, of the form 'command=image'")
+	flagset.StringVar(&cfg.DockerLabelUser, "imagelabel", cfg.DockerLabelUser, "Label to find images for users by")
+	flagset.BoolVar(&cfg.PullImages, "pull", cfg.PullImages, "Pull images that do not exist locally")
+
+	flagset.StringVar(&cfg.ContainerShell, "shell", cfg.ContainerShell, "Shell to execute within the container")
+	flagset.BoolVar(&cfg.AllowUnauthenticated, "allowunauthenticated", cfg.AllowUnauthenticated, "Allow running without authentication, anyone who can connect can then create containers")
+}
+
+// ImageMapVar represents a "flag".Value that contains a map to images.
+// It can be passed multiple times, each time with a value of the form 'key=image'.
+type ImageMapVar struct {
+	Images *map[string]string
+}
+
+// String turns this ImageMapVar into a comma-seperated list of 'key=image' pairs.
+func (m *ImageMapVar) String() string {
+	if m.Images == nil {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(*m.Images))
+	for key, image := range *m.Images {
+		pairs = append(pairs, key+"="+image)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set sets the value of this ImageMapVar
+// This function is intended to be called by flag.Var()
+func (m *ImageMapVar) Set(value string) error {
+	key, image, ok := strings.Cut(value, "=")
+	if !ok || key == "" || image == "" {
+		return errors.Errorf("Invalid image mapping %q", value)
+	}
+	if *m.Images == nil {
+		*m.Images = make(map[string]string)
+	}
+	(*m.Images)[key] = image
+	return nil
+}
+
+func init() {
+	// ensure that ImageMapVar fullfills the flag.Value interface
+	var _ flag.Value = (*ImageMapVar)(nil)
+}
@@ -0,0 +1,100 @@
+package dockerrun
+
+import (
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+)
+
+// testSession is an ssh.Session with a fixed user and command
+type testSession struct {
+	ssh.Session
+
+	user    string
+	command []string
+}
+
+func (ts testSession) User() string      { return ts.user }
+func (ts testSession) Command() []string { return ts.command }
+
+func TestContainerRunConfig_SelectImage(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ContainerRunConfig
+		session testSession
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "default image",
+			config:  ContainerRunConfig{Image: "alpine"},
+			session: testSession{user: "user"},
+			want:    "alpine",
+		},
+		{
+			name:    "no image",
+			config:  ContainerRunConfig{},
+			session: testSession{user: "user"},
+			wantErr: ErrNoImage,
+		},
+		{
+			name:    "user image",
+			config:  ContainerRunConfig{Image: "alpine", UserImages: map[string]string{"user": "debian"}},
+			session: testSession{user: "user"},
+			want:    "debian",
+		},
+		{
+			name:    "other user image",
+			config:  ContainerRunConfig{Image: "alpine", UserImages: map[string]string{"other": "debian"}},
+			session: testSession{user: "user"},
+			want:    "alpine",
+		},
+		{
+			name:    "command image takes precedence",
+			config:  ContainerRunConfig{Image: "alpine", UserImages: map[string]string{"user": "debian"}, CommandImages: map[string]string{"python3": "python"}},
+			session: testSession{user: "user", command: []string{"python3", "-V"}},
+			want:    "python",
+		},
+		{
+			name:    "unknown command",
+			config:  ContainerRunConfig{Image: "alpine", CommandImages: map[string]string{"python3": "python"}},
+			session: testSession{user: "user", command: []string{"ls"}},
+			want:    "alpine",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.config.SelectImage(tt.session)
+			if err != tt.wantErr {
+				t.Errorf("ContainerRunConfig.SelectImage() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ContainerRunConfig.SelectImage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerRunConfig_Apply(t *testing.T) {
+	passwordServer := &ssh.Server{PasswordHandler: func(ctx ssh.Context, password string) bool { return true }}
+
+	tests := []struct {
+		name    string
+		cfg     *ContainerRunConfig
+		server  *ssh.Server
+		wantErr error
+	}{
+		{"without authentication", &ContainerRunConfig{}, &ssh.Server{}, ErrNoAuthentication},
+		{"with authentication", &ContainerRunConfig{}, passwordServer, nil},
+		{"without authentication, but allowed", &ContainerRunConfig{AllowUnauthenticated: true}, &ssh.Server{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Apply(integrationtest.GetLogger(), tt.server); err != tt.wantErr {
+				t.Errorf("Apply() got err = %v, want = %v", err, tt.wantErr)
+			}
+		})
+	}
+}
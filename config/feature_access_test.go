@@ -0,0 +1,63 @@
+package config
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestRestrictAccess(t *testing.T) {
+	local := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	remote := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	tests := []struct {
+		name       string
+		access     feature.AccessList
+		userAccess map[string]feature.AccessList
+		password   bool
+		wantAlice  bool
+		wantDeploy bool
+	}{
+		{"no restrictions", feature.AccessList{}, nil, true, true, true},
+		{"allow local", feature.AccessList{Allow: local}, nil, true, true, true},
+		{"allow remote", feature.AccessList{Allow: remote}, nil, true, false, false},
+		{"deny local", feature.AccessList{Deny: local}, nil, true, false, false},
+		{"deny overrides allow", feature.AccessList{Allow: local, Deny: local}, nil, true, false, false},
+		{"allow deploy from remote", feature.AccessList{}, map[string]feature.AccessList{"deploy": {Allow: remote}}, true, true, false},
+		{"deny deploy from local", feature.AccessList{}, map[string]feature.AccessList{"deploy": {Deny: local}}, true, true, false},
+		{"allow deploy from remote without authentication", feature.AccessList{}, map[string]feature.AccessList{"deploy": {Allow: remote}}, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := &proxyssh.Options{Access: tt.access, UserAccess: tt.userAccess}
+
+			var configurations []proxyssh.Configuration
+			if tt.password {
+				configurations = append(configurations, passwordConfig("secret"))
+			}
+
+			testServer, _, cleanup := integrationtest.NewServer(options, configurations...)
+			defer cleanup()
+
+			login := func(user string) bool {
+				_, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{
+					User: user,
+					Auth: []gossh.AuthMethod{gossh.Password("secret")},
+				}, "", "")
+				return err == nil
+			}
+
+			if got := login("alice"); got != tt.wantAlice {
+				t.Errorf("login(alice) = %v, want %v", got, tt.wantAlice)
+			}
+			if got := login("deploy"); got != tt.wantDeploy {
+				t.Errorf("login(deploy) = %v, want %v", got, tt.wantDeploy)
+			}
+		})
+	}
+}
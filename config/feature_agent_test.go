@@ -0,0 +1,116 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var agentTestOptions = &proxyssh.Options{
+	AgentForwarding: []string{"a*"},
+}
+
+func TestAllowAgentForwarding(t *testing.T) {
+	testServer, testLogger, cleanup := integrationtest.NewServer(agentTestOptions)
+	defer cleanup()
+
+	// respond with the comments of the keys in the forwarded agent, or "not forwarded"
+	testServer.Handler = func(s ssh.Session) {
+		defer s.Exit(0)
+
+		if !feature.AgentForwarded(testLogger, s) {
+			fmt.Fprint(s, "not forwarded")
+			return
+		}
+
+		listener, err := feature.ListenAgent(testLogger, s, "")
+		if err != nil {
+			fmt.Fprintf(s, "ListenAgent() returned error: %s", err)
+			return
+		}
+		defer func() {
+			listener.Close()
+			if _, err := os.Stat(listener.Dir); !os.IsNotExist(err) {
+				t.Errorf("Close() did not remove agent directory")
+			}
+		}()
+
+		conn, err := net.Dial("unix", listener.Path)
+		if err != nil {
+			fmt.Fprintf(s, "Dial() returned error: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		keys, err := agent.NewClient(conn).List()
+		if err != nil {
+			fmt.Fprintf(s, "List() returned error: %s", err)
+			return
+		}
+		for _, key := range keys {
+			fmt.Fprint(s, key.Comment)
+		}
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "test key"}); err != nil {
+		t.Fatalf("Unable to add key to keyring: %s", err)
+	}
+
+	// run runs a session as user, optionally forwarding keyring
+	run := func(user string, forward bool) string {
+		client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{User: user})
+		if err != nil {
+			t.Fatalf("Unable to create test server session: %s", err)
+		}
+		defer client.Close()
+
+		if forward {
+			if err := agent.ForwardToAgent(client, keyring); err != nil {
+				t.Fatalf("Unable to forward agent: %s", err)
+			}
+			if err := agent.RequestAgentForwarding(session); err != nil {
+				t.Fatalf("Unable to request agent forwarding: %s", err)
+			}
+		}
+
+		out, err := session.Output("")
+		if err != nil {
+			t.Fatalf("Unable to run command: %s", err)
+		}
+		return string(out)
+	}
+
+	tests := []struct {
+		name    string
+		user    string
+		forward bool
+		want    string
+	}{
+		{"allowed user forwarding agent", "alice", true, "test key"},
+		{"allowed user not forwarding agent", "alice", false, "not forwarded"},
+		{"other user forwarding agent", "bob", true, "not forwarded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := run(tt.user, tt.forward); got != tt.want {
+				t.Errorf("run() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
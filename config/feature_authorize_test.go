@@ -1,6 +1,8 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/gliderlabs/ssh"
@@ -114,3 +116,19 @@ func TestAuthorizeKeys(t *testing.T) {
 	}
 
 }
+
+func TestFindUserKeys(t *testing.T) {
+	_, key := testutils.GenerateRSATestKeyPair()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "alice"), []byte(testutils.AuthorizedKeysString(key)+"\n"), 0600); err != nil {
+		t.Fatalf("Unable to write keys: %s", err)
+	}
+
+	if keys := feature.FindUserKeys(dir, "alice"); len(keys) != 1 || !ssh.KeysEqual(keys[0], key) {
+		t.Errorf("FindUserKeys() got = %v, want = [%v]", keys, key)
+	}
+	if keys := feature.FindUserKeys(dir, "bob"); len(keys) != 0 {
+		t.Errorf("FindUserKeys() got = %v, want = []", keys)
+	}
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// passwordConfig is a configuration that accepts a single password
+type passwordConfig string
+
+func (pc passwordConfig) Apply(logger logging.Logger, server *ssh.Server) error {
+	server.PasswordHandler = func(ctx ssh.Context, password string) bool {
+		return password == string(pc)
+	}
+	return nil
+}
+
+// newBruteForceTestServer creates a new test server that accepts the password "secret" and is protected using protection
+func newBruteForceTestServer(protection feature.BruteForceProtection) (address string, login func(user, password string) error, cleanup func()) {
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{BruteForce: protection}, passwordConfig("secret"))
+
+	login = func(user, password string) error {
+		_, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{
+			User: user,
+			Auth: []gossh.AuthMethod{gossh.Password(password)},
+		}, "", "")
+		return err
+	}
+	return testServer.Addr, login, cleanup
+}
+
+func TestProtectBruteForce_ban(t *testing.T) {
+	_, login, cleanup := newBruteForceTestServer(feature.BruteForceProtection{
+		MaxFailures: 3,
+		BanTime:     time.Second,
+	})
+	defer cleanup()
+
+	if err := login("alice", "secret"); err != nil {
+		t.Fatalf("login() = %v, want access", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := login("bob", "wrong"); err == nil {
+			t.Fatal("login() got access with wrong password")
+		}
+	}
+
+	if err := login("alice", "secret"); err == nil {
+		t.Error("login() got access while banned")
+	}
+
+	time.Sleep(time.Second + time.Second/2)
+
+	if err := login("alice", "secret"); err != nil {
+		t.Errorf("login() = %v, want access after ban expired", err)
+	}
+}
+
+func TestProtectBruteForce_maxStartups(t *testing.T) {
+	address, login, cleanup := newBruteForceTestServer(feature.BruteForceProtection{
+		MaxStartups: 1,
+	})
+	defer cleanup()
+
+	if err := login("alice", "secret"); err != nil {
+		t.Fatalf("login() = %v, want access", err)
+	}
+
+	// open an unauthenticated connection, and keep it open
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second / 10)
+
+	if err := login("alice", "secret"); err == nil {
+		t.Error("login() got access with too many unauthenticated connections")
+	}
+
+	conn.Close()
+	time.Sleep(time.Second / 10)
+
+	if err := login("alice", "secret"); err != nil {
+		t.Errorf("login() = %v, want access after closing unauthenticated connection", err)
+	}
+}
+
+// publicKeyConfig is a configuration that accepts a single public key
+type publicKeyConfig struct{ key ssh.PublicKey }
+
+func (pc publicKeyConfig) Apply(logger logging.Logger, server *ssh.Server) error {
+	server.PublicKeyHandler = func(ctx ssh.Context, key ssh.PublicKey) bool {
+		return ssh.KeysEqual(key, pc.key)
+	}
+	return nil
+}
+
+func TestProtectBruteForce_publicKeys(t *testing.T) {
+	signer, key := testutils.GenerateRSATestKeyPair()
+	wrong := make([]gossh.Signer, 3)
+	for i := range wrong {
+		wrong[i], _ = testutils.GenerateRSATestKeyPair()
+	}
+
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{BruteForce: feature.BruteForceProtection{
+		MaxFailures: 3,
+		BanTime:     time.Second,
+		MaxBanTime:  time.Second,
+	}}, publicKeyConfig{key: key})
+	defer cleanup()
+
+	// login connects offering signers one after another
+	login := func(signers ...gossh.Signer) error {
+		_, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{
+			User: "alice",
+			Auth: []gossh.AuthMethod{gossh.PublicKeys(signers...)},
+		}, "", "")
+		return err
+	}
+
+	// offering several keys before the right one is not a failure
+	for i := 0; i < 3; i++ {
+		if err := login(append(wrong, signer)...); err != nil {
+			t.Fatalf("login() = %v, want access after offering several keys", err)
+		}
+	}
+
+	// each rejected connection counts as a single failure
+	for i := 0; i < 3; i++ {
+		if err := login(wrong...); err == nil {
+			t.Fatal("login() got access with wrong keys")
+		}
+	}
+	if err := login(signer); err == nil {
+		t.Error("login() got access while banned")
+	}
+
+	time.Sleep(time.Second + time.Second/2)
+
+	if err := login(signer); err != nil {
+		t.Errorf("login() = %v, want access after ban expired", err)
+	}
+}
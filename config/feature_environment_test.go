@@ -0,0 +1,74 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var environmentTestOptions = &proxyssh.Options{
+	AcceptEnv: []string{"LANG", "LC_*"},
+}
+
+func TestAcceptEnvironment(t *testing.T) {
+	testServer, _, cleanup := integrationtest.NewServer(environmentTestOptions)
+	defer cleanup()
+
+	// respond with the environment, one variable per line
+	testServer.Handler = func(s ssh.Session) {
+		s.Write([]byte(strings.Join(feature.Environ(s), "\n")))
+		s.Exit(0)
+	}
+
+	client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Errorf("Unable to create test server session: %s", err)
+		t.FailNow()
+	}
+	defer client.Close()
+
+	for key, value := range map[string]string{
+		"LANG":       "C.UTF-8",
+		"LC_ALL":     "C",
+		"LD_PRELOAD": "evil.so",
+		"USER":       "root",
+	} {
+		if err := session.Setenv(key, value); err != nil {
+			t.Errorf("Unable to set environment variable %s: %s", key, err)
+		}
+	}
+
+	out, err := session.Output("")
+	if err != nil {
+		t.Errorf("Unable to run command: %s", err)
+		t.FailNow()
+	}
+	got := strings.Split(string(out), "\n")
+
+	for _, want := range []string{"LANG=C.UTF-8", "LC_ALL=C", "USER=user"} {
+		if !testutils.SliceContainsString(got, want) {
+			t.Errorf("Environ() = %v, want to contain %q", got, want)
+		}
+	}
+	for _, unwanted := range []string{"LD_PRELOAD=evil.so", "USER=root"} {
+		if testutils.SliceContainsString(got, unwanted) {
+			t.Errorf("Environ() = %v, want to not contain %q", got, unwanted)
+		}
+	}
+
+	for _, prefix := range []string{"SSH_CONNECTION=127.0.0.1 ", "SSH_CLIENT=127.0.0.1 "} {
+		var found bool
+		for _, kv := range got {
+			found = found || strings.HasPrefix(kv, prefix)
+		}
+		if !found {
+			t.Errorf("Environ() = %v, want to contain %q", got, prefix)
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package config
 
 import (
+	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"testing"
 
+	"github.com/gliderlabs/ssh"
 	"github.com/tkw1536/proxyssh"
 	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/internal/integrationtest"
 	"github.com/tkw1536/proxyssh/internal/testutils"
+	"github.com/tkw1536/proxyssh/logging"
 	gossh "golang.org/x/crypto/ssh"
 )
 
@@ -167,3 +171,114 @@ func TestPortForwardingReverse(t *testing.T) {
 
 	})
 }
+
+// tunnelsConfig is a configuration whose sessions list the tunnels of their connection, or close the tunnel with the id given as the command.
+type tunnelsConfig struct{}
+
+func (tunnelsConfig) Apply(logger logging.Logger, server *ssh.Server) error {
+	server.Handler = func(session ssh.Session) {
+		if command := session.Command(); len(command) == 1 {
+			id, _ := strconv.Atoi(command[0])
+			if err := feature.CloseTunnel(session.Context(), id); err != nil {
+				io.WriteString(session, err.Error())
+				session.Exit(1)
+				return
+			}
+		}
+
+		for _, tunnel := range feature.Tunnels(session.Context()) {
+			fmt.Fprintf(session, "%d %s %s %d\n", tunnel.ID, tunnel.Direction, tunnel.Address, tunnel.BytesOut())
+		}
+		session.Exit(0)
+	}
+	return nil
+}
+
+func TestTunnels(t *testing.T) {
+	forward := feature.MustParseNetworkAddress(testutils.NewTestListenAddress())
+	reverse := feature.MustParseNetworkAddress(testutils.NewTestListenAddress())
+
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{
+		ForwardAddresses: []feature.NetworkAddress{forward},
+		ReverseAddresses: []feature.NetworkAddress{reverse},
+	}, tunnelsConfig{})
+	defer cleanup()
+
+	client, _, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	// run runs command in a new session of client
+	run := func(command string) (string, error) {
+		session, err := client.NewSession()
+		if err != nil {
+			return "", err
+		}
+		defer session.Close()
+
+		out, err := session.Output(command)
+		return string(out), err
+	}
+
+	// create a reverse tunnel
+	rl, err := client.Listen("tcp", reverse.String())
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go testutils.TCPConstantTestResponse(rl, "reverse\n")
+	defer rl.Close()
+
+	// create a local tunnel and read from it
+	ll, err := net.Listen("tcp", forward.String())
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go testutils.TCPConstantTestResponse(ll, "success\n")
+	defer ll.Close()
+
+	cc, err := client.Dial("tcp", forward.String())
+	if err != nil {
+		t.Fatalf("Unable to dial forward: %s", err)
+	}
+	io.ReadAll(cc)
+	cc.Close()
+
+	// list the tunnels
+	got, err := run("")
+	if err != nil {
+		t.Fatalf("Unable to list tunnels: %s", err)
+	}
+	want := fmt.Sprintf("1 reverse %s 0\n2 local %s 8\n", reverse, forward)
+	if got != want {
+		t.Errorf("tunnels = %q, want %q", got, want)
+	}
+
+	// close the reverse tunnel
+	got, err = run("1")
+	if err != nil {
+		t.Fatalf("Unable to close tunnel: %s", err)
+	}
+	if want := fmt.Sprintf("2 local %s 8\n", forward); got != want {
+		t.Errorf("tunnels = %q, want %q", got, want)
+	}
+	if conn, err := net.Dial("tcp", reverse.String()); err == nil {
+		conn.Close()
+		t.Error("Able to dial closed reverse tunnel")
+	}
+
+	// close the local tunnel
+	if _, err := run("2"); err != nil {
+		t.Fatalf("Unable to close tunnel: %s", err)
+	}
+	if cc, err := client.Dial("tcp", forward.String()); err == nil {
+		cc.Close()
+		t.Error("Able to dial closed local tunnel")
+	}
+
+	// closing an unknown tunnel fails
+	if _, err := run("3"); err == nil {
+		t.Error("Able to close unknown tunnel")
+	}
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/config/osexec"
+	"github.com/tkw1536/proxyssh/config/terminal"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestShowBanner(t *testing.T) {
+	path, cleanupFile := testutils.WriteTempFile("banner-*.txt", "Authorized access only, {{.User}}!\n")
+	defer cleanupFile()
+
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{BannerPath: path}, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	defer cleanup()
+
+	var banner string
+	_, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{
+		User: "alice",
+		BannerCallback: func(message string) error {
+			banner = message
+			return nil
+		},
+	}, "true", "")
+	if err != nil {
+		t.Fatalf("Unable to run command: %s", err)
+	}
+
+	if want := "Authorized access only, alice!\n"; banner != want {
+		t.Errorf("banner = %q, want %q", banner, want)
+	}
+}
+
+func TestShowMessageOfTheDay(t *testing.T) {
+	path, cleanupFile := testutils.WriteTempFile("motd-*.txt", "Welcome {{.User}}\nfrom {{.RemoteAddr}}\n")
+	defer cleanupFile()
+
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{MessageOfTheDayPath: path}, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	defer cleanup()
+
+	t.Run("regular session does not show message of the day", func(t *testing.T) {
+		stdout, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{User: "alice"}, "echo hello", "")
+		if err != nil {
+			t.Fatalf("Unable to run command: %s", err)
+		}
+		if stdout != "hello\n" {
+			t.Errorf("stdout = %q, want %q", stdout, "hello\n")
+		}
+	})
+
+	t.Run("pty session shows message of the day", func(t *testing.T) {
+		client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{User: "alice"})
+		if err != nil {
+			t.Fatalf("Unable to create test server session: %s", err)
+		}
+		defer client.Close()
+
+		if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+			t.Fatalf("Unable to request pty: %s", err)
+		}
+		// keep the process alive, so that its output is read before the pty is closed
+		out, err := session.Output("echo hello; sleep 1")
+		if err != nil {
+			t.Fatalf("Unable to run command: %s", err)
+		}
+
+		wantPrefix := "Welcome alice\r\nfrom " + client.LocalAddr().String() + "\r\n"
+		if !strings.HasPrefix(string(out), wantPrefix) {
+			t.Errorf("output = %q, want prefix %q", out, wantPrefix)
+		}
+		if !strings.HasSuffix(string(out), "hello\r\n") {
+			t.Errorf("output = %q, want suffix %q", out, "hello\r\n")
+		}
+	})
+}
+
+func TestREPLConfig_WelcomeMessage(t *testing.T) {
+	testServer, _, cleanup := integrationtest.NewServer(nil, &terminal.REPLConfig{WelcomeMessage: "Hello {{.User}}", Prompt: "> "})
+	defer cleanup()
+
+	stdout, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{User: "alice"}, "", "exit\n")
+	if err != nil {
+		t.Fatalf("Unable to run command: %s", err)
+	}
+	if want := "Hello alice\n> "; stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+}
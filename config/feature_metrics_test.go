@@ -0,0 +1,117 @@
+package config
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/config/osexec"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestServeMetrics(t *testing.T) {
+	metricsAddress := testutils.NewTestListenAddress()
+
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{MetricsAddress: metricsAddress}, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	defer cleanup()
+
+	_, _, code, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, "exit 3", "")
+	if err != nil || code != 3 {
+		t.Fatalf("Unable to run command: code = %d, err = %v", code, err)
+	}
+
+	res, err := http.Get("http://" + metricsAddress + "/metrics")
+	if err != nil {
+		t.Fatalf("Unable to get metrics: %s", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Unable to read metrics: %s", err)
+	}
+	got := string(body)
+
+	for _, want := range []string{
+		"proxyssh_connections_total ",
+		"proxyssh_connections_active ",
+		`proxyssh_sessions_total{backend="osexec",exit_code="3"} `,
+		`proxyssh_sessions_active{backend="osexec"} 0`,
+		`proxyssh_leak_detector_total{result="success"} `,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("ServeMetrics(): metrics do not contain %q", want)
+		}
+	}
+}
+
+// scrapeMetric returns the value of the metric named name served at address
+func scrapeMetric(t *testing.T, address, name string) float64 {
+	t.Helper()
+
+	res, err := http.Get("http://" + address + "/metrics")
+	if err != nil {
+		t.Fatalf("Unable to get metrics: %s", err)
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), name+" "); ok {
+			got, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("Unable to parse metric %s: %s", name, err)
+			}
+			return got
+		}
+	}
+	return 0
+}
+
+func TestServeMetrics_reverseForwarding(t *testing.T) {
+	metricsAddress := testutils.NewTestListenAddress()
+	reverse := feature.MustParseNetworkAddress(testutils.NewTestListenAddress())
+
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{
+		MetricsAddress:   metricsAddress,
+		ReverseAddresses: []feature.NetworkAddress{reverse},
+	})
+	defer cleanup()
+
+	const bytesIn = `proxyssh_forward_bytes_total{direction="in"}`
+	before := scrapeMetric(t, metricsAddress, bytesIn)
+
+	client, _, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	listener, err := client.Listen("tcp", reverse.String())
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	go testutils.TCPConstantTestResponse(listener, "success\n")
+
+	conn, err := net.Dial("tcp", reverse.String())
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	if out, err := io.ReadAll(conn); err != nil || string(out) != "success\n" {
+		t.Fatalf("ReadAll() got out = %q, err = %v", out, err)
+	}
+	conn.Close()
+
+	if after := scrapeMetric(t, metricsAddress, bytesIn); after-before < float64(len("success\n")) {
+		t.Errorf("ServeMetrics(): %s got %v after reverse forwarding, want at least %v", bytesIn, after, before+float64(len("success\n")))
+	}
+}
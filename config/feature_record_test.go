@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/config/osexec"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestRecordSessions(t *testing.T) {
+	dir := t.TempDir()
+
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{RecordDirectory: dir}, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	defer cleanup()
+
+	t.Run("regular session is recorded as transcript", func(t *testing.T) {
+		_, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, "cat; echo stderr 1>&2", "Hello world")
+		if err != nil {
+			t.Fatalf("Unable to run command: %s", err)
+		}
+
+		matches, _ := filepath.Glob(filepath.Join(dir, "*_user_127.0.0.1_*.stdin"))
+		if len(matches) != 1 {
+			t.Fatalf("Recording: got %d transcripts, want 1", len(matches))
+		}
+		base := strings.TrimSuffix(matches[0], ".stdin")
+
+		for ext, want := range map[string]string{
+			".stdin":  "Hello world",
+			".stdout": "Hello world",
+			".stderr": "stderr\n",
+		} {
+			got, err := os.ReadFile(base + ext)
+			if err != nil || string(got) != want {
+				t.Errorf("Recording %s: got %q, err = %v, want %q", ext, got, err, want)
+			}
+		}
+	})
+
+	t.Run("pty session is recorded as asciicast", func(t *testing.T) {
+		client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+		if err != nil {
+			t.Fatalf("Unable to create test server session: %s", err)
+		}
+		defer client.Close()
+
+		if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+			t.Fatalf("Unable to request pty: %s", err)
+		}
+		// run an interactive shell, and send input once it is ready
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			t.Fatalf("Unable to create stdin: %s", err)
+		}
+		if err := session.Shell(); err != nil {
+			t.Fatalf("Unable to start shell: %s", err)
+		}
+		time.Sleep(time.Second / 2)
+		io.WriteString(stdin, "echo recorded\n")
+		time.Sleep(time.Second / 2)
+		io.WriteString(stdin, "exit\n")
+		if err := session.Wait(); err != nil {
+			t.Fatalf("Unable to run shell: %s", err)
+		}
+		time.Sleep(time.Second / 2) // wait for the recording to be finished
+
+		matches, _ := filepath.Glob(filepath.Join(dir, "*.cast"))
+		if len(matches) != 1 {
+			t.Fatalf("Recording: got %d casts, want 1", len(matches))
+		}
+		file, err := os.Open(matches[0])
+		if err != nil {
+			t.Fatalf("Unable to open recording: %s", err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+
+		// check the header
+		var header struct {
+			Version, Width, Height int
+		}
+		if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil {
+			t.Fatalf("Recording: invalid header")
+		}
+		if header.Version != 2 || header.Width != 80 || header.Height != 24 {
+			t.Errorf("Recording: got header %v, want version 2 with 80x24", header)
+		}
+
+		// and the output events
+		var output string
+		for scanner.Scan() {
+			var event []interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+				t.Fatalf("Recording: invalid event %q", scanner.Text())
+			}
+			if event[1] == "o" {
+				output += event[2].(string)
+			}
+		}
+		if !strings.Contains(output, "recorded") {
+			t.Errorf("Recording: got output %q, want to contain %q", output, "recorded")
+		}
+	})
+}
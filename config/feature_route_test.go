@@ -0,0 +1,84 @@
+package config
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// routeConfig is a configuration that routes forwardings to "alias:1" to target, and rejects forwardings to "rejected:1".
+type routeConfig struct {
+	target string
+}
+
+func (rc routeConfig) Apply(logger logging.Logger, server *ssh.Server) error {
+	feature.RouteForwards(logger, server, func(ctx ssh.Context, destination feature.NetworkAddress) (string, bool, error) {
+		switch destination.String() {
+		case "alias:1":
+			return rc.target, true, nil
+		case "rejected:1":
+			return "", false, errors.New("rejected")
+		default:
+			return "", false, nil
+		}
+	})
+	return nil
+}
+
+func TestRouteForwards(t *testing.T) {
+	// start a server to forward to
+	ll, err := net.Listen("tcp", testutils.NewTestListenAddress())
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go testutils.TCPConstantTestResponse(ll, "success\n")
+	defer ll.Close()
+
+	allowed := feature.MustParseNetworkAddress(ll.Addr().String())
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{
+		ForwardAddresses: []feature.NetworkAddress{allowed},
+	}, routeConfig{target: allowed.String()})
+	defer cleanup()
+
+	client, _, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{"routed forwarding connects to target", "alias:1", false},
+		{"unrouted forwarding uses callback", allowed.String(), false},
+		{"unrouted forwarding denied by callback", "unknown:1", true},
+		{"forwarding rejected by router", "rejected:1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := client.Dial("tcp", tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			if got, _ := io.ReadAll(conn); string(got) != "success\n" {
+				t.Errorf("Dial() got output = %q, want = %q", got, "success\n")
+			}
+		})
+	}
+}
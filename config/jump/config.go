@@ -0,0 +1,109 @@
+// Package jump provides JumpConfig.
+package jump
+
+import (
+	"flag"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// JumpConfig implements a proxyssh.Configuration and proxyssh.Handler that turn the server into a jump host, also known as a bastion host.
+//
+// Clients connect to backend ssh servers through the jump host, for example using 'ssh -J gateway host'.
+// For this purpose, the jump host routes the local port forwardings of clients to backends, see feature.RouteForwards.
+// The backend for a host is found using the first matching entry in Routes, and otherwise using Backends.
+// All routed connections are logged, and are tracked as tunnels of the client connection.
+//
+// Hosts without a backend are handled like any other port forwarding, and are usually denied.
+// Sessions on the jump host itself are not supported, and fail with an error message.
+//
+// To authenticate a user, the server uses ssh keys.
+// When AuthorizedKeysDir is set, the keys of each user are read from a file named like the user inside of it.
+// The file uses the authorized_keys format.
+// Apply refuses to configure a jump host without authentication, unless AllowUnauthenticated is set.
+type JumpConfig struct {
+	// Routes are the hosts users may jump to.
+	Routes []Route
+
+	// Backends is used to find the backends of hosts not found in Routes.
+	// When nil, only Routes are used.
+	Backends Backends
+
+	// AuthorizedKeysDir is a directory containing the authorized keys of each user.
+	// When empty, authentication is not configured.
+	AuthorizedKeysDir string
+
+	// AllowUnauthenticated allows AuthorizedKeysDir to be empty.
+	// Clients then have to be authenticated by other means, as otherwise anyone can reach the backends.
+	AllowUnauthenticated bool
+}
+
+// ErrNoAuthentication is returned by JumpConfig.Apply when AuthorizedKeysDir is not set, and AllowUnauthenticated is false
+var ErrNoAuthentication = errors.New("JumpConfig: AuthorizedKeysDir is not set")
+
+// ErrNoSessions is returned by JumpConfig.Handle for all sessions
+var ErrNoSessions = errors.New("This is a jump host, use 'ssh -J' to connect to a host behind it")
+
+// Apply applies this configuration to the server.
+func (cfg *JumpConfig) Apply(logger logging.Logger, sshserver *ssh.Server) error {
+	if cfg.AuthorizedKeysDir == "" && !cfg.AllowUnauthenticated {
+		return ErrNoAuthentication
+	}
+
+	feature.RouteForwards(logger, sshserver, cfg.route)
+
+	if cfg.AuthorizedKeysDir == "" {
+		return nil
+	}
+
+	sshserver.PublicKeyHandler = feature.AuthorizeKeys(logger, func(ctx ssh.Context) ([]ssh.PublicKey, error) {
+		return feature.FindUserKeys(cfg.AuthorizedKeysDir, ctx.User()), nil
+	})
+	return nil
+}
+
+// route implements feature.ForwardRouter
+func (cfg *JumpConfig) route(ctx ssh.Context, destination feature.NetworkAddress) (target string, ok bool, err error) {
+	for _, r := range cfg.Routes {
+		if r.Matches(ctx.User(), destination) {
+			return r.Target, true, nil
+		}
+	}
+
+	if cfg.Backends == nil {
+		return "", false, nil
+	}
+	return cfg.Backends.FindBackend(ctx, ctx.User(), destination)
+}
+
+// Backend implements proxyssh.BackendHandler
+func (cfg *JumpConfig) Backend() string {
+	return "jump"
+}
+
+// Handle implements the handler.
+// It always returns ErrNoSessions.
+func (cfg *JumpConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	return nil, ErrNoSessions
+}
+
+// RegisterFlags registers flags representing the config to the provided flagset.
+// When flagset is nil, uses flag.CommandLine.
+func (cfg *JumpConfig) RegisterFlags(flagset *flag.FlagSet) {
+	if flagset == nil {
+		flagset = flag.CommandLine
+	}
+
+	if cfg.Routes == nil {
+		cfg.Routes = []Route{}
+	}
+	rv := RouteListVar{Routes: &cfg.Routes}
+	flagset.Var(&rv, "route", "Hosts users may jump to, e.g. 'alice@db=10.0.0.5:22' or '*@web=web.internal'")
+
+	flagset.StringVar(&cfg.AuthorizedKeysDir, "authorizedkeys", cfg.AuthorizedKeysDir, "Directory containing an authorized_keys file for each user, named like the user")
+	flagset.BoolVar(&cfg.AllowUnauthenticated, "allowunauthenticated", cfg.AllowUnauthenticated, "Allow running without '-authorizedkeys', clients then have to be authenticated by other means")
+}
@@ -0,0 +1,114 @@
+package jump
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// testBackends is a Backends that returns the backend with the name of the host, if any
+type testBackends map[string]string
+
+func (tb testBackends) FindBackend(ctx context.Context, user string, host feature.NetworkAddress) (string, bool, error) {
+	if host.Hostname == "broken" {
+		return "", false, errors.New("broken backend")
+	}
+	target, ok := tb[host.Hostname]
+	return target, ok, nil
+}
+
+func TestJumpConfig(t *testing.T) {
+	// start two backends
+	db, err := net.Listen("tcp", testutils.NewTestListenAddress())
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer db.Close()
+	go testutils.TCPConstantTestResponse(db, "db\n")
+
+	box, err := net.Listen("tcp", testutils.NewTestListenAddress())
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer box.Close()
+	go testutils.TCPConstantTestResponse(box, "box\n")
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, &JumpConfig{
+		Routes: []Route{
+			{User: "alice", Host: feature.MustParseNetworkAddress("db:22"), Target: db.Addr().String()},
+		},
+		Backends: testBackends{"box": box.Addr().String()},
+
+		AllowUnauthenticated: true,
+	})
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		user    string
+		address string
+		want    string
+		wantErr bool
+	}{
+		{"user jumps to route", "alice", "db:22", "db\n", false},
+		{"other user can not jump to route", "bob", "db:22", "", true},
+		{"user can not jump to route on other port", "alice", "db:2222", "", true},
+		{"user jumps to backend", "bob", "box:22", "box\n", false},
+		{"user can not jump to broken backend", "bob", "broken:22", "", true},
+		{"user can not jump to unknown host", "alice", "unknown:22", "", true},
+		{"user can not connect to backend directly", "alice", db.Addr().String(), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{User: tt.user})
+			if err != nil {
+				t.Fatalf("Unable to create test server session: %s", err)
+			}
+			defer client.Close()
+
+			conn, err := client.Dial("tcp", tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			got, _ := io.ReadAll(conn)
+			if string(got) != tt.want {
+				t.Errorf("Dial() got output = %q, want = %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("sessions are not supported", func(t *testing.T) {
+		_, stderr, code, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, "", "")
+		if err != nil {
+			t.Fatalf("RunTestServerCommand() got err = %s", err)
+		}
+		if want := "Failed to create process: " + ErrNoSessions.Error() + "\n"; stderr != want || code != 255 {
+			t.Errorf("RunTestServerCommand() got stderr = %q, code = %d, want stderr = %q, code = 255", stderr, code, want)
+		}
+	})
+}
+
+func TestJumpConfig_Apply(t *testing.T) {
+	if err := (&JumpConfig{}).Apply(integrationtest.GetLogger(), &ssh.Server{}); err != ErrNoAuthentication {
+		t.Errorf("Apply() got err = %v, want %v", err, ErrNoAuthentication)
+	}
+	if err := (&JumpConfig{AllowUnauthenticated: true}).Apply(integrationtest.GetLogger(), &ssh.Server{}); err != nil {
+		t.Errorf("Apply() got err = %v, want nil", err)
+	}
+	if err := (&JumpConfig{AuthorizedKeysDir: t.TempDir()}).Apply(integrationtest.GetLogger(), &ssh.Server{}); err != nil {
+		t.Errorf("Apply() got err = %v, want nil", err)
+	}
+}
@@ -0,0 +1,98 @@
+package jump
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/feature"
+)
+
+// Backends find backend ssh servers for hosts that are not listed in the routes of a JumpConfig.
+type Backends interface {
+	// FindBackend finds the backend that user may connect to when requesting host.
+	// When there is none, it should return ok = false.
+	FindBackend(ctx context.Context, user string, host feature.NetworkAddress) (target string, ok bool, err error)
+}
+
+// DockerBackends finds backends among running docker containers.
+//
+// A host refers to the container of the same name, and can only be requested on DefaultPort.
+// The container must have a label whose value is equal to the name of the user.
+// Clients are connected to the ssh server listening on Port in the container.
+type DockerBackends struct {
+	// Client is the docker client to be used to the docker daemon.
+	Client client.APIClient
+
+	// DockerLabelUser is the label to use for associating a user to a container.
+	DockerLabelUser string
+
+	// Port is the port of the ssh server within containers.
+	// When zero, DefaultPort is used.
+	Port uint16
+}
+
+// FindBackend implements Backends
+func (db *DockerBackends) FindBackend(ctx context.Context, user string, host feature.NetworkAddress) (target string, ok bool, err error) {
+	if host.Port != DefaultPort || host.Hostname == "" {
+		return "", false, nil
+	}
+
+	args := filters.NewArgs()
+	args.Add("label", db.DockerLabelUser+"="+user)
+	args.Add("name", host.Hostname)
+	args.Add("status", "running")
+
+	containers, err := db.Client.ContainerList(ctx, container.ListOptions{Filters: args})
+	if err != nil {
+		return "", false, errors.Wrap(err, "Unable to list containers")
+	}
+
+	// the name filter matches substrings, so look for an exact match
+	for _, c := range containers {
+		for _, name := range c.Names {
+			if name != "/"+host.Hostname {
+				continue
+			}
+
+			ip := containerIP(c.NetworkSettings)
+			if ip == "" {
+				return "", false, errors.Errorf("Container %s does not have an ip address", host.Hostname)
+			}
+
+			port := db.Port
+			if port == 0 {
+				port = DefaultPort
+			}
+			return net.JoinHostPort(ip, strconv.Itoa(int(port))), true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+// containerIP returns the ip address of a container in the first of its networks, by name.
+// When the container has no ip address, returns the empty string.
+func containerIP(settings *container.NetworkSettingsSummary) string {
+	if settings == nil {
+		return ""
+	}
+
+	names := make([]string, 0, len(settings.Networks))
+	for name := range settings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if endpoint := settings.Networks[name]; endpoint != nil && endpoint.IPAddress != "" {
+			return endpoint.IPAddress
+		}
+	}
+	return ""
+}
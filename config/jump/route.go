@@ -0,0 +1,107 @@
+package jump
+
+import (
+	"flag"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/feature"
+)
+
+// DefaultPort is the port of hosts and backends that do not specify one.
+const DefaultPort = 22
+
+// Route allows a user to jump to a host.
+type Route struct {
+	// User is the name of the user allowed to use the route, or '*' to allow all users.
+	User string
+
+	// Host is the address clients request, for example 'db:22' when running 'ssh -J gateway db'.
+	Host feature.NetworkAddress
+
+	// Target is the address of the backend ssh server the host refers to, of the form 'host:port'.
+	Target string
+}
+
+// Matches checks if this route applies to user connecting to host.
+func (r Route) Matches(user string, host feature.NetworkAddress) bool {
+	return (r.User == "*" || r.User == user) && r.Host == host
+}
+
+// String turns this route into a string that can be parsed by ParseRoute.
+func (r Route) String() string {
+	return r.User + "@" + r.Host.String() + "=" + r.Target
+}
+
+// ParseRoute parses a route of the form 'user@host[:port]=target[:port]'.
+// When a port is omitted, DefaultPort is used.
+//
+// For example, 'alice@db=10.0.0.5' allows the user 'alice' to connect to the ssh server at '10.0.0.5:22' using 'ssh -J gateway db'.
+func ParseRoute(s string) (r Route, err error) {
+	host, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return r, errors.Errorf("ParseRoute: %q is not of the form 'user@host=target'", s)
+	}
+
+	r.User, host, ok = strings.Cut(host, "@")
+	if !ok || r.User == "" {
+		return r, errors.Errorf("ParseRoute: %q does not contain a user", s)
+	}
+
+	r.Host, err = feature.ParseNetworkAddress(withDefaultPort(host))
+	if err != nil {
+		return r, errors.Wrapf(err, "ParseRoute: Invalid host in %q", s)
+	}
+
+	r.Target = withDefaultPort(target)
+	if _, _, err := net.SplitHostPort(r.Target); err != nil || target == "" {
+		return r, errors.Errorf("ParseRoute: Invalid target in %q", s)
+	}
+
+	return r, nil
+}
+
+// withDefaultPort adds DefaultPort to address if it does not contain a port.
+func withDefaultPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), strconv.Itoa(DefaultPort))
+}
+
+// RouteListVar is a flag.Value representing a list of routes.
+// See ParseRoute for the syntax of each route.
+type RouteListVar struct {
+	Routes *[]Route
+}
+
+// String turns this RouteListVar into a comma-seperated list of routes.
+func (rv *RouteListVar) String() string {
+	if rv.Routes == nil {
+		return ""
+	}
+
+	routes := make([]string, len(*rv.Routes))
+	for i, r := range *rv.Routes {
+		routes[i] = r.String()
+	}
+	return strings.Join(routes, ",")
+}
+
+// Set parses a route and adds it to the list.
+// This function is intended to be called by flag.Var()
+func (rv *RouteListVar) Set(value string) error {
+	r, err := ParseRoute(value)
+	if err != nil {
+		return err
+	}
+	*rv.Routes = append(*rv.Routes, r)
+	return nil
+}
+
+func init() {
+	// ensure that RouteListVar fullfills the flag.Value interface
+	var _ flag.Value = (*RouteListVar)(nil)
+}
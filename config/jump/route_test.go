@@ -0,0 +1,65 @@
+package jump
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tkw1536/proxyssh/feature"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Route
+		wantErr bool
+	}{
+		{"route without ports", "alice@db=10.0.0.5", Route{User: "alice", Host: feature.MustParseNetworkAddress("db:22"), Target: "10.0.0.5:22"}, false},
+		{"route with ports", "alice@db:2222=10.0.0.5:22022", Route{User: "alice", Host: feature.MustParseNetworkAddress("db:2222"), Target: "10.0.0.5:22022"}, false},
+		{"route for all users", "*@web=web.internal", Route{User: "*", Host: feature.MustParseNetworkAddress("web:22"), Target: "web.internal:22"}, false},
+		{"route to ipv6 target", "bob@db=[::1]", Route{User: "bob", Host: feature.MustParseNetworkAddress("db:22"), Target: "[::1]:22"}, false},
+
+		{"route without target", "alice@db", Route{}, true},
+		{"route without user", "db=10.0.0.5", Route{}, true},
+		{"route with empty user", "@db=10.0.0.5", Route{}, true},
+		{"route with empty target", "alice@db=", Route{}, true},
+		{"route with invalid port", "alice@db:ssh=10.0.0.5", Route{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRoute(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRoute() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRoute() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoute_Matches(t *testing.T) {
+	db := feature.MustParseNetworkAddress("db:22")
+
+	tests := []struct {
+		name  string
+		route Route
+		user  string
+		host  feature.NetworkAddress
+		want  bool
+	}{
+		{"matching user and host", Route{User: "alice", Host: db}, "alice", db, true},
+		{"wildcard user", Route{User: "*", Host: db}, "alice", db, true},
+		{"other user", Route{User: "alice", Host: db}, "bob", db, false},
+		{"other host", Route{User: "alice", Host: db}, "alice", feature.MustParseNetworkAddress("web:22"), false},
+		{"other port", Route{User: "alice", Host: db}, "alice", feature.MustParseNetworkAddress("db:2222"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.route.Matches(tt.user, tt.host); got != tt.want {
+				t.Errorf("Route.Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
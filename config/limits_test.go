@@ -0,0 +1,100 @@
+package config
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/config/osexec"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestLimits_sessionsPerUser(t *testing.T) {
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{
+		Limits: proxyssh.Limits{MaxSessionsPerUser: 1},
+	}, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	defer cleanup()
+
+	// start a long-running session, and wait for it to be running
+	client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{User: "alice"})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Unable to get stdout: %s", err)
+	}
+	if err := session.Start("echo ready; sleep 10"); err != nil {
+		t.Fatalf("Unable to start command: %s", err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("Unable to wait for command: got %q, err = %v", line, err)
+	}
+
+	// a second session of the same user is rejected
+	_, stderr, code, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{User: "alice"}, "echo hello", "")
+	if err != nil || code != 255 || !strings.Contains(stderr, `Too many sessions for user "alice"`) {
+		t.Errorf("Limits: second session got code %d, stderr %q, err = %v", code, stderr, err)
+	}
+
+	// but a session of a different user is not
+	stdoutString, _, code, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{User: "bob"}, "echo hello", "")
+	if err != nil || code != 0 || stdoutString != "hello\n" {
+		t.Errorf("Limits: other user got code %d, stdout %q, err = %v", code, stdoutString, err)
+	}
+}
+
+func TestLimits_sessionDuration(t *testing.T) {
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{
+		Limits: proxyssh.Limits{MaxSessionDuration: time.Second / 2},
+	}, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	defer cleanup()
+
+	start := time.Now()
+	_, stderr, code, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, "sleep 10", "")
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Limits: session took %s, expected it to be terminated", took)
+	}
+	if err != nil || code != 255 || !strings.Contains(stderr, "Session exceeded maximum duration of 500ms") {
+		t.Errorf("Limits: session got code %d, stderr %q, err = %v", code, stderr, err)
+	}
+}
+
+func TestLimits_connectionsPerUser(t *testing.T) {
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{
+		Limits: proxyssh.Limits{MaxConnectionsPerUser: 1},
+	}, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	defer cleanup()
+
+	// open a connection that never starts a session, as used for port forwarding
+	client, _, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{User: "alice"})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+
+	// a second connection of the same user is closed
+	if _, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{User: "alice"}, "echo hello", ""); err == nil {
+		t.Error("Limits: second connection was not closed")
+	}
+
+	// but a connection of a different user is not
+	stdout, _, code, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{User: "bob"}, "echo hello", "")
+	if err != nil || code != 0 || stdout != "hello\n" {
+		t.Errorf("Limits: other user got code %d, stdout %q, err = %v", code, stdout, err)
+	}
+
+	// once the first connection is closed, the user may connect again
+	client.Close()
+	time.Sleep(time.Second / 10)
+
+	stdout, _, code, err = testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{User: "alice"}, "echo hello", "")
+	if err != nil || code != 0 || stdout != "hello\n" {
+		t.Errorf("Limits: connection after closing got code %d, stdout %q, err = %v", code, stdout, err)
+	}
+}
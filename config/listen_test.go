@@ -0,0 +1,74 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/config/osexec"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestListenAndServe(t *testing.T) {
+	testLogger := integrationtest.GetLogger()
+
+	tcpAddress := testutils.NewTestListenAddress()
+	unixAddress := "unix:" + filepath.Join(t.TempDir(), "ssh.sock")
+
+	options := &proxyssh.Options{
+		ListenAddress:   tcpAddress,
+		ListenAddresses: []string{unixAddress},
+		DrainTimeout:    time.Second / 10,
+	}
+	sshserver, err := proxyssh.NewServer(testLogger, options, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err)
+	}
+	signer, _ := testutils.GenerateRSATestKeyPair()
+	sshserver.HostSigners = append(sshserver.HostSigners, signer)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- proxyssh.ListenAndServe(testLogger, sshserver, options)
+	}()
+
+	for _, address := range []string{tcpAddress, unixAddress} {
+		var out string
+		var err error
+
+		// wait for the server to start listening
+		for i := 0; i < 50; i++ {
+			out, _, _, err = testutils.RunTestServerCommand(address, gossh.ClientConfig{}, "echo hello", "")
+			if err == nil {
+				break
+			}
+			time.Sleep(time.Second / 10)
+		}
+
+		if err != nil || out != "hello\n" {
+			t.Errorf("ListenAndServe(): %s got %q, err = %v", address, out, err)
+		}
+	}
+
+	// shut down the server
+	process, _ := os.FindProcess(os.Getpid())
+	process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ListenAndServe() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() did not return after terminate signal")
+	}
+
+	// the unix socket is removed
+	if _, err := os.Stat(unixAddress[len("unix:"):]); !os.IsNotExist(err) {
+		t.Errorf("ListenAndServe(): unix socket still exists, err = %v", err)
+	}
+}
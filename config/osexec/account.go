@@ -0,0 +1,156 @@
+package osexec
+
+import (
+	"bufio"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+)
+
+// Account represents a unix user account that a SystemProcess can be run as.
+type Account struct {
+	Username string
+
+	UID, GID uint32   // primary user and group id
+	Groups   []uint32 // supplementary group ids
+
+	HomeDir string // home directory, used as working directory
+	Shell   string // login shell, may be empty
+}
+
+// PasswdFile is the path to the passwd(5) database used by LookupAccount.
+var PasswdFile = "/etc/passwd"
+
+// ErrAccountNotFound is returned by LookupAccount when no account with the provided username exists.
+var ErrAccountNotFound = errors.New("No matching unix account found")
+
+// LookupAccount finds the unix account with the given username.
+//
+// The user id, group id, home directory and login shell are read from PasswdFile.
+// Supplementary groups are determined using the os/user package.
+//
+// If there is no account with the provided username, returns ErrAccountNotFound.
+// If something goes wrong, other errors may be returned.
+func LookupAccount(username string) (*Account, error) {
+	file, err := os.Open(PasswdFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open passwd file")
+	}
+	defer file.Close()
+
+	// find the line belonging to the user
+	var fields []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		candidate := strings.Split(scanner.Text(), ":")
+		if len(candidate) == 7 && candidate[0] == username {
+			fields = candidate
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Unable to read passwd file")
+	}
+	if fields == nil {
+		return nil, ErrAccountNotFound
+	}
+
+	// parse uid and gid
+	uid, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid uid in passwd file")
+	}
+	gid, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid gid in passwd file")
+	}
+
+	account := &Account{
+		Username: username,
+		UID:      uint32(uid),
+		GID:      uint32(gid),
+		HomeDir:  fields[5],
+		Shell:    fields[6],
+	}
+
+	// find the supplementary groups, ignoring any errors.
+	if u, err := user.LookupId(fields[2]); err == nil {
+		groups, _ := u.GroupIds()
+		for _, group := range groups {
+			if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+				account.Groups = append(account.Groups, uint32(id))
+			}
+		}
+	}
+
+	return account, nil
+}
+
+// Credential returns the credential that processes running as this account should use.
+func (account *Account) Credential() *syscall.Credential {
+	return &syscall.Credential{
+		Uid:    account.UID,
+		Gid:    account.GID,
+		Groups: account.Groups,
+	}
+}
+
+// Environ returns the standard environment variables for processes running as this account.
+func (account *Account) Environ() []string {
+	env := []string{
+		"USER=" + account.Username,
+		"LOGNAME=" + account.Username,
+		"HOME=" + account.HomeDir,
+	}
+	if account.Shell != "" {
+		env = append(env, "SHELL="+account.Shell)
+	}
+	return env
+}
+
+// switchCredential switches the current process to cred.
+// It is used by helper processes that need to drop privileges only after performing privileged operations.
+func switchCredential(cred *syscall.Credential) error {
+	groups := make([]int, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = int(g)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return errors.Wrap(err, "Unable to set groups")
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return errors.Wrap(err, "Unable to set gid")
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return errors.Wrap(err, "Unable to set uid")
+	}
+	return nil
+}
+
+// FindAccountKeys finds the public keys authorized to login as account and returns them.
+// These are read from the '.ssh/authorized_keys' file inside the home directory of the account.
+//
+// This function will ignore all errors and or invalid values.
+func FindAccountKeys(account *Account) (keys []ssh.PublicKey) {
+	bytes, err := os.ReadFile(filepath.Join(account.HomeDir, ".ssh", "authorized_keys"))
+	if err != nil {
+		return nil
+	}
+
+	var key ssh.PublicKey
+	for {
+		key, _, _, bytes, err = ssh.ParseAuthorizedKey(bytes)
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return
+}
@@ -0,0 +1,202 @@
+package osexec
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const testPasswdFile = `root:x:0:0:root:/root:/bin/bash
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+broken:x:notanumber:1000::/home/broken:/bin/sh
+nologin:x:1001:1001::/home/nologin:
+`
+
+func TestLookupAccount(t *testing.T) {
+	passwd, cleanup := testutils.WriteTempFile("passwd", testPasswdFile)
+	defer cleanup()
+
+	defer func(old string) { PasswdFile = old }(PasswdFile)
+	PasswdFile = passwd
+
+	tests := []struct {
+		name     string
+		username string
+		want     *Account
+		wantErr  bool
+	}{
+		{
+			name:     "existing account",
+			username: "daemon",
+			want:     &Account{Username: "daemon", UID: 1, GID: 1, HomeDir: "/usr/sbin", Shell: "/usr/sbin/nologin"},
+		},
+		{
+			name:     "account without shell",
+			username: "nologin",
+			want:     &Account{Username: "nologin", UID: 1001, GID: 1001, HomeDir: "/home/nologin", Shell: ""},
+		},
+		{
+			name:     "invalid uid",
+			username: "broken",
+			wantErr:  true,
+		},
+		{
+			name:     "missing account",
+			username: "missing",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LookupAccount(tt.username)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LookupAccount() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != nil {
+				got.Groups = nil // depend on the system
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LookupAccount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing the account of a process requires root")
+	}
+
+	// create a home directory accessible to the account
+	home, err := os.MkdirTemp("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	if err := os.Chmod(home, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, &SystemExecConfig{
+		Shell:     "/bin/bash",
+		RunAsUser: true,
+		AccountLookup: func(username string) (*Account, error) {
+			return &Account{Username: username, UID: 65534, GID: 65534, HomeDir: home, Shell: "/bin/sh"}, nil
+		},
+	})
+	defer cleanup()
+
+	// authorize the test key
+	privateKey, publicKey := testutils.GenerateRSATestKeyPair()
+	if err := os.Mkdir(home+"/.ssh", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(home+"/.ssh/authorized_keys", []byte(testutils.AuthorizedKeysString(publicKey)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gotOut, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{
+		User: "virtual",
+		Auth: []gossh.AuthMethod{gossh.PublicKeys(privateKey)},
+	}, "id -u; id -g; pwd; echo $USER $HOME", "")
+	if err != nil {
+		t.Fatalf("Unable to run command: %s", err)
+	}
+
+	wantOut := strings.Join([]string{"65534", "65534", home, "virtual " + home}, "\n") + "\n"
+	if gotOut != wantOut || gotCode != 0 {
+		t.Errorf("RunAsUser got out = %q, err = %q, code = %d, want out = %q, code = 0", gotOut, gotErr, gotCode, wantOut)
+	}
+
+	t.Run("unauthorized key is rejected", func(t *testing.T) {
+		otherKey, _ := testutils.GenerateRSATestKeyPair()
+		_, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{
+			User: "virtual",
+			Auth: []gossh.AuthMethod{gossh.PublicKeys(otherKey)},
+		}, "true", "")
+		if err == nil {
+			t.Errorf("RunAsUser: unauthorized key was accepted")
+		}
+	})
+}
+
+func TestRunAsUser_sandboxRoot(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Sandbox is only supported on linux")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("Changing the account of a process requires root")
+	}
+
+	// create a root filesystem using /usr of the host, with a shell that only exists inside of it
+	root := t.TempDir()
+	if err := os.Chmod(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"usr", "proc"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, link := range []string{"bin", "lib", "lib64", "sbin"} {
+		if err := os.Symlink(filepath.Join("usr", link), filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("usr/bin/bash", filepath.Join(root, "shell")); err != nil {
+		t.Fatal(err)
+	}
+
+	home := t.TempDir()
+	if err := os.Chmod(home, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, &SystemExecConfig{
+		Shell:     "/bin/bash",
+		RunAsUser: true,
+		AccountLookup: func(username string) (*Account, error) {
+			return &Account{Username: username, UID: 65534, GID: 65534, HomeDir: home, Shell: "/shell"}, nil
+		},
+		Sandbox: Sandbox{
+			MountNamespace: true,
+			PIDNamespace:   true,
+			Root:           root,
+			Mounts: []BindMount{
+				{Source: "/usr", Target: "/usr", ReadOnly: true},
+			},
+		},
+	})
+	defer cleanup()
+
+	// authorize the test key
+	privateKey, publicKey := testutils.GenerateRSATestKeyPair()
+	if err := os.Mkdir(home+"/.ssh", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(home+"/.ssh/authorized_keys", []byte(testutils.AuthorizedKeysString(publicKey)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gotOut, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{
+		User: "virtual",
+		Auth: []gossh.AuthMethod{gossh.PublicKeys(privateKey)},
+	}, "id -u; id -g; pwd; grep CapEff /proc/self/status; grep CapBnd /proc/self/status", "")
+	if err != nil {
+		t.Fatalf("Unable to run command: %s", err)
+	}
+
+	// the home directory does not exist inside of the root
+	wantOut := strings.Join([]string{"65534", "65534", "/", "CapEff:\t0000000000000000", "CapBnd:\t0000000000000000"}, "\n") + "\n"
+	if gotOut != wantOut || gotCode != 0 {
+		t.Errorf("RunAsUser got out = %q, err = %q, code = %d, want out = %q, code = 0", gotOut, gotErr, gotCode, wantOut)
+	}
+}
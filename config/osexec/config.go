@@ -7,6 +7,7 @@ import (
 
 	"github.com/gliderlabs/ssh"
 	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/logging"
 )
 
@@ -16,14 +17,104 @@ type SystemExecConfig struct {
 	// This is called like `shell -c "command"`` when an ssh command is provided or like `shell` when not.
 	// The shell is passed to exec.LookPath().
 	Shell string
+
+	// RunAsUser indicates that processes should run as the unix account of the authenticated user.
+	// The login shell of the account is used instead of Shell, unless it is empty.
+	// This typically requires the server to run as root.
+	//
+	// When set, users are authenticated using the '.ssh/authorized_keys' file in the home directory of the account.
+	RunAsUser bool
+
+	// AccountLookup is used to find the unix account of an authenticated user when RunAsUser is set.
+	// It may map usernames onto different accounts, for example to implement virtual users.
+	//
+	// When nil, LookupAccount is used.
+	AccountLookup func(username string) (*Account, error)
+
+	// Sandbox describes an isolated environment to start each process in.
+	// The zero value does not isolate processes.
+	Sandbox Sandbox
+
+	// SFTP enables the sftp subsystem, see HandleSFTP.
+	// Files are served from the host filesystem, as the same account and inside the same sandbox as regular processes.
+	SFTP bool
+
+	// SFTPRoot is a directory to use as the root directory for sftp sessions.
+	// When empty, the root directory is not changed.
+	// Changing the root directory requires the server to run as root and RunAsUser to be set, and can not be combined with Sandbox.Root.
+	SFTPRoot string
+
+	// AgentDir is a directory to create the sockets of forwarded agents in, see feature.ListenAgent.
+	// When empty, the default directory for temporary files is used.
+	// When Sandbox.Root is set, the directory should be bind mounted at the same path.
+	//
+	// Agents are only forwarded for users allowed by feature.AllowAgentForwarding.
+	AgentDir string
+}
+
+// execContextKeys represents context keys for this package
+type execContextKeys int
+
+const (
+	accountContextKey execContextKeys = iota
+)
+
+func (cfg *SystemExecConfig) findAccount(ctx ssh.Context) (*Account, error) {
+	// if we previously fetched the account it will be in the context
+	if account, ok := ctx.Value(accountContextKey).(*Account); ok {
+		return account, nil
+	}
+
+	// find the actual account
+	lookup := cfg.AccountLookup
+	if lookup == nil {
+		lookup = LookupAccount
+	}
+	account, err := lookup(ctx.User())
+	if err != nil {
+		return nil, err
+	}
+
+	// store it in the context and return
+	ctx.SetValue(accountContextKey, account)
+	return account, nil
 }
 
 // Apply applies this configuration to the server.
-// This is a no-op.
+// It validates the sandbox, sets up the sftp subsystem when SFTP is set, and sets up authentication when RunAsUser is set.
 func (cfg *SystemExecConfig) Apply(logger logging.Logger, sshserver *ssh.Server) error {
+	if err := cfg.Sandbox.Validate(); err != nil {
+		return err
+	}
+
+	if cfg.SFTP {
+		if err := cfg.validateSFTP(); err != nil {
+			return err
+		}
+		if err := proxyssh.ApplySubsystem(logger, sshserver, "sftp", proxyssh.HandlerFunc(cfg.HandleSFTP)); err != nil {
+			return err
+		}
+	}
+
+	if !cfg.RunAsUser {
+		return nil
+	}
+
+	sshserver.PublicKeyHandler = feature.AuthorizeKeys(logger, func(ctx ssh.Context) ([]ssh.PublicKey, error) {
+		account, err := cfg.findAccount(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return FindAccountKeys(account), nil
+	})
 	return nil
 }
 
+// Backend implements proxyssh.BackendHandler
+func (cfg *SystemExecConfig) Backend() string {
+	return "osexec"
+}
+
 // Handle handles a new configuration thingy
 func (cfg *SystemExecConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
 	userCommand := session.Command()
@@ -34,8 +125,37 @@ func (cfg *SystemExecConfig) Handle(logger logging.Logger, session ssh.Session)
 		args = []string{"-c", strings.Join(userCommand, " ")}
 	}
 
-	// create a new system process
-	return NewSystemProcess(cfg.Shell, args), nil
+	var process *SystemProcess
+	if !cfg.RunAsUser {
+		process = NewSystemProcess(cfg.Shell, args)
+	} else {
+		// find the account to run as
+		account, err := cfg.findAccount(session.Context())
+		if err != nil {
+			return nil, err
+		}
+
+		shell := account.Shell
+		if shell == "" {
+			shell = cfg.Shell
+		}
+
+		process = NewSystemProcess(shell, args)
+		process.Account = account
+	}
+	process.Env = feature.Environ(session)
+	process.Sandbox = &cfg.Sandbox
+
+	// forward the agent if requested
+	if feature.AgentForwarded(logger, session) {
+		agent, err := feature.ListenAgent(logger, session, cfg.AgentDir)
+		if err != nil {
+			return nil, err
+		}
+		process.Agent = agent
+	}
+
+	return process, nil
 }
 
 // RegisterFlags registers flags representing the config to the provided flagset.
@@ -45,5 +165,13 @@ func (cfg *SystemExecConfig) RegisterFlags(flagset *flag.FlagSet) {
 		flagset = flag.CommandLine
 	}
 
-	flag.StringVar(&cfg.Shell, "shell", cfg.Shell, "Shell to use")
+	flagset.StringVar(&cfg.Shell, "shell", cfg.Shell, "Shell to use")
+	flagset.BoolVar(&cfg.RunAsUser, "runasuser", cfg.RunAsUser, "Run processes as the unix account of the authenticated user")
+
+	flagset.BoolVar(&cfg.SFTP, "sftp", cfg.SFTP, "Enable the sftp subsystem")
+	flagset.StringVar(&cfg.SFTPRoot, "sftproot", cfg.SFTPRoot, "Root directory for sftp sessions")
+
+	flagset.StringVar(&cfg.AgentDir, "agentdir", cfg.AgentDir, "Directory to create the sockets of forwarded agents in")
+
+	cfg.Sandbox.RegisterFlags(flagset)
 }
@@ -4,9 +4,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/tkw1536/proxyssh"
 	"github.com/tkw1536/proxyssh/internal/integrationtest"
 	"github.com/tkw1536/proxyssh/internal/testutils"
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 var commandTestConfig = &SystemExecConfig{
@@ -143,3 +145,44 @@ func TestCommandIsKilled(t *testing.T) {
 		}
 	})
 }
+
+func TestCommandAgent(t *testing.T) {
+	testServer, _, cleanup := integrationtest.NewServer(&proxyssh.Options{AgentForwarding: []string{"*"}}, commandTestConfig)
+	defer cleanup()
+
+	client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	if err := agent.ForwardToAgent(client, agent.NewKeyring()); err != nil {
+		t.Fatalf("Unable to forward agent: %s", err)
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		t.Fatalf("Unable to request agent forwarding: %s", err)
+	}
+
+	out, err := session.Output(`test -S "$SSH_AUTH_SOCK" && echo "socket"`)
+	if err != nil || string(out) != "socket\n" {
+		t.Errorf("Output() got out = %q, err = %v, want out = %q", out, err, "socket\n")
+	}
+}
+
+func TestCommandBackground(t *testing.T) {
+	testServer, _, cleanup := integrationtest.NewServer(nil, commandTestConfig)
+	defer cleanup()
+
+	// the background process keeps stdout open after the shell has exited
+	start := time.Now()
+	gotOut, _, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, "sleep 10 & echo 'Hello world'", "")
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	if gotOut != "Hello world\n" || gotCode != 0 {
+		t.Errorf("Command() got out = %q, code = %d, want out = %q, code = 0", gotOut, gotCode, "Hello world\n")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Command() took %s, want it not to wait for background processes", took)
+	}
+}
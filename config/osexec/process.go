@@ -7,10 +7,13 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/pkg/errors"
 	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/internal/term"
 	"github.com/tkw1536/proxyssh/logging"
 )
@@ -28,8 +31,33 @@ type SystemProcess struct {
 	command string
 	args    []string
 
+	// Env are environment variables to set for the process, in addition to those of the current process.
+	// Each entry is of the form "key=value", later entries take precedence.
+	// Env must be set before Init is called.
+	Env []string
+
+	// Account is the unix account to run the process as.
+	// When nil, the process runs as the current user and inherits the environment of the current process.
+	// Otherwise the environment only consists of DefaultPath and Env.
+	// Account must be set before Init is called.
+	Account *Account
+
+	// Sandbox is the sandbox to run the process in.
+	// When nil, or when the sandbox is not enabled, no sandbox is used.
+	// Sandbox must be set before Init is called.
+	Sandbox *Sandbox
+
+	// Agent relays connections to the agent forwarded by the client, and is passed to the process using SSH_AUTH_SOCK.
+	// When running as a different Account, the socket is handed to the account.
+	// When nil, no agent is forwarded.
+	// Agent must be set before Init is called, and is closed by Cleanup.
+	Agent *feature.AgentListener
+
 	cmd      *exec.Cmd
 	terminal *term.Pair
+	sandbox  *sandboxProcess
+
+	outputs []*term.OutputPipe // output pipes that should be drained before Wait returns
 }
 
 // Init initializes this process
@@ -37,16 +65,60 @@ func (sp *SystemProcess) Init(ctx context.Context, detector logging.MemoryLeakDe
 	// exec.Command internally does use LookPath(), but doesn't return an error
 	// Instead we explicitly call LookPath() to intercept the error
 
-	exe, err := exec.LookPath(sp.command)
-	if err != nil {
-		err = errors.Wrapf(err, "Can't find %s in path", sp.command)
-		return err
+	// Inside of a sandbox root the executable is looked up by the sandbox, after changing the root.
+	if sp.Sandbox.Enabled() && sp.Sandbox.Root != "" {
+		sp.cmd = &exec.Cmd{Path: sp.command, Args: append([]string{sp.command}, sp.args...)}
+	} else {
+		exe, err := exec.LookPath(sp.command)
+		if err != nil {
+			err = errors.Wrapf(err, "Can't find %s in path", sp.command)
+			return err
+		}
+		sp.cmd = exec.Command(exe, sp.args...)
+	}
+	sp.cmd.SysProcAttr = &syscall.SysProcAttr{}
+
+	if sp.Account == nil {
+		// not running as a different account => inherit our own environment
+		sp.cmd.Env = append(os.Environ(), sp.Env...)
+		if home, err := os.UserHomeDir(); err == nil {
+			sp.cmd.Env = append(sp.cmd.Env, "HOME="+home)
+		}
+	} else {
+		// setup a clean environment and switch to the account
+		sp.cmd.Env = append(append([]string{"PATH=" + DefaultPath}, sp.Env...), sp.Account.Environ()...)
+		sp.cmd.Dir = sp.Account.HomeDir
+		sp.cmd.SysProcAttr.Credential = sp.Account.Credential()
+	}
+
+	// pass the agent to the process
+	if sp.Agent != nil {
+		sp.cmd.Env = append(sp.cmd.Env, "SSH_AUTH_SOCK="+sp.Agent.Path)
+		if sp.Account != nil {
+			if err := sp.Agent.Chown(int(sp.Account.UID), int(sp.Account.GID)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// setup the sandbox
+	if sp.Sandbox.Enabled() {
+		sandbox, err := sp.Sandbox.prepare(sp.cmd, sp.Account)
+		if err != nil {
+			return err
+		}
+		sp.sandbox = sandbox
 	}
 
-	sp.cmd = exec.Command(exe, sp.args...)
 	return nil
 }
 
+// OutputDrainTimeout is the maximum time Wait waits for the output of a process to be read after it has exited.
+var OutputDrainTimeout = time.Second
+
+// DefaultPath is the value of the PATH environment variable for processes running as a different Account.
+var DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
 // String turns ShellProcess into a string
 func (sp *SystemProcess) String() string {
 	if sp == nil || sp.cmd == nil {
@@ -58,12 +130,26 @@ func (sp *SystemProcess) String() string {
 
 // Stdout returns a pipe to Stdout
 func (sp *SystemProcess) Stdout() (io.ReadCloser, error) {
-	return sp.cmd.StdoutPipe()
+	return sp.outputPipe(&sp.cmd.Stdout)
 }
 
 // Stderr returns a pipe to Stderr
 func (sp *SystemProcess) Stderr() (io.ReadCloser, error) {
-	return sp.cmd.StderrPipe()
+	return sp.outputPipe(&sp.cmd.Stderr)
+}
+
+// outputPipe creates a new output pipe, and sets dest to the writing end.
+//
+// cmd.StdoutPipe() and cmd.StderrPipe() can not be used, because cmd.Wait() closes their reading ends.
+// This races with the session copying the output, and loses output written shortly before the process exits.
+func (sp *SystemProcess) outputPipe(dest *io.Writer) (io.ReadCloser, error) {
+	pipe, writer, err := term.NewOutputPipe()
+	if err != nil {
+		return nil, err
+	}
+	*dest = writer
+	sp.outputs = append(sp.outputs, pipe)
+	return pipe, nil
 }
 
 // Stdin returns a pipe to Stdin
@@ -75,15 +161,44 @@ func (sp *SystemProcess) Stdin() (io.WriteCloser, error) {
 func (sp *SystemProcess) Start(detector logging.MemoryLeakDetector, Term string, resizeChan <-chan proxyssh.WindowSize, isPty bool) (*os.File, error) {
 	// not a tty => start the process and be done!
 	if !isPty {
-		return nil, sp.cmd.Start()
+		err := sp.cmd.Start()
+		sp.sandbox.started()
+
+		// the writing ends of the output pipes are now owned by the process
+		for _, dest := range []io.Writer{sp.cmd.Stdout, sp.cmd.Stderr} {
+			if writer, ok := dest.(*os.File); ok {
+				writer.Close()
+			}
+		}
+
+		return nil, err
 	}
 
-	// add the terminal environment variable
-	sp.cmd.Env = append(sp.cmd.Env, fmt.Sprintf("TERM=%s", Term))
+	// open the pty manually rather than using pty.Start(), as SSH_TTY needs the name of the tty
+	f, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	// hand the tty to the account, ignoring any errors
+	if sp.Account != nil {
+		os.Chown(tty.Name(), int(sp.Account.UID), int(sp.Account.GID))
+	}
+
+	// add the terminal environment variables
+	sp.cmd.Env = append(sp.cmd.Env, fmt.Sprintf("TERM=%s", Term), fmt.Sprintf("SSH_TTY=%s", tty.Name()))
 
-	// start the pty
-	f, err := pty.Start(sp.cmd)
+	// start the process in a new session with the tty as controlling terminal, like pty.Start() does
+	sp.cmd.Stdin = tty
+	sp.cmd.Stdout = tty
+	sp.cmd.Stderr = tty
+	sp.cmd.SysProcAttr.Setsid = true
+	sp.cmd.SysProcAttr.Setctty = true
+	err = sp.cmd.Start()
+	sp.sandbox.started()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
@@ -107,6 +222,19 @@ func (sp *SystemProcess) Wait(detector logging.MemoryLeakDetector) (code int, er
 	code = 255
 	detector.Done("osexec: Wait")
 
+	// wait for the output to be read.
+	// background processes may still hold the output open, so only wait for a limited time.
+	detector.Add("osexec: Wait output")
+	drainCtx, cancel := context.WithTimeout(context.Background(), OutputDrainTimeout)
+	for _, pipe := range sp.outputs {
+		select {
+		case <-pipe.Done():
+		case <-drainCtx.Done():
+		}
+	}
+	cancel()
+	detector.Done("osexec: Wait output")
+
 	// if we have a failure and it's not an exit code
 	// we need to return an error
 	_, isExitError := err.(*exec.ExitError)
@@ -123,9 +251,13 @@ func (sp *SystemProcess) Wait(detector logging.MemoryLeakDetector) (code int, er
 // Cleanup cleans up this process, typically killing it
 func (sp *SystemProcess) Cleanup() (killed bool) {
 	sp.terminal.Close()
+	sp.Agent.Close()
+
+	// kill anything left in the sandbox
+	defer sp.sandbox.cleanup()
 
 	// no process => return
-	if sp.cmd.Process == nil {
+	if sp.cmd == nil || sp.cmd.Process == nil {
 		return true
 	}
 
@@ -0,0 +1,171 @@
+package osexec
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Sandbox describes an isolated environment that a SystemProcess can be run in.
+// The zero value describes no isolation at all.
+//
+// Sandboxes are only supported on Linux.
+// Namespaces are created when the process is started, and cgroup limits are enforced using cgroups v2.
+//
+// When a sandbox uses a mount, network or user namespace, the process is started using a small helper.
+// The helper re-executes the current binary, performs mounts within the new namespaces, and then executes the actual process.
+// The root filesystem is changed using pivot_root, and the old root filesystem is detached.
+// When a user namespace or a root directory is used, the helper drops all capabilities before executing the process.
+type Sandbox struct {
+	// MountNamespace, PIDNamespace, NetworkNamespace and UserNamespace indicate which new namespaces to create.
+	//
+	// A new network namespace only contains a loopback interface.
+	// When both a mount and pid namespace are created, a new proc filesystem is mounted.
+	// When a new user namespace is created, the process runs as root inside of it, but without any capabilities.
+	// This root user is mapped to the user id the process would otherwise run as.
+	MountNamespace   bool
+	PIDNamespace     bool
+	NetworkNamespace bool
+	UserNamespace    bool
+
+	// Root is a directory to use as the (read-only) root filesystem of the process.
+	// Mounts are bind mounts to create within the root filesystem.
+	//
+	// Both require MountNamespace to be set.
+	// When Root is empty, the root filesystem of the host is used and Mounts are made relative to it.
+	// Otherwise the shell is looked up inside of Root, using the PATH of the process.
+	Root   string
+	Mounts []BindMount
+
+	// CgroupParent is the cgroup v2 directory to create cgroups for processes in.
+	// When empty, DefaultCgroupParent is used.
+	//
+	// A new cgroup is only created when at least one of CPUs, MemoryMax and PidsMax is set.
+	CgroupParent string
+
+	CPUs      float64 // maximum number of cpus the process may use, 0 for no limit
+	MemoryMax int64   // maximum amount of memory in bytes, 0 for no limit
+	PidsMax   int64   // maximum number of processes, 0 for no limit
+}
+
+// DefaultCgroupParent is the default cgroup directory used by a Sandbox.
+const DefaultCgroupParent = "/sys/fs/cgroup/proxyssh"
+
+// BindMount represents a bind mount inside a Sandbox.
+type BindMount struct {
+	Source   string // path on the host
+	Target   string // path inside the sandbox
+	ReadOnly bool   // mount read-only
+}
+
+// ParseBindMount parses a bind mount of the form 'source:target' or 'source:target:ro'.
+// When target is omitted, it is assumed to be identical to source.
+func ParseBindMount(s string) (mount BindMount, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 3 && parts[2] == "ro" {
+		mount.ReadOnly = true
+		parts = parts[:2]
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		mount.Source, mount.Target = parts[0], parts[0]
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		mount.Source, mount.Target = parts[0], parts[1]
+	default:
+		err = errors.Errorf("Invalid bind mount %q", s)
+	}
+	return
+}
+
+// String turns this BindMount into a string that can be parsed by ParseBindMount.
+func (mount BindMount) String() string {
+	s := mount.Source + ":" + mount.Target
+	if mount.ReadOnly {
+		s += ":ro"
+	}
+	return s
+}
+
+// Enabled checks if this sandbox performs any isolation.
+func (sandbox *Sandbox) Enabled() bool {
+	return sandbox != nil && (sandbox.needsInit() || sandbox.PIDNamespace || sandbox.UserNamespace || sandbox.needsCgroup())
+}
+
+// needsInit checks if this sandbox requires the helper process.
+func (sandbox *Sandbox) needsInit() bool {
+	return sandbox.MountNamespace || sandbox.NetworkNamespace || sandbox.UserNamespace
+}
+
+// needsCgroup checks if this sandbox requires a new cgroup.
+func (sandbox *Sandbox) needsCgroup() bool {
+	return sandbox.CPUs > 0 || sandbox.MemoryMax > 0 || sandbox.PidsMax > 0
+}
+
+// ErrSandboxNeedsMountNamespace is returned when a sandbox has a root or mounts, but no mount namespace.
+var ErrSandboxNeedsMountNamespace = errors.New("Sandbox: Root and Mounts require a mount namespace")
+
+// Validate checks that this sandbox is valid.
+func (sandbox *Sandbox) Validate() error {
+	if (sandbox.Root != "" || len(sandbox.Mounts) > 0) && !sandbox.MountNamespace {
+		return ErrSandboxNeedsMountNamespace
+	}
+	return nil
+}
+
+// RegisterFlags registers flags representing the sandbox to the provided flagset.
+// When flagset is nil, uses flag.CommandLine.
+func (sandbox *Sandbox) RegisterFlags(flagset *flag.FlagSet) {
+	if flagset == nil {
+		flagset = flag.CommandLine
+	}
+
+	flagset.BoolVar(&sandbox.MountNamespace, "sandbox-mountns", sandbox.MountNamespace, "Run processes in a new mount namespace")
+	flagset.BoolVar(&sandbox.PIDNamespace, "sandbox-pidns", sandbox.PIDNamespace, "Run processes in a new pid namespace")
+	flagset.BoolVar(&sandbox.NetworkNamespace, "sandbox-netns", sandbox.NetworkNamespace, "Run processes in a new network namespace")
+	flagset.BoolVar(&sandbox.UserNamespace, "sandbox-userns", sandbox.UserNamespace, "Run processes in a new user namespace")
+
+	flagset.StringVar(&sandbox.Root, "sandbox-root", sandbox.Root, "Directory to use as read-only root filesystem for processes")
+	flagset.Var(&BindMountListVar{Mounts: &sandbox.Mounts}, "sandbox-bind", "Bind mount to create for processes, of the form 'source:target[:ro]'")
+
+	flagset.StringVar(&sandbox.CgroupParent, "sandbox-cgroup", sandbox.CgroupParent, "Cgroup v2 directory to create process cgroups in")
+	flagset.Float64Var(&sandbox.CPUs, "sandbox-cpus", sandbox.CPUs, "Maximum number of cpus a process may use")
+	flagset.Int64Var(&sandbox.MemoryMax, "sandbox-memory", sandbox.MemoryMax, "Maximum amount of memory in bytes a process may use")
+	flagset.Int64Var(&sandbox.PidsMax, "sandbox-pids", sandbox.PidsMax, "Maximum number of processes a session may create")
+}
+
+// BindMountListVar represents a "flag".Value that contains a list of bind mounts.
+// It can be passed multiple times, and collects all BindMounts in an ordered list.
+type BindMountListVar struct {
+	Mounts *[]BindMount
+}
+
+// String turns this BindMountListVar into a comma-seperated list of bind mounts.
+func (b *BindMountListVar) String() string {
+	if b.Mounts == nil {
+		return ""
+	}
+
+	mounts := make([]string, len(*b.Mounts))
+	for i, m := range *b.Mounts {
+		mounts[i] = m.String()
+	}
+	return strings.Join(mounts, ",")
+}
+
+// Set sets the value of this BindMountListVar
+// This function is intended to be called by flag.Var()
+func (b *BindMountListVar) Set(value string) error {
+	mount, err := ParseBindMount(value)
+	if err != nil {
+		return err
+	}
+	*b.Mounts = append(*b.Mounts, mount)
+	return nil
+}
+
+func init() {
+	// ensure that BindMountListVar fullfills the flag.Value interface
+	var _ flag.Value = (*BindMountListVar)(nil)
+}
@@ -0,0 +1,430 @@
+//go:build linux
+// +build linux
+
+package osexec
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// This file implements Sandbox on Linux.
+
+// sandboxProcess holds the state of a single process running inside a sandbox.
+type sandboxProcess struct {
+	cgroup   string   // path to the cgroup of the process, if any
+	cgroupFD *os.File // open file descriptor to the cgroup, until the process is started
+}
+
+// prepare prepares cmd to be run inside this sandbox.
+// account is the account the process should run as, and may be nil.
+//
+// The path, arguments, working directory and SysProcAttr of cmd must have been fully configured, and should not be modified afterwards.
+// The caller must ensure that started and cleanup are called on the returned sandboxProcess.
+func (sandbox *Sandbox) prepare(cmd *exec.Cmd, account *Account) (sp *sandboxProcess, err error) {
+	if err := sandbox.Validate(); err != nil {
+		return nil, err
+	}
+
+	sp = &sandboxProcess{}
+	defer func() {
+		if err != nil {
+			sp.cleanup()
+		}
+	}()
+
+	attr := cmd.SysProcAttr
+
+	// create the appropriate namespaces
+	if sandbox.MountNamespace {
+		attr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if sandbox.PIDNamespace {
+		attr.Cloneflags |= syscall.CLONE_NEWPID
+	}
+	if sandbox.NetworkNamespace {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	// inside a user namespace, run as root mapped onto the outside user.
+	if sandbox.UserNamespace {
+		uid, gid := os.Getuid(), os.Getgid()
+		if account != nil {
+			uid, gid = int(account.UID), int(account.GID)
+		}
+
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+		attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true}
+	}
+
+	// create a new cgroup
+	if sandbox.needsCgroup() {
+		if err := sp.makeCgroup(sandbox); err != nil {
+			return nil, errors.Wrap(err, "Sandbox: Unable to create cgroup")
+		}
+
+		attr.UseCgroupFD = true
+		attr.CgroupFD = int(sp.cgroupFD.Fd())
+	}
+
+	// setup the helper process
+	if sandbox.needsInit() {
+		config := sandboxInitConfig{
+			Mount:    sandbox.MountNamespace,
+			Root:     sandbox.Root,
+			Mounts:   sandbox.Mounts,
+			Proc:     sandbox.MountNamespace && sandbox.PIDNamespace,
+			Loopback: sandbox.NetworkNamespace,
+			Dir:      cmd.Dir,
+			Path:     cmd.Path,
+			Args:     cmd.Args,
+
+			DropCapabilities: sandbox.UserNamespace || sandbox.Root != "",
+		}
+
+		// the helper needs privileges to setup mounts, so drop them only inside of the helper
+		if attr.Credential != nil && !sandbox.UserNamespace {
+			config.Credential = attr.Credential
+			attr.Credential = nil
+		}
+
+		configBytes, err := json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd.Path = "/proc/self/exe"
+		cmd.Args = []string{sandboxInitArg}
+		cmd.Dir = ""
+		cmd.Env = append(cmd.Env, sandboxInitEnv+"="+string(configBytes))
+	}
+
+	return sp, nil
+}
+
+// makeCgroup creates a new cgroup for this process, and opens it.
+func (sp *sandboxProcess) makeCgroup(sandbox *Sandbox) error {
+	parent := sandbox.CgroupParent
+	if parent == "" {
+		parent = DefaultCgroupParent
+	}
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	// enable the controllers for children of parent.
+	// These might already be enabled, or unavailable, so ignore errors.
+	for _, controller := range []string{"cpu", "memory", "pids"} {
+		os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+"+controller), 0)
+	}
+
+	cgroup, err := os.MkdirTemp(parent, "session-")
+	if err != nil {
+		return err
+	}
+	sp.cgroup = cgroup
+
+	// write all the limits
+	limits := make(map[string]string, 3)
+	if sandbox.CPUs > 0 {
+		const period = 100000
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int64(sandbox.CPUs*period), period)
+	}
+	if sandbox.MemoryMax > 0 {
+		limits["memory.max"] = strconv.FormatInt(sandbox.MemoryMax, 10)
+	}
+	if sandbox.PidsMax > 0 {
+		limits["pids.max"] = strconv.FormatInt(sandbox.PidsMax, 10)
+	}
+	for name, value := range limits {
+		if err := os.WriteFile(filepath.Join(cgroup, name), []byte(value), 0); err != nil {
+			return errors.Wrapf(err, "Unable to set %s", name)
+		}
+	}
+
+	sp.cgroupFD, err = os.Open(cgroup)
+	return err
+}
+
+// started is called once the process has been started (or failed to start).
+func (sp *sandboxProcess) started() {
+	if sp == nil || sp.cgroupFD == nil {
+		return
+	}
+
+	sp.cgroupFD.Close()
+	sp.cgroupFD = nil
+}
+
+// sandboxCleanupTimeout is the maximal time cleanup waits for processes inside of the cgroup to exit.
+const sandboxCleanupTimeout = time.Second
+
+// cleanup kills all processes inside the cgroup of this process, and then removes it.
+func (sp *sandboxProcess) cleanup() {
+	if sp == nil {
+		return
+	}
+	sp.started()
+
+	if sp.cgroup == "" {
+		return
+	}
+
+	// kill everything inside the cgroup, and wait for it to be removable.
+	os.WriteFile(filepath.Join(sp.cgroup, "cgroup.kill"), []byte("1"), 0)
+	for deadline := time.Now().Add(sandboxCleanupTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if syscall.Rmdir(sp.cgroup) == nil {
+			break
+		}
+	}
+	sp.cgroup = ""
+}
+
+//
+// Helper process
+//
+
+const (
+	sandboxInitArg = "proxyssh-sandbox-init" // os.Args[0] of the helper
+	sandboxInitEnv = "PROXYSSH_SANDBOX_INIT" // environment variable holding the sandboxInitConfig
+)
+
+// sandboxInitConfig is the configuration passed to the helper process
+type sandboxInitConfig struct {
+	Mount  bool // running inside a new mount namespace
+	Root   string
+	Mounts []BindMount
+
+	Proc     bool // mount a new proc filesystem
+	Loopback bool // bring up the loopback interface
+
+	Dir        string              // working directory
+	Credential *syscall.Credential // credential to switch to, if any
+
+	Path string   // path to the executable to run
+	Args []string // arguments of the executable, including Args[0]
+
+	DropCapabilities bool // drop all capabilities before executing
+}
+
+func init() {
+	if len(os.Args) == 0 || os.Args[0] != sandboxInitArg {
+		return
+	}
+
+	err := sandboxInit()
+	fmt.Fprintf(os.Stderr, "Sandbox: %s\n", err)
+	os.Exit(255)
+}
+
+// sandboxInit is run inside of the helper process.
+// It sets up the sandbox and then executes the configured executable.
+// If it returns, something went wrong.
+func sandboxInit() error {
+	// capabilities are dropped per thread, so the thread that drops them must be the one executing.
+	runtime.LockOSThread()
+
+	// read the configuration and remove it from the environment
+	var config sandboxInitConfig
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxInitEnv)), &config); err != nil {
+		return errors.Wrap(err, "Invalid configuration")
+	}
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, sandboxInitEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	if config.Loopback {
+		if err := sandboxLoopbackUp(); err != nil {
+			return errors.Wrap(err, "Unable to bring up loopback interface")
+		}
+	}
+
+	if err := sandboxMount(config); err != nil {
+		return err
+	}
+
+	// change into the working directory, falling back to the root directory
+	if config.Dir == "" || syscall.Chdir(config.Dir) != nil {
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+
+	// drop privileges.
+	// The bounding set can only be changed before switching credentials, as doing so needs CAP_SETPCAP.
+	if config.DropCapabilities {
+		if err := sandboxDropBoundingCapabilities(); err != nil {
+			return err
+		}
+	}
+	if config.Credential != nil {
+		if err := switchCredential(config.Credential); err != nil {
+			return err
+		}
+	}
+	if config.DropCapabilities {
+		if err := sandboxDropCapabilities(); err != nil {
+			return err
+		}
+	}
+
+	// the executable is looked up inside of the new root
+	path := config.Path
+	if config.Root != "" {
+		var err error
+		if path, err = exec.LookPath(config.Path); err != nil {
+			return errors.Wrapf(err, "Can't find %s in path", config.Path)
+		}
+	}
+
+	return syscall.Exec(path, config.Args, env)
+}
+
+// sandboxMount performs all mounts inside the helper process.
+// If config.Root is set, changes the root directory.
+func sandboxMount(config sandboxInitConfig) error {
+	if !config.Mount {
+		return nil
+	}
+
+	// don't propagate mounts to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return errors.Wrap(err, "Unable to make mounts private")
+	}
+
+	root := config.Root
+	if root != "" {
+		if err := syscall.Mount(root, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return errors.Wrap(err, "Unable to mount root")
+		}
+	} else {
+		root = "/"
+	}
+
+	for _, mount := range config.Mounts {
+		target := filepath.Join(root, mount.Target)
+		if err := syscall.Mount(mount.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return errors.Wrapf(err, "Unable to bind mount %s", mount)
+		}
+		if mount.ReadOnly {
+			if err := sandboxRemountReadOnly(target); err != nil {
+				return errors.Wrapf(err, "Unable to remount %s read-only", mount)
+			}
+		}
+	}
+
+	if config.Proc {
+		if err := syscall.Mount("proc", filepath.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return errors.Wrap(err, "Unable to mount proc")
+		}
+	}
+
+	if config.Root == "" {
+		return nil
+	}
+
+	if err := sandboxRemountReadOnly(root); err != nil {
+		return errors.Wrap(err, "Unable to remount root read-only")
+	}
+	return sandboxPivotRoot(root)
+}
+
+// sandboxPivotRoot changes the root filesystem to the mount at root, and detaches the old root filesystem.
+// Unlike chroot, this leaves no way to reach the old root filesystem from within the new one.
+func sandboxPivotRoot(root string) error {
+	if err := syscall.Chdir(root); err != nil {
+		return err
+	}
+
+	// stack the old root on top of the new one, and then detach it
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return errors.Wrap(err, "Unable to pivot root")
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return errors.Wrap(err, "Unable to detach old root")
+	}
+	return syscall.Chdir("/")
+}
+
+// sandboxDropBoundingCapabilities drops all capabilities from the bounding set of the current thread, and prevents it from gaining new ones.
+// Otherwise root inside of a user namespace could undo mounts, or change its root directory.
+func sandboxDropBoundingCapabilities() error {
+	// the bounding set prevents regaining capabilities when executing
+	for capability := 0; ; capability++ {
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0)
+		if err == unix.EINVAL {
+			break // no more capabilities
+		}
+		if err != nil {
+			return errors.Wrap(err, "Unable to drop bounding capabilities")
+		}
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil && err != unix.EINVAL {
+		return errors.Wrap(err, "Unable to drop ambient capabilities")
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "Unable to set no_new_privs")
+	}
+	return nil
+}
+
+// sandboxDropCapabilities drops all remaining capabilities of the current thread.
+// It should be called after sandboxDropBoundingCapabilities.
+func sandboxDropCapabilities() error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return errors.Wrap(err, "Unable to drop capabilities")
+	}
+	return nil
+}
+
+// sandboxRemountReadOnly remounts the bind mount at target read-only.
+// It preserves the flags that the kernel does not permit to be cleared.
+func sandboxRemountReadOnly(target string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(target, &stat); err != nil {
+		return err
+	}
+
+	// the ST_* flags coincide with the MS_* flags on linux
+	preserve := uintptr(stat.Flags) & (unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC | unix.MS_NOATIME | unix.MS_NODIRATIME | unix.MS_RELATIME)
+	return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|preserve, "")
+}
+
+// sandboxLoopbackUp brings up the loopback interface.
+func sandboxLoopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
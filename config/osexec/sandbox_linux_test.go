@@ -0,0 +1,187 @@
+//go:build linux
+// +build linux
+
+package osexec
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestSandbox(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Creating namespaces requires root")
+	}
+
+	// create a directory to bind mount, and a directory to mount it at
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, &SystemExecConfig{
+		Shell: "/bin/bash",
+		Sandbox: Sandbox{
+			MountNamespace:   true,
+			PIDNamespace:     true,
+			NetworkNamespace: true,
+			Mounts: []BindMount{
+				{Source: source, Target: target, ReadOnly: true},
+			},
+		},
+	})
+	defer cleanup()
+
+	tests := []struct {
+		name     string
+		command  string
+		wantOut  string
+		wantCode int
+	}{
+		{
+			name:    "process is pid 1",
+			command: "echo $$",
+			wantOut: "1\n",
+		},
+		{
+			name:    "only loopback interface exists",
+			command: "tail -n +3 /proc/net/dev | cut -d: -f1 | xargs",
+			wantOut: "lo\n",
+		},
+		{
+			name:    "bind mount is readable",
+			command: "cat " + target + "/file",
+			wantOut: "content",
+		},
+		{
+			name:     "bind mount is read-only",
+			command:  "touch " + target + "/other 2>/dev/null",
+			wantCode: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOut, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, tt.command, "")
+			if err != nil {
+				t.Fatalf("Unable to run command: %s", err)
+			}
+			if gotOut != tt.wantOut || gotCode != tt.wantCode {
+				t.Errorf("Sandbox got out = %q, err = %q, code = %d, want out = %q, code = %d", gotOut, gotErr, gotCode, tt.wantOut, tt.wantCode)
+			}
+		})
+	}
+
+	t.Run("host mounts are unaffected", func(t *testing.T) {
+		if _, err := os.Stat(filepath.Join(target, "file")); !os.IsNotExist(err) {
+			t.Errorf("Sandbox: bind mount leaked onto the host")
+		}
+	})
+}
+
+func TestSandboxRoot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Creating namespaces requires root")
+	}
+
+	// create a root filesystem using /usr of the host
+	root := t.TempDir()
+	for _, dir := range []string{"usr", "proc"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, link := range []string{"bin", "lib", "lib64", "sbin"} {
+		if err := os.Symlink(filepath.Join("usr", link), filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// create a file outside of the root
+	outside := filepath.Join(t.TempDir(), "outside")
+	if err := os.WriteFile(outside, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, &SystemExecConfig{
+		Shell: "/bin/bash",
+		Sandbox: Sandbox{
+			MountNamespace: true,
+			PIDNamespace:   true,
+			UserNamespace:  true,
+			Root:           root,
+			Mounts: []BindMount{
+				{Source: "/usr", Target: "/usr", ReadOnly: true},
+			},
+		},
+	})
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{"run from mount", "/bin/true", "allowed"},
+		{"write to root", "touch /file", "denied"},
+		{"write to mount", "touch /usr/file", "denied"},
+		{"remount root writable", "mount -o remount,rw /", "denied"},
+		{"change root", "chroot / /bin/true", "denied"},
+		{"read outside of root", "cat " + outside, "denied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOut, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, tt.command+" 2>&1 && echo allowed || echo denied", "")
+			if err != nil {
+				t.Fatalf("Unable to run command: %s", err)
+			}
+			if !strings.HasSuffix(gotOut, tt.want+"\n") || gotCode != 0 {
+				t.Errorf("Sandbox got out = %q, err = %q, code = %d, want %s", gotOut, gotErr, gotCode, tt.want)
+			}
+		})
+	}
+
+	t.Run("no capabilities", func(t *testing.T) {
+		gotOut, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, "grep CapEff /proc/self/status", "")
+		if err != nil {
+			t.Fatalf("Unable to run command: %s", err)
+		}
+		if wantOut := "CapEff:\t0000000000000000\n"; gotOut != wantOut || gotCode != 0 {
+			t.Errorf("Sandbox got out = %q, err = %q, code = %d, want out = %q", gotOut, gotErr, gotCode, wantOut)
+		}
+	})
+}
+
+func TestSandboxCgroup(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Creating cgroups requires root")
+	}
+	controllers, err := os.ReadFile(filepath.Join(filepath.Dir(DefaultCgroupParent), "cgroup.controllers"))
+	if err != nil || !strings.Contains(string(controllers), "pids") {
+		t.Skip("cgroup v2 pids controller is not available")
+	}
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, &SystemExecConfig{
+		Shell: "/bin/bash",
+		Sandbox: Sandbox{
+			PidsMax: 10,
+		},
+	})
+	defer cleanup()
+
+	gotOut, gotErr, gotCode, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, "cat /sys/fs/cgroup$(cut -d: -f3 /proc/self/cgroup)/pids.max", "")
+	if err != nil {
+		t.Fatalf("Unable to run command: %s", err)
+	}
+	if gotOut != "10\n" || gotCode != 0 {
+		t.Errorf("Sandbox got out = %q, err = %q, code = %d, want out = %q, code = 0", gotOut, gotErr, gotCode, "10\n")
+	}
+}
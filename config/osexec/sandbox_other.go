@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package osexec
+
+import (
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// This file disables Sandbox on non-Linux systems.
+
+// sandboxProcess holds the state of a single process running inside a sandbox.
+type sandboxProcess struct{}
+
+var errSandboxUnsupported = errors.New("Sandbox: Only supported on Linux")
+
+// prepare prepares cmd to be run inside this sandbox.
+// On non-Linux systems, this always returns an error.
+func (sandbox *Sandbox) prepare(cmd *exec.Cmd, account *Account) (*sandboxProcess, error) {
+	return nil, errSandboxUnsupported
+}
+
+// started is called once the process has been started (or failed to start).
+func (sp *sandboxProcess) started() {}
+
+// cleanup cleans up the sandbox.
+func (sp *sandboxProcess) cleanup() {}
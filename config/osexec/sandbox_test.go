@@ -0,0 +1,51 @@
+package osexec
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBindMount(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    BindMount
+		wantErr bool
+	}{
+		{
+			name: "/data",
+			want: BindMount{Source: "/data", Target: "/data"},
+		},
+		{
+			name: "/srv/data:/data",
+			want: BindMount{Source: "/srv/data", Target: "/data"},
+		},
+		{
+			name: "/srv/data:/data:ro",
+			want: BindMount{Source: "/srv/data", Target: "/data", ReadOnly: true},
+		},
+		{
+			name:    "/srv/data:/data:rw",
+			wantErr: true,
+		},
+		{
+			name:    ":/data",
+			wantErr: true,
+		},
+		{
+			name:    "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseBindMount(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseBindMount() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseBindMount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
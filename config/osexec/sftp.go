@@ -0,0 +1,157 @@
+package osexec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// This file implements the sftp subsystem of SystemExecConfig.
+//
+// Each sftp session runs inside a new process, that executes the current executable in a special helper mode.
+// This ensures that sessions run as the appropriate account, and inside the appropriate sandbox.
+
+// ErrSFTPRootNeedsRoot is returned by SystemExecConfig.Apply when SFTPRoot is set, but the server is not running as root.
+var ErrSFTPRootNeedsRoot = errors.New("Changing the sftp root directory requires running as root")
+
+// ErrSFTPWithSandboxRoot is returned by SystemExecConfig.Apply when both SFTPRoot and Sandbox.Root are set.
+var ErrSFTPWithSandboxRoot = errors.New("SFTP can not be used together with a sandbox root directory")
+
+// ErrSFTPRootNeedsAccount is returned by SystemExecConfig.Apply when SFTPRoot is set, but RunAsUser is not.
+// Without an account to switch to, sftp sessions would keep the privileges of the server inside of the changed root directory.
+var ErrSFTPRootNeedsAccount = errors.New("Changing the sftp root directory requires RunAsUser")
+
+// validateSFTP validates the sftp configuration
+func (cfg *SystemExecConfig) validateSFTP() error {
+	if cfg.Sandbox.Root != "" {
+		return ErrSFTPWithSandboxRoot
+	}
+	if cfg.SFTPRoot != "" && os.Geteuid() != 0 {
+		return ErrSFTPRootNeedsRoot
+	}
+	if cfg.SFTPRoot != "" && !cfg.RunAsUser {
+		return ErrSFTPRootNeedsAccount
+	}
+	return nil
+}
+
+// HandleSFTP handles a session requesting the sftp subsystem.
+func (cfg *SystemExecConfig) HandleSFTP(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to find executable")
+	}
+
+	var account *Account
+	if cfg.RunAsUser {
+		account, err = cfg.findAccount(session.Context())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config := sftpServerConfig{Root: cfg.SFTPRoot}
+	process := NewSystemProcess(exe, []string{sftpServerArg})
+	process.Sandbox = &cfg.Sandbox
+
+	// changing the root directory needs privileges, so drop them only inside of the helper
+	if config.Root != "" {
+		if account == nil {
+			return nil, ErrSFTPRootNeedsAccount
+		}
+		config.Credential = account.Credential()
+	} else {
+		process.Account = account
+	}
+
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	process.Env = append(feature.Environ(session), sftpServerEnv+"="+string(configBytes))
+
+	return process, nil
+}
+
+const (
+	sftpServerArg = "proxyssh-sftp-server" // os.Args[1] of the helper
+	sftpServerEnv = "PROXYSSH_SFTP_SERVER" // environment variable holding the sftpServerConfig
+)
+
+// sftpServerConfig is the configuration passed to the sftp helper process
+type sftpServerConfig struct {
+	Root       string              // root directory to change into, if any
+	Credential *syscall.Credential // credential to switch to after changing the root directory, required when Root is set
+}
+
+func init() {
+	if len(os.Args) < 2 || os.Args[1] != sftpServerArg {
+		return
+	}
+
+	if err := sftpServer(); err != nil {
+		fmt.Fprintf(os.Stderr, "SFTP: %s\n", err)
+		os.Exit(255)
+	}
+	os.Exit(0)
+}
+
+// sftpServer is run inside of the helper process.
+// It serves the sftp protocol on standard input and output.
+func sftpServer() error {
+	var config sftpServerConfig
+	if err := json.Unmarshal([]byte(os.Getenv(sftpServerEnv)), &config); err != nil {
+		return errors.Wrap(err, "Invalid configuration")
+	}
+	os.Unsetenv(sftpServerEnv)
+
+	if config.Root != "" {
+		if config.Credential == nil {
+			return errors.New("Refusing to change root directory without a credential")
+		}
+		if err := syscall.Chroot(config.Root); err != nil {
+			return errors.Wrap(err, "Unable to change root directory")
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+
+	// drop privileges
+	if config.Credential != nil {
+		if err := switchCredential(config.Credential); err != nil {
+			return err
+		}
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	server, err := sftp.NewServer(sftpStdio{os.Stdin, os.Stdout}, sftp.WithServerWorkingDirectory(dir))
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	if err := server.Serve(); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// sftpStdio combines standard input and output into an io.ReadWriteCloser
+type sftpStdio struct {
+	io.Reader
+	io.WriteCloser
+}
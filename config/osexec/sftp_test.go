@@ -0,0 +1,148 @@
+package osexec
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestSFTP(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		root     string
+		path     string // path to access via sftp
+		needRoot bool
+	}{
+		{name: "host filesystem", path: filepath.Join(dir, "file.txt")},
+		{name: "changed root directory", root: dir, path: "/file.txt", needRoot: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.needRoot && os.Geteuid() != 0 {
+				t.Skip("test requires root")
+			}
+			os.Remove(filepath.Join(dir, "file.txt"))
+
+			config := &SystemExecConfig{
+				Shell:    "/bin/sh",
+				SFTP:     true,
+				SFTPRoot: tt.root,
+			}
+			var clientConfig gossh.ClientConfig
+
+			// changing the root directory requires an account to switch to
+			if tt.root != "" {
+				clientConfig = sftpAccount(t, config, tt.root)
+			}
+
+			testServer, _, cleanup := integrationtest.NewServer(nil, config)
+			defer cleanup()
+
+			client, sftpClient, err := testutils.NewTestSFTPClient(testServer.Addr, clientConfig)
+			if err != nil {
+				t.Fatalf("Unable to create sftp client: %s", err)
+			}
+			defer client.Close()
+			defer sftpClient.Close()
+
+			// write a file
+			f, err := sftpClient.Create(tt.path)
+			if err != nil {
+				t.Fatalf("Create() got err = %s", err)
+			}
+			io.WriteString(f, "Hello world")
+			f.Close()
+
+			// it should exist on the host
+			got, err := os.ReadFile(filepath.Join(dir, "file.txt"))
+			if err != nil || string(got) != "Hello world" {
+				t.Errorf("ReadFile() got = %q, err = %v, want = %q", got, err, "Hello world")
+			}
+
+			// and be listed
+			infos, err := sftpClient.ReadDir(filepath.Dir(tt.path))
+			if err != nil {
+				t.Fatalf("ReadDir() got err = %s", err)
+			}
+			if len(infos) != 1 || infos[0].Name() != "file.txt" {
+				t.Errorf("ReadDir() got %d entries, want only 'file.txt'", len(infos))
+			}
+
+			// files created inside of a changed root directory belong to the account
+			if tt.root != "" {
+				info, err := os.Stat(filepath.Join(dir, "file.txt"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if uid := info.Sys().(*syscall.Stat_t).Uid; uid != 65534 {
+					t.Errorf("Stat() got uid = %d, want = 65534", uid)
+				}
+			}
+		})
+	}
+}
+
+// sftpAccount makes config run sessions as an unprivileged account, with write access to dir.
+// It returns a client configuration that authenticates as the account.
+func sftpAccount(t *testing.T, config *SystemExecConfig, dir string) gossh.ClientConfig {
+	t.Helper()
+
+	home := t.TempDir()
+	if err := os.Chmod(home, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, publicKey := testutils.GenerateRSATestKeyPair()
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "authorized_keys"), []byte(testutils.AuthorizedKeysString(publicKey)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config.RunAsUser = true
+	config.AccountLookup = func(username string) (*Account, error) {
+		return &Account{Username: username, UID: 65534, GID: 65534, HomeDir: home, Shell: "/bin/sh"}, nil
+	}
+
+	return gossh.ClientConfig{
+		User: "virtual",
+		Auth: []gossh.AuthMethod{gossh.PublicKeys(privateKey)},
+	}
+}
+
+func TestSystemExecConfig_validateSFTP(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root")
+	}
+
+	tests := []struct {
+		name    string
+		cfg     SystemExecConfig
+		wantErr error
+	}{
+		{name: "host filesystem", cfg: SystemExecConfig{SFTP: true}},
+		{name: "changed root directory", cfg: SystemExecConfig{SFTP: true, SFTPRoot: "/srv", RunAsUser: true}},
+		{name: "changed root directory without account", cfg: SystemExecConfig{SFTP: true, SFTPRoot: "/srv"}, wantErr: ErrSFTPRootNeedsAccount},
+		{name: "sandbox root directory", cfg: SystemExecConfig{SFTP: true, Sandbox: Sandbox{Root: "/srv"}}, wantErr: ErrSFTPWithSandboxRoot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validateSFTP(); err != tt.wantErr {
+				t.Errorf("validateSFTP() got err = %v, want = %v", err, tt.wantErr)
+			}
+		})
+	}
+}
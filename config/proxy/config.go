@@ -0,0 +1,299 @@
+// Package proxy provides ProxyConfig.
+package proxy
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ProxyConfig implements a proxyssh.Configuration and proxyssh.Handler that proxy sessions to upstream ssh servers.
+//
+// Clients authenticate to the proxy, which then opens a session on an upstream server and relays the session to it.
+// This allows authentication, logging and recording of sessions in front of existing servers.
+// See UpstreamProcess for details on what is relayed.
+//
+// To authenticate a client, the server uses ssh keys.
+// When AuthorizedKeysDir is set, the keys of each user are read from a file named like the user inside of it, see feature.FindUserKeys.
+// For users of the form 'name@host', the file is named like 'name' instead.
+// Apply refuses to configure a proxy without authentication, unless AllowUnauthenticated is set.
+// Clients then have to be authenticated by other means, as otherwise anyone can use the credentials of the proxy.
+//
+// The upstream server of each session is found using Route.
+// By default, users can only select DefaultUpstream and the servers listed in AllowedUpstreams.
+// The proxy authenticates to upstream servers using keys held by the server, and optionally using the agent forwarded by the client.
+// The keys of upstream servers are verified using HostKeyCallback.
+type ProxyConfig struct {
+	// Route returns the upstream server to proxy the sessions of a connection to.
+	// When nil, uses ParseUpstream with the name of the user and DefaultUpstream,
+	// and rejects upstream servers other than DefaultUpstream and AllowedUpstreams with ErrUpstreamNotAllowed.
+	Route func(ctx ssh.Context) (Upstream, error)
+
+	// AuthorizedKeysDir is a directory containing the authorized keys of each user.
+	// When empty, authentication is not configured.
+	AuthorizedKeysDir string
+
+	// AllowUnauthenticated allows AuthorizedKeysDir to be empty.
+	AllowUnauthenticated bool
+
+	// DefaultUpstream is the address of the upstream server for users that do not select one.
+	// It is only used when Route is nil.
+	DefaultUpstream string
+
+	// AllowedUpstreams are the addresses of additional upstream servers users may select using 'name@host'.
+	// Addresses without a port use DefaultPort.
+	// It is only used when Route is nil.
+	AllowedUpstreams []string
+
+	// Signers are used to authenticate to upstream servers.
+	// IdentityFiles are paths to additional private keys, which are read by Apply.
+	Signers       []gossh.Signer
+	IdentityFiles []string
+
+	// ForwardAgent additionally authenticates to upstream servers using the agent of the client, when the client forwarded it.
+	// The user must be allowed to forward their agent, see proxyssh.Options.AgentForwarding.
+	ForwardAgent bool
+
+	// HostKeyCallback verifies the host keys of upstream servers.
+	// When nil, the keys are verified using the known_hosts file at KnownHostsPath.
+	// When both are unset, Apply returns an error.
+	HostKeyCallback gossh.HostKeyCallback
+	KnownHostsPath  string
+
+	// Timeout is the maximum time to wait for a connection to an upstream server.
+	// When zero, there is no timeout.
+	Timeout time.Duration
+
+	// Subsystems are the names of subsystems to relay to upstream servers, for example 'sftp'.
+	Subsystems []string
+
+	signers []gossh.Signer // Signers and the keys read from IdentityFiles, set by Apply
+}
+
+// ErrNoAuthentication is returned by ProxyConfig.Apply when AuthorizedKeysDir is not set, and AllowUnauthenticated is false
+var ErrNoAuthentication = errors.New("ProxyConfig: AuthorizedKeysDir is not set")
+
+// ErrUpstreamNotAllowed is returned by ProxyConfig.Handle when a user selects an upstream server that is not allowed
+var ErrUpstreamNotAllowed = errors.New("ProxyConfig: Upstream server is not allowed")
+
+// ErrNoHostKeyCallback is returned by ProxyConfig.Apply when neither HostKeyCallback nor KnownHostsPath are set
+var ErrNoHostKeyCallback = errors.New("ProxyConfig: Neither HostKeyCallback nor KnownHostsPath are set")
+
+// Apply applies this configuration to the server.
+// It reads the IdentityFiles and known hosts, and sets up authentication and the Subsystems.
+func (cfg *ProxyConfig) Apply(logger logging.Logger, sshserver *ssh.Server) error {
+	if cfg.AuthorizedKeysDir == "" && !cfg.AllowUnauthenticated {
+		return ErrNoAuthentication
+	}
+
+	cfg.signers = append([]gossh.Signer(nil), cfg.Signers...)
+	for _, path := range cfg.IdentityFiles {
+		signer, err := readIdentity(path)
+		if err != nil {
+			return err
+		}
+		cfg.signers = append(cfg.signers, signer)
+	}
+
+	if cfg.HostKeyCallback == nil {
+		if cfg.KnownHostsPath == "" {
+			return ErrNoHostKeyCallback
+		}
+
+		callback, err := knownhosts.New(cfg.KnownHostsPath)
+		if err != nil {
+			return errors.Wrap(err, "Unable to read known hosts")
+		}
+		cfg.HostKeyCallback = callback
+	}
+
+	for _, name := range cfg.Subsystems {
+		if err := proxyssh.ApplySubsystem(logger, sshserver, name, cfg); err != nil {
+			return err
+		}
+	}
+
+	if cfg.AuthorizedKeysDir == "" {
+		return nil
+	}
+
+	sshserver.PublicKeyHandler = feature.AuthorizeKeys(logger, func(ctx ssh.Context) ([]ssh.PublicKey, error) {
+		name := ctx.User()
+		if i := strings.LastIndex(name, "@"); i >= 0 {
+			name = name[:i]
+		}
+		return feature.FindUserKeys(cfg.AuthorizedKeysDir, name), nil
+	})
+	return nil
+}
+
+// readIdentity reads a private key from path
+func readIdentity(path string) (gossh.Signer, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read identity file")
+	}
+
+	signer, err := gossh.ParsePrivateKey(bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse identity file %s", path)
+	}
+	return signer, nil
+}
+
+// Backend implements proxyssh.BackendHandler
+func (cfg *ProxyConfig) Backend() string {
+	return "proxy"
+}
+
+// Handle implements the handler
+func (cfg *ProxyConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	upstream, err := cfg.route(session.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []gossh.AuthMethod
+	if len(cfg.signers) > 0 {
+		auth = append(auth, gossh.PublicKeys(cfg.signers...))
+	}
+
+	return &UpstreamProcess{
+		Session:  session,
+		Upstream: upstream,
+		Config: &gossh.ClientConfig{
+			Auth:            auth,
+			HostKeyCallback: cfg.HostKeyCallback,
+			Timeout:         cfg.Timeout,
+		},
+		ForwardAgent: cfg.ForwardAgent && feature.AgentForwarded(logger, session),
+		Env:          feature.AcceptedEnviron(session),
+	}, nil
+}
+
+// route returns the upstream server for ctx
+func (cfg *ProxyConfig) route(ctx ssh.Context) (Upstream, error) {
+	if cfg.Route != nil {
+		return cfg.Route(ctx)
+	}
+	return cfg.routeUser(ctx.User())
+}
+
+// routeUser returns the upstream server for user when Route is nil.
+// Only DefaultUpstream and AllowedUpstreams are allowed.
+func (cfg *ProxyConfig) routeUser(user string) (Upstream, error) {
+	upstream, err := ParseUpstream(user, cfg.DefaultUpstream)
+	if err != nil {
+		return Upstream{}, err
+	}
+
+	if cfg.DefaultUpstream != "" && upstream.Address == upstreamAddress(cfg.DefaultUpstream) {
+		return upstream, nil
+	}
+	for _, allowed := range cfg.AllowedUpstreams {
+		if upstream.Address == upstreamAddress(allowed) {
+			return upstream, nil
+		}
+	}
+	return Upstream{}, ErrUpstreamNotAllowed
+}
+
+// dial connects to the ssh server at address.
+// Unlike gossh.Dial, the connection is aborted when ctx is done.
+func dial(ctx context.Context, address string, config *gossh.ClientConfig) (*gossh.Client, error) {
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// abort the handshake once ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, chans, reqs, err := gossh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return gossh.NewClient(c, chans, reqs), nil
+}
+
+// RegisterFlags registers flags representing the config to the provided flagset.
+// When flagset is nil, uses flag.CommandLine.
+func (cfg *ProxyConfig) RegisterFlags(flagset *flag.FlagSet) {
+	if flagset == nil {
+		flagset = flag.CommandLine
+	}
+
+	flagset.StringVar(&cfg.AuthorizedKeysDir, "authorizedkeys", cfg.AuthorizedKeysDir, "Directory containing an authorized_keys file for each user, named like the user")
+	flagset.BoolVar(&cfg.AllowUnauthenticated, "allowunauthenticated", cfg.AllowUnauthenticated, "Allow running without '-authorizedkeys', clients then have to be authenticated by other means")
+	flagset.StringVar(&cfg.DefaultUpstream, "upstream", cfg.DefaultUpstream, "Upstream server for users that do not select one using 'user@host' as user name")
+	flagset.StringVar(&cfg.KnownHostsPath, "knownhosts", cfg.KnownHostsPath, "Path to a known_hosts file to verify the keys of upstream servers with")
+	flagset.BoolVar(&cfg.ForwardAgent, "forwardagent", cfg.ForwardAgent, "Authenticate to upstream servers using the agent forwarded by the client")
+	flagset.DurationVar(&cfg.Timeout, "upstreamtimeout", cfg.Timeout, "Timeout for connecting to upstream servers")
+
+	if cfg.AllowedUpstreams == nil {
+		cfg.AllowedUpstreams = []string{}
+	}
+	av := stringListVar{Values: &cfg.AllowedUpstreams}
+	flagset.Var(&av, "allowupstream", "Additional upstream server users may select using 'user@host' as user name, can be passed multiple times")
+
+	if cfg.IdentityFiles == nil {
+		cfg.IdentityFiles = []string{}
+	}
+	iv := stringListVar{Values: &cfg.IdentityFiles}
+	flagset.Var(&iv, "identity", "Private key to authenticate to upstream servers with, can be passed multiple times")
+
+	if cfg.Subsystems == nil {
+		cfg.Subsystems = []string{}
+	}
+	sv := stringListVar{Values: &cfg.Subsystems}
+	flagset.Var(&sv, "subsystem", "Subsystem to relay to upstream servers, e.g. 'sftp'")
+}
+
+// stringListVar represents a "flag".Value that contains a list of non-empty strings.
+// It can be passed multiple times, and collects all values in an ordered list.
+type stringListVar struct {
+	Values *[]string
+}
+
+// String turns this stringListVar into a comma-seperated list of values.
+func (s *stringListVar) String() string {
+	if s.Values == nil {
+		return ""
+	}
+	return strings.Join(*s.Values, ",")
+}
+
+// Set adds a value to this stringListVar.
+// This function is intended to be called by flag.Var()
+func (s *stringListVar) Set(value string) error {
+	if value == "" {
+		return errors.New("Value must not be empty")
+	}
+	*s.Values = append(*s.Values, value)
+	return nil
+}
+
+func init() {
+	// ensure that stringListVar fullfills the flag.Value interface
+	var _ flag.Value = (*stringListVar)(nil)
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// key used to authenticate to the upstream server
+var (
+	upstreamPrivateKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	upstreamSigner, _     = gossh.NewSignerFromKey(upstreamPrivateKey)
+	upstreamKey           = upstreamSigner.PublicKey()
+)
+
+// upstreamConfig is the configuration of the upstream server used in tests.
+// It only accepts upstreamKey, and runs the following commands:
+//
+//   - 'info' prints the user, command and environment
+//   - 'cat' copies the input to the output
+//   - 'exit 3' exits with code 3
+//   - 'signal' prints 'ready', and then waits for a signal and prints it
+//   - the shell prints the terminal and its size on every change, until 'q' is pressed
+//
+// The 'echo' subsystem copies the input to the output.
+type upstreamConfig struct{}
+
+func (upstreamConfig) Apply(logger logging.Logger, server *ssh.Server) error {
+	server.PublicKeyHandler = func(ctx ssh.Context, key ssh.PublicKey) bool {
+		return ssh.KeysEqual(key, upstreamKey)
+	}
+	server.Handler = func(s ssh.Session) {
+		switch s.RawCommand() {
+		case "info":
+			fmt.Fprintf(s, "%s %s %v\n", s.User(), s.RawCommand(), s.Environ())
+		case "cat":
+			io.Copy(s, s)
+		case "exit 3":
+			s.Exit(3)
+			return
+		case "signal":
+			signals := make(chan ssh.Signal, 1)
+			s.Signals(signals)
+			io.WriteString(s, "ready\n")
+			fmt.Fprintf(s, "signal %s\n", <-signals)
+		case "":
+			pty, winCh, _ := s.Pty()
+			go func() {
+				for win := range winCh {
+					fmt.Fprintf(s, "pty %s %dx%d\r\n", pty.Term, win.Width, win.Height)
+				}
+			}()
+
+			buf := make([]byte, 1)
+			for {
+				if _, err := s.Read(buf); err != nil || buf[0] == 'q' {
+					break
+				}
+			}
+		}
+		s.Exit(0)
+	}
+	server.SubsystemHandlers = map[string]ssh.SubsystemHandler{
+		"echo": func(s ssh.Session) {
+			io.Copy(s, s)
+			s.Exit(0)
+		},
+	}
+	return nil
+}
+
+// newProxyTestServers starts an upstream server and a proxy in front of it
+func newProxyTestServers(cfg *ProxyConfig) (proxyServer *ssh.Server, cleanup func()) {
+	upstreamServer, _, upstreamCleanup := integrationtest.NewServer(nil, upstreamConfig{})
+
+	cfg.DefaultUpstream = upstreamServer.Addr
+	cfg.HostKeyCallback = gossh.InsecureIgnoreHostKey()
+	cfg.Subsystems = []string{"echo"}
+	cfg.AllowUnauthenticated = true
+
+	proxyServer, _, proxyCleanup := integrationtest.NewServer(&proxyssh.Options{
+		AcceptEnv:       []string{"LANG"},
+		AgentForwarding: []string{"alice"},
+	}, cfg)
+
+	return proxyServer, func() {
+		proxyCleanup()
+		upstreamCleanup()
+	}
+}
+
+func TestProxyConfig(t *testing.T) {
+	proxyServer, cleanup := newProxyTestServers(&ProxyConfig{Signers: []gossh.Signer{upstreamSigner}})
+	defer cleanup()
+
+	// newSession creates a new session to the proxy
+	newSession := func(t *testing.T) (*gossh.Client, *gossh.Session) {
+		client, session, err := testutils.NewTestServerSession(proxyServer.Addr, gossh.ClientConfig{User: "alice"})
+		if err != nil {
+			t.Fatalf("Unable to create test server session: %s", err)
+		}
+		return client, session
+	}
+
+	t.Run("commands, input and exit codes are relayed", func(t *testing.T) {
+		tests := []struct {
+			command  string
+			stdin    string
+			wantOut  string
+			wantCode int
+		}{
+			{"info", "", "alice info []\n", 0},
+			{"cat", "hello world", "hello world", 0},
+			{"exit 3", "", "", 3},
+		}
+		for _, tt := range tests {
+			stdout, _, code, err := testutils.RunTestServerCommand(proxyServer.Addr, gossh.ClientConfig{User: "alice"}, tt.command, tt.stdin)
+			if err != nil {
+				t.Fatalf("RunTestServerCommand(%q) got err = %s", tt.command, err)
+			}
+			if stdout != tt.wantOut || code != tt.wantCode {
+				t.Errorf("RunTestServerCommand(%q) got stdout = %q, code = %d, want stdout = %q, code = %d", tt.command, stdout, code, tt.wantOut, tt.wantCode)
+			}
+		}
+	})
+
+	t.Run("unlisted upstream servers are rejected", func(t *testing.T) {
+		_, stderr, code, err := testutils.RunTestServerCommand(proxyServer.Addr, gossh.ClientConfig{User: "alice@127.0.0.1:1"}, "info", "")
+		if err != nil {
+			t.Fatalf("RunTestServerCommand() got err = %s", err)
+		}
+		if code == 0 || !strings.Contains(stderr, ErrUpstreamNotAllowed.Error()) {
+			t.Errorf("RunTestServerCommand() got stderr = %q, code = %d, want an error", stderr, code)
+		}
+	})
+
+	t.Run("accepted environment variables are relayed", func(t *testing.T) {
+		client, session := newSession(t)
+		defer client.Close()
+
+		session.Setenv("LANG", "C.UTF-8")
+		session.Setenv("SECRET", "value")
+
+		out, err := session.Output("info")
+		if want := "alice info [LANG=C.UTF-8]\n"; err != nil || string(out) != want {
+			t.Errorf("Output() got out = %q, err = %v, want out = %q", out, err, want)
+		}
+	})
+
+	t.Run("subsystems are relayed", func(t *testing.T) {
+		client, session := newSession(t)
+		defer client.Close()
+
+		stdin, _ := session.StdinPipe()
+		stdout, _ := session.StdoutPipe()
+		if err := session.RequestSubsystem("echo"); err != nil {
+			t.Fatalf("RequestSubsystem() got err = %s", err)
+		}
+
+		io.WriteString(stdin, "hello subsystem")
+		stdin.Close()
+
+		if out, err := io.ReadAll(stdout); err != nil || string(out) != "hello subsystem" {
+			t.Errorf("ReadAll() got out = %q, err = %v, want out = %q", out, err, "hello subsystem")
+		}
+	})
+
+	t.Run("signals are relayed", func(t *testing.T) {
+		client, session := newSession(t)
+		defer client.Close()
+
+		stdout, _ := session.StdoutPipe()
+		if err := session.Start("signal"); err != nil {
+			t.Fatalf("Start() got err = %s", err)
+		}
+		lines := bufio.NewReader(stdout)
+		if line, _ := lines.ReadString('\n'); line != "ready\n" {
+			t.Fatalf("got output = %q, want = %q", line, "ready\n")
+		}
+
+		session.Signal(gossh.SIGUSR1)
+		if line, _ := lines.ReadString('\n'); line != "signal USR1\n" {
+			t.Errorf("got output = %q, want = %q", line, "signal USR1\n")
+		}
+	})
+
+	t.Run("pty and window changes are relayed", func(t *testing.T) {
+		client, session := newSession(t)
+		defer client.Close()
+
+		if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+			t.Fatalf("Unable to request pty: %s", err)
+		}
+		stdin, _ := session.StdinPipe()
+		stdout, _ := session.StdoutPipe()
+		if err := session.Shell(); err != nil {
+			t.Fatalf("Unable to start shell: %s", err)
+		}
+		lines := bufio.NewReader(stdout)
+
+		// expect expects the next line of output to be want
+		expect := func(want string) {
+			t.Helper()
+
+			got, err := lines.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Unable to read output: %s", err)
+			}
+			if got = strings.TrimRight(got, "\r\n"); got != want {
+				t.Errorf("got output = %q, want = %q", got, want)
+			}
+		}
+
+		expect("pty xterm 80x24")
+
+		session.WindowChange(30, 100)
+		expect("pty xterm 100x30")
+
+		stdin.Write([]byte("q"))
+		if err := session.Wait(); err != nil {
+			t.Errorf("Wait() got err = %s", err)
+		}
+	})
+}
+
+func TestProxyConfig_ForwardAgent(t *testing.T) {
+	proxyServer, cleanup := newProxyTestServers(&ProxyConfig{ForwardAgent: true})
+	defer cleanup()
+
+	// run runs the 'info' command as user, optionally forwarding an agent holding the upstream key
+	run := func(user string, forward bool) (string, error) {
+		client, session, err := testutils.NewTestServerSession(proxyServer.Addr, gossh.ClientConfig{User: user})
+		if err != nil {
+			return "", err
+		}
+		defer client.Close()
+
+		if forward {
+			keyring := agent.NewKeyring()
+			if err := keyring.Add(agent.AddedKey{PrivateKey: upstreamPrivateKey}); err != nil {
+				return "", err
+			}
+			if err := agent.ForwardToAgent(client, keyring); err != nil {
+				return "", err
+			}
+			if err := agent.RequestAgentForwarding(session); err != nil {
+				return "", err
+			}
+		}
+
+		out, err := session.CombinedOutput("info")
+		return string(out), err
+	}
+
+	if out, err := run("alice", true); err != nil || out != "alice info []\n" {
+		t.Errorf("run(alice, true) got out = %q, err = %v, want out = %q", out, err, "alice info []\n")
+	}
+	if out, err := run("alice", false); err == nil {
+		t.Errorf("run(alice, false) got out = %q, want error", out)
+	}
+	if out, err := run("bob", true); err == nil {
+		t.Errorf("run(bob, true) got out = %q, want error", out)
+	}
+}
+
+func TestProxyConfig_Apply(t *testing.T) {
+	callback := gossh.InsecureIgnoreHostKey()
+	tests := []struct {
+		name string
+		cfg  ProxyConfig
+		want error
+	}{
+		{"no authentication", ProxyConfig{HostKeyCallback: callback}, ErrNoAuthentication},
+		{"explicitly unauthenticated", ProxyConfig{HostKeyCallback: callback, AllowUnauthenticated: true}, nil},
+		{"authorized keys", ProxyConfig{HostKeyCallback: callback, AuthorizedKeysDir: t.TempDir()}, nil},
+		{"no host key callback", ProxyConfig{AuthorizedKeysDir: t.TempDir()}, ErrNoHostKeyCallback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Apply(integrationtest.GetLogger(), &ssh.Server{}); err != tt.want {
+				t.Errorf("Apply() got err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
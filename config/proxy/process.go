@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/term"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// UpstreamProcess represents a process that relays a session to a session on an upstream ssh server.
+//
+// The command or subsystem, pty and environment requested by the client are sent to the upstream session.
+// Window size changes and signals are relayed while the session is running.
+type UpstreamProcess struct {
+	Session  ssh.Session
+	Upstream Upstream
+
+	// Config is used to connect to the upstream server.
+	// Config must be set before Init is called.
+	Config *gossh.ClientConfig
+
+	// ForwardAgent indicates that the agent of the client should be used to authenticate to the upstream server.
+	// It should only be set when the agent of the client may be forwarded, see feature.AgentForwarded.
+	ForwardAgent bool
+
+	// Env are the environment variables to request on the upstream session.
+	// Upstream servers may ignore some or all of them.
+	Env []string
+
+	term.Pipes
+	terminal *term.Pair
+
+	client   *gossh.Client
+	upstream *gossh.Session
+
+	ctx     context.Context
+	cancel  func()          // cancels ctx
+	signals chan ssh.Signal // signals received from the client, nil until started
+
+	subsystemDone chan struct{}  // closed once the output of a subsystem is relayed, nil unless a subsystem was started
+	closers       []func() error // called by Cleanup in reverse order
+}
+
+// Init initializes this process by connecting to the upstream server.
+func (up *UpstreamProcess) Init(ctx context.Context, detector logging.MemoryLeakDetector, isPty bool) error {
+	up.ctx, up.cancel = context.WithCancel(ctx)
+
+	config := *up.Config
+	config.User = up.Upstream.User
+	if up.ForwardAgent {
+		agent, err := feature.NewForwardedAgent(up.Session.Context())
+		if err != nil {
+			return err
+		}
+		up.closers = append(up.closers, agent.Close)
+		config.Auth = append(append([]gossh.AuthMethod(nil), config.Auth...), gossh.PublicKeysCallback(agent.Signers))
+	}
+
+	client, err := dial(up.ctx, up.Upstream.Address, &config)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to connect to %s", up.Upstream)
+	}
+	up.client = client
+	up.closers = append(up.closers, client.Close)
+
+	up.upstream, err = client.NewSession()
+	if err != nil {
+		return errors.Wrapf(err, "Unable to start session on %s", up.Upstream)
+	}
+	up.closers = append(up.closers, up.upstream.Close)
+
+	for _, env := range up.Env {
+		if key, value, ok := strings.Cut(env, "="); ok {
+			up.upstream.Setenv(key, value) // upstream servers commonly refuse variables
+		}
+	}
+
+	return nil
+}
+
+// String turns UpstreamProcess into a string
+func (up *UpstreamProcess) String() string {
+	return "UpstreamProcess " + up.Upstream.String()
+}
+
+// Start starts this process
+func (up *UpstreamProcess) Start(detector logging.MemoryLeakDetector, Term string, resizeChan <-chan proxyssh.WindowSize, isPty bool) (*os.File, error) {
+	if !isPty {
+		up.upstream.Stdin = up.StdinPipe
+		up.upstream.Stdout = up.StdoutPipe
+		up.upstream.Stderr = up.StderrPipe
+		return nil, up.start(detector)
+	}
+
+	up.terminal = &term.Pair{}
+	if err := up.terminal.Open(true); err != nil {
+		return nil, err
+	}
+	up.upstream.Stdin = up.terminal.Internal()
+	up.upstream.Stdout = up.terminal.Internal()
+	up.upstream.Stderr = up.terminal.Internal()
+
+	// request a pty of the current size, and relay all changes
+	ptyReq, _, _ := up.Session.Pty()
+	if err := up.upstream.RequestPty(Term, ptyReq.Window.Height, ptyReq.Window.Width, gossh.TerminalModes{}); err != nil {
+		return nil, errors.Wrap(err, "Unable to request pty")
+	}
+	last := proxyssh.WindowSize{Width: uint16(ptyReq.Window.Width), Height: uint16(ptyReq.Window.Height)}
+	up.terminal.HandleWith(resizeChan, func(size proxyssh.WindowSize) {
+		if size == last {
+			return // the initial size was already sent with the pty request
+		}
+		last = size
+		up.upstream.WindowChange(int(size.Height), int(size.Width))
+	})
+
+	return up.terminal.External(), up.start(detector)
+}
+
+// start starts the command, shell or subsystem on the upstream session and relays signals to it.
+func (up *UpstreamProcess) start(detector logging.MemoryLeakDetector) (err error) {
+	switch {
+	case up.Session.Subsystem() != "":
+		err = up.startSubsystem(detector)
+	case len(up.Session.Command()) > 0:
+		err = up.upstream.Start(up.Session.RawCommand())
+	default:
+		err = up.upstream.Shell()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to start upstream session")
+	}
+
+	up.signals = make(chan ssh.Signal, 1)
+	up.Session.Signals(up.signals)
+
+	detector.Add("proxy: signals")
+	go func() {
+		defer detector.Done("proxy: signals")
+		for {
+			select {
+			case <-up.ctx.Done():
+				return
+			case signal := <-up.signals:
+				up.upstream.Signal(gossh.Signal(signal))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// startSubsystem requests the subsystem on the upstream session.
+//
+// Unlike for commands and shells, x/crypto does not relay input and output of subsystems, nor does it report their exit code.
+// Input and output are instead relayed using pipes, and the subsystem is done once its output is closed.
+func (up *UpstreamProcess) startSubsystem(detector logging.MemoryLeakDetector) error {
+	stdin, stdout, stderr := up.upstream.Stdin, up.upstream.Stdout, up.upstream.Stderr
+	up.upstream.Stdin, up.upstream.Stdout, up.upstream.Stderr = nil, nil, nil
+
+	inPipe, err := up.upstream.StdinPipe()
+	if err != nil {
+		return err
+	}
+	outPipe, err := up.upstream.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	errPipe, err := up.upstream.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := up.upstream.RequestSubsystem(up.Session.Subsystem()); err != nil {
+		return err
+	}
+
+	detector.Add("proxy: subsystem input")
+	go func() {
+		defer detector.Done("proxy: subsystem input")
+		io.Copy(inPipe, stdin)
+		inPipe.Close()
+	}()
+
+	up.subsystemDone = make(chan struct{})
+	detector.Add("proxy: subsystem output")
+	go func() {
+		defer detector.Done("proxy: subsystem output")
+		defer close(up.subsystemDone)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			io.Copy(stdout, outPipe)
+		}()
+		go func() {
+			defer wg.Done()
+			io.Copy(stderr, errPipe)
+		}()
+		wg.Wait()
+	}()
+
+	return nil
+}
+
+// Wait waits for the upstream session and returns its exit code.
+func (up *UpstreamProcess) Wait(detector logging.MemoryLeakDetector) (code int, err error) {
+	detector.Add("proxy: Wait")
+	defer detector.Done("proxy: Wait")
+
+	if up.subsystemDone != nil {
+		<-up.subsystemDone
+		up.DrainOutput(up.ctx)
+		return 0, nil
+	}
+
+	err = up.upstream.Wait()
+	up.DrainOutput(up.ctx)
+
+	var exitErr *gossh.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr):
+		return exitErr.ExitStatus(), nil
+	default:
+		return 255, errors.Wrap(err, "Upstream session failed")
+	}
+}
+
+// Cleanup cleans up this process by disconnecting from the upstream server.
+func (up *UpstreamProcess) Cleanup() (killed bool) {
+	// stop receiving signals before the relay stops, as delivering them blocks the session
+	if up.signals != nil {
+		up.Session.Signals(nil)
+	}
+	if up.cancel != nil {
+		up.cancel()
+	}
+
+	for i := len(up.closers) - 1; i >= 0; i-- {
+		up.closers[i]()
+	}
+
+	up.ClosePipes()
+	up.terminal.UnhangHack()
+	up.terminal.Close()
+	return true
+}
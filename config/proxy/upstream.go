@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultPort is the port of upstream servers that do not specify one.
+const DefaultPort = 22
+
+// Upstream is an upstream ssh server that sessions are proxied to.
+type Upstream struct {
+	// Address is the address of the upstream server, of the form 'host:port'.
+	Address string
+
+	// User is the name of the user to login as on the upstream server.
+	User string
+}
+
+// String turns this upstream into a string of the form 'user@host:port'.
+func (u Upstream) String() string {
+	return u.User + "@" + u.Address
+}
+
+// ParseUpstream finds the upstream server for a client logged in as user.
+//
+// A user of the form 'name@host[:port]' selects the user name on the upstream server host.
+// Clients can use it by running, for example, 'ssh alice@db@proxy'.
+// Other users login as themselves on the upstream server at defaultAddress.
+// When a port is omitted, DefaultPort is used.
+//
+// When user does not contain a host and defaultAddress is empty, returns an error.
+func ParseUpstream(user, defaultAddress string) (Upstream, error) {
+	name, host := user, defaultAddress
+	if i := strings.LastIndex(user, "@"); i >= 0 {
+		name, host = user[:i], user[i+1:]
+	}
+
+	if name == "" || host == "" {
+		return Upstream{}, errors.Errorf("No upstream server for user %q, use 'user@host' as user name", user)
+	}
+
+	return Upstream{Address: upstreamAddress(host), User: name}, nil
+}
+
+// upstreamAddress turns host into an address of the form 'host:port'.
+// When host does not contain a port, DefaultPort is used.
+func upstreamAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(DefaultPort))
+	}
+	return host
+}
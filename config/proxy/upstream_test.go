@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		name           string
+		user           string
+		defaultAddress string
+		want           Upstream
+		wantErr        bool
+	}{
+		{"user with host", "alice@db", "", Upstream{Address: "db:22", User: "alice"}, false},
+		{"user with host and port", "alice@db:2222", "", Upstream{Address: "db:2222", User: "alice"}, false},
+		{"user with ipv6 host", "alice@[::1]", "", Upstream{Address: "[::1]:22", User: "alice"}, false},
+		{"user containing @", "alice@example.com@db", "", Upstream{Address: "db:22", User: "alice@example.com"}, false},
+		{"user with host ignores default", "alice@db", "legacy:22", Upstream{Address: "db:22", User: "alice"}, false},
+		{"user without host uses default", "alice", "legacy", Upstream{Address: "legacy:22", User: "alice"}, false},
+
+		{"user without host and default", "alice", "", Upstream{}, true},
+		{"user with empty host", "alice@", "", Upstream{}, true},
+		{"user with empty name", "@db", "", Upstream{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUpstream(tt.user, tt.defaultAddress)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseUpstream() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseUpstream() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyConfig_routeUser(t *testing.T) {
+	cfg := &ProxyConfig{
+		DefaultUpstream:  "legacy",
+		AllowedUpstreams: []string{"db", "[::1]:2222"},
+	}
+
+	tests := []struct {
+		name    string
+		user    string
+		want    Upstream
+		wantErr error
+	}{
+		{"user without host uses default", "alice", Upstream{Address: "legacy:22", User: "alice"}, nil},
+		{"user selecting default", "alice@legacy:22", Upstream{Address: "legacy:22", User: "alice"}, nil},
+		{"user selecting allowed host", "alice@db", Upstream{Address: "db:22", User: "alice"}, nil},
+		{"user selecting allowed ipv6 host", "alice@[::1]:2222", Upstream{Address: "[::1]:2222", User: "alice"}, nil},
+
+		{"user selecting unlisted host", "alice@evil", Upstream{}, ErrUpstreamNotAllowed},
+		{"user selecting unlisted port", "alice@db:2222", Upstream{}, ErrUpstreamNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cfg.routeUser(tt.user)
+			if err != tt.wantErr {
+				t.Errorf("routeUser() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("routeUser() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/config/osexec"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestReloadableServer(t *testing.T) {
+	testLogger := integrationtest.GetLogger()
+
+	options := &proxyssh.Options{}
+	sshserver, err := proxyssh.NewServer(testLogger, options, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err)
+	}
+	signer, _ := testutils.GenerateRSATestKeyPair()
+	sshserver.HostSigners = append(sshserver.HostSigners, signer)
+
+	var reloadErr error
+	server := proxyssh.NewReloadableServer(testLogger, sshserver, options, func() (*proxyssh.Options, []proxyssh.Configuration, error) {
+		if reloadErr != nil {
+			return nil, nil, reloadErr
+		}
+		return &proxyssh.Options{}, []proxyssh.Configuration{&osexec.SystemExecConfig{Shell: "/bin/echo"}}, nil
+	})
+
+	addr := testutils.NewTestListenAddress()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// start a session using the initial configuration, and wait for it to be running
+	client, session, err := testutils.NewTestServerSession(addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Unable to get stdout: %s", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("Unable to get stdin: %s", err)
+	}
+	if err := session.Start("echo ready; read line; echo old"); err != nil {
+		t.Fatalf("Unable to start command: %s", err)
+	}
+	reader := bufio.NewReader(stdout)
+	if line, err := reader.ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("Unable to wait for command: got %q, err = %v", line, err)
+	}
+
+	// a failed reload keeps the current configuration
+	reloadErr = errors.New("invalid configuration")
+	if err := server.Reload(); err != reloadErr {
+		t.Errorf("Reload() error = %v, want %v", err, reloadErr)
+	}
+	if out, _, _, err := testutils.RunTestServerCommand(addr, gossh.ClientConfig{}, "echo hello", ""); err != nil || out != "hello\n" {
+		t.Errorf("Reload(): failed reload changed configuration, got %q, err = %v", out, err)
+	}
+
+	// a successful reload applies to new connections
+	reloadErr = nil
+	if err := server.Reload(); err != nil {
+		t.Errorf("Reload() error = %v", err)
+	}
+	if out, _, _, err := testutils.RunTestServerCommand(addr, gossh.ClientConfig{}, "echo hello", ""); err != nil || out != "-c echo hello\n" {
+		t.Errorf("Reload(): new connection got %q, err = %v, want %q", out, err, "-c echo hello\n")
+	}
+
+	// but not to existing sessions
+	stdin.Write([]byte("\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "old\n" {
+		t.Errorf("Reload(): existing session got %q, err = %v, want %q", line, err, "old\n")
+	}
+	if err := session.Wait(); err != nil {
+		t.Errorf("Reload(): existing session exited with %v", err)
+	}
+}
+
+func TestReloadableServer_Shutdown(t *testing.T) {
+	testLogger := integrationtest.GetLogger()
+
+	options := &proxyssh.Options{}
+	sshserver, err := proxyssh.NewServer(testLogger, options, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	if err != nil {
+		t.Fatalf("Unable to create server: %s", err)
+	}
+	signer, _ := testutils.GenerateRSATestKeyPair()
+	sshserver.HostSigners = append(sshserver.HostSigners, signer)
+
+	server := proxyssh.NewReloadableServer(testLogger, sshserver, options, func() (*proxyssh.Options, []proxyssh.Configuration, error) {
+		return &proxyssh.Options{}, []proxyssh.Configuration{&osexec.SystemExecConfig{Shell: "/bin/sh"}}, nil
+	})
+
+	addr := testutils.NewTestListenAddress()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// start a long-running session using a reloaded configuration
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	client, session, err := testutils.NewTestServerSession(addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Unable to get stdout: %s", err)
+	}
+	if err := session.Start("echo ready; sleep 10"); err != nil {
+		t.Fatalf("Unable to start command: %s", err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("Unable to wait for command: got %q, err = %v", line, err)
+	}
+
+	// shutting down the listening server should reach the session
+	if err := proxyssh.Shutdown(testLogger, server.Server, "Goodbye", time.Second/10); err != nil {
+		t.Errorf("Shutdown() returned error %s", err)
+	}
+	session.Wait()
+	if want := "Goodbye\n"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("Shutdown(): session stderr %q does not contain %q", stderr.String(), want)
+	}
+}
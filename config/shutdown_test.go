@@ -0,0 +1,128 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/config/osexec"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestShutdown(t *testing.T) {
+	testServer, testLogger, cleanup := integrationtest.NewServer(nil, &osexec.SystemExecConfig{Shell: "/bin/sh"})
+	defer cleanup()
+
+	client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Unable to get stdout: %s", err)
+	}
+
+	// start a long-running command, and wait for it to be running
+	if err := session.Start("echo ready; sleep 10"); err != nil {
+		t.Fatalf("Unable to start command: %s", err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("Unable to wait for command: got %q, err = %v", line, err)
+	}
+
+	start := time.Now()
+	if err := proxyssh.Shutdown(testLogger, testServer, "Goodbye", time.Second/10); err != nil {
+		t.Errorf("Shutdown() returned error %s", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Shutdown() took %s, expected to terminate the session", took)
+	}
+
+	// the connection was closed, so the session ended without an exit status
+	err = session.Wait()
+	if _, ok := err.(*gossh.ExitMissingError); !ok {
+		t.Errorf("Shutdown(): session exited with %v, want missing exit status", err)
+	}
+	if want := "Goodbye\n"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("Shutdown(): session stderr %q does not contain %q", stderr.String(), want)
+	}
+
+	// no new connections should be accepted
+	if _, _, _, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, "true", ""); err == nil {
+		t.Error("Shutdown(): server still accepts connections")
+	}
+}
+
+// hangingConfig is a configuration whose processes are not cleaned up until release is closed
+type hangingConfig struct {
+	*osexec.SystemExecConfig
+	release chan struct{}
+}
+
+func (hc hangingConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	process, err := hc.SystemExecConfig.Handle(logger, session)
+	if err != nil {
+		return nil, err
+	}
+	return hangingProcess{Process: process, release: hc.release}, nil
+}
+
+type hangingProcess struct {
+	proxyssh.Process
+	release chan struct{}
+}
+
+func (hp hangingProcess) Cleanup() bool {
+	<-hp.release
+	return hp.Process.Cleanup()
+}
+
+func TestShutdown_hangingCleanup(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	testServer, testLogger, cleanup := integrationtest.NewServer(nil, hangingConfig{
+		SystemExecConfig: &osexec.SystemExecConfig{Shell: "/bin/sh"},
+		release:          release,
+	})
+	defer cleanup()
+
+	client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Unable to create test server session: %s", err)
+	}
+	defer client.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Unable to get stdout: %s", err)
+	}
+	if err := session.Start("echo ready; sleep 10"); err != nil {
+		t.Fatalf("Unable to start command: %s", err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("Unable to wait for command: got %q, err = %v", line, err)
+	}
+
+	defer func(timeout time.Duration) { proxyssh.ShutdownCleanupTimeout = timeout }(proxyssh.ShutdownCleanupTimeout)
+	proxyssh.ShutdownCleanupTimeout = time.Second / 10
+
+	start := time.Now()
+	if err := proxyssh.Shutdown(testLogger, testServer, "", time.Second/10); err == nil {
+		t.Error("Shutdown() returned no error, want an error for the hanging cleanup")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Shutdown() took %s, expected to give up on the hanging cleanup", took)
+	}
+}
@@ -0,0 +1,165 @@
+package terminal
+
+import (
+	"context"
+	"os"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/internal/term"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// App is an application that takes over the terminal of a session, such as a full-screen terminal user interface.
+//
+// It is called once per session, and should read input from and write output to pty until the user exits it.
+// ctx is cancelled when the session ends, at which point the application should return as soon as possible.
+// The returned code is used as the exit code of the session.
+type App func(ctx context.Context, session ssh.Session, pty *PTY) (code int)
+
+// PTY is the terminal handed to an App.
+type PTY struct {
+	// File is the terminal end of a pty, in raw mode.
+	// It implements io.ReadWriter, and can be passed to libraries that require an *os.File.
+	*os.File
+
+	// Term is the value of the TERM environment variable requested by the client, e.g. "xterm-256color".
+	Term string
+
+	// Resize receives the size of the terminal whenever the client resizes its window.
+	// The first value is the initial size of the terminal.
+	//
+	// Only the most recent size is kept, when an application falls behind, older sizes are dropped.
+	// Resize is never closed; applications should stop receiving once ctx is done.
+	Resize <-chan proxyssh.WindowSize
+}
+
+// AppProcess represents a process that runs an App inside of a pty.
+// It does not support sessions without a pty.
+type AppProcess struct {
+	App     App
+	Session ssh.Session
+
+	// Env are the environment variables of this process.
+	// They can be retrieved from within App using Environ.
+	Env []string
+
+	term.Pipes
+	terminal *term.Pair
+
+	cancel   func()        // cancels the context passed to App
+	exitCode int           // exit code App returned
+	done     chan struct{} // close()d when App returns
+}
+
+// Init initializes this process.
+func (ap *AppProcess) Init(ctx context.Context, detector logging.MemoryLeakDetector, isPty bool) error {
+	ap.done = make(chan struct{})
+	ap.cancel = func() {}
+
+	if !isPty {
+		return errNotATTY
+	}
+	return nil
+}
+
+// Start starts this process
+func (ap *AppProcess) Start(detector logging.MemoryLeakDetector, Term string, resizeChan <-chan proxyssh.WindowSize, isPty bool) (*os.File, error) {
+	ap.terminal = &term.Pair{}
+	if err := ap.terminal.Open(true); err != nil {
+		return nil, err
+	}
+
+	// resize the terminal, and forward the most recent size to the app
+	resize := make(chan proxyssh.WindowSize, 1)
+	ap.terminal.HandleWith(resizeChan, func(size proxyssh.WindowSize) {
+		for {
+			select {
+			case resize <- size:
+				return
+			default:
+			}
+
+			// drop the size the app did not receive yet
+			select {
+			case <-resize:
+			default:
+			}
+		}
+	})
+
+	ctx := context.WithValue(context.Background(), environContextKey{}, ap.Env)
+	ctx, ap.cancel = context.WithCancel(ctx)
+
+	pty := &PTY{
+		File:   ap.terminal.Internal(),
+		Term:   Term,
+		Resize: resize,
+	}
+
+	detector.Add("terminal: app")
+	go func() {
+		defer detector.Done("terminal: app")
+
+		ap.exitCode = ap.App(ctx, ap.Session, pty)
+
+		// close the underlying terminals and exit
+		ap.terminal.Close()
+		close(ap.done)
+	}()
+
+	return ap.terminal.External(), nil
+}
+
+// Wait waits for the process and returns the exit code.
+func (ap *AppProcess) Wait(detector logging.MemoryLeakDetector) (code int, err error) {
+	detector.Add("terminal: app Wait")
+	defer detector.Done("terminal: app Wait")
+
+	<-ap.done
+	return ap.exitCode, nil
+}
+
+// Cleanup cleans up this process
+func (ap *AppProcess) Cleanup() (killed bool) {
+	ap.cancel()
+	ap.ClosePipes()
+
+	// unhang any read of the app
+	ap.terminal.UnhangHack()
+	ap.terminal.Close()
+
+	return true
+}
+
+// String turns AppProcess into a string
+func (ap *AppProcess) String() string {
+	return "AppProcess"
+}
+
+// AppConfig implements a configuration that runs an App in every session.
+// Sessions that did not request a pty are rejected.
+type AppConfig struct {
+	App App
+}
+
+// Apply applies this configuration to a server.
+// It does not modify the server.
+func (a *AppConfig) Apply(logger logging.Logger, sshserver *ssh.Server) error {
+	return nil
+}
+
+// Backend implements proxyssh.BackendHandler
+func (a *AppConfig) Backend() string {
+	return "app"
+}
+
+// Handle handles a session by running App
+func (a *AppConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	return &AppProcess{
+		App:     a.App,
+		Session: session,
+		Env:     feature.Environ(session),
+	}, nil
+}
@@ -0,0 +1,97 @@
+package terminal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sizeApp is an App that prints the terminal type and every size, and echoes every key until 'q' is pressed.
+func sizeApp(ctx context.Context, session ssh.Session, pty *PTY) int {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case size := <-pty.Resize:
+				fmt.Fprintf(pty, "size %s %dx%d\r\n", pty.Term, size.Width, size.Height)
+			}
+		}
+	}()
+
+	buf := make([]byte, 1)
+	for {
+		if _, err := pty.Read(buf); err != nil {
+			return 255
+		}
+		if buf[0] == 'q' {
+			return 3
+		}
+		fmt.Fprintf(pty, "key %c\r\n", buf[0])
+	}
+}
+
+func TestAppConfig(t *testing.T) {
+	testServer, _, cleanup := integrationtest.NewServer(nil, &AppConfig{App: sizeApp})
+	defer cleanup()
+
+	t.Run("app runs in a pty", func(t *testing.T) {
+		client, session, err := testutils.NewTestServerSession(testServer.Addr, gossh.ClientConfig{})
+		if err != nil {
+			t.Fatalf("Unable to create test server session: %s", err)
+		}
+		defer client.Close()
+		defer session.Close()
+
+		if err := session.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+			t.Fatalf("Unable to request pty: %s", err)
+		}
+		stdin, _ := session.StdinPipe()
+		stdout, _ := session.StdoutPipe()
+		if err := session.Shell(); err != nil {
+			t.Fatalf("Unable to start shell: %s", err)
+		}
+		lines := bufio.NewReader(stdout)
+
+		// expect expects the next line of output to be want
+		expect := func(want string) {
+			t.Helper()
+
+			got, err := lines.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Unable to read output: %s", err)
+			}
+			if got = strings.TrimRight(got, "\r\n"); got != want {
+				t.Errorf("got output = %q, want = %q", got, want)
+			}
+		}
+
+		expect("size xterm 80x24")
+
+		session.WindowChange(30, 100)
+		expect("size xterm 100x30")
+
+		stdin.Write([]byte("a"))
+		expect("key a")
+
+		stdin.Write([]byte("q"))
+		err = session.Wait()
+		if exit, ok := err.(*gossh.ExitError); !ok || exit.ExitStatus() != 3 {
+			t.Errorf("Wait() got err = %v, want exit status 3", err)
+		}
+	})
+
+	t.Run("app requires a pty", func(t *testing.T) {
+		_, _, code, err := testutils.RunTestServerCommand(testServer.Addr, gossh.ClientConfig{}, "", "")
+		if err == nil && code == 0 {
+			t.Error("RunTestServerCommand() succeeded without a pty")
+		}
+	})
+}
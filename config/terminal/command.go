@@ -0,0 +1,304 @@
+package terminal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+)
+
+// Command is a command that can be run inside of a REPLProcess.
+type Command struct {
+	// Name is the name of the command, for example "close".
+	// Usage describes the arguments of the command, for example "<id>".
+	// Description is a short description shown by the 'help' command.
+	Name        string
+	Usage       string
+	Description string
+
+	// MinArgs and MaxArgs are the minimal and maximal number of arguments the command accepts.
+	// A negative MaxArgs means that the number of arguments is not limited.
+	MinArgs int
+	MaxArgs int
+
+	// Run runs the command with the provided arguments.
+	// When it returns an error, the error is shown to the user and the session continues.
+	Run func(session *CommandSession, args []string) error
+
+	// Complete returns candidates to complete the last argument in args with.
+	// args contains all arguments up to the cursor, and the last one may be empty.
+	// Candidates not starting with the last argument are ignored.
+	//
+	// Complete may be nil, in which case arguments are not completed.
+	Complete func(session *CommandSession, args []string) []string
+}
+
+// ErrCommandAlreadySet is returned by Commands.Register when a command with the same name is already registered.
+var ErrCommandAlreadySet = errors.New("Commands.Register: Command already set")
+
+// Commands is a set of commands that implements the loop of a REPLProcess.
+//
+// Each line of input is split into arguments, similar to a shell, and the first argument selects the command to run.
+// See SplitArgs for details.
+//
+// The 'help' and 'exit' commands are always available.
+// Commands should be registered before the first session starts, afterwards Commands may be used by several sessions concurrently.
+type Commands struct {
+	commands map[string]*Command
+}
+
+// NewCommands creates a new set of commands that contains the builtin 'help' and 'exit' commands.
+func NewCommands() *Commands {
+	commands := &Commands{commands: make(map[string]*Command)}
+	commands.Register(Command{
+		Name:        "help",
+		Usage:       "[command]",
+		Description: "Show the list of commands, or help for a single command",
+		MaxArgs:     1,
+		Run:         commands.runHelp,
+		Complete: func(session *CommandSession, args []string) []string {
+			if len(args) != 1 {
+				return nil
+			}
+			return commands.Names()
+		},
+	})
+	commands.Register(Command{
+		Name:        "exit",
+		Usage:       "[code]",
+		Description: "End the session",
+		MaxArgs:     1,
+		Run: func(session *CommandSession, args []string) error {
+			code := 0
+			if len(args) == 1 {
+				var err error
+				if code, err = strconv.Atoi(args[0]); err != nil {
+					return errors.Errorf("Invalid exit code %q", args[0])
+				}
+			}
+			session.Exit(code)
+			return nil
+		},
+	})
+	return commands
+}
+
+// Register registers a new command.
+// When a command of the same name is already registered, returns ErrCommandAlreadySet.
+func (c *Commands) Register(command Command) error {
+	if _, ok := c.commands[command.Name]; ok {
+		return ErrCommandAlreadySet
+	}
+	c.commands[command.Name] = &command
+	return nil
+}
+
+// Names returns the names of all registered commands in sorted order.
+func (c *Commands) Names() []string {
+	names := make([]string, 0, len(c.commands))
+	for name := range c.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runHelp implements the 'help' command
+func (c *Commands) runHelp(session *CommandSession, args []string) error {
+	names := c.Names()
+	if len(args) == 1 {
+		if _, ok := c.commands[args[0]]; !ok {
+			return errors.Errorf("Unknown command %q", args[0])
+		}
+		names = args[:1]
+	}
+
+	for _, name := range names {
+		command := c.commands[name]
+		fmt.Fprintf(session.Output, "%-24s %s\n", strings.TrimSpace(command.Name+" "+command.Usage), command.Description)
+	}
+	return nil
+}
+
+// NewSession creates a new CommandSession for session.
+func (c *Commands) NewSession(session ssh.Session) *CommandSession {
+	return &CommandSession{
+		Session: session,
+		Values:  make(map[string]interface{}),
+
+		commands: c,
+	}
+}
+
+// CommandSession holds the state of a single session running commands.
+// It is passed to all commands run in the session.
+type CommandSession struct {
+	// Session is the underlying ssh session.
+	Session ssh.Session
+
+	// Context is the context of the currently running command, and is cancelled when the session ends.
+	// Output is where the currently running command should write its output to.
+	Context context.Context
+	Output  io.Writer
+
+	// Values are arbitrary values stored for the duration of the session.
+	// Commands may use it to share state between invocations.
+	Values map[string]interface{}
+
+	commands *Commands
+
+	exit bool // has Exit been called?
+	code int  // code passed to Exit
+}
+
+// Exit ends the session with the provided exit code, once the current command has returned.
+func (cs *CommandSession) Exit(code int) {
+	cs.exit, cs.code = true, code
+}
+
+// Loop runs a single line of input.
+// It can be used as the Loop of a REPLProcess.
+func (cs *CommandSession) Loop(ctx context.Context, w io.Writer, input string) (exit bool, code int) {
+	args, err := SplitArgs(input)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return false, 0
+	}
+	if len(args) == 0 {
+		return false, 0
+	}
+
+	command, ok := cs.commands.commands[args[0]]
+	if !ok {
+		fmt.Fprintf(w, "Unknown command %q, type 'help' for a list of commands\n", args[0])
+		return false, 0
+	}
+
+	args = args[1:]
+	if len(args) < command.MinArgs || (command.MaxArgs >= 0 && len(args) > command.MaxArgs) {
+		fmt.Fprintln(w, strings.TrimSpace("Usage: "+command.Name+" "+command.Usage))
+		return false, 0
+	}
+
+	cs.Context, cs.Output = ctx, w
+	if err := command.Run(cs, args); err != nil {
+		fmt.Fprintln(w, err)
+	}
+	return cs.exit, cs.code
+}
+
+// AutoComplete completes command names and arguments when the tab key is pressed.
+// It can be used as the AutoComplete of a REPLProcess.
+//
+// When there is a single candidate, it is completed and followed by a space.
+// When there are several candidates, their common prefix is completed.
+func (cs *CommandSession) AutoComplete(line string, pos int, key rune) (newLine string, newPos int, ok bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	prefix := line[:pos]
+	args := strings.Fields(prefix)
+	if len(args) == 0 || unicode.IsSpace(rune(prefix[len(prefix)-1])) {
+		args = append(args, "")
+	}
+	last := args[len(args)-1]
+
+	// find the candidates for the last argument
+	var candidates []string
+	if len(args) == 1 {
+		candidates = cs.commands.Names()
+	} else if command, ok := cs.commands.commands[args[0]]; ok && command.Complete != nil {
+		candidates = command.Complete(cs, args[1:])
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, last) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		// do not insert the tab into the line
+		return line, pos, true
+	}
+
+	completion := commonPrefix(matches)
+	if len(matches) == 1 {
+		completion += " "
+	}
+
+	prefix += completion[len(last):]
+	return prefix + line[pos:], len(prefix), true
+}
+
+// commonPrefix returns the longest common prefix of all strings in values.
+// values must not be empty.
+func commonPrefix(values []string) string {
+	prefix := values[0]
+	for _, value := range values[1:] {
+		for !strings.HasPrefix(value, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// SplitArgs splits input into arguments, similar to a shell.
+//
+// Arguments are seperated by whitespace.
+// Single and double quotes can be used to include whitespace in arguments, and a backslash escapes the next character outside of single quotes.
+// When a quote is not terminated, returns an error.
+func SplitArgs(input string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool // is there a current argument, possibly empty?
+		quote   rune // the current quote character, or 0
+		escaped bool // was the last character an unquoted backslash?
+	)
+
+	for _, r := range input {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == '\'':
+			current.WriteRune(r)
+		case r == '\\':
+			escaped, inArg = true, true
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.Errorf("Unterminated %c quote", quote)
+	}
+	if escaped {
+		current.WriteRune('\\')
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
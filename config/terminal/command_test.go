@@ -0,0 +1,141 @@
+package terminal
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"  ", nil, false},
+		{"close 1", []string{"close", "1"}, false},
+		{"  close   1  ", []string{"close", "1"}, false},
+		{`echo "hello world"`, []string{"echo", "hello world"}, false},
+		{`echo 'hello "world"'`, []string{"echo", `hello "world"`}, false},
+		{`echo "" ''`, []string{"echo", "", ""}, false},
+		{`echo hello\ world`, []string{"echo", "hello world"}, false},
+		{`echo 'a\b'`, []string{"echo", `a\b`}, false},
+		{`echo a"b c"d`, []string{"echo", "ab cd"}, false},
+		{`echo "hello`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := SplitArgs(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SplitArgs() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestCommands creates a new set of commands for testing
+func newTestCommands() *Commands {
+	commands := NewCommands()
+	commands.Register(Command{
+		Name:        "close",
+		Usage:       "<id>",
+		Description: "Close a tunnel",
+		MinArgs:     1,
+		MaxArgs:     1,
+		Run: func(session *CommandSession, args []string) error {
+			session.Values["closed"] = args[0]
+			return nil
+		},
+		Complete: func(session *CommandSession, args []string) []string {
+			return []string{"tunnel-1", "tunnel-2", "other"}
+		},
+	})
+	commands.Register(Command{Name: "clear", MaxArgs: -1, Run: func(session *CommandSession, args []string) error { return nil }})
+	return commands
+}
+
+func TestCommands_Register(t *testing.T) {
+	commands := newTestCommands()
+	if err := commands.Register(Command{Name: "close"}); err != ErrCommandAlreadySet {
+		t.Errorf("Register() = %v, want %v", err, ErrCommandAlreadySet)
+	}
+	if got, want := commands.Names(), []string{"clear", "close", "exit", "help"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+}
+
+func TestCommandSession_Loop(t *testing.T) {
+	session := newTestCommands().NewSession(nil)
+
+	tests := []struct {
+		input    string
+		wantOut  string
+		wantExit bool
+		wantCode int
+	}{
+		{"", "", false, 0},
+		{"unknown", "Unknown command \"unknown\", type 'help' for a list of commands\n", false, 0},
+		{"close", "Usage: close <id>\n", false, 0},
+		{"close 1 2", "Usage: close <id>\n", false, 0},
+		{"close 1", "", false, 0},
+		{"help close", "close <id>               Close a tunnel\n", false, 0},
+		{"exit nope", "Invalid exit code \"nope\"\n", false, 0},
+		{"exit 3", "", true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var out bytes.Buffer
+			exit, code := session.Loop(context.Background(), &out, tt.input)
+			if out.String() != tt.wantOut {
+				t.Errorf("Loop() output = %q, want %q", out.String(), tt.wantOut)
+			}
+			if exit != tt.wantExit || code != tt.wantCode {
+				t.Errorf("Loop() = (%v, %d), want (%v, %d)", exit, code, tt.wantExit, tt.wantCode)
+			}
+		})
+	}
+
+	if got := session.Values["closed"]; got != "1" {
+		t.Errorf("Values[closed] = %v, want %q", got, "1")
+	}
+}
+
+func TestCommandSession_AutoComplete(t *testing.T) {
+	session := newTestCommands().NewSession(nil)
+
+	tests := []struct {
+		line    string
+		pos     int
+		want    string
+		wantPos int
+	}{
+		{"", 0, "", 0},
+		{"h", 1, "help ", 5},
+		{"cl", 2, "cl", 2},
+		{"clo", 3, "close ", 6},
+		{"close ", 6, "close ", 6},
+		{"close t", 7, "close tunnel-", 13},
+		{"close tunnel-2", 14, "close tunnel-2 ", 15},
+		{"close o and more", 7, "close other  and more", 12},
+		{"exit ", 5, "exit ", 5},
+		{"help c", 6, "help cl", 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, gotPos, ok := session.AutoComplete(tt.line, tt.pos, '\t')
+			if !ok || got != tt.want || gotPos != tt.wantPos {
+				t.Errorf("AutoComplete() = (%q, %d, %v), want (%q, %d, true)", got, gotPos, ok, tt.want, tt.wantPos)
+			}
+		})
+	}
+
+	if _, _, ok := session.AutoComplete("clo", 3, 'x'); ok {
+		t.Error("AutoComplete() handled a key other than tab")
+	}
+}
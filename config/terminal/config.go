@@ -1,39 +1,163 @@
-// Package terminal provides REPLConfig.
+// Package terminal provides REPLConfig and AppConfig.
 package terminal
 
 import (
 	"context"
 	"flag"
 	"io"
+	"sync"
+	"text/template"
 
 	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
 	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/logging"
 )
 
 // REPLConfig implements a configuration that does not provide any shell access.
 type REPLConfig struct {
+	// WelcomeMessage is shown when a session starts.
+	// It is a message template, see feature.ParseMessage.
 	WelcomeMessage string
 	Prompt         string
 	Loop           func(ctx context.Context, term io.Writer, input string) (exit bool, code int)
+
+	// Commands, when not nil, are the commands available in the REPL.
+	// They replace Loop, and additionally provide tab completion.
+	Commands *Commands
+
+	// HistoryDir, when not empty, is a directory to store the history of each user in.
+	// The history is keyed by the public key a session authenticated with, see OpenHistory.
+	// It requires authentication: Apply fails when no authentication handler has been configured,
+	// and sessions that did not authenticate using a public key are rejected.
+	HistoryDir string
+
+	// SFTP enables the sftp subsystem.
+	// It serves each user a virtual filesystem that is kept in memory, and shared between all sessions of that user.
+	// It requires authentication: Apply fails when no authentication handler has been configured.
+	//
+	// SFTPQuota is the maximum number of bytes of the filesystem of each user, see NewInMemHandlers.
+	// When zero, DefaultSFTPQuota is used.
+	SFTP      bool
+	SFTPQuota int64
+
+	welcome *template.Template // parsed WelcomeMessage, set by Apply
+
+	sftpMutex sync.Mutex
+	sftpFS    map[string]sftp.Handlers // filesystems of each user, created on demand
 }
 
+// DefaultSFTPQuota is the default value for REPLConfig.SFTPQuota
+const DefaultSFTPQuota = 16 * 1024 * 1024
+
+// ErrHistoryUnauthenticated is returned when REPLConfig.HistoryDir is set, but authentication is disabled
+var ErrHistoryUnauthenticated = errors.New("REPLConfig: HistoryDir requires public key authentication")
+
+// ErrSFTPUnauthenticated is returned by REPLConfig.Apply when SFTP is set, but authentication is disabled
+var ErrSFTPUnauthenticated = errors.New("REPLConfig: SFTP requires authentication")
+
 // Apply applies this configuration to a server.
-// This is a no-op.
+// It parses the WelcomeMessage, and when SFTP is set, it sets up the sftp subsystem.
+//
+// When HistoryDir or SFTP are set, authentication must have been configured before Apply is called.
 func (r *REPLConfig) Apply(logger logging.Logger, sshserver *ssh.Server) error {
-	return nil
+	if r.HistoryDir != "" && sshserver.PublicKeyHandler == nil {
+		return ErrHistoryUnauthenticated
+	}
+	if r.SFTP && sshserver.PublicKeyHandler == nil && sshserver.PasswordHandler == nil && sshserver.KeyboardInteractiveHandler == nil {
+		return ErrSFTPUnauthenticated
+	}
+
+	welcome, err := feature.ParseMessage("welcome", r.WelcomeMessage)
+	if err != nil {
+		return err
+	}
+	r.welcome = welcome
+
+	if !r.SFTP {
+		return nil
+	}
+
+	return proxyssh.ApplySubsystem(logger, sshserver, "sftp", proxyssh.HandlerFunc(r.handleSFTP))
+}
+
+// handleSFTP handles a session requesting the sftp subsystem.
+// It serves the filesystem of the user of the session, and creates it if needed.
+func (r *REPLConfig) handleSFTP(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
+	r.sftpMutex.Lock()
+	defer r.sftpMutex.Unlock()
+
+	handlers, ok := r.sftpFS[session.User()]
+	if !ok {
+		quota := r.SFTPQuota
+		if quota == 0 {
+			quota = DefaultSFTPQuota
+		}
+
+		if r.sftpFS == nil {
+			r.sftpFS = make(map[string]sftp.Handlers)
+		}
+		handlers = NewInMemHandlers(quota)
+		r.sftpFS[session.User()] = handlers
+	}
+
+	return &SFTPProcess{Handlers: handlers}, nil
+}
+
+// Backend implements proxyssh.BackendHandler
+func (r *REPLConfig) Backend() string {
+	return "terminal"
 }
 
 // Handle handles
 func (r *REPLConfig) Handle(logger logging.Logger, session ssh.Session) (proxyssh.Process, error) {
-	return &REPLProcess{
-		WelcomeMessage: r.WelcomeMessage,
+	welcome := r.WelcomeMessage
+	if r.welcome != nil {
+		var err error
+		welcome, err = feature.RenderMessage(r.welcome, session.Context())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	process := &REPLProcess{
+		WelcomeMessage: welcome,
 		Prompt:         r.Prompt,
 		Loop:           r.Loop,
-	}, nil
+		Env:            feature.Environ(session),
+	}
+
+	if r.Commands != nil {
+		cs := r.Commands.NewSession(session)
+		process.Loop = cs.Loop
+		process.AutoComplete = cs.AutoComplete
+	}
+
+	if r.HistoryDir != "" {
+		key := session.PublicKey()
+		if key == nil {
+			return nil, ErrHistoryUnauthenticated
+		}
+
+		history, err := OpenHistory(r.HistoryDir, session.User(), key)
+		if err != nil {
+			return nil, err
+		}
+		process.History = history
+	}
+
+	return process, nil
 }
 
 // RegisterFlags registers flags representing the config to the provided flagset.
 // When flagset is nil, uses flag.CommandLine.
 func (r *REPLConfig) RegisterFlags(flagset *flag.FlagSet) {
+	if flagset == nil {
+		flagset = flag.CommandLine
+	}
+
+	flagset.BoolVar(&r.SFTP, "sftp", r.SFTP, "Enable the sftp subsystem serving an in-memory filesystem to each user")
+	flagset.Int64Var(&r.SFTPQuota, "sftp-quota", r.SFTPQuota, "Maximum size of the in-memory filesystem of each user in bytes")
 }
@@ -0,0 +1,186 @@
+package terminal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// HistorySize is the maximal number of lines kept in a History.
+// HistoryLineLength is the maximal length of a line in a History, longer lines are not stored.
+const (
+	HistorySize       = 1000
+	HistoryLineLength = 1024
+)
+
+// History is the persistent history of input lines of a single user.
+// It is stored in a file, and shared between all sessions of the user.
+type History struct {
+	m         sync.Mutex
+	path      string
+	lines     []string
+	fileLines int // number of lines in the underlying file
+}
+
+// OpenHistory opens the history of user authenticated using key stored inside of dir.
+// The directory is created if it does not exist.
+//
+// The history is stored in a file named after both the user and the fingerprint of key.
+// This ensures that only clients holding the key can access the history.
+func OpenHistory(dir, user string, key ssh.PublicKey) (*History, error) {
+	if key == nil {
+		return nil, errors.New("Unable to open history without a public key")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "Unable to create history directory")
+	}
+
+	fingerprint := sha256.Sum256(key.Marshal())
+	name := url.PathEscape(user) + "." + base64.RawURLEncoding.EncodeToString(fingerprint[:]) + ".history"
+	history := &History{path: filepath.Join(dir, name)}
+
+	file, err := os.Open(history.path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open history")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		history.lines = append(history.lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Unable to read history")
+	}
+	history.fileLines = len(history.lines)
+
+	// the file grows with every line, so truncate it once it is too big
+	if history.fileLines > 2*HistorySize {
+		history.lines = history.lines[len(history.lines)-HistorySize:]
+		if err := history.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+	if len(history.lines) > HistorySize {
+		history.lines = history.lines[len(history.lines)-HistorySize:]
+	}
+
+	return history, nil
+}
+
+// Lines returns the lines in this history, oldest first.
+func (h *History) Lines() []string {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	return append([]string(nil), h.lines...)
+}
+
+// Add adds line to this history and appends it to the underlying file.
+// Empty lines, lines containing control characters, and lines longer than HistoryLineLength are ignored.
+//
+// The underlying file holds at most twice HistorySize lines, and is rewritten once it would exceed them.
+func (h *History) Add(line string) error {
+	if !isHistoryLine(line) {
+		return nil
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.lines = append(h.lines, line)
+	if len(h.lines) > HistorySize {
+		h.lines = h.lines[len(h.lines)-HistorySize:]
+	}
+
+	if h.fileLines >= 2*HistorySize {
+		return h.rewrite()
+	}
+	h.fileLines++
+
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Unable to open history")
+	}
+	defer file.Close()
+
+	_, err = io.WriteString(file, line+"\n")
+	return err
+}
+
+// rewrite replaces the underlying file with the lines of this history
+func (h *History) rewrite() error {
+	temp := h.path + ".tmp"
+	if err := os.WriteFile(temp, []byte(strings.Join(h.lines, "\n")+"\n"), 0600); err != nil {
+		return errors.Wrap(err, "Unable to write history")
+	}
+	if err := os.Rename(temp, h.path); err != nil {
+		return errors.Wrap(err, "Unable to write history")
+	}
+	h.fileLines = len(h.lines)
+	return nil
+}
+
+// isHistoryLine checks if line can be stored in a history
+func isHistoryLine(line string) bool {
+	if strings.TrimSpace(line) == "" || len(line) > HistoryLineLength {
+		return false
+	}
+	return strings.IndexFunc(line, unicode.IsControl) == -1
+}
+
+// newHistoryTerminal creates a new terminal on rw, and replays lines into its history.
+//
+// The terminal package does not allow to modify the history directly.
+// Instead, the lines are read from the terminal as if the user had typed them, with all output discarded.
+func newHistoryTerminal(rw io.ReadWriter, prompt string, lines []string) *terminal.Terminal {
+	replay := &replayReadWriter{ReadWriter: rw}
+	term := terminal.NewTerminal(replay, "")
+
+	for _, line := range lines {
+		if !isHistoryLine(line) {
+			continue
+		}
+		replay.input = strings.NewReader(line + "\r")
+		term.ReadLine()
+	}
+
+	replay.input = nil
+	term.SetPrompt(prompt)
+	return term
+}
+
+// replayReadWriter is an io.ReadWriter that replays input and discards all output.
+// Once input is nil, it reads from and writes to the underlying io.ReadWriter.
+type replayReadWriter struct {
+	io.ReadWriter
+	input *strings.Reader
+}
+
+func (r *replayReadWriter) Read(p []byte) (int, error) {
+	if r.input != nil {
+		return r.input.Read(p)
+	}
+	return r.ReadWriter.Read(p)
+}
+
+func (r *replayReadWriter) Write(p []byte) (int, error) {
+	if r.input != nil {
+		return len(p), nil
+	}
+	return r.ReadWriter.Write(p)
+}
@@ -0,0 +1,167 @@
+package terminal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	_, key := testutils.GenerateRSATestKeyPair()
+
+	history, err := OpenHistory(dir, "alice/..", key)
+	if err != nil {
+		t.Fatalf("OpenHistory() error = %v", err)
+	}
+	for _, line := range []string{"first", "", "  ", "bad\x1b[A", strings.Repeat("x", HistoryLineLength+1), "second"} {
+		if err := history.Add(line); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	// the history is stored inside of the directory
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.history"))
+	if len(matches) != 1 {
+		t.Fatalf("got %d history files, want 1", len(matches))
+	}
+
+	reopened, err := OpenHistory(dir, "alice/..", key)
+	if err != nil {
+		t.Fatalf("OpenHistory() error = %v", err)
+	}
+	if got, want := reopened.Lines(), []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines() = %q, want %q", got, want)
+	}
+
+	// a different key has a different history
+	_, other := testutils.GenerateRSATestKeyPair()
+	otherHistory, err := OpenHistory(dir, "alice/..", other)
+	if err != nil {
+		t.Fatalf("OpenHistory() error = %v", err)
+	}
+	if got := otherHistory.Lines(); len(got) != 0 {
+		t.Errorf("Lines() of other key = %q, want no lines", got)
+	}
+
+	// no key has no history
+	if _, err := OpenHistory(dir, "alice/..", nil); err == nil {
+		t.Error("OpenHistory() without key did not return an error")
+	}
+}
+
+func TestHistory_truncate(t *testing.T) {
+	dir := t.TempDir()
+	_, key := testutils.GenerateRSATestKeyPair()
+
+	empty, err := OpenHistory(dir, "bob", key)
+	if err != nil {
+		t.Fatalf("OpenHistory() error = %v", err)
+	}
+	path := empty.path
+
+	lines := make([]string, 2*HistorySize+1)
+	for i := range lines {
+		lines[i] = strconv.Itoa(i)
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := OpenHistory(dir, "bob", key)
+	if err != nil {
+		t.Fatalf("OpenHistory() error = %v", err)
+	}
+	if got := history.Lines(); !reflect.DeepEqual(got, lines[HistorySize+1:]) {
+		t.Errorf("Lines() has %d lines, want the last %d", len(got), HistorySize)
+	}
+
+	data, _ := os.ReadFile(path)
+	if got := strings.Count(string(data), "\n"); got != HistorySize {
+		t.Errorf("history file has %d lines, want %d", got, HistorySize)
+	}
+}
+
+func TestHistory_Add_truncate(t *testing.T) {
+	dir := t.TempDir()
+	_, key := testutils.GenerateRSATestKeyPair()
+
+	history, err := OpenHistory(dir, "carol", key)
+	if err != nil {
+		t.Fatalf("OpenHistory() error = %v", err)
+	}
+
+	// adding lines never grows the file beyond twice the history size
+	for i := 0; i < 3*HistorySize; i++ {
+		if err := history.Add(strconv.Itoa(i)); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	data, _ := os.ReadFile(history.path)
+	if got := strings.Count(string(data), "\n"); got > 2*HistorySize {
+		t.Errorf("history file has %d lines, want at most %d", got, 2*HistorySize)
+	}
+	if got := history.Lines(); len(got) != HistorySize || got[len(got)-1] != strconv.Itoa(3*HistorySize-1) {
+		t.Errorf("Lines() has %d lines, want the last %d", len(got), HistorySize)
+	}
+}
+
+// testReadWriter is an io.ReadWriter that reads from a fixed input and records output
+type testReadWriter struct {
+	io.Reader
+	strings.Builder
+}
+
+func TestNewHistoryTerminal(t *testing.T) {
+	// press 'up' twice and then 'enter'
+	rw := &testReadWriter{Reader: strings.NewReader("\x1b[A\x1b[A\r")}
+
+	term := newHistoryTerminal(rw, "> ", []string{"first", "second"})
+	line, err := term.ReadLine()
+	if err != nil {
+		t.Fatalf("ReadLine() error = %v", err)
+	}
+	if line != "first" {
+		t.Errorf("ReadLine() = %q, want %q", line, "first")
+	}
+
+	// replaying the history should not have produced any output
+	if output := rw.String(); !strings.HasPrefix(output, "> second") {
+		t.Errorf("output = %q, want prefix %q", output, "> second")
+	}
+}
+
+func TestREPLConfig_Apply_history(t *testing.T) {
+	config := &REPLConfig{HistoryDir: t.TempDir()}
+
+	if err := config.Apply(integrationtest.GetLogger(), &ssh.Server{}); err != ErrHistoryUnauthenticated {
+		t.Errorf("Apply() without authentication got err = %v, want %v", err, ErrHistoryUnauthenticated)
+	}
+
+	server := &ssh.Server{PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool { return true }}
+	if err := config.Apply(integrationtest.GetLogger(), server); err != nil {
+		t.Errorf("Apply() with authentication got err = %v, want nil", err)
+	}
+}
+
+func TestREPLConfig_Apply_sftp(t *testing.T) {
+	config := &REPLConfig{SFTP: true}
+
+	if err := config.Apply(integrationtest.GetLogger(), &ssh.Server{}); err != ErrSFTPUnauthenticated {
+		t.Errorf("Apply() without authentication got err = %v, want %v", err, ErrSFTPUnauthenticated)
+	}
+
+	server := &ssh.Server{PasswordHandler: func(ctx ssh.Context, password string) bool { return true }}
+	if err := config.Apply(integrationtest.GetLogger(), server); err != nil {
+		t.Errorf("Apply() with authentication got err = %v, want nil", err)
+	}
+}
@@ -0,0 +1,249 @@
+package terminal
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+// ErrSFTPQuotaExceeded is returned by the handlers of NewInMemHandlers when an operation would exceed the quota.
+var ErrSFTPQuotaExceeded = errors.New("SFTP: Quota exceeded")
+
+var errSFTPPathTooLong = errors.New("SFTP: Path too long")
+var errSFTPLinkUnsupported = errors.New("SFTP: Hard links are not supported")
+
+const (
+	inMemEntrySize = 4096 // number of bytes each file, directory and symbolic link counts towards the quota
+	inMemMaxPath   = 1024 // maximal length of paths and symbolic link targets
+)
+
+// NewInMemHandlers returns handlers serving a new and empty virtual filesystem that is kept in memory.
+//
+// The total size of all files is limited to quota bytes.
+// Each file, directory and symbolic link additionally counts as 4096 bytes.
+// Hard links are not supported.
+func NewInMemHandlers(quota int64) sftp.Handlers {
+	fs := &inMemFS{
+		handlers: sftp.InMemHandler(),
+		quota:    quota,
+		entries:  make(map[inMemEntry]struct{}),
+	}
+	return sftp.Handlers{
+		FileGet:  fs.handlers.FileGet,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs.handlers.FileList,
+	}
+}
+
+// inMemFS enforces a quota on top of the in-memory handlers of the sftp package.
+//
+// All operations that create, remove or grow entries go through inMemFS, and hold mu.
+type inMemFS struct {
+	handlers sftp.Handlers
+	quota    int64
+
+	mu      sync.Mutex
+	entries map[inMemEntry]struct{} // all entries that count towards the quota
+}
+
+// inMemEntry is a file, directory or symbolic link of the in-memory handlers
+type inMemEntry interface {
+	os.FileInfo
+	io.WriterAt
+}
+
+// used returns the number of bytes counting towards the quota.
+// fs.mu must be held.
+func (fs *inMemFS) used() (used int64) {
+	for entry := range fs.entries {
+		used += entry.Size() + inMemEntrySize
+	}
+	return used
+}
+
+// reserve checks that grow additional bytes fit into the quota.
+// fs.mu must be held.
+func (fs *inMemFS) reserve(grow int64) error {
+	if grow > 0 && fs.used()+grow > fs.quota {
+		return ErrSFTPQuotaExceeded
+	}
+	return nil
+}
+
+// lstat returns the entry at path, without following symbolic links.
+// When path does not exist, returns nil.
+func (fs *inMemFS) lstat(path string) inMemEntry {
+	lister, err := fs.handlers.FileList.(sftp.LstatFileLister).Lstat(sftp.NewRequest("Lstat", path))
+	if err != nil {
+		return nil
+	}
+
+	infos := make([]os.FileInfo, 1)
+	if n, _ := lister.ListAt(infos, 0); n != 1 {
+		return nil
+	}
+	entry, _ := infos[0].(inMemEntry)
+	return entry
+}
+
+// stat is like lstat, but follows symbolic links.
+func (fs *inMemFS) stat(path string) inMemEntry {
+	lister, err := fs.handlers.FileList.Filelist(sftp.NewRequest("Stat", path))
+	if err != nil {
+		return nil
+	}
+
+	infos := make([]os.FileInfo, 1)
+	if n, _ := lister.ListAt(infos, 0); n != 1 {
+		return nil
+	}
+	entry, _ := infos[0].(inMemEntry)
+	return entry
+}
+
+// checkPaths checks that the paths of r are not too long
+func checkPaths(r *sftp.Request) error {
+	if len(r.Filepath) > inMemMaxPath || len(r.Target) > inMemMaxPath {
+		return errSFTPPathTooLong
+	}
+	return nil
+}
+
+// create calls open to open the file at path, and tracks it as an entry.
+// If the file does not yet exist, it has to fit into the quota.
+// fs.mu must be held.
+func (fs *inMemFS) create(r *sftp.Request, open func(r *sftp.Request) (io.WriterAt, error)) (*inMemWriter, error) {
+	if err := checkPaths(r); err != nil {
+		return nil, err
+	}
+	if fs.stat(r.Filepath) == nil {
+		if err := fs.reserve(inMemEntrySize); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := open(r)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := file.(inMemEntry)
+	if !ok {
+		return nil, errors.New("SFTP: Unknown file type")
+	}
+	fs.entries[entry] = struct{}{}
+
+	return &inMemWriter{fs: fs, entry: entry}, nil
+}
+
+// Filewrite implements sftp.FileWriter
+func (fs *inMemFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.create(r, fs.handlers.FilePut.Filewrite)
+}
+
+// OpenFile implements sftp.OpenFileWriter
+func (fs *inMemFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	writer, err := fs.create(r, func(r *sftp.Request) (io.WriterAt, error) {
+		return fs.handlers.FilePut.(sftp.OpenFileWriter).OpenFile(r)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		io.ReaderAt
+		io.WriterAt
+	}{writer.entry.(io.ReaderAt), writer}, nil
+}
+
+// Filecmd implements sftp.FileCmder
+func (fs *inMemFS) Filecmd(r *sftp.Request) error {
+	if err := checkPaths(r); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch r.Method {
+	case "Link":
+		// a hard link could keep an entry alive after it stopped being tracked
+		return errSFTPLinkUnsupported
+
+	case "Setstat":
+		if r.AttrFlags().Size {
+			entry := fs.stat(r.Filepath)
+			if entry == nil {
+				return os.ErrNotExist
+			}
+			if err := fs.reserve(int64(r.Attributes().Size) - entry.Size()); err != nil {
+				return err
+			}
+		}
+		return fs.handlers.FileCmd.Filecmd(r)
+
+	case "Mkdir", "Symlink":
+		if err := fs.reserve(inMemEntrySize); err != nil {
+			return err
+		}
+		if err := fs.handlers.FileCmd.Filecmd(r); err != nil {
+			return err
+		}
+
+		path := r.Filepath
+		if r.Method == "Symlink" {
+			path = r.Target
+		}
+		if entry := fs.lstat(path); entry != nil {
+			fs.entries[entry] = struct{}{}
+		}
+		return nil
+
+	case "Remove", "Rmdir", "Rename":
+		// find the entry that is going away
+		path := r.Filepath
+		if r.Method == "Rename" {
+			path = r.Target
+		}
+		entry := fs.lstat(path)
+
+		if err := fs.handlers.FileCmd.Filecmd(r); err != nil {
+			return err
+		}
+
+		// renaming onto itself keeps the entry
+		if entry != nil && fs.lstat(path) != entry {
+			delete(fs.entries, entry)
+		}
+		return nil
+	}
+
+	return fs.handlers.FileCmd.Filecmd(r)
+}
+
+// inMemWriter checks the quota before writing to an entry
+type inMemWriter struct {
+	fs    *inMemFS
+	entry inMemEntry
+}
+
+// WriteAt implements io.WriterAt
+func (w *inMemWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+
+	if err := w.fs.reserve(off + int64(len(p)) - w.entry.Size()); err != nil {
+		return 0, err
+	}
+	return w.entry.WriteAt(p, off)
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/tkw1536/proxyssh"
 	"github.com/tkw1536/proxyssh/internal/term"
 	"github.com/tkw1536/proxyssh/logging"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
 // REPLProcess represents a process that is run using a the shell on the current machine
@@ -20,6 +19,18 @@ type REPLProcess struct {
 	Prompt         string
 	Loop           func(ctx context.Context, w io.Writer, read string) (exit bool, code int)
 
+	// AutoComplete, when not nil, is called for every key pressed in a pty.
+	// See terminal.Terminal.AutoCompleteCallback for details.
+	AutoComplete func(line string, pos int, key rune) (newLine string, newPos int, ok bool)
+
+	// History, when not nil, records all input lines.
+	// In a pty, the lines in it can be recalled using the arrow keys.
+	History *History
+
+	// Env are the environment variables of this process.
+	// They can be retrieved from within Loop using Environ.
+	Env []string
+
 	term.Pipes
 	terminal *term.Pair
 
@@ -76,8 +87,32 @@ func (repl *REPLProcess) String() string {
 	return "REPLProcess"
 }
 
+// addHistory adds line to the history, if any.
+// Errors are ignored, as they should not interrupt the session.
+func (repl *REPLProcess) addHistory(line string) {
+	if repl.History != nil {
+		repl.History.Add(line)
+	}
+}
+
 var errNotATTY = errors.New("tty was not allocated")
 
+// environContextKey is the context key used to store the environment
+type environContextKey struct{}
+
+// Environ returns the environment variables of the REPLProcess or AppProcess that passed ctx to Loop or App.
+func Environ(ctx context.Context) []string {
+	env, _ := ctx.Value(environContextKey{}).([]string)
+	return env
+}
+
+// newWorkerContext creates a new context for the terminal loop and stores the cancel function.
+func (repl *REPLProcess) newWorkerContext() (ctx context.Context) {
+	ctx = context.WithValue(context.Background(), environContextKey{}, repl.Env)
+	ctx, repl.workerContextCancel = context.WithCancel(ctx)
+	return
+}
+
 // Start starts this process
 func (repl *REPLProcess) Start(detector logging.MemoryLeakDetector, Term string, resizeChan <-chan proxyssh.WindowSize, isPty bool) (*os.File, error) {
 	if !isPty {
@@ -89,8 +124,7 @@ func (repl *REPLProcess) Start(detector logging.MemoryLeakDetector, Term string,
 func (repl *REPLProcess) startPipes(detector logging.MemoryLeakDetector) error {
 
 	// make a context for the terminal loop
-	var ctx context.Context
-	ctx, repl.workerContextCancel = context.WithCancel(context.Background())
+	ctx := repl.newWorkerContext()
 
 	detector.Add("terminal: pipes loop")
 	go repl.runLoopPipes(ctx, detector)
@@ -136,6 +170,7 @@ func (repl *REPLProcess) runLoopPipes(ctx context.Context, detector logging.Memo
 		}
 
 		// do the loop code
+		repl.addHistory(line)
 		exit, code := repl.Loop(ctx, repl.StdoutPipe, line)
 		if exit {
 			repl.exitCode = code
@@ -161,8 +196,7 @@ func (repl *REPLProcess) startPty(detector logging.MemoryLeakDetector, Term stri
 	repl.terminal.Handle(resizeChan)
 
 	// make a context for the terminal loop
-	var ctx context.Context
-	ctx, repl.workerContextCancel = context.WithCancel(context.Background())
+	ctx := repl.newWorkerContext()
 
 	detector.Add("terminal: pty loop")
 	go repl.runLoopPty(ctx, detector)
@@ -185,7 +219,12 @@ func (repl *REPLProcess) runLoopPty(ctx context.Context, detector logging.Memory
 	}
 
 	// create a new terminal and write the welcome message to the terminal.
-	term := terminal.NewTerminal(repl.terminal.Internal(), repl.Prompt)
+	var history []string
+	if repl.History != nil {
+		history = repl.History.Lines()
+	}
+	term := newHistoryTerminal(repl.terminal.Internal(), repl.Prompt, history)
+	term.AutoCompleteCallback = repl.AutoComplete
 	io.WriteString(term, repl.WelcomeMessage+"\n")
 
 	// Keep reading input and running the REPL loop
@@ -215,6 +254,7 @@ func (repl *REPLProcess) runLoopPty(ctx context.Context, detector logging.Memory
 		}
 
 		// do the loop code
+		repl.addHistory(input)
 		exit, code := repl.Loop(ctx, term, input)
 		if exit {
 			repl.exitCode = code
@@ -0,0 +1,86 @@
+package terminal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/pkg/sftp"
+	"github.com/tkw1536/proxyssh"
+	"github.com/tkw1536/proxyssh/internal/term"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// SFTPProcess represents a process that serves the sftp protocol using Handlers.
+type SFTPProcess struct {
+	Handlers sftp.Handlers
+
+	term.Pipes
+
+	ctx      context.Context
+	server   *sftp.RequestServer
+	exitCode int
+	done     chan struct{} // close()d when the server exits
+}
+
+// Init initializes this process.
+func (sp *SFTPProcess) Init(ctx context.Context, detector logging.MemoryLeakDetector, isPty bool) error {
+	if isPty {
+		return errNotAPipe
+	}
+
+	sp.ctx = ctx
+	sp.done = make(chan struct{})
+	return nil
+}
+
+var errNotAPipe = errors.New("sftp does not support a tty")
+
+// Start starts this process
+func (sp *SFTPProcess) Start(detector logging.MemoryLeakDetector, Term string, resizeChan <-chan proxyssh.WindowSize, isPty bool) (*os.File, error) {
+	sp.server = sftp.NewRequestServer(sftpPipes{sp.StdinPipe, sp.StdoutPipe}, sp.Handlers)
+
+	detector.Add("terminal: sftp")
+	go func() {
+		defer detector.Done("terminal: sftp")
+		defer close(sp.done)
+
+		if err := sp.server.Serve(); err != nil && err != io.EOF {
+			io.WriteString(sp.StderrPipe, err.Error()+"\n")
+			sp.exitCode = 1
+		}
+		sp.DrainOutput(sp.ctx)
+	}()
+
+	return nil, nil
+}
+
+// sftpPipes combines the input and output pipes into an io.ReadWriteCloser
+type sftpPipes struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// Wait waits for the process and returns the exit code.
+func (sp *SFTPProcess) Wait(detector logging.MemoryLeakDetector) (code int, err error) {
+	detector.Add("terminal: sftp Wait")
+	defer detector.Done("terminal: sftp Wait")
+
+	<-sp.done
+	return sp.exitCode, nil
+}
+
+// Cleanup cleans up this process
+func (sp *SFTPProcess) Cleanup() (killed bool) {
+	if sp.server != nil {
+		sp.server.Close()
+	}
+	sp.ClosePipes()
+	return true
+}
+
+// String turns SFTPProcess into a string
+func (sp *SFTPProcess) String() string {
+	return "SFTPProcess"
+}
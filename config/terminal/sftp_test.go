@@ -0,0 +1,131 @@
+package terminal
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	"github.com/tkw1536/proxyssh/internal/integrationtest"
+	"github.com/tkw1536/proxyssh/internal/testutils"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// passwordConfig is a configuration that accepts a single password for every user
+type passwordConfig string
+
+func (pc passwordConfig) Apply(logger logging.Logger, server *ssh.Server) error {
+	server.PasswordHandler = func(ctx ssh.Context, password string) bool {
+		return password == string(pc)
+	}
+	return nil
+}
+
+// newSFTPTestClient starts an sftp session as user
+func newSFTPTestClient(t *testing.T, addr, user string) *sftp.Client {
+	t.Helper()
+
+	client, sftpClient, err := testutils.NewTestSFTPClient(addr, gossh.ClientConfig{
+		User: user,
+		Auth: []gossh.AuthMethod{gossh.Password("secret")},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create sftp client: %s", err)
+	}
+	t.Cleanup(func() {
+		sftpClient.Close()
+		client.Close()
+	})
+	return sftpClient
+}
+
+// writeSFTPFile writes content to the file at path
+func writeSFTPFile(client *sftp.Client, path, content string) error {
+	f, err := client.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func TestSFTP(t *testing.T) {
+	testServer, _, cleanup := integrationtest.NewServer(nil, passwordConfig("secret"), &REPLConfig{SFTP: true})
+	defer cleanup()
+
+	// write a file in one session
+	if err := writeSFTPFile(newSFTPTestClient(t, testServer.Addr, "user"), "/hello.txt", "Hello world"); err != nil {
+		t.Fatalf("writeSFTPFile() got err = %s", err)
+	}
+
+	// and read it in the next one
+	f, err := newSFTPTestClient(t, testServer.Addr, "user").Open("/hello.txt")
+	if err != nil {
+		t.Fatalf("Open() got err = %s", err)
+	}
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	if err != nil || string(got) != "Hello world" {
+		t.Errorf("ReadAll() got = %q, err = %v, want = %q", got, err, "Hello world")
+	}
+
+	t.Run("other users do not see the file", func(t *testing.T) {
+		if _, err := newSFTPTestClient(t, testServer.Addr, "other").Stat("/hello.txt"); err == nil {
+			t.Errorf("Stat() got err = nil, want an error")
+		}
+	})
+}
+
+func TestSFTP_quota(t *testing.T) {
+	quota := int64(4*inMemEntrySize + 100)
+
+	testServer, _, cleanup := integrationtest.NewServer(nil, passwordConfig("secret"), &REPLConfig{SFTP: true, SFTPQuota: quota})
+	defer cleanup()
+
+	client := newSFTPTestClient(t, testServer.Addr, "user")
+
+	// fill up the quota
+	if err := writeSFTPFile(client, "/full.txt", strings.Repeat("x", 100)); err != nil {
+		t.Fatalf("writeSFTPFile() within quota got err = %s", err)
+	}
+	if err := client.Mkdir("/dir"); err != nil {
+		t.Fatalf("Mkdir() within quota got err = %s", err)
+	}
+	if err := client.Symlink("/full.txt", "/link"); err != nil {
+		t.Fatalf("Symlink() within quota got err = %s", err)
+	}
+	if err := writeSFTPFile(client, "/empty.txt", ""); err != nil {
+		t.Fatalf("writeSFTPFile() within quota got err = %s", err)
+	}
+
+	// writing or creating anything should now fail
+	if err := client.Truncate("/empty.txt", 1); err == nil {
+		t.Error("Truncate() exceeding quota got err = nil")
+	}
+	if err := client.Mkdir("/dir2"); err == nil {
+		t.Error("Mkdir() exceeding quota got err = nil")
+	}
+	if err := writeSFTPFile(client, "/new.txt", ""); err == nil {
+		t.Error("writeSFTPFile() exceeding quota got err = nil")
+	}
+	if err := client.Link("/full.txt", "/hardlink"); err == nil {
+		t.Error("Link() got err = nil")
+	}
+	if err := writeSFTPFile(client, "/full.txt", strings.Repeat("x", 101)); err == nil {
+		t.Error("writeSFTPFile() exceeding quota got err = nil")
+	}
+
+	// removing a file frees up space again
+	if err := client.Remove("/full.txt"); err != nil {
+		t.Fatalf("Remove() got err = %s", err)
+	}
+	if err := writeSFTPFile(client, "/new.txt", strings.Repeat("x", 100)); err != nil {
+		t.Errorf("writeSFTPFile() after Remove() got err = %s", err)
+	}
+}
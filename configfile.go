@@ -0,0 +1,160 @@
+package proxyssh
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ParseFlags parses command line flags from arguments into flagset, and then applies a configuration file if requested.
+// When flagset is nil, uses flag.CommandLine.
+//
+// Before parsing, this function registers an additional '-config' flag with flagset.
+// When the flag is given, the configuration file it points to is applied using ApplyConfigFile.
+//
+// Errors in the configuration file are handled according to the error handling of flagset, like errors on the command line.
+// In particular, when using flag.CommandLine, they are printed and the program exits.
+func ParseFlags(flagset *flag.FlagSet, arguments []string) error {
+	if flagset == nil {
+		flagset = flag.CommandLine
+	}
+
+	var path string
+	flagset.StringVar(&path, "config", path, "Configuration file to read flags from, in yaml or json format")
+
+	if err := flagset.Parse(arguments); err != nil {
+		return err
+	}
+	if path == "" {
+		return nil
+	}
+
+	err := ApplyConfigFile(flagset, path)
+	if err == nil {
+		return nil
+	}
+
+	switch flagset.ErrorHandling() {
+	case flag.ExitOnError:
+		fmt.Fprintln(flagset.Output(), err)
+		os.Exit(2)
+	case flag.PanicOnError:
+		panic(err)
+	}
+	return err
+}
+
+// ApplyConfigFile reads the configuration file at path and sets the flags in flagset accordingly.
+// When flagset is nil, uses flag.CommandLine.
+//
+// The configuration file should be in yaml format, which includes json.
+// It must consist of a single mapping from flag names to values, for example:
+//
+//	port: ":2222"
+//	timeout: 1h
+//	L:
+//	  - localhost:8080
+//	  - localhost:8081
+//	userimage:
+//	  alice: debian
+//
+// A scalar value is set like it was passed on the command line.
+// A sequence value is set once for each of its elements, like a flag passed multiple times.
+// A mapping value is set once for each of its entries, using a value of the form 'key=value'.
+//
+// Flags that have already been set, for example on the command line, are not overwritten.
+// Unknown flags or invalid values result in an error that includes the offending key and its line.
+func ApplyConfigFile(flagset *flag.FlagSet, path string) error {
+	if flagset == nil {
+		flagset = flag.CommandLine
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "Unable to read configuration file")
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return errors.Wrapf(err, "%s: Invalid configuration file", path)
+	}
+
+	// an empty file does not contain any nodes
+	if len(document.Content) == 0 {
+		return nil
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return errors.Errorf("%s:%d: Configuration file must be a mapping from flag names to values", path, root.Line)
+	}
+
+	// find the flags that have already been set
+	isSet := make(map[string]bool)
+	flagset.Visit(func(f *flag.Flag) {
+		isSet[f.Name] = true
+	})
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		if flagset.Lookup(key.Value) == nil {
+			return errors.Errorf("%s:%d: Unknown key %q", path, key.Line, key.Value)
+		}
+		if isSet[key.Value] {
+			continue
+		}
+
+		values, invalid := configFileValues(value)
+		if invalid != nil {
+			return errors.Errorf("%s:%d: Invalid value for key %q: Expected a scalar value", path, invalid.Line, key.Value)
+		}
+		for _, v := range values {
+			if err := flagset.Set(key.Value, v.value); err != nil {
+				return errors.Wrapf(err, "%s:%d: Invalid value for key %q", path, v.line, key.Value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configFileValue is a single value to set a flag to
+type configFileValue struct {
+	value string
+	line  int
+}
+
+// configFileValues returns the values a flag should be set to for the provided yaml node.
+// When node contains nested values that can not be used, returns the first such node as invalid.
+func configFileValues(node *yaml.Node) (values []configFileValue, invalid *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []configFileValue{{value: node.Value, line: node.Line}}, nil
+	case yaml.SequenceNode:
+		for _, element := range node.Content {
+			if element.Kind != yaml.ScalarNode {
+				return nil, element
+			}
+			values = append(values, configFileValue{value: element.Value, line: element.Line})
+		}
+		return values, nil
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				return nil, key
+			}
+			if value.Kind != yaml.ScalarNode {
+				return nil, value
+			}
+			values = append(values, configFileValue{value: key.Value + "=" + value.Value, line: key.Line})
+		}
+		return values, nil
+	default:
+		return nil, node
+	}
+}
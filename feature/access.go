@@ -0,0 +1,236 @@
+package feature
+
+import (
+	"encoding/hex"
+	"flag"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Because of import cyles, tests for this file reside in config/feature_access_test.go.
+
+// AccessList determines the source addresses connections are accepted from.
+type AccessList struct {
+	// Allow are the prefixes connections are allowed from.
+	// When empty, connections are allowed from everywhere not denied.
+	Allow []netip.Prefix
+
+	// Deny are the prefixes connections are denied from.
+	// They take precedence over Allow.
+	Deny []netip.Prefix
+}
+
+// IsEmpty checks if this AccessList allows connections from everywhere.
+func (al AccessList) IsEmpty() bool {
+	return len(al.Allow) == 0 && len(al.Deny) == 0
+}
+
+// Check checks if this AccessList allows connections from addr.
+// When the connection is not allowed, returns an error describing the reason.
+func (al AccessList) Check(addr net.Addr) error {
+	ip, ok := addrIP(addr)
+	if !ok {
+		// only restrict connections with an ip address, e.g. not those on a unix socket
+		return nil
+	}
+
+	for _, prefix := range al.Deny {
+		if prefix.Contains(ip) {
+			return errors.Errorf("%s is denied by %s", ip, prefix)
+		}
+	}
+
+	if len(al.Allow) == 0 {
+		return nil
+	}
+	for _, prefix := range al.Allow {
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+	return errors.Errorf("%s is not allowed", ip)
+}
+
+// addrIP returns the ip address of addr, if any
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	default:
+		return netip.Addr{}, false
+	}
+
+	nip, ok := netip.AddrFromSlice(ip)
+	return nip.Unmap(), ok
+}
+
+// RestrictAccess restricts the source addresses server accepts connections from.
+//
+// Connections are first checked against global when they are accepted, and closed when they are not allowed.
+// Once the user of a connection is known, the connection is additionally checked against the access list of that user in users, if any.
+// Connections of users not allowed are rejected before they can authenticate.
+//
+// logger is called whenever a connection is rejected, including the reason for the rejection.
+//
+// This function wraps any already configured ConnCallback, ServerConfigCallback, PublicKeyHandler, PasswordHandler and KeyboardInteractiveHandler.
+// Handlers that are not configured are left untouched.
+func RestrictAccess(logger logging.Logger, server *ssh.Server, global AccessList, users map[string]AccessList) {
+	if !global.IsEmpty() {
+		logging.LogSSHEvent(logger, nil, logging.EventRestrictAccess, "allow %v deny %v", global.Allow, global.Deny)
+	}
+	for user, list := range users {
+		logging.LogSSHEvent(logger, nil, logging.EventRestrictAccess, "user %q allow %v deny %v", user, list.Allow, list.Deny)
+	}
+
+	next := server.ConnCallback
+	server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		if next != nil {
+			conn = next(ctx, conn)
+			if conn == nil {
+				return nil
+			}
+		}
+
+		if err := global.Check(conn.RemoteAddr()); err != nil {
+			logging.LogSSHEvent(logger, nil, logging.EventDenyConnection, "%s: %s", conn.RemoteAddr(), err)
+			return nil
+		}
+		return conn
+	}
+
+	if len(users) == 0 {
+		return
+	}
+
+	// checkUser checks if the user of ctx may connect
+	checkUser := func(ctx ssh.Context) bool {
+		list, ok := users[ctx.User()]
+		if !ok {
+			return true
+		}
+		if err := list.Check(ctx.RemoteAddr()); err != nil {
+			logging.LogSSHEvent(logger, ctx, logging.EventDenyConnection, "%s: user %q: %s", ctx.RemoteAddr(), ctx.User(), err)
+			return false
+		}
+		return true
+	}
+
+	if handler := server.PublicKeyHandler; handler != nil {
+		server.PublicKeyHandler = func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return checkUser(ctx) && handler(ctx, key)
+		}
+	}
+	if handler := server.PasswordHandler; handler != nil {
+		server.PasswordHandler = func(ctx ssh.Context, password string) bool {
+			return checkUser(ctx) && handler(ctx, password)
+		}
+	}
+	if handler := server.KeyboardInteractiveHandler; handler != nil {
+		server.KeyboardInteractiveHandler = func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+			return checkUser(ctx) && handler(ctx, challenger)
+		}
+	}
+
+	// when authentication is disabled, none of the handlers above are called.
+	// Instead check users when they connect without authentication.
+	nextConfig := server.ServerConfigCallback
+	server.ServerConfigCallback = func(ctx ssh.Context) *gossh.ServerConfig {
+		config := &gossh.ServerConfig{}
+		if nextConfig != nil {
+			config = nextConfig(ctx)
+		}
+		config.NoClientAuthCallback = func(conn gossh.ConnMetadata) (*gossh.Permissions, error) {
+			applyConnMetadata(ctx, conn)
+			if !checkUser(ctx) {
+				return nil, errors.New("Access denied")
+			}
+			return nil, nil
+		}
+		return config
+	}
+}
+
+// applyConnMetadata stores the metadata of conn in ctx, unless it has already been stored.
+// The handlers of ssh.Server store the same metadata before they are called.
+func applyConnMetadata(ctx ssh.Context, conn gossh.ConnMetadata) {
+	if ctx.Value(ssh.ContextKeySessionID) != nil {
+		return
+	}
+	ctx.SetValue(ssh.ContextKeySessionID, hex.EncodeToString(conn.SessionID()))
+	ctx.SetValue(ssh.ContextKeyClientVersion, string(conn.ClientVersion()))
+	ctx.SetValue(ssh.ContextKeyServerVersion, string(conn.ServerVersion()))
+	ctx.SetValue(ssh.ContextKeyUser, conn.User())
+	ctx.SetValue(ssh.ContextKeyLocalAddr, conn.LocalAddr())
+	ctx.SetValue(ssh.ContextKeyRemoteAddr, conn.RemoteAddr())
+}
+
+// UserAccessListVar represents a "flag".Value that contains per-user network prefixes to allow or deny.
+// It can be passed multiple times, each time with a value of the form 'user=prefix[,prefix...]'.
+// Prefixes are parsed using ParseNetworkPrefix.
+//
+// When Deny is true, prefixes are added to the Deny list of the user, otherwise to the Allow list.
+type UserAccessListVar struct {
+	Lists *map[string]AccessList
+	Deny  bool
+}
+
+// String turns this UserAccessListVar into a space-seperated list of 'user=prefix[,prefix...]' pairs.
+func (u *UserAccessListVar) String() string {
+	if u.Lists == nil {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(*u.Lists))
+	for user, list := range *u.Lists {
+		prefixes := list.Allow
+		if u.Deny {
+			prefixes = list.Deny
+		}
+		if len(prefixes) == 0 {
+			continue
+		}
+		pairs = append(pairs, user+"="+(&NetworkPrefixListVar{Prefixes: &prefixes}).String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// Set sets the value of this UserAccessListVar
+// This function is intended to be called by flag.Var()
+func (u *UserAccessListVar) Set(value string) error {
+	user, prefixes, ok := strings.Cut(value, "=")
+	if !ok || user == "" || prefixes == "" {
+		return errors.Errorf("Invalid user access list %q", value)
+	}
+	if *u.Lists == nil {
+		*u.Lists = make(map[string]AccessList)
+	}
+
+	list := (*u.Lists)[user]
+	target := &list.Allow
+	if u.Deny {
+		target = &list.Deny
+	}
+	if err := (&NetworkPrefixListVar{Prefixes: target}).Set(prefixes); err != nil {
+		return err
+	}
+	(*u.Lists)[user] = list
+	return nil
+}
+
+func init() {
+	// ensure that UserAccessListVar fullfills the flag.Value interface
+	var _ flag.Value = (*UserAccessListVar)(nil)
+}
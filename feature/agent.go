@@ -0,0 +1,214 @@
+package feature
+
+import (
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentContextKey is the context key used to store the patterns of users allowed to forward their agent
+type agentContextKey struct{}
+
+// AllowAgentForwarding allows users matching any of patterns to forward their ssh agent, for example using 'ssh -A'.
+// Patterns use the syntax of path.Match, for example "*" allows all users.
+// When patterns is empty, no agents are forwarded.
+//
+// Whether the agent of a session is forwarded can be checked using AgentForwarded.
+// Handlers then make it available to processes using ListenAgent.
+// This function wraps any already configured ConnCallback.
+func AllowAgentForwarding(logger logging.Logger, server *ssh.Server, patterns []string) {
+	if len(patterns) > 0 {
+		logging.LogSSHEvent(logger, nil, logging.EventAllowAgentForwarding, "%v", patterns)
+	}
+
+	next := server.ConnCallback
+	server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		ctx.SetValue(agentContextKey{}, patterns)
+		if next == nil {
+			return conn
+		}
+		return next(ctx, conn)
+	}
+}
+
+// AgentForwarded checks if the client of session forwarded its agent, and the user is allowed to do so.
+// When the client forwarded its agent but the user is not allowed to, the denial is logged.
+func AgentForwarded(logger logging.Logger, session ssh.Session) bool {
+	if !ssh.AgentRequested(session) {
+		return false
+	}
+
+	patterns, _ := session.Context().Value(agentContextKey{}).([]string)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, session.User()); ok {
+			return true
+		}
+	}
+
+	logging.LogSSHEvent(logger, session, logging.EventDenyAgentForward, "user %q", session.User())
+	return false
+}
+
+// agentChannelType is the type of channels opened to a forwarded agent
+const agentChannelType = "auth-agent@openssh.com"
+
+// OpenAgent opens a new connection to the agent forwarded by the client of the connection of ctx.
+// Callers should check that the client forwarded its agent, and close the connection once they are done.
+func OpenAgent(ctx ssh.Context) (gossh.Channel, error) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok {
+		return nil, errors.New("No connection")
+	}
+
+	channel, requests, err := conn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open forwarded agent")
+	}
+	go gossh.DiscardRequests(requests)
+
+	return channel, nil
+}
+
+// ForwardedAgent is an agent forwarded by a client.
+type ForwardedAgent struct {
+	agent.ExtendedAgent
+	channel gossh.Channel
+}
+
+// NewForwardedAgent opens the agent forwarded by the client of the connection of ctx, see OpenAgent.
+func NewForwardedAgent(ctx ssh.Context) (*ForwardedAgent, error) {
+	channel, err := OpenAgent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardedAgent{ExtendedAgent: agent.NewClient(channel), channel: channel}, nil
+}
+
+// Close closes the connection to the agent
+func (fa *ForwardedAgent) Close() error {
+	return fa.channel.Close()
+}
+
+// AgentSocketName is the name of the unix socket created by ListenAgent.
+const AgentSocketName = "agent.sock"
+
+// AgentListener is a unix socket that relays connections to the agent forwarded by the client of a session.
+// It is typically passed to a process using the SSH_AUTH_SOCK environment variable.
+type AgentListener struct {
+	// Dir is a new directory only containing the socket.
+	// Path is the path to the socket, it is named AgentSocketName.
+	Dir  string
+	Path string
+
+	listener net.Listener
+}
+
+// ListenAgent creates a new unix socket that relays connections to the agent forwarded by the client of session.
+// The caller should first check that the agent may be forwarded using AgentForwarded.
+//
+// The socket is created inside a new directory with a random name inside of dir.
+// When dir is empty, uses the default directory for temporary files.
+// Both are only accessible by the current user, see Chown and Share to change this.
+//
+// Connections are accepted and relayed in the background, until the listener is closed.
+func ListenAgent(logger logging.Logger, session ssh.Session, dir string) (*AgentListener, error) {
+	dir, err := os.MkdirTemp(dir, "agent-")
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create agent directory")
+	}
+
+	al := &AgentListener{Dir: dir, Path: filepath.Join(dir, AgentSocketName)}
+	al.listener, err = net.Listen("unix", al.Path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Wrap(err, "Unable to listen on agent socket")
+	}
+	if err := os.Chmod(al.Path, 0600); err != nil {
+		al.Close()
+		return nil, errors.Wrap(err, "Unable to change mode of agent socket")
+	}
+
+	logging.LogSSHEvent(logger, session, logging.EventGrantAgentForward, "%s", al.Path)
+
+	go al.serve(session.Context())
+
+	return al, nil
+}
+
+// serve accepts connections and relays them to the agent forwarded by the client of ctx
+func (al *AgentListener) serve(ctx ssh.Context) {
+	for {
+		conn, err := al.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			channel, err := OpenAgent(ctx)
+			if err != nil {
+				return
+			}
+			defer channel.Close()
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				io.Copy(conn, channel)
+				conn.(*net.UnixConn).CloseWrite()
+			}()
+			go func() {
+				defer wg.Done()
+				io.Copy(channel, conn)
+				channel.CloseWrite()
+			}()
+			wg.Wait()
+		}()
+	}
+}
+
+// Chown changes the owner of the socket and its directory, for example to the account a process is run as.
+func (al *AgentListener) Chown(uid, gid int) error {
+	if err := os.Chown(al.Dir, uid, gid); err != nil {
+		return errors.Wrap(err, "Unable to change owner of agent directory")
+	}
+	if err := os.Chown(al.Path, uid, gid); err != nil {
+		return errors.Wrap(err, "Unable to change owner of agent socket")
+	}
+	return nil
+}
+
+// Share makes the socket accessible to all users that know its path, for example users inside of a container.
+// The directory can not be listed, so the path can not be found by other users unless the parent directory can be listed.
+func (al *AgentListener) Share() error {
+	if err := os.Chmod(al.Dir, 0711); err != nil {
+		return errors.Wrap(err, "Unable to change mode of agent directory")
+	}
+	if err := os.Chmod(al.Path, 0666); err != nil {
+		return errors.Wrap(err, "Unable to change mode of agent socket")
+	}
+	return nil
+}
+
+// Close stops accepting connections, and removes the socket and its directory.
+// Connections that are already being relayed continue until either side closes them.
+func (al *AgentListener) Close() error {
+	if al == nil {
+		return nil
+	}
+
+	err := al.listener.Close()
+	os.RemoveAll(al.Dir)
+	return err
+}
@@ -1,6 +1,10 @@
 package feature
 
 import (
+	"net/url"
+	"os"
+	"path/filepath"
+
 	"github.com/gliderlabs/ssh"
 	"github.com/tkw1536/proxyssh/logging"
 )
@@ -18,7 +22,7 @@ func AuthorizeKeys(logger logging.Logger, keyfinder func(ctx ssh.Context) (keys
 	return func(ctx ssh.Context, key ssh.PublicKey) bool {
 		keys, err := keyfinder(ctx)
 		if err != nil {
-			logging.FmtSSHLog(logger, ctx, "error_keyfinder %s", err.Error())
+			logging.LogSSHEvent(logger, ctx, logging.EventKeyfinderError, "%s", err.Error())
 			return false
 		}
 
@@ -33,3 +37,24 @@ func AuthorizeKeys(logger logging.Logger, keyfinder func(ctx ssh.Context) (keys
 		return res
 	}
 }
+
+// FindUserKeys finds the public keys authorized to login as user and returns them.
+// These are read from a file named like the user inside of dir.
+//
+// This function will ignore all errors and or invalid values.
+func FindUserKeys(dir, user string) (keys []ssh.PublicKey) {
+	bytes, err := os.ReadFile(filepath.Join(dir, url.PathEscape(user)))
+	if err != nil {
+		return nil
+	}
+
+	var key ssh.PublicKey
+	for {
+		key, _, _, bytes, err = ssh.ParseAuthorizedKey(bytes)
+		if err != nil {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return
+}
@@ -0,0 +1,427 @@
+package feature
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Because of import cyles, tests for this file reside in config/feature_bruteforce_test.go.
+
+// BruteForceProtection configures protection against brute-force authentication attempts, see ProtectBruteForce.
+type BruteForceProtection struct {
+	// MaxFailures is the number of failed authentication attempts after which a source address or username is banned.
+	// Failures are counted separately for each source address, and when BanUsers is set, for each username.
+	// When zero, nothing is ever banned.
+	MaxFailures int
+
+	// BanUsers enables banning usernames in addition to source addresses.
+	// Because anyone can fail to authenticate as a known user, this allows anyone to lock out legitimate users.
+	// It is thus disabled by default.
+	BanUsers bool
+
+	// FindTime is the time window failures are counted in.
+	// When zero, defaults to 10 minutes.
+	FindTime time.Duration
+
+	// BanTime is the duration of the first ban.
+	// Every following ban of the same source address or username takes twice as long, up to MaxBanTime.
+	// When zero, BanTime defaults to 10 minutes, and MaxBanTime to one day.
+	BanTime    time.Duration
+	MaxBanTime time.Duration
+
+	// FailureDelay is the time to wait before rejecting a failed password or keyboard-interactive authentication attempt.
+	// The delay doubles with every recent failure from the same source address, up to 10 seconds.
+	// When zero, failed attempts are rejected immediately.
+	FailureDelay time.Duration
+
+	// MaxStartups is the maximum number of concurrent unauthenticated connections.
+	// Further connections are closed immediately, until an existing connection has authenticated or been closed.
+	// When zero, the number of unauthenticated connections is not limited.
+	MaxStartups int
+}
+
+// maxFailureDelay is the maximal delay of a failed authentication attempt
+const maxFailureDelay = 10 * time.Second
+
+// ProtectBruteForce protects server against brute-force authentication attempts.
+// It should be called after all authentication handlers have been configured.
+//
+// Failed authentication attempts are tracked by source address, and when protection.BanUsers is set, by username.
+// Every rejected password or keyboard-interactive attempt counts as a failure.
+// Public keys are commonly probed one after another by clients, so they are not counted individually.
+// Instead, a connection that attempted public key authentication counts as a single failure when it is closed without having authenticated.
+// This includes connections closed because of an invalid signature.
+// Once protection.MaxFailures attempts have failed within protection.FindTime, the source address or username is temporarily banned.
+// Connections from banned source addresses are closed immediately, and authentication attempts for banned usernames are rejected.
+// Bans, and tracked failures, are shared between all servers in the same process.
+//
+// logger is called whenever a source address or username is banned or unbanned, and whenever a connection is rejected.
+//
+// This function wraps any already configured ConnCallback, ServerConfigCallback, PublicKeyHandler, PasswordHandler and KeyboardInteractiveHandler.
+// Handlers that are not configured are left untouched.
+// In particular, unauthenticated connections are only limited when at least one authentication handler is configured.
+func ProtectBruteForce(logger logging.Logger, server *ssh.Server, protection BruteForceProtection) {
+	if protection.FindTime == 0 {
+		protection.FindTime = 10 * time.Minute
+	}
+	if protection.BanTime == 0 {
+		protection.BanTime = 10 * time.Minute
+	}
+	if protection.MaxBanTime == 0 {
+		protection.MaxBanTime = 24 * time.Hour
+	}
+	if protection.MaxBanTime < protection.BanTime {
+		protection.MaxBanTime = protection.BanTime
+	}
+
+	guard := &bruteForceGuard{logger: logger, protection: protection}
+	hasAuth := server.PublicKeyHandler != nil || server.PasswordHandler != nil || server.KeyboardInteractiveHandler != nil
+
+	next := server.ConnCallback
+	server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		if next != nil {
+			conn = next(ctx, conn)
+			if conn == nil {
+				return nil
+			}
+		}
+
+		source := sourceKey(conn.RemoteAddr())
+		if bruteForce.banned(source) {
+			logging.LogSSHEvent(logger, nil, logging.EventRejectBanned, "%s", conn.RemoteAddr())
+			return nil
+		}
+
+		if !hasAuth {
+			return conn
+		}
+
+		bc := &bruteForceConn{Conn: conn, ctx: ctx, guard: guard}
+		if protection.MaxStartups > 0 {
+			startup, ok := bruteForce.startup(protection.MaxStartups)
+			if !ok {
+				logging.LogSSHEvent(logger, nil, logging.EventRejectMaxStartups, "%s", conn.RemoteAddr())
+				return nil
+			}
+			bc.startup = startup
+		}
+		ctx.SetValue(bruteForceConnContextKey{}, bc)
+		return bc
+	}
+
+	if !hasAuth {
+		return
+	}
+
+	// only the server configuration knows if authentication ultimately succeeded
+	nextConfig := server.ServerConfigCallback
+	server.ServerConfigCallback = func(ctx ssh.Context) *gossh.ServerConfig {
+		config := &gossh.ServerConfig{}
+		if nextConfig != nil {
+			config = nextConfig(ctx)
+		}
+
+		nextLog := config.AuthLogCallback
+		config.AuthLogCallback = func(conn gossh.ConnMetadata, method string, err error) {
+			if bc, ok := ctx.Value(bruteForceConnContextKey{}).(*bruteForceConn); ok && err == nil {
+				bc.authenticated()
+			}
+			if nextLog != nil {
+				nextLog(conn, method, err)
+			}
+		}
+		return config
+	}
+
+	if handler := server.PublicKeyHandler; handler != nil {
+		server.PublicKeyHandler = func(ctx ssh.Context, key ssh.PublicKey) bool {
+			if guard.banned(ctx) {
+				return false
+			}
+			if bc, ok := ctx.Value(bruteForceConnContextKey{}).(*bruteForceConn); ok {
+				bc.attemptedPublicKey()
+			}
+			return handler(ctx, key)
+		}
+	}
+	if handler := server.PasswordHandler; handler != nil {
+		server.PasswordHandler = func(ctx ssh.Context, password string) bool {
+			return guard.authenticate(ctx, func() bool { return handler(ctx, password) })
+		}
+	}
+	if handler := server.KeyboardInteractiveHandler; handler != nil {
+		server.KeyboardInteractiveHandler = func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+			return guard.authenticate(ctx, func() bool { return handler(ctx, challenger) })
+		}
+	}
+}
+
+// sourceKey returns the key used to track failures of the source address addr
+func sourceKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return "address " + host
+}
+
+// userKey returns the key used to track failures of username
+func userKey(username string) string {
+	return "user " + username
+}
+
+// bruteForceGuard implements ProtectBruteForce for a single server
+type bruteForceGuard struct {
+	logger     logging.Logger
+	protection BruteForceProtection
+}
+
+// banned checks if the source address or user of ctx is currently banned
+func (guard *bruteForceGuard) banned(ctx ssh.Context) bool {
+	if bruteForce.banned(sourceKey(ctx.RemoteAddr())) {
+		return true
+	}
+	return guard.protection.BanUsers && bruteForce.banned(userKey(ctx.User()))
+}
+
+// authenticate checks if ctx may attempt to authenticate, and if so calls attempt to do so.
+// A failed attempt is recorded, and delayed according to the number of recent failures.
+// Returns the result of the attempt.
+func (guard *bruteForceGuard) authenticate(ctx ssh.Context, attempt func() bool) bool {
+	if guard.banned(ctx) {
+		return false
+	}
+	if attempt() {
+		return true
+	}
+
+	failures := guard.fail(ctx)
+	if delay := guard.protection.FailureDelay; delay > 0 {
+		for i := 1; i < failures && delay < maxFailureDelay; i++ {
+			delay *= 2
+		}
+		time.Sleep(min(delay, maxFailureDelay))
+	}
+	return false
+}
+
+// fail records a failed authentication attempt of ctx.
+// Returns the number of recent failures of the source address.
+func (guard *bruteForceGuard) fail(ctx ssh.Context) int {
+	if guard.protection.MaxFailures > 0 && guard.protection.BanUsers {
+		bruteForce.fail(guard.logger, userKey(ctx.User()), guard.protection)
+	}
+	return bruteForce.fail(guard.logger, sourceKey(ctx.RemoteAddr()), guard.protection)
+}
+
+// bruteForce holds the state of brute-force protection for all servers
+var bruteForce bruteForceState
+
+// bruteForceState holds tracked failures, bans and unauthenticated connections.
+// The zero value is ready to use.
+type bruteForceState struct {
+	m        sync.Mutex
+	entries  map[string]*bruteForceEntry
+	startups int
+}
+
+// bruteForceEntry holds the state of a single source address or username
+type bruteForceEntry struct {
+	failures []time.Time // recent failures, oldest first
+	last     time.Time   // time of the last failure or unban
+
+	bans  int       // number of bans so far
+	until time.Time // end of the current ban, zero when not banned
+
+	findTime time.Duration
+	timer    *time.Timer
+}
+
+// banned checks if key is currently banned
+func (state *bruteForceState) banned(key string) bool {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	entry, ok := state.entries[key]
+	return ok && time.Now().Before(entry.until)
+}
+
+// fail records a failed authentication attempt for key, and bans key when needed.
+// Returns the number of recent failures for key.
+func (state *bruteForceState) fail(logger logging.Logger, key string, protection BruteForceProtection) int {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	if state.entries == nil {
+		state.entries = make(map[string]*bruteForceEntry)
+	}
+	entry, ok := state.entries[key]
+	if !ok {
+		entry = &bruteForceEntry{}
+		state.entries[key] = entry
+	}
+
+	now := time.Now()
+	entry.last = now
+	entry.findTime = protection.FindTime
+
+	// forget about old failures
+	recent := entry.failures[:0]
+	for _, failure := range entry.failures {
+		if now.Sub(failure) < protection.FindTime {
+			recent = append(recent, failure)
+		}
+	}
+	entry.failures = append(recent, now)
+	failures := len(entry.failures)
+
+	if protection.MaxFailures > 0 && failures >= protection.MaxFailures && !now.Before(entry.until) {
+		duration := protection.BanTime
+		for i := 0; i < entry.bans && duration < protection.MaxBanTime; i++ {
+			duration *= 2
+		}
+		duration = min(duration, protection.MaxBanTime)
+
+		entry.bans++
+		entry.until = now.Add(duration)
+		entry.failures = nil
+
+		logging.LogSSHEvent(logger, nil, logging.EventBan, "%s for %s", key, duration)
+	}
+
+	state.schedule(logger, key, entry, now)
+	return failures
+}
+
+// schedule schedules the next update of entry, that is unbanning or forgetting it.
+// state.m must be held.
+func (state *bruteForceState) schedule(logger logging.Logger, key string, entry *bruteForceEntry, now time.Time) {
+	next := entry.until
+	if !now.Before(next) {
+		next = entry.last.Add(entry.findTime)
+	}
+
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	entry.timer = time.AfterFunc(next.Sub(now), func() {
+		state.expire(logger, key, entry)
+	})
+}
+
+// expire unbans entry when its ban has ended, and forgets it when it has not been used recently.
+func (state *bruteForceState) expire(logger logging.Logger, key string, entry *bruteForceEntry) {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	// entry was replaced or already forgotten
+	if state.entries[key] != entry {
+		return
+	}
+
+	now := time.Now()
+	if !entry.until.IsZero() {
+		if now.Before(entry.until) {
+			state.schedule(logger, key, entry, now)
+			return
+		}
+
+		entry.until = time.Time{}
+		entry.last = now
+		logging.LogSSHEvent(logger, nil, logging.EventUnban, "%s", key)
+	}
+
+	if now.Sub(entry.last) < entry.findTime {
+		state.schedule(logger, key, entry, now)
+		return
+	}
+	delete(state.entries, key)
+}
+
+// startup registers a new unauthenticated connection.
+// When there already are max unauthenticated connections, returns false.
+func (state *bruteForceState) startup(max int) (*bruteForceStartup, bool) {
+	state.m.Lock()
+	defer state.m.Unlock()
+
+	if state.startups >= max {
+		return nil, false
+	}
+	state.startups++
+	return &bruteForceStartup{state: state}, true
+}
+
+// bruteForceStartup is an unauthenticated connection
+type bruteForceStartup struct {
+	state    *bruteForceState
+	released sync.Once
+}
+
+// release marks this connection as authenticated or closed
+func (startup *bruteForceStartup) release() {
+	startup.released.Do(func() {
+		startup.state.m.Lock()
+		defer startup.state.m.Unlock()
+
+		startup.state.startups--
+	})
+}
+
+// bruteForceConnContextKey is the context key used to store the *bruteForceConn of a connection
+type bruteForceConnContextKey struct{}
+
+// bruteForceConn is a connection to a server protected using ProtectBruteForce.
+// It keeps track of the authentication state of the connection.
+type bruteForceConn struct {
+	net.Conn
+
+	ctx     ssh.Context
+	guard   *bruteForceGuard
+	startup *bruteForceStartup // nil when unauthenticated connections are not limited
+
+	m         sync.Mutex
+	publicKey bool // public key authentication was attempted
+	success   bool // authentication succeeded
+	closed    bool
+}
+
+// attemptedPublicKey records that public key authentication was attempted
+func (bc *bruteForceConn) attemptedPublicKey() {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+
+	bc.publicKey = true
+}
+
+// authenticated records that the connection has authenticated
+func (bc *bruteForceConn) authenticated() {
+	bc.m.Lock()
+	bc.success = true
+	bc.m.Unlock()
+
+	if bc.startup != nil {
+		bc.startup.release()
+	}
+}
+
+// Close closes the connection.
+// When public key authentication was attempted but did not succeed, records a single failure.
+func (bc *bruteForceConn) Close() error {
+	bc.m.Lock()
+	failed := !bc.closed && bc.publicKey && !bc.success
+	bc.closed = true
+	bc.m.Unlock()
+
+	if failed {
+		bc.guard.fail(bc.ctx)
+	}
+	if bc.startup != nil {
+		bc.startup.release()
+	}
+	return bc.Conn.Close()
+}
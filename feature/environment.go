@@ -0,0 +1,82 @@
+package feature
+
+import (
+	"net"
+	"path"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// environmentContextKey is the context key used to store accepted environment patterns
+type environmentContextKey struct{}
+
+// AcceptEnvironment configures server to accept environment variables sent by clients that match any of patterns.
+// Patterns use the syntax of path.Match, for example "LC_*" matches any variable that starts with "LC_".
+// When patterns is empty, no client-provided variables are accepted.
+//
+// The accepted variables of a session can be retrieved using Environ or AcceptedEnviron.
+// This function wraps any already configured ConnCallback.
+func AcceptEnvironment(logger logging.Logger, server *ssh.Server, patterns []string) {
+	if len(patterns) > 0 {
+		logging.LogSSHEvent(logger, nil, logging.EventAcceptEnv, "%v", patterns)
+	}
+
+	next := server.ConnCallback
+	server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		ctx.SetValue(environmentContextKey{}, patterns)
+		if next == nil {
+			return conn
+		}
+		return next(ctx, conn)
+	}
+}
+
+// Environ returns the environment variables that should be passed to a process started for session.
+// Each variable is of the form "key=value".
+//
+// The result consists of the variables sent by the client that were accepted using AcceptEnvironment.
+// These are followed by the SSH_CONNECTION, SSH_CLIENT and USER variables, which always take precedence.
+// Other standard variables, such as HOME and SSH_TTY, depend on the process and are not included.
+func Environ(session ssh.Session) (env []string) {
+	env = AcceptedEnviron(session)
+
+	// SSH_CONNECTION and SSH_CLIENT describe the network connection
+	remoteHost, remotePort, _ := net.SplitHostPort(session.RemoteAddr().String())
+	localHost, localPort, _ := net.SplitHostPort(session.LocalAddr().String())
+
+	return append(env,
+		"SSH_CONNECTION="+strings.Join([]string{remoteHost, remotePort, localHost, localPort}, " "),
+		"SSH_CLIENT="+strings.Join([]string{remoteHost, remotePort, localPort}, " "),
+		"USER="+session.User(),
+	)
+}
+
+// AcceptedEnviron returns the environment variables sent by the client of session that were accepted using AcceptEnvironment.
+// Each variable is of the form "key=value".
+func AcceptedEnviron(session ssh.Session) (env []string) {
+	patterns, _ := session.Context().Value(environmentContextKey{}).([]string)
+
+	for _, kv := range session.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if MatchEnvironment(patterns, key) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// MatchEnvironment checks if the environment variable key matches any of patterns.
+// Patterns are matched using path.Match, invalid patterns never match.
+func MatchEnvironment(patterns []string, key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package feature
+
+import "testing"
+
+func TestMatchEnvironment(t *testing.T) {
+	patterns := []string{"LANG", "LC_*", "[invalid"}
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"LANG", true},
+		{"LANGUAGE", false},
+		{"LC_ALL", true},
+		{"LC_", true},
+		{"LD_PRELOAD", false},
+		{"[invalid", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := MatchEnvironment(patterns, tt.key); got != tt.want {
+				t.Errorf("MatchEnvironment() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -12,10 +12,11 @@ import (
 // logger is called whenever a request from a caller is allowed or denied.
 func AllowForwardTo(logger logging.Logger, addresses []NetworkAddress) ssh.LocalPortForwardingCallback {
 	if len(addresses) > 0 {
-		logger.Printf("allow_forward_to %v", addresses)
+		logging.LogSSHEvent(logger, nil, logging.EventAllowForwardTo, "%v", addresses)
 	}
 	return func(ctx ssh.Context, dhost string, dport uint32) bool {
-		return filterInternal(logger, "", ctx, addresses, NetworkAddress{Hostname: dhost, Port: NetworkPort(dport)})
+		ok := filterInternal(logger, logging.EventGrantPortForward, logging.EventDenyPortForward, ctx, addresses, NetworkAddress{Hostname: dhost, Port: NetworkPort(dport)})
+		return observeForward("local", ok)
 	}
 }
 
@@ -24,22 +25,23 @@ func AllowForwardTo(logger logging.Logger, addresses []NetworkAddress) ssh.Local
 // logger is called whenever a request from a caller is allowed or denied.
 func AllowForwardFrom(logger logging.Logger, addresses []NetworkAddress) ssh.ReversePortForwardingCallback {
 	if len(addresses) > 0 {
-		logger.Printf("allow_forward_from %v", addresses)
+		logging.LogSSHEvent(logger, nil, logging.EventAllowForwardFrom, "%v", addresses)
 	}
 	return func(ctx ssh.Context, bindHost string, bindPort uint32) bool {
-		return filterInternal(logger, "_reverse", ctx, addresses, NetworkAddress{Hostname: bindHost, Port: NetworkPort(bindPort)})
+		ok := filterInternal(logger, logging.EventGrantReversePortForward, logging.EventDenyReversePortForward, ctx, addresses, NetworkAddress{Hostname: bindHost, Port: NetworkPort(bindPort)})
+		return observeForward("reverse", ok)
 	}
 }
 
 // filterInternal is the internal function used by AllowForwardPorts and AllowReversePorts
-func filterInternal(logger logging.Logger, logExtra string, ctx ssh.Context, addresses []NetworkAddress, actualAddress NetworkAddress) bool {
+func filterInternal(logger logging.Logger, grant, deny logging.EventType, ctx ssh.Context, addresses []NetworkAddress, actualAddress NetworkAddress) bool {
 	for _, p := range addresses {
 		if p.Hostname == actualAddress.Hostname && p.Port == actualAddress.Port {
-			logging.FmtSSHLog(logger, ctx, "grant%s_portforward %s", logExtra, actualAddress.String())
+			logging.LogSSHEvent(logger, ctx, grant, "%s", actualAddress.String())
 			return true
 		}
 	}
-	logging.FmtSSHLog(logger, ctx, "deny%s_portforward %s", logExtra, actualAddress.String())
+	logging.LogSSHEvent(logger, ctx, deny, "%s", actualAddress.String())
 	return false
 }
 
@@ -53,12 +55,11 @@ func AllowPortForwarding(logger logging.Logger, server *ssh.Server, toAddresses
 
 // EnablePortForwarding enables portforwarding with the given callbacks on the ssh Server server.
 // This includes tcpip forward requests as well as direct-tcpip channels.
+// The forwardings of each connection are tracked, see Tunnels.
 //
 // This function overwrites any already configured LocalPortForwardingCallback and ReversePortForwardingCallback functions.
 // It will furthermore remove the 'tcpip-forward' and 'cancel-tcpip-forward' request handlers along with the 'direct-tcpip' channel handler.
 func EnablePortForwarding(server *ssh.Server, localCallback ssh.LocalPortForwardingCallback, reverseCallback ssh.ReversePortForwardingCallback) {
-	forwardHandler := &ssh.ForwardedTCPHandler{}
-
 	// store the fowarding callbacks
 	server.LocalPortForwardingCallback = localCallback
 	server.ReversePortForwardingCallback = reverseCallback
@@ -79,9 +80,9 @@ func EnablePortForwarding(server *ssh.Server, localCallback ssh.LocalPortForward
 	}
 
 	// setup the channel handlers for tcip forwarding
-	server.RequestHandlers["tcpip-forward"] = forwardHandler.HandleSSHRequest
-	server.RequestHandlers["cancel-tcpip-forward"] = forwardHandler.HandleSSHRequest
+	server.RequestHandlers["tcpip-forward"] = tunnelForwardHandler
+	server.RequestHandlers["cancel-tcpip-forward"] = tunnelForwardHandler
 
-	// allow direct-tcip handlers also
-	server.ChannelHandlers["direct-tcpip"] = ssh.DirectTCPIPHandler
+	// allow direct-tcip handlers also, and record metrics about them
+	server.ChannelHandlers["direct-tcpip"] = tunnelDirectTCPIPHandler
 }
@@ -80,7 +80,7 @@ func ReadOrMakeHostKey(logger logging.Logger, privateKeyPath string, algorithm H
 
 // loadHostKey loadsa host key
 func loadHostKey(logger logging.Logger, key HostKey, path string) (err error) {
-	logger.Printf("load_hostkey %s %s", key.Algorithm(), path)
+	logging.LogSSHEvent(logger, nil, logging.EventLoadHostKey, "%s %s", key.Algorithm(), path)
 
 	// read all the bytes from the file
 	privateKeyBytes, err := os.ReadFile(path)
@@ -106,7 +106,7 @@ func loadHostKey(logger logging.Logger, key HostKey, path string) (err error) {
 
 // makeHostKey makes a new host key
 func makeHostKey(logger logging.Logger, key HostKey, path string) error {
-	logger.Printf("generate_hostkey %s %s", key.Algorithm(), path)
+	logging.LogSSHEvent(logger, nil, logging.EventGenerateHostKey, "%s %s", key.Algorithm(), path)
 
 	if err := key.Generate(0, nil); err != nil {
 		return errors.Wrap(err, "Failed to generate key")
@@ -0,0 +1,204 @@
+package feature
+
+import (
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// Listen creates the listeners for address.
+// address can be of one of the following forms:
+//
+//	host:port      listen on the tcp address host:port
+//	unix:path      listen on a unix socket at path
+//	systemd        use all sockets passed via systemd socket activation
+//	systemd:name   use the sockets passed via systemd socket activation with the given name
+//
+// When a unix socket at path already exists, but nothing is listening on it, it is removed first.
+// The name of a socket passed via systemd can be set using the 'FileDescriptorName=' setting of the socket unit.
+// Each socket passed via systemd can only be used once.
+//
+// logger is called once for every listener created.
+func Listen(logger logging.Logger, address string) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	switch {
+	case address == "systemd" || strings.HasPrefix(address, "systemd:"):
+		var err error
+		listeners, err = takeSystemdListeners(strings.TrimPrefix(address, "systemd:"), address != "systemd")
+		if err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(address, "unix:"):
+		path := strings.TrimPrefix(address, "unix:")
+		removeStaleSocket(path)
+
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to listen on %q", address)
+		}
+		listeners = []net.Listener{listener}
+	default:
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to listen on %q", address)
+		}
+		listeners = []net.Listener{listener}
+	}
+
+	for _, listener := range listeners {
+		logging.LogSSHEvent(logger, nil, logging.EventListen, "%s %s", listener.Addr().Network(), listener.Addr())
+	}
+	return listeners, nil
+}
+
+// removeStaleSocket removes the unix socket at path, unless something is listening on it.
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// systemdFirstFD is the first file descriptor passed via systemd socket activation
+const systemdFirstFD = 3
+
+// systemdListener is a listener passed via systemd socket activation
+type systemdListener struct {
+	listener net.Listener
+	name     string
+	taken    bool
+}
+
+// systemd holds the listeners passed via systemd socket activation.
+// They are created when first needed.
+var systemd struct {
+	once sync.Once
+	err  error
+
+	m         sync.Mutex
+	listeners []*systemdListener
+}
+
+// takeSystemdListeners returns the listeners passed via systemd socket activation that have not yet been taken.
+// When filter is true, only returns listeners with the provided name.
+//
+// Returns an error when there are no such listeners.
+func takeSystemdListeners(name string, filter bool) ([]net.Listener, error) {
+	systemd.once.Do(func() {
+		systemd.listeners, systemd.err = systemdListeners(os.Getenv, os.Getpid(), systemdFirstFD)
+
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	if systemd.err != nil {
+		return nil, systemd.err
+	}
+
+	systemd.m.Lock()
+	defer systemd.m.Unlock()
+
+	var listeners []net.Listener
+	for _, sl := range systemd.listeners {
+		if sl.taken || (filter && sl.name != name) {
+			continue
+		}
+		sl.taken = true
+		listeners = append(listeners, sl.listener)
+	}
+
+	if len(listeners) == 0 {
+		if filter {
+			return nil, errors.Errorf("No unused sockets named %q passed via systemd socket activation", name)
+		}
+		return nil, errors.New("No unused sockets passed via systemd socket activation")
+	}
+	return listeners, nil
+}
+
+// systemdListeners creates listeners for the file descriptors passed via systemd socket activation.
+// getenv is used to read the environment, pid is the id of the current process, and firstFD the first passed file descriptor.
+//
+// See sd_listen_fds(3) for a description of the protocol.
+func systemdListeners(getenv func(string) string, pid int, firstFD int) ([]*systemdListener, error) {
+	if listenPID, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || listenPID != pid {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if fdnames := getenv("LISTEN_FDNAMES"); fdnames != "" {
+		names = strings.Split(fdnames, ":")
+	}
+
+	listeners := make([]*systemdListener, count)
+	for i := range listeners {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		// net.FileListener duplicates the file descriptor, so the original one can be closed
+		file := os.NewFile(uintptr(firstFD+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, sl := range listeners[:i] {
+				sl.listener.Close()
+			}
+			return nil, errors.Wrapf(err, "Unable to use socket %d passed via systemd socket activation", i)
+		}
+
+		listeners[i] = &systemdListener{listener: listener, name: name}
+	}
+	return listeners, nil
+}
+
+// ListenAddressListVar represents a "flag".Value that contains a list of addresses to listen on.
+// It can be passed multiple times, and collects all addresses in an ordered list.
+//
+// See the Listen function for the supported forms of addresses.
+type ListenAddressListVar struct {
+	Addresses *[]string
+}
+
+// String turns this ListenAddressListVar into a comma-seperated list of addresses.
+func (l *ListenAddressListVar) String() string {
+	if l.Addresses == nil {
+		return ""
+	}
+	return strings.Join(*l.Addresses, ",")
+}
+
+// Set adds an address to this ListenAddressListVar.
+// This function is intended to be called by flag.Var()
+func (l *ListenAddressListVar) Set(value string) error {
+	if value == "" {
+		return errors.New("Listen address must not be empty")
+	}
+	*l.Addresses = append(*l.Addresses, value)
+	return nil
+}
+
+func init() {
+	// ensure that ListenAddressListVar fullfills the flag.Value interface
+	var _ flag.Value = (*ListenAddressListVar)(nil)
+}
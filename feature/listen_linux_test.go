@@ -0,0 +1,63 @@
+//go:build linux
+
+package feature
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		wantNames []string
+	}{
+		{"not activated", map[string]string{}, nil},
+		{"other process", map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}, nil},
+		{"without names", map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"}, []string{"unknown"}},
+		{"with names", map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1", "LISTEN_FDNAMES": "public"}, []string{"public"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// create a listener, and pass a duplicate of its file descriptor
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			file, err := listener.(*net.TCPListener).File()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd, err := syscall.Dup(int(file.Fd()))
+			file.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			listeners, err := systemdListeners(func(key string) string { return tt.env[key] }, 42, fd)
+			if err != nil {
+				t.Fatalf("systemdListeners() error = %v", err)
+			}
+			if listeners == nil {
+				syscall.Close(fd)
+			}
+
+			var names []string
+			for _, sl := range listeners {
+				names = append(names, sl.name)
+				if got, want := sl.listener.Addr().String(), listener.Addr().String(); got != want {
+					t.Errorf("systemdListeners() returned listener on %q, want %q", got, want)
+				}
+				sl.listener.Close()
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("systemdListeners() returned names %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package feature
+
+import (
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen_unix(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	path := filepath.Join(t.TempDir(), "ssh.sock")
+
+	// create a stale socket file
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listeners, err := Listen(logger, "unix:"+path)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("Listen() returned %d listeners, want 1", len(listeners))
+	}
+	defer listeners[0].Close()
+
+	// a socket that is in use is not removed
+	if _, err := Listen(logger, "unix:"+path); err == nil {
+		t.Error("Listen() did not return an error for a socket in use")
+	}
+	if conn, err := net.Dial("unix", path); err != nil {
+		t.Errorf("Listen(): unable to connect to socket: %v", err)
+	} else {
+		conn.Close()
+	}
+}
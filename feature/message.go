@@ -0,0 +1,135 @@
+package feature
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// Because of import cyles, tests for this file reside in config/feature_message_test.go.
+
+// MessageData is the data available to message templates, such as the banner and the message of the day.
+type MessageData struct {
+	User       string // name of the user
+	RemoteAddr string // address of the client
+
+	// Container is the id of the container the connection was matched to.
+	// It is empty when the connection was not matched to a container, for example before the user has authenticated.
+	Container string
+}
+
+// NewMessageData creates a new MessageData for the connection of ctx.
+func NewMessageData(ctx ssh.Context) MessageData {
+	data := MessageData{User: ctx.User()}
+	if addr := ctx.RemoteAddr(); addr != nil {
+		data.RemoteAddr = addr.String()
+	}
+	data.Container, _ = ctx.Value(containerContextKey{}).(string)
+	return data
+}
+
+// containerContextKey is the context key used to store the id of the matched container
+type containerContextKey struct{}
+
+// SetContainer records that the connection of ctx was matched to the container with the provided id.
+// The id is made available to message templates as the Container field of MessageData.
+func SetContainer(ctx ssh.Context, id string) {
+	ctx.SetValue(containerContextKey{}, id)
+}
+
+// ParseMessage parses text into a message template.
+// Templates use the syntax of the "text/template" package, and are executed with a MessageData.
+func ParseMessage(name, text string) (*template.Template, error) {
+	tpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse message %q", name)
+	}
+	return tpl, nil
+}
+
+// LoadMessage loads a message template from the file at path.
+// See ParseMessage for details.
+func LoadMessage(path string) (*template.Template, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load message")
+	}
+	return ParseMessage(filepath.Base(path), string(text))
+}
+
+// RenderMessage executes the message template tpl for the connection of ctx.
+func RenderMessage(tpl *template.Template, ctx ssh.Context) (string, error) {
+	var builder strings.Builder
+	if err := tpl.Execute(&builder, NewMessageData(ctx)); err != nil {
+		return "", errors.Wrapf(err, "Unable to render message %q", tpl.Name())
+	}
+	return builder.String(), nil
+}
+
+// ShowBanner configures server to show banner to clients before they authenticate.
+// When the banner fails to render, an error is logged and no banner is shown.
+//
+// Because the banner is shown before authentication, the Container field of MessageData is always empty.
+func ShowBanner(logger logging.Logger, server *ssh.Server, banner *template.Template) {
+	logging.LogSSHEvent(logger, nil, logging.EventShowBanner, "%s", banner.Name())
+
+	server.BannerHandler = func(ctx ssh.Context) string {
+		message, err := RenderMessage(banner, ctx)
+		if err != nil {
+			logging.LogSSHEvent(logger, ctx, logging.EventRenderMessageFail, "%s", err)
+			return ""
+		}
+		return message
+	}
+}
+
+// motdContextKey is the context key used to store the message of the day configuration
+type motdContextKey struct{}
+
+// motdConfig is the message of the day configuration stored in the context
+type motdConfig struct {
+	logger logging.Logger
+	motd   *template.Template
+}
+
+// ShowMessageOfTheDay configures server to show motd to clients after they have logged in.
+// It is only shown to sessions that requested a pty, so that the output of commands and subsystems stays untouched.
+//
+// The message of the day for a specific session can be rendered using MessageOfTheDay.
+// This function wraps any already configured ConnCallback.
+func ShowMessageOfTheDay(logger logging.Logger, server *ssh.Server, motd *template.Template) {
+	logging.LogSSHEvent(logger, nil, logging.EventShowMessageOfTheDay, "%s", motd.Name())
+
+	config := &motdConfig{logger: logger, motd: motd}
+
+	next := server.ConnCallback
+	server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		ctx.SetValue(motdContextKey{}, config)
+		if next == nil {
+			return conn
+		}
+		return next(ctx, conn)
+	}
+}
+
+// MessageOfTheDay renders the message of the day for session.
+// When no message of the day was configured using ShowMessageOfTheDay, or it fails to render, returns the empty string.
+func MessageOfTheDay(session ssh.Session) string {
+	config, ok := session.Context().Value(motdContextKey{}).(*motdConfig)
+	if !ok {
+		return ""
+	}
+
+	message, err := RenderMessage(config.motd, session.Context())
+	if err != nil {
+		logging.LogSSHEvent(config.logger, session, logging.EventRenderMessageFail, "%s", err)
+		return ""
+	}
+	return message
+}
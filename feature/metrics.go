@@ -0,0 +1,268 @@
+package feature
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Because of import cyles, tests for this file reside in config/feature_metrics_test.go.
+
+// metricsRegistry holds all metrics collected by proxyssh
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricConnectionsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "proxyssh_connections_active",
+		Help: "Number of currently open ssh connections",
+	})
+	metricConnectionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proxyssh_connections_total",
+		Help: "Total number of accepted ssh connections",
+	})
+	metricAuthTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyssh_auth_total",
+		Help: "Total number of authentication attempts by method and result",
+	}, []string{"method", "result"})
+	metricSessionsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxyssh_sessions_active",
+		Help: "Number of currently running sessions by backend",
+	}, []string{"backend"})
+	metricSessionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyssh_sessions_total",
+		Help: "Total number of finished sessions by backend and exit code",
+	}, []string{"backend", "exit_code"})
+	metricForwardTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyssh_forward_requests_total",
+		Help: "Total number of port forwarding requests by direction and result",
+	}, []string{"direction", "result"})
+	metricForwardChannelsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "proxyssh_forward_channels_active",
+		Help: "Number of currently open local and reverse port forwarding channels",
+	})
+	metricForwardBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxyssh_forward_bytes_total",
+		Help: "Total number of bytes sent over local and reverse port forwarding channels by direction, 'in' meaning received from the client",
+	}, []string{"direction"})
+	metricDockerAPIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxyssh_docker_api_duration_seconds",
+		Help:    "Latency of calls to the docker api by operation",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		metricConnectionsActive,
+		metricConnectionsTotal,
+		metricAuthTotal,
+		metricSessionsActive,
+		metricSessionsTotal,
+		metricForwardTotal,
+		metricForwardChannelsActive,
+		metricForwardBytesTotal,
+		metricDockerAPIDuration,
+
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "proxyssh_leak_detector_total",
+			Help:        "Total number of memory leak detector checks by result",
+			ConstLabels: prometheus.Labels{"result": "success"},
+		}, func() float64 {
+			success, _ := logging.GetGlobalLeakDetectorStats()
+			return float64(success)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "proxyssh_leak_detector_total",
+			Help:        "Total number of memory leak detector checks by result",
+			ConstLabels: prometheus.Labels{"result": "failure"},
+		}, func() float64 {
+			_, failure := logging.GetGlobalLeakDetectorStats()
+			return float64(failure)
+		}),
+	)
+}
+
+// MetricsHandler returns an http.Handler that serves all metrics in the prometheus exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// metricsAddresses holds the addresses metrics are already being served on
+var metricsAddresses struct {
+	sync.Mutex
+	m map[string]struct{}
+}
+
+// ServeMetrics starts an http server in the background that serves metrics on the path '/metrics' of address.
+// It furthermore configures server to collect connection and authentication metrics, see CollectMetrics.
+//
+// When metrics are already being served on address, for example when called again for a reloaded server, does not start another http server.
+// Returns an error when address can not be listened on.
+func ServeMetrics(logger logging.Logger, server *ssh.Server, address string) error {
+	metricsAddresses.Lock()
+	defer metricsAddresses.Unlock()
+
+	if _, ok := metricsAddresses.m[address]; !ok {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return errors.Wrap(err, "Unable to listen for metrics")
+		}
+		logging.LogSSHEvent(logger, nil, logging.EventServeMetrics, "%s", listener.Addr())
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", MetricsHandler())
+		go http.Serve(listener, mux)
+
+		if metricsAddresses.m == nil {
+			metricsAddresses.m = make(map[string]struct{})
+		}
+		metricsAddresses.m[address] = struct{}{}
+	}
+
+	CollectMetrics(server)
+	return nil
+}
+
+// CollectMetrics configures server to collect metrics about connections and authentication attempts.
+// It should be called after all authentication handlers have been configured.
+//
+// This function wraps any already configured ConnCallback, PublicKeyHandler, PasswordHandler and KeyboardInteractiveHandler.
+// Handlers that are not configured are left untouched.
+func CollectMetrics(server *ssh.Server) {
+	next := server.ConnCallback
+	server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		if next != nil {
+			conn = next(ctx, conn)
+			if conn == nil {
+				return nil
+			}
+		}
+
+		metricConnectionsTotal.Inc()
+		metricConnectionsActive.Inc()
+		return &metricsConn{Conn: conn}
+	}
+
+	if handler := server.PublicKeyHandler; handler != nil {
+		server.PublicKeyHandler = func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return observeAuth("publickey", handler(ctx, key))
+		}
+	}
+	if handler := server.PasswordHandler; handler != nil {
+		server.PasswordHandler = func(ctx ssh.Context, password string) bool {
+			return observeAuth("password", handler(ctx, password))
+		}
+	}
+	if handler := server.KeyboardInteractiveHandler; handler != nil {
+		server.KeyboardInteractiveHandler = func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+			return observeAuth("keyboard-interactive", handler(ctx, challenger))
+		}
+	}
+}
+
+// observeAuth records the result of an authentication attempt using method and returns ok
+func observeAuth(method string, ok bool) bool {
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+	metricAuthTotal.WithLabelValues(method, result).Inc()
+	return ok
+}
+
+// metricsConn is a net.Conn that marks the connection as inactive when it is closed
+type metricsConn struct {
+	net.Conn
+	closed sync.Once
+}
+
+func (mc *metricsConn) Close() error {
+	mc.closed.Do(metricConnectionsActive.Dec)
+	return mc.Conn.Close()
+}
+
+// ObserveSession records that a session using backend has started.
+// The returned function should be called with the exit code of the session once it has finished.
+func ObserveSession(backend string) (done func(code int)) {
+	metricSessionsActive.WithLabelValues(backend).Inc()
+	return func(code int) {
+		metricSessionsActive.WithLabelValues(backend).Dec()
+		metricSessionsTotal.WithLabelValues(backend, strconv.Itoa(code)).Inc()
+	}
+}
+
+// ObserveDockerAPI records the latency of a call to the docker api.
+// It should be called right before the call to the api, and the returned function right after it.
+//
+// A typical use is like:
+//
+//	defer feature.ObserveDockerAPI("container_start")()
+func ObserveDockerAPI(operation string) (done func()) {
+	start := time.Now()
+	return func() {
+		metricDockerAPIDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeForward records the result of a port forwarding request in direction and returns ok
+func observeForward(direction string, ok bool) bool {
+	result := "deny"
+	if ok {
+		result = "grant"
+	}
+	metricForwardTotal.WithLabelValues(direction, result).Inc()
+	return ok
+}
+
+// metricsNewChannel is a gossh.NewChannel that records metrics about the channel once accepted
+type metricsNewChannel struct {
+	gossh.NewChannel
+}
+
+func (mnc metricsNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	channel, requests, err := mnc.NewChannel.Accept()
+	if err != nil {
+		return channel, requests, err
+	}
+
+	return newMetricsChannel(channel), requests, nil
+}
+
+// newMetricsChannel records that channel, a local or reverse port forwarding channel, has been opened
+func newMetricsChannel(channel gossh.Channel) *metricsChannel {
+	metricForwardChannelsActive.Inc()
+	return &metricsChannel{Channel: channel}
+}
+
+// metricsChannel is a gossh.Channel that counts the bytes read from and written to it.
+// It records that the channel has been closed once Close is called.
+type metricsChannel struct {
+	gossh.Channel
+	closed sync.Once
+}
+
+func (mc *metricsChannel) Read(data []byte) (int, error) {
+	n, err := mc.Channel.Read(data)
+	metricForwardBytesTotal.WithLabelValues("in").Add(float64(n))
+	return n, err
+}
+
+func (mc *metricsChannel) Write(data []byte) (int, error) {
+	n, err := mc.Channel.Write(data)
+	metricForwardBytesTotal.WithLabelValues("out").Add(float64(n))
+	return n, err
+}
+
+func (mc *metricsChannel) Close() error {
+	mc.closed.Do(metricForwardChannelsActive.Dec)
+	return mc.Channel.Close()
+}
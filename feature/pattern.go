@@ -0,0 +1,40 @@
+package feature
+
+import (
+	"flag"
+	"path"
+	"strings"
+)
+
+// PatternListVar represents a "flag".Value that contains a list of patterns, for example of environment variables or user names.
+// It can be passed multiple times, and collects all patterns in an ordered list.
+// Each value may contain several patterns separated by spaces or commas.
+// Patterns use the syntax of path.Match.
+type PatternListVar struct {
+	Patterns *[]string
+}
+
+// String turns this PatternListVar into a comma-separated list of patterns.
+func (p *PatternListVar) String() string {
+	if p.Patterns == nil {
+		return ""
+	}
+	return strings.Join(*p.Patterns, ",")
+}
+
+// Set sets the value of this PatternListVar
+// This function is intended to be called by flag.Var()
+func (p *PatternListVar) Set(value string) error {
+	for _, pattern := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+		*p.Patterns = append(*p.Patterns, pattern)
+	}
+	return nil
+}
+
+func init() {
+	// ensure that PatternListVar fullfills the flag.Value interface
+	var _ flag.Value = (*PatternListVar)(nil)
+}
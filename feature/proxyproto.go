@@ -0,0 +1,317 @@
+package feature
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// ProxyProtocolListener wraps listener to accept connections using the PROXY protocol, versions 1 and 2.
+// The PROXY protocol is used by load balancers such as HAProxy to pass on the address of the original client.
+//
+// trusted is a list of source addresses that are expected to send a PROXY protocol header.
+// Connections from trusted sources must start with a PROXY protocol header, the RemoteAddr and LocalAddr methods of such connections return the addresses it contains.
+// Connections from other sources, including connections on unix sockets, are used as is.
+//
+// The header is read when the connection is first read from, or its addresses are first requested.
+// When a trusted source does not send a valid header within a few seconds, the connection is closed and logger is called.
+func ProxyProtocolListener(logger logging.Logger, listener net.Listener, trusted []netip.Prefix) net.Listener {
+	for _, prefix := range trusted {
+		logging.LogSSHEvent(logger, nil, logging.EventAcceptProxyProtocol, "%s %s", listener.Addr(), prefix)
+	}
+	return &proxyListener{Listener: listener, logger: logger, trusted: trusted}
+}
+
+// proxyHeaderTimeout is the time to wait for a PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyListener implements ProxyProtocolListener
+type proxyListener struct {
+	net.Listener
+	logger  logging.Logger
+	trusted []netip.Prefix
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil || !pl.isTrusted(conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn, logger: pl.logger, reader: bufio.NewReader(conn)}, nil
+}
+
+// isTrusted checks if addr is a trusted source address
+func (pl *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range pl.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection that starts with a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	logger logging.Logger
+	reader *bufio.Reader
+
+	header        sync.Once
+	err           error
+	remote, local net.Addr
+
+	m        sync.Mutex
+	deadline time.Time // read deadline set by the caller
+}
+
+// readHeader reads the header of this connection unless it has already been read
+func (pc *proxyConn) readHeader() error {
+	pc.header.Do(func() {
+		pc.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		pc.remote, pc.local, pc.err = readProxyHeader(pc.reader)
+
+		pc.m.Lock()
+		pc.Conn.SetReadDeadline(pc.deadline)
+		pc.m.Unlock()
+
+		if pc.err != nil {
+			logging.LogSSHEvent(pc.logger, nil, logging.EventProxyHeaderFail, "%s %s", pc.Conn.RemoteAddr(), pc.err)
+			pc.Conn.Close()
+		}
+	})
+	return pc.err
+}
+
+func (pc *proxyConn) Read(p []byte) (int, error) {
+	if err := pc.readHeader(); err != nil {
+		return 0, err
+	}
+	return pc.reader.Read(p)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	if pc.readHeader() != nil || pc.remote == nil {
+		return pc.Conn.RemoteAddr()
+	}
+	return pc.remote
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	if pc.readHeader() != nil || pc.local == nil {
+		return pc.Conn.LocalAddr()
+	}
+	return pc.local
+}
+
+func (pc *proxyConn) SetDeadline(t time.Time) error {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	pc.deadline = t
+	return pc.Conn.SetDeadline(t)
+}
+
+func (pc *proxyConn) SetReadDeadline(t time.Time) error {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	pc.deadline = t
+	return pc.Conn.SetReadDeadline(t)
+}
+
+// proxyV2Signature is the signature at the start of every version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the maximal length of a version 1 header, including the final "\r\n"
+const proxyV1MaxLength = 107
+
+// readProxyHeader reads a PROXY protocol header from reader.
+// It returns the source and destination addresses contained in it.
+// When the header does not contain addresses, for example for health checks, returns nil addresses.
+func readProxyHeader(reader *bufio.Reader) (remote, local net.Addr, err error) {
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to read PROXY protocol header")
+	}
+
+	switch {
+	case bytes.Equal(signature, proxyV2Signature):
+		return readProxyHeaderV2(reader)
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		return readProxyHeaderV1(reader)
+	default:
+		return nil, nil, errors.New("Missing PROXY protocol header")
+	}
+}
+
+// readProxyHeaderV1 reads a version 1 (human-readable) PROXY protocol header
+func readProxyHeaderV1(reader *bufio.Reader) (remote, local net.Addr, err error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, nil, errors.New("Invalid PROXY protocol header: Header too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Unable to read PROXY protocol header")
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.Errorf("Invalid PROXY protocol header: %q", line)
+	}
+
+	src, err := parseProxyAddrV1(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddrV1(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// parseProxyAddrV1 parses an address and port of a version 1 PROXY protocol header
+func parseProxyAddrV1(addr, port string) (*net.TCPAddr, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid PROXY protocol header")
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid PROXY protocol header")
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(p))), nil
+}
+
+// readProxyHeaderV2 reads a version 2 (binary) PROXY protocol header
+func readProxyHeaderV2(reader *bufio.Reader) (remote, local net.Addr, err error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to read PROXY protocol header")
+	}
+
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to read PROXY protocol header")
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, nil, errors.Errorf("Invalid PROXY protocol header: Unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0xF {
+	case 0: // LOCAL, e.g. a health check by the proxy itself
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, errors.Errorf("Invalid PROXY protocol header: Unsupported command %d", versionCommand&0xF)
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default: // other protocols, addresses are not used
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("Invalid PROXY protocol header: Address block too short")
+	}
+
+	src, _ := netip.AddrFromSlice(payload[:size])
+	dst, _ := netip.AddrFromSlice(payload[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(payload[2*size:])
+	dstPort := binary.BigEndian.Uint16(payload[2*size+2:])
+
+	remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort))
+	local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, dstPort))
+	return remote, local, nil
+}
+
+// ParseNetworkPrefix parses a network prefix in CIDR notation, such as '10.0.0.0/8'.
+// A single address, such as '10.0.0.1', is parsed as a prefix containing only that address.
+func ParseNetworkPrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// NetworkPrefixListVar represents a "flag".Value that contains a list of network prefixes.
+// It can be passed multiple times, and collects all prefixes in an ordered list.
+// Each value may contain several prefixes seperated by commas.
+//
+// See ParseNetworkPrefix for the supported syntax.
+type NetworkPrefixListVar struct {
+	Prefixes *[]netip.Prefix
+}
+
+// String turns this NetworkPrefixListVar into a comma-seperated list of prefixes.
+func (p *NetworkPrefixListVar) String() string {
+	if p.Prefixes == nil {
+		return ""
+	}
+
+	prefixes := make([]string, len(*p.Prefixes))
+	for i, prefix := range *p.Prefixes {
+		prefixes[i] = prefix.String()
+	}
+	return strings.Join(prefixes, ",")
+}
+
+// Set adds prefixes to this NetworkPrefixListVar.
+// This function is intended to be called by flag.Var()
+func (p *NetworkPrefixListVar) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		prefix, err := ParseNetworkPrefix(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		*p.Prefixes = append(*p.Prefixes, prefix)
+	}
+	return nil
+}
+
+func init() {
+	// ensure that NetworkPrefixListVar fullfills the flag.Value interface
+	var _ flag.Value = (*NetworkPrefixListVar)(nil)
+}
@@ -0,0 +1,151 @@
+package feature
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, payload string) string {
+		return string(proxyV2Signature) + string([]byte{0x20 | command, family, 0, byte(len(payload))}) + payload
+	}
+
+	tests := []struct {
+		name       string
+		input      string
+		wantRemote string
+		wantLocal  string
+		wantErr    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nSSH-2.0", "192.0.2.1:56324", "198.51.100.1:22", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\nSSH-2.0", "[2001:db8::1]:56324", "[2001:db8::2]:22", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\nSSH-2.0", "", "", false},
+		{"v1 invalid address", "PROXY TCP4 192.0.2.x 198.51.100.1 56324 22\r\nSSH-2.0", "", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", "", true},
+		{"v2 tcp4", v2(1, 0x11, "\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x16") + "SSH-2.0", "192.0.2.1:56324", "198.51.100.1:22", false},
+		{"v2 local", v2(0, 0x00, "") + "SSH-2.0", "", "", false},
+		{"v2 short address", v2(1, 0x11, "\xc0\x00\x02\x01") + "SSH-2.0", "", "", true},
+		{"missing header", "SSH-2.0-OpenSSH_9.6\r\n", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.input))
+			remote, local, err := readProxyHeader(reader)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProxyHeader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := addrString(remote); got != tt.wantRemote {
+				t.Errorf("readProxyHeader() remote = %q, want %q", got, tt.wantRemote)
+			}
+			if got := addrString(local); got != tt.wantLocal {
+				t.Errorf("readProxyHeader() local = %q, want %q", got, tt.wantLocal)
+			}
+			if rest, _ := io.ReadAll(reader); string(rest) != "SSH-2.0" {
+				t.Errorf("readProxyHeader() did not consume exactly the header, remaining %q", rest)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	tests := []struct {
+		name       string
+		trusted    string
+		send       string
+		wantRemote string
+		wantRead   string
+	}{
+		{"trusted source", "127.0.0.0/8", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nhello", "192.0.2.1:56324", "hello"},
+		{"untrusted source", "192.0.2.0/24", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nhello", "127.0.0.1", "PROXY"},
+		{"trusted source without header", "127.0.0.1", "hello, world", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, err := ParseNetworkPrefix(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := ProxyProtocolListener(logger, inner, []netip.Prefix{prefix})
+			defer listener.Close()
+
+			client, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte(tt.send))
+
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if tt.wantRead == "" {
+				if _, err := conn.Read(make([]byte, 1)); err == nil {
+					t.Error("Read() did not return an error for a missing header")
+				}
+				return
+			}
+
+			buffer := make([]byte, len(tt.wantRead))
+			if _, err := io.ReadFull(conn, buffer); err != nil || string(buffer) != tt.wantRead {
+				t.Errorf("Read() = %q, %v, want %q", buffer, err, tt.wantRead)
+			}
+
+			if got := conn.RemoteAddr().String(); !strings.HasPrefix(got, tt.wantRemote) {
+				t.Errorf("RemoteAddr() = %q, want prefix %q", got, tt.wantRemote)
+			}
+		})
+	}
+}
+
+func TestParseNetworkPrefix(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.1.2.3/8", "10.0.0.0/8", false},
+		{"192.0.2.1", "192.0.2.1/32", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"10.0.0.0/33", "", true},
+		{"example.com", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseNetworkPrefix(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNetworkPrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("ParseNetworkPrefix() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
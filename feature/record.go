@@ -0,0 +1,355 @@
+package feature
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// recordContextKey is the context key used to store the recording configuration
+type recordContextKey struct{}
+
+// recordConfig is the recording configuration stored in the context
+type recordConfig struct {
+	logger logging.Logger
+	dir    string
+}
+
+// RecordSessions configures server to record all sessions into files inside of dir.
+// The directory is created if it does not exist.
+//
+// Sessions that requested a pty are recorded in the asciicast v2 format, and can be replayed using 'asciinema play'.
+// Other sessions are recorded as plain transcripts, consisting of one file each for standard input, output and error.
+// Files are named by the time, user, remote address and id of the session.
+//
+// A recorder for a specific session can be created using NewRecorder.
+// This function wraps any already configured ConnCallback.
+func RecordSessions(logger logging.Logger, server *ssh.Server, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "Unable to create recording directory")
+	}
+	logging.LogSSHEvent(logger, nil, logging.EventRecordSessions, "%s", dir)
+
+	config := &recordConfig{logger: logger, dir: dir}
+
+	next := server.ConnCallback
+	server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		ctx.SetValue(recordContextKey{}, config)
+		if next == nil {
+			return conn
+		}
+		return next(ctx, conn)
+	}
+	return nil
+}
+
+// Recorder records the streams of a single session.
+//
+// Writes to the streams never fail, so that a failing recording does not interrupt the session.
+// All methods may be called concurrently, and may continue to be called after Close.
+type Recorder interface {
+	Stdin() io.Writer  // input of the session
+	Stdout() io.Writer // output of the session; for a pty this is the terminal
+	Stderr() io.Writer // error output of the session
+
+	// Resize records that the terminal has been resized
+	Resize(width, height int)
+
+	// Close finishes the recording
+	Close() error
+}
+
+// NewRecorder creates a new Recorder for session.
+// When recording has not been enabled using RecordSessions, returns nil.
+//
+// isPty indicates if the session requested a pty.
+func NewRecorder(session ssh.Session, isPty bool) (Recorder, error) {
+	config, ok := session.Context().Value(recordContextKey{}).(*recordConfig)
+	if !ok {
+		return nil, nil
+	}
+
+	// user, remote address and session id of the session
+	ctx := session.Context()
+	name := strings.Join([]string{
+		time.Now().UTC().Format("20060102T150405Z"),
+		sanitizeRecordName(session.User()),
+		sanitizeRecordName(session.RemoteAddr().String()),
+		sanitizeRecordName(ctx.SessionID()),
+	}, "_")
+
+	var (
+		recorder Recorder
+		path     string
+		err      error
+	)
+	if isPty {
+		pty, _, _ := session.Pty()
+		recorder, path, err = newAsciicastRecorder(config.dir, name, session.User()+"@"+session.RemoteAddr().String(), pty)
+	} else {
+		recorder, path, err = newTranscriptRecorder(config.dir, name)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to start recording")
+	}
+
+	logging.LogSSHEvent(config.logger, session, logging.EventSessionRecord, "%s", path)
+	return recorder, nil
+}
+
+// sanitizeRecordName replaces all characters of name that are not safe for use in a filename.
+func sanitizeRecordName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// createRecordFile exclusively creates a new file inside dir with the given name and extension.
+// When a file with that name exists, a numeric suffix is added.
+func createRecordFile(dir, name, ext string) (*os.File, error) {
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, name+ext)
+		if i > 0 {
+			path = filepath.Join(dir, name+"-"+strconv.Itoa(i)+ext)
+		}
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+}
+
+//
+// asciicast
+//
+
+// asciicastRecorder records a session in asciicast v2 format.
+// See https://docs.asciinema.org/manual/asciicast/v2/.
+type asciicastRecorder struct {
+	l      sync.Mutex
+	file   *os.File
+	start  time.Time
+	closed bool
+
+	stdin, stdout, stderr *asciicastWriter
+}
+
+// asciicastHeader is the header of an asciicast v2 file
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+func newAsciicastRecorder(dir, name, title string, pty ssh.Pty) (*asciicastRecorder, string, error) {
+	file, err := createRecordFile(dir, name, ".cast")
+	if err != nil {
+		return nil, "", err
+	}
+
+	recorder := &asciicastRecorder{file: file, start: time.Now()}
+	recorder.stdin = &asciicastWriter{recorder: recorder, kind: "i"}
+	recorder.stdout = &asciicastWriter{recorder: recorder, kind: "o"}
+	recorder.stderr = &asciicastWriter{recorder: recorder, kind: "o"}
+
+	header, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     pty.Window.Width,
+		Height:    pty.Window.Height,
+		Timestamp: recorder.start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": pty.Term},
+	})
+	if err == nil {
+		_, err = file.Write(append(header, '\n'))
+	}
+	if err != nil {
+		file.Close()
+		return nil, "", err
+	}
+
+	return recorder, file.Name(), nil
+}
+
+// event writes a new event of the given kind
+func (ar *asciicastRecorder) event(kind string, data string) {
+	ar.l.Lock()
+	defer ar.l.Unlock()
+
+	ar.writeEvent(kind, data)
+}
+
+// writeEvent writes a new event of the given kind.
+// ar.l must be held.
+func (ar *asciicastRecorder) writeEvent(kind string, data string) {
+	if ar.closed {
+		return
+	}
+
+	line, err := json.Marshal([]interface{}{time.Since(ar.start).Seconds(), kind, data})
+	if err != nil {
+		return
+	}
+	ar.file.Write(append(line, '\n'))
+}
+
+// asciicastWriter writes all data as events of a specific kind.
+//
+// Events hold strings, which json encodes as utf-8.
+// An incomplete utf-8 sequence at the end of a write is therefore held back until the next write completes it.
+type asciicastWriter struct {
+	recorder *asciicastRecorder
+	kind     string
+	pending  []byte // incomplete utf-8 sequence at the end of the last write, guarded by recorder.l
+}
+
+func (aw *asciicastWriter) Write(p []byte) (int, error) {
+	aw.recorder.l.Lock()
+	defer aw.recorder.l.Unlock()
+
+	data := append(aw.pending, p...)
+	complete := len(data) - incompleteUTF8Suffix(data)
+	aw.pending = append([]byte(nil), data[complete:]...)
+
+	if complete > 0 {
+		aw.recorder.writeEvent(aw.kind, string(data[:complete]))
+	}
+	return len(p), nil
+}
+
+// incompleteUTF8Suffix returns the length of an incomplete utf-8 sequence at the end of data.
+// When data ends with a complete sequence or invalid bytes, returns 0.
+func incompleteUTF8Suffix(data []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if utf8.FullRune(data[len(data)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+func (ar *asciicastRecorder) Stdin() io.Writer  { return ar.stdin }
+func (ar *asciicastRecorder) Stdout() io.Writer { return ar.stdout }
+func (ar *asciicastRecorder) Stderr() io.Writer { return ar.stderr }
+
+func (ar *asciicastRecorder) Resize(width, height int) {
+	ar.event("r", strconv.Itoa(width)+"x"+strconv.Itoa(height))
+}
+
+func (ar *asciicastRecorder) Close() error {
+	ar.l.Lock()
+	defer ar.l.Unlock()
+
+	if ar.closed {
+		return nil
+	}
+	ar.closed = true
+	return ar.file.Close()
+}
+
+//
+// transcripts
+//
+
+// transcriptRecorder records each stream of a session into a separate file.
+type transcriptRecorder struct {
+	stdin, stdout, stderr *transcriptWriter
+}
+
+func newTranscriptRecorder(dir, name string) (*transcriptRecorder, string, error) {
+	// find a unique name using the standard input file
+	file, err := createRecordFile(dir, name, ".stdin")
+	if err != nil {
+		return nil, "", err
+	}
+	recorder := &transcriptRecorder{stdin: &transcriptWriter{file: file}}
+	base := strings.TrimSuffix(file.Name(), ".stdin")
+
+	for _, stream := range []struct {
+		dest **transcriptWriter
+		ext  string
+	}{
+		{&recorder.stdout, ".stdout"},
+		{&recorder.stderr, ".stderr"},
+	} {
+		file, err := os.OpenFile(base+stream.ext, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			recorder.Close()
+			return nil, "", err
+		}
+		*stream.dest = &transcriptWriter{file: file}
+	}
+
+	return recorder, base + ".{stdin,stdout,stderr}", nil
+}
+
+func (tr *transcriptRecorder) Stdin() io.Writer  { return tr.stdin }
+func (tr *transcriptRecorder) Stdout() io.Writer { return tr.stdout }
+func (tr *transcriptRecorder) Stderr() io.Writer { return tr.stderr }
+
+func (tr *transcriptRecorder) Resize(width, height int) {}
+
+func (tr *transcriptRecorder) Close() error {
+	var err error
+	for _, w := range []*transcriptWriter{tr.stdin, tr.stdout, tr.stderr} {
+		if w == nil {
+			continue
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// transcriptWriter writes to a file and ignores all errors
+type transcriptWriter struct {
+	l      sync.Mutex
+	file   *os.File
+	closed bool
+}
+
+func (tw *transcriptWriter) Write(p []byte) (int, error) {
+	tw.l.Lock()
+	defer tw.l.Unlock()
+
+	if !tw.closed {
+		tw.file.Write(p)
+	}
+	return len(p), nil
+}
+
+func (tw *transcriptWriter) Close() error {
+	tw.l.Lock()
+	defer tw.l.Unlock()
+
+	if tw.closed {
+		return nil
+	}
+	tw.closed = true
+	return tw.file.Close()
+}
@@ -0,0 +1,49 @@
+package feature
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gliderlabs/ssh"
+)
+
+func Test_asciicastWriter_utf8(t *testing.T) {
+	recorder, path, err := newAsciicastRecorder(t.TempDir(), "test", "", ssh.Pty{Term: "xterm"})
+	if err != nil {
+		t.Fatalf("newAsciicastRecorder() returned error: %s", err)
+	}
+
+	// split "é" (0xC3 0xA9) across two writes
+	recorder.Stdout().Write([]byte("caf\xc3"))
+	recorder.Stdout().Write([]byte("\xa9!"))
+	recorder.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // skip the header
+
+	var got string
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Unable to parse event %q: %s", scanner.Text(), err)
+		}
+		data, _ := event[2].(string)
+		if !utf8.ValidString(data) || data == "" {
+			t.Errorf("event %q does not contain valid utf-8", scanner.Text())
+		}
+		got += data
+	}
+
+	if want := "café!"; got != want {
+		t.Errorf("recorded %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package feature
+
+import (
+	"net"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// Because of import cyles, tests for this file reside in config/feature_route_test.go.
+
+// ForwardRouter routes local port forwardings to a different target, for example to implement a jump host.
+//
+// It is called with the destination requested by the client, before the LocalPortForwardingCallback of the server.
+// When ok is true, the forwarding is allowed and connects to target, an address of the form 'host:port', instead of destination.
+// When ok is false and err is nil, the forwarding is handled by the LocalPortForwardingCallback as usual.
+// When err is not nil, the forwarding is rejected and err is reported to the client.
+type ForwardRouter func(ctx ssh.Context, destination NetworkAddress) (target string, ok bool, err error)
+
+// routeContextKey is the context key used to store the *routeConfig of a connection
+type routeContextKey struct{}
+
+// routeConfig is the routing configuration stored in the context
+type routeConfig struct {
+	logger logging.Logger
+	router ForwardRouter
+}
+
+// RouteForwards configures server to route local port forwardings using router.
+// Routed forwardings are tracked as tunnels to the destination requested by the client, see Tunnels.
+//
+// Port forwarding must additionally be enabled using EnablePortForwarding, which may happen afterwards.
+// This function wraps any already configured ConnCallback.
+func RouteForwards(logger logging.Logger, server *ssh.Server, router ForwardRouter) {
+	config := &routeConfig{logger: logger, router: router}
+
+	next := server.ConnCallback
+	server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		ctx.SetValue(routeContextKey{}, config)
+		if next == nil {
+			return conn
+		}
+		return next(ctx, conn)
+	}
+}
+
+// routeForward routes a forwarding to destination using the router configured with RouteForwards, if any.
+// See ForwardRouter for the meaning of the return values.
+func routeForward(ctx ssh.Context, destination NetworkAddress) (target string, ok bool, err error) {
+	config, hasRouter := ctx.Value(routeContextKey{}).(*routeConfig)
+	if !hasRouter {
+		return "", false, nil
+	}
+
+	target, ok, err = config.router(ctx, destination)
+	switch {
+	case err != nil:
+		logging.LogSSHEvent(config.logger, ctx, logging.EventDenyRoute, "%s: %s", destination, err)
+		return "", false, err
+	case ok:
+		logging.LogSSHEvent(config.logger, ctx, logging.EventGrantRoute, "%s -> %s", destination, target)
+	}
+	return target, ok, nil
+}
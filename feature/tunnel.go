@@ -0,0 +1,413 @@
+package feature
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Because of import cyles, tests for this file reside in config/feature_forward_test.go.
+
+// Tunnel is a port forwarding held by a single connection.
+//
+// A local tunnel forwards traffic from the client to a destination, and consists of all channels to the same destination.
+// A reverse tunnel listens for connections on the server, and forwards them to the client.
+type Tunnel struct {
+	// ID identifies the tunnel within its connection.
+	ID int
+
+	// Direction is either "local" or "reverse".
+	Direction string
+
+	// Address is the destination of a local tunnel, or the address a reverse tunnel listens on.
+	Address NetworkAddress
+
+	// Started is the time the tunnel was created.
+	Started time.Time
+
+	bytesIn     atomic.Int64 // bytes received from the client
+	bytesOut    atomic.Int64 // bytes sent to the client
+	connections atomic.Int64 // number of active connections
+
+	requested string // address requested by the client, for reverse tunnels
+
+	m       sync.Mutex
+	closed  bool
+	closers map[io.Closer]struct{} // listener and active connections
+}
+
+// BytesIn returns the number of bytes received from the client through this tunnel.
+func (t *Tunnel) BytesIn() int64 {
+	return t.bytesIn.Load()
+}
+
+// BytesOut returns the number of bytes sent to the client through this tunnel.
+func (t *Tunnel) BytesOut() int64 {
+	return t.bytesOut.Load()
+}
+
+// Connections returns the number of connections currently active in this tunnel.
+func (t *Tunnel) Connections() int64 {
+	return t.connections.Load()
+}
+
+// Closed checks if this tunnel has been closed.
+func (t *Tunnel) Closed() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	return t.closed
+}
+
+// Close closes this tunnel along with all of its active connections.
+// A closed local tunnel rejects all further channels to its destination.
+//
+// Closing a tunnel more than once has no effect.
+func (t *Tunnel) Close() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	for closer := range t.closers {
+		closer.Close()
+	}
+	t.closers = nil
+	return nil
+}
+
+// track adds closers to be closed together with this tunnel.
+// When the tunnel is already closed, closes them immediatly and returns false.
+func (t *Tunnel) track(closers ...io.Closer) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.closed {
+		for _, closer := range closers {
+			closer.Close()
+		}
+		return false
+	}
+
+	if t.closers == nil {
+		t.closers = make(map[io.Closer]struct{})
+	}
+	for _, closer := range closers {
+		t.closers[closer] = struct{}{}
+	}
+	return true
+}
+
+// untrack removes closers added by track.
+func (t *Tunnel) untrack(closers ...io.Closer) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for _, closer := range closers {
+		delete(t.closers, closer)
+	}
+}
+
+// pipe copies data between channel and conn in both directions until either one is closed.
+// Traffic is counted in this tunnel.
+func (t *Tunnel) pipe(channel gossh.Channel, conn net.Conn) {
+	if !t.track(channel, conn) {
+		return
+	}
+	t.connections.Add(1)
+
+	var once sync.Once
+	done := func() {
+		once.Do(func() {
+			channel.Close()
+			conn.Close()
+			t.untrack(channel, conn)
+			t.connections.Add(-1)
+		})
+	}
+
+	go func() {
+		defer done()
+		io.Copy(countingWriter{Writer: conn, count: &t.bytesIn}, channel)
+	}()
+	go func() {
+		defer done()
+		io.Copy(countingWriter{Writer: channel, count: &t.bytesOut}, conn)
+	}()
+}
+
+// countingWriter is an io.Writer that counts the bytes written to it
+type countingWriter struct {
+	io.Writer
+	count *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	cw.count.Add(int64(n))
+	return n, err
+}
+
+// tunnelSet holds the tunnels of a single connection
+type tunnelSet struct {
+	m       sync.Mutex
+	nextID  int
+	tunnels []*Tunnel // ordered by id
+}
+
+// tunnelContextKey is the context key used to store the *tunnelSet of a connection
+type tunnelContextKey struct{}
+
+// tunnelsOf returns the tunnels of the connection of ctx, creating them if needed.
+func tunnelsOf(ctx ssh.Context) *tunnelSet {
+	ctx.Lock()
+	defer ctx.Unlock()
+
+	if set, ok := ctx.Value(tunnelContextKey{}).(*tunnelSet); ok {
+		return set
+	}
+
+	set := &tunnelSet{nextID: 1}
+	ctx.SetValue(tunnelContextKey{}, set)
+	return set
+}
+
+// add adds a new tunnel to this set.
+func (ts *tunnelSet) add(direction string, address NetworkAddress) *Tunnel {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	return ts.addLocked(direction, address)
+}
+
+// addLocked is like add, but expects ts.m to be held.
+func (ts *tunnelSet) addLocked(direction string, address NetworkAddress) *Tunnel {
+	tunnel := &Tunnel{
+		ID:        ts.nextID,
+		Direction: direction,
+		Address:   address,
+		Started:   time.Now(),
+	}
+	ts.nextID++
+	ts.tunnels = append(ts.tunnels, tunnel)
+	return tunnel
+}
+
+// local returns the local tunnel to address, creating it if it does not exist.
+// The returned tunnel may be closed.
+func (ts *tunnelSet) local(address NetworkAddress) *Tunnel {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	for _, tunnel := range ts.tunnels {
+		if tunnel.Direction == "local" && tunnel.Address == address {
+			return tunnel
+		}
+	}
+	return ts.addLocked("local", address)
+}
+
+// reverse returns the open reverse tunnel requested for, or listening on, address, if any.
+func (ts *tunnelSet) reverse(address string) (*Tunnel, bool) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	for _, tunnel := range ts.tunnels {
+		if tunnel.Direction == "reverse" && (tunnel.requested == address || tunnel.Address.String() == address) && !tunnel.Closed() {
+			return tunnel, true
+		}
+	}
+	return nil, false
+}
+
+// open returns all open tunnels in this set.
+func (ts *tunnelSet) open() []*Tunnel {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	tunnels := make([]*Tunnel, 0, len(ts.tunnels))
+	for _, tunnel := range ts.tunnels {
+		if !tunnel.Closed() {
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+	return tunnels
+}
+
+// Tunnels returns the open tunnels of the connection of ctx, ordered by their id.
+// Tunnels are only tracked when port forwarding has been enabled using EnablePortForwarding.
+func Tunnels(ctx ssh.Context) []*Tunnel {
+	return tunnelsOf(ctx).open()
+}
+
+// ErrTunnelNotFound is returned by CloseTunnel when the tunnel does not exist
+var ErrTunnelNotFound = errors.New("CloseTunnel: Tunnel not found")
+
+// CloseTunnel closes the open tunnel with the provided id of the connection of ctx.
+// When no such tunnel exists, returns ErrTunnelNotFound.
+func CloseTunnel(ctx ssh.Context, id int) error {
+	for _, tunnel := range Tunnels(ctx) {
+		if tunnel.ID == id {
+			return tunnel.Close()
+		}
+	}
+	return ErrTunnelNotFound
+}
+
+// direct-tcpip channel data, see RFC4254, Section 7.2
+type directTCPIPData struct {
+	DestAddr string
+	DestPort uint32
+
+	OriginAddr string
+	OriginPort uint32
+}
+
+// tunnelDirectTCPIPHandler is like ssh.DirectTCPIPHandler, but keeps track of tunnels, records metrics and routes forwardings, see RouteForwards
+func tunnelDirectTCPIPHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	var data directTCPIPData
+	if err := gossh.Unmarshal(newChan.ExtraData(), &data); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	destination := NetworkAddress{Hostname: data.DestAddr, Port: NetworkPort(data.DestPort)}
+
+	// routed forwardings bypass the callback
+	target, routed, err := routeForward(ctx, destination)
+	if err != nil {
+		newChan.Reject(gossh.Prohibited, err.Error())
+		return
+	}
+	if !routed {
+		if srv.LocalPortForwardingCallback == nil || !srv.LocalPortForwardingCallback(ctx, data.DestAddr, data.DestPort) {
+			newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
+			return
+		}
+		target = net.JoinHostPort(data.DestAddr, strconv.FormatUint(uint64(data.DestPort), 10))
+	}
+
+	tunnel := tunnelsOf(ctx).local(destination)
+	if tunnel.Closed() {
+		newChan.Reject(gossh.Prohibited, "tunnel has been closed")
+		return
+	}
+
+	var dialer net.Dialer
+	dconn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := metricsNewChannel{NewChannel: newChan}.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(requests)
+
+	tunnel.pipe(channel, dconn)
+}
+
+// tcpip-forward and cancel-tcpip-forward request data, see RFC4254, Section 7.1
+type tcpipForwardData struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// tcpip-forward response data, see RFC4254, Section 7.1
+type tcpipForwardSuccess struct {
+	BindPort uint32
+}
+
+// forwarded-tcpip channel data, see RFC4254, Section 7.2
+type forwardedTCPIPData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// tunnelForwardHandler is like ssh.ForwardedTCPHandler, but keeps track of tunnels.
+// Unlike ssh.ForwardedTCPHandler, a client can only cancel its own reverse tunnels.
+func tunnelForwardHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	var data tcpipForwardData
+	if err := gossh.Unmarshal(req.Payload, &data); err != nil {
+		return false, []byte{}
+	}
+	address := net.JoinHostPort(data.BindAddr, strconv.FormatUint(uint64(data.BindPort), 10))
+
+	switch req.Type {
+	case "tcpip-forward":
+		if srv.ReversePortForwardingCallback == nil || !srv.ReversePortForwardingCallback(ctx, data.BindAddr, data.BindPort) {
+			return false, []byte("port forwarding is disabled")
+		}
+
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return false, []byte{}
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+
+		tunnel := tunnelsOf(ctx).add("reverse", NetworkAddress{Hostname: data.BindAddr, Port: NetworkPort(port)})
+		tunnel.requested = address
+		tunnel.track(listener)
+
+		go func() {
+			<-ctx.Done()
+			tunnel.Close()
+		}()
+
+		conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+		go func() {
+			defer tunnel.Close()
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+
+				go func() {
+					originAddr, originPort, _ := net.SplitHostPort(c.RemoteAddr().String())
+					originPortNumber, _ := strconv.ParseUint(originPort, 10, 32)
+
+					channel, requests, err := conn.OpenChannel("forwarded-tcpip", gossh.Marshal(&forwardedTCPIPData{
+						DestAddr:   data.BindAddr,
+						DestPort:   uint32(port),
+						OriginAddr: originAddr,
+						OriginPort: uint32(originPortNumber),
+					}))
+					if err != nil {
+						c.Close()
+						return
+					}
+					go gossh.DiscardRequests(requests)
+
+					tunnel.pipe(newMetricsChannel(channel), c)
+				}()
+			}
+		}()
+
+		return true, gossh.Marshal(&tcpipForwardSuccess{BindPort: uint32(port)})
+
+	case "cancel-tcpip-forward":
+		if tunnel, ok := tunnelsOf(ctx).reverse(address); ok {
+			tunnel.Close()
+		}
+		return true, nil
+
+	default:
+		return false, nil
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/gliderlabs/ssh"
 	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/logging"
 )
 
@@ -13,6 +14,32 @@ type Handler interface {
 	Handle(logger logging.Logger, session ssh.Session) (Process, error)
 }
 
+// HandlerFunc is an adapter to allow the use of ordinary functions as a Handler.
+type HandlerFunc func(logger logging.Logger, session ssh.Session) (Process, error)
+
+// Handle calls f(logger, session).
+func (f HandlerFunc) Handle(logger logging.Logger, session ssh.Session) (Process, error) {
+	return f(logger, session)
+}
+
+// BackendHandler is a Handler that reports the name of its backend.
+// The name is used to label metrics about sessions.
+type BackendHandler interface {
+	Handler
+
+	// Backend returns the name of the backend, for example "osexec".
+	Backend() string
+}
+
+// backendName returns the name of the backend of handler.
+// When handler does not implement BackendHandler, returns "unknown".
+func backendName(handler Handler) string {
+	if bh, ok := handler.(BackendHandler); ok {
+		return bh.Backend()
+	}
+	return "unknown"
+}
+
 // ErrHandlerAlreadySet is returned by ApplyHandler when a handler is already applies to the server.
 var ErrHandlerAlreadySet = errors.New("ApplyHandler: Handler already set")
 
@@ -24,20 +51,52 @@ func ApplyHandler(logger logging.Logger, server *ssh.Server, handler Handler) er
 		return ErrHandlerAlreadySet
 	}
 
-	server.Handler = makeProcessHandler(logger, handler)
+	server.Handler = makeProcessHandler(logger, backendName(handler), handler)
+	return nil
+}
+
+// ErrSubsystemAlreadySet is returned by ApplySubsystem when a handler for the subsystem is already applied to the server.
+var ErrSubsystemAlreadySet = errors.New("ApplySubsystem: Subsystem already set")
+
+// ApplySubsystem applies a handler for the subsystem with the provided name to a server by setting server.SubsystemHandlers.
+// When a handler for this subsystem is already set, returns an error.
+//
+// Sessions requesting the subsystem are handled like regular sessions, but using the provided handler.
+// In metrics, the name of the subsystem is used as the name of the backend.
+func ApplySubsystem(logger logging.Logger, server *ssh.Server, name string, handler Handler) error {
+	if _, ok := server.SubsystemHandlers[name]; ok {
+		return ErrSubsystemAlreadySet
+	}
+
+	if server.SubsystemHandlers == nil {
+		server.SubsystemHandlers = make(map[string]ssh.SubsystemHandler)
+	}
+	server.SubsystemHandlers[name] = ssh.SubsystemHandler(makeProcessHandler(logger, name, handler))
 	return nil
 }
 
 // makeProcessHandler creates a new ssh.Handler that implements handler.
-func makeProcessHandler(logger logging.Logger, handler Handler) ssh.Handler {
+// backend is the name of the backend used for metrics.
+func makeProcessHandler(logger logging.Logger, backend string, handler Handler) ssh.Handler {
 	return func(session ssh.Session) {
 		// logging
-		logging.FmtSSHLog(logger, session, "session_start %s", session.User())
-		defer logging.FmtSSHLog(logger, session, "session_end")
+		logging.LogSSHEvent(logger, session, logging.EventSessionStart, "%s", session.User())
+		defer logging.LogSSHEvent(logger, session, logging.EventSessionEnd, "")
+
+		// enforce limits
+		limits := limitsOf(serverOf(session.Context()))
+		release, err := acquireSession(session, limits)
+		if err != nil {
+			feature.ObserveSession(backend)(255)
+			abortsession(logger, session, err)
+			return
+		}
+		defer release()
 
 		// handle the provided session
 		process, err := handler.Handle(logger, session)
 		if err != nil {
+			feature.ObserveSession(backend)(255)
 			abortsession(logger, session, errors.Wrap(err, "Failed to create process"))
 			return
 		}
@@ -45,14 +104,20 @@ func makeProcessHandler(logger logging.Logger, handler Handler) ssh.Handler {
 		sshcmd := &Session{
 			Session: session,
 			Logger:  logger,
+			Backend: backend,
 			Process: process,
+
+			sessions: sessionGroupOf(serverOf(session.Context())),
+		}
+		if limits != nil {
+			sshcmd.maxDuration = limits.MaxSessionDuration
 		}
 		if err != nil {
 			abortsession(logger, session, errors.Wrap(err, "Failed to create ssh command"))
 			return
 		}
 
-		logging.FmtSSHLog(logger, session, "session_valid %s", process)
+		sshcmd.logEvent(logging.EventSessionValid, "%s", process)
 		sshcmd.Run()
 	}
 }
@@ -61,7 +126,7 @@ func makeProcessHandler(logger logging.Logger, handler Handler) ssh.Handler {
 // It also prints the error message to the user on STDERR.
 func abortsession(logger logging.Logger, s ssh.Session, err error) {
 	errmsg := err.Error()
-	logging.FmtSSHLog(logger, s, "session_command %s", errmsg)
+	logging.LogSSHEvent(logger, s, logging.EventSessionCommand, "%s", errmsg)
 	io.WriteString(s.Stderr(), errmsg+"\n")
 	s.Exit(255)
 }
@@ -1,8 +1,10 @@
 package term
 
 import (
+	"context"
 	"io"
 	"os"
+	"sync"
 )
 
 // Pipes can be used by a Process to implement piped input / output
@@ -10,7 +12,8 @@ type Pipes struct {
 	StdoutPipe, StderrPipe *os.File
 	StdinPipe              *os.File
 
-	descriptors []io.Closer // will be closed after a call to Close()
+	descriptors []io.Closer   // will be closed after a call to Close()
+	outputs     []*OutputPipe // reading ends of the output pipes
 }
 
 // osPipe calls os.Pipe() and adds both ends to descriptors.
@@ -23,15 +26,27 @@ func (p *Pipes) osPipe() (*os.File, *os.File, error) {
 	return pr, pw, nil
 }
 
+// outputPipe calls NewOutputPipe() and keeps track of the reading end, so that it can be drained.
+// Both ends are added to descriptors.
+func (p *Pipes) outputPipe() (io.ReadCloser, *os.File, error) {
+	pipe, pw, err := NewOutputPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.descriptors = append(p.descriptors, pw, pipe.File)
+	p.outputs = append(p.outputs, pipe)
+	return pipe, pw, nil
+}
+
 // Stdout returns a pipe to Stdout
 func (p *Pipes) Stdout() (stdout io.ReadCloser, err error) {
-	stdout, p.StdoutPipe, err = p.osPipe()
+	stdout, p.StdoutPipe, err = p.outputPipe()
 	return
 }
 
 // Stderr returns a pipe to Stderr
 func (p *Pipes) Stderr() (stderr io.ReadCloser, err error) {
-	stderr, p.StderrPipe, err = p.osPipe()
+	stderr, p.StderrPipe, err = p.outputPipe()
 	return
 }
 
@@ -41,6 +56,26 @@ func (p *Pipes) Stdin() (stdin io.WriteCloser, err error) {
 	return
 }
 
+// DrainOutput closes the writing ends of StdoutPipe and StderrPipe.
+// It then waits until the reading ends have been read until the end, or have been closed, or ctx is done.
+//
+// This should be called once the process will not produce any more output, to ensure that the output is not lost.
+func (p *Pipes) DrainOutput(ctx context.Context) {
+	for _, writer := range []*os.File{p.StdoutPipe, p.StderrPipe} {
+		if writer != nil {
+			writer.Close()
+		}
+	}
+
+	for _, pipe := range p.outputs {
+		select {
+		case <-pipe.Done():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 // ClosePipes closes all pipes (if any)
 func (p *Pipes) ClosePipes() {
 	for _, d := range p.descriptors {
@@ -48,3 +83,42 @@ func (p *Pipes) ClosePipes() {
 	}
 	p.descriptors = nil
 }
+
+// NewOutputPipe creates a new pipe for the output of a process.
+// The writing end should be passed to the process, and closed once the process has been started.
+//
+// Unlike the pipes of exec.Cmd, the reading end is not closed once the process exits.
+// Instead callers can wait for it to be read until the end using Done.
+func NewOutputPipe() (reader *OutputPipe, writer *os.File, err error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &OutputPipe{File: pr, done: make(chan struct{})}, pw, nil
+}
+
+// OutputPipe is the reading end of an output pipe.
+type OutputPipe struct {
+	*os.File
+
+	once sync.Once
+	done chan struct{}
+}
+
+// Done returns a channel that is closed once the pipe has been read until the end, or has been closed.
+func (op *OutputPipe) Done() <-chan struct{} {
+	return op.done
+}
+
+func (op *OutputPipe) Read(p []byte) (n int, err error) {
+	n, err = op.File.Read(p)
+	if err != nil {
+		op.once.Do(func() { close(op.done) })
+	}
+	return
+}
+
+func (op *OutputPipe) Close() error {
+	op.once.Do(func() { close(op.done) })
+	return op.File.Close()
+}
@@ -3,12 +3,15 @@ package testutils
 import (
 	"bytes"
 	"net"
+	"strings"
 	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 // NewTestServerSession connects and starts a new ssh session on the sever listening at address.
+// address may be of the form 'unix:path' to connect to a unix socket instead.
 //
 // This function sets reasonable defaults for the options.
 // If options.HostKeyCallback is not set, sets it to a function that accepts every host key.
@@ -38,7 +41,11 @@ func NewTestServerSession(address string, options ssh.ClientConfig) (*ssh.Client
 	}
 
 	// create a new client
-	conn, err := ssh.Dial("tcp", address, &options)
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", path
+	}
+	conn, err := ssh.Dial(network, address, &options)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -101,3 +108,25 @@ func RunTestServerCommand(address string, options ssh.ClientConfig, command, std
 
 	return
 }
+
+// NewTestSFTPClient connects to the ssh server listening at address and starts a new sftp client.
+// The address and options parameters are passed to NewTestServerSession.
+//
+// If no error occurs, the function expects the caller to call the Close() method on both clients.
+// If an error occurs during initialization, the clients will be closed and an error will be returned.
+//
+// This function is itself untested.
+func NewTestSFTPClient(address string, options ssh.ClientConfig) (*ssh.Client, *sftp.Client, error) {
+	client, session, err := NewTestServerSession(address, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	session.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return client, sftpClient, nil
+}
@@ -0,0 +1,201 @@
+package proxyssh
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Limits limit the number of concurrent connections and sessions, and the duration of sessions.
+// A zero value means that the respective quantity is not limited.
+//
+// Connections and sessions are counted for all servers in the same process.
+// A connection is counted once it has authenticated, including connections only used for port forwarding.
+// Connections exceeding a limit are closed right after authenticating.
+type Limits struct {
+	// MaxConnections is the maximum number of concurrent connections.
+	// MaxConnectionsPerUser is the maximum number of concurrent connections of a single user.
+	MaxConnections        int
+	MaxConnectionsPerUser int
+
+	// MaxSessions is the maximum number of concurrent sessions.
+	// MaxSessionsPerUser is the maximum number of concurrent sessions of a single user.
+	MaxSessions        int
+	MaxSessionsPerUser int
+
+	// MaxSessionDuration is the maximum duration of a single session.
+	// Sessions that take longer are terminated with exit code 255.
+	MaxSessionDuration time.Duration
+}
+
+// serverLimits holds the limits of all servers.
+// It maps an *ssh.Server to a *Limits.
+var serverLimits sync.Map
+
+// limitsOf returns the limits of server.
+// When server has no limits, returns nil.
+func limitsOf(server *ssh.Server) *Limits {
+	limits, _ := serverLimits.Load(server)
+	l, _ := limits.(*Limits)
+	return l
+}
+
+// apply applies limits to server.
+// This function wraps any already configured ConnCallback and ServerConfigCallback.
+func (limits Limits) apply(logger logging.Logger, server *ssh.Server) {
+	if limits == (Limits{}) {
+		serverLimits.Delete(server)
+		return
+	}
+	serverLimits.Store(server, &limits)
+
+	if limits.MaxConnections > 0 || limits.MaxConnectionsPerUser > 0 {
+		limits.limitConnections(logger, server)
+	}
+}
+
+// limiterConnKey is the context key used to store the net.Conn of a connection
+type limiterConnKey struct{}
+
+// limitConnections counts the authenticated connections of server, and closes those exceeding the limits.
+func (limits *Limits) limitConnections(logger logging.Logger, server *ssh.Server) {
+	// the connection is only available before the handshake
+	next := server.ConnCallback
+	server.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+		if next != nil {
+			conn = next(ctx, conn)
+			if conn == nil {
+				return nil
+			}
+		}
+		ctx.SetValue(limiterConnKey{}, conn)
+		return conn
+	}
+
+	// only the server configuration knows if authentication ultimately succeeded
+	nextConfig := server.ServerConfigCallback
+	server.ServerConfigCallback = func(ctx ssh.Context) *gossh.ServerConfig {
+		config := &gossh.ServerConfig{}
+		if nextConfig != nil {
+			config = nextConfig(ctx)
+		}
+
+		nextLog := config.AuthLogCallback
+		config.AuthLogCallback = func(meta gossh.ConnMetadata, method string, err error) {
+			if nextLog != nil {
+				nextLog(meta, method, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if err := acquireConnection(ctx, meta.User(), limits); err != nil {
+				logging.LogSSHEvent(logger, nil, logging.EventRejectMaxConnections, "%s: %s", meta.RemoteAddr(), err)
+				if conn, ok := ctx.Value(limiterConnKey{}).(net.Conn); ok {
+					conn.Close()
+				}
+			}
+		}
+		return config
+	}
+}
+
+// limiter counts the connections and sessions of all servers
+var limiter struct {
+	m sync.Mutex
+
+	connections     int
+	userConnections map[string]int
+
+	sessions     int
+	userSessions map[string]int
+}
+
+// acquireConnection checks that the connection of ctx may be used according to limits, and then counts it until ctx is done.
+// When a limit would be exceeded, returns an error.
+func acquireConnection(ctx ssh.Context, user string, limits *Limits) error {
+	limiter.m.Lock()
+	defer limiter.m.Unlock()
+
+	if limiter.userConnections == nil {
+		limiter.userConnections = make(map[string]int)
+	}
+
+	// check the limits
+	switch {
+	case limits.MaxConnections > 0 && limiter.connections >= limits.MaxConnections:
+		return errors.New("Too many connections")
+	case limits.MaxConnectionsPerUser > 0 && limiter.userConnections[user] >= limits.MaxConnectionsPerUser:
+		return errors.Errorf("Too many connections for user %q, at most %d are allowed", user, limits.MaxConnectionsPerUser)
+	}
+
+	// count the connection until it is closed
+	limiter.connections++
+	limiter.userConnections[user]++
+
+	go func() {
+		<-ctx.Done()
+
+		limiter.m.Lock()
+		defer limiter.m.Unlock()
+
+		limiter.connections--
+		decrementUser(limiter.userConnections, user)
+	}()
+	return nil
+}
+
+// acquireSession checks that session may be started according to limits, and then counts it.
+//
+// When a limit would be exceeded, returns an error that can be shown to the user.
+// Otherwise, returns a function that should be called once the session has ended.
+func acquireSession(session ssh.Session, limits *Limits) (release func(), err error) {
+	if limits == nil {
+		return func() {}, nil
+	}
+
+	user := session.User()
+
+	limiter.m.Lock()
+	defer limiter.m.Unlock()
+
+	if limiter.userSessions == nil {
+		limiter.userSessions = make(map[string]int)
+	}
+
+	// check the limits
+	switch {
+	case limits.MaxSessions > 0 && limiter.sessions >= limits.MaxSessions:
+		return nil, errors.New("Too many sessions, try again later")
+	case limits.MaxSessionsPerUser > 0 && limiter.userSessions[user] >= limits.MaxSessionsPerUser:
+		return nil, errors.Errorf("Too many sessions for user %q, at most %d are allowed", user, limits.MaxSessionsPerUser)
+	}
+
+	// count the session until it is released
+	limiter.sessions++
+	limiter.userSessions[user]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limiter.m.Lock()
+			defer limiter.m.Unlock()
+
+			limiter.sessions--
+			decrementUser(limiter.userSessions, user)
+		})
+	}, nil
+}
+
+// decrementUser decrements the count of user in counts, and removes it once it reaches zero.
+func decrementUser(counts map[string]int, user string) {
+	counts[user]--
+	if counts[user] <= 0 {
+		delete(counts, user)
+	}
+}
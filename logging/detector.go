@@ -146,12 +146,12 @@ func (d *MemoryLeakDetectorOn) Finish(logger Logger, s LogSessionOrContext) {
 
 func (d *MemoryLeakDetectorOn) unfire(logger Logger, s LogSessionOrContext) {
 	atomic.AddUint64(&leakDetectorState.Success, 1)
-	FmtSSHLog(logger, s, "leak_ok")
+	LogSSHEvent(logger, s, EventLeakOK, "")
 }
 
 func (d *MemoryLeakDetectorOn) fire(logger Logger, s LogSessionOrContext) {
 	atomic.AddUint64(&leakDetectorState.Failure, 1)
-	FmtSSHLog(logger, s, "leak_fail")
+	LogSSHEvent(logger, s, EventLeakFail, "")
 	d.m.Range(func(k, v interface{}) bool {
 		logger.Printf("Leak Detector: %s (%q)", v, k)
 		return true
@@ -0,0 +1,298 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+)
+
+// EventType identifies the kind of an Event.
+//
+// Event types are stable and can be used by log pipelines to identify events.
+type EventType string
+
+// Event types logged by proxyssh.
+const (
+	// events related to the lifecycle of a session
+	EventSessionStart   EventType = "session_start"
+	EventSessionValid   EventType = "session_valid"
+	EventSessionCommand EventType = "session_command"
+	EventSessionRecord  EventType = "session_record"
+	EventSessionExit    EventType = "session_exit"
+	EventSessionEnd     EventType = "session_end"
+	EventPtyStart       EventType = "pty_start_success"
+
+	// events related to the process of a session
+	EventCommandReturn      EventType = "command_return"
+	EventCommandReturnFail  EventType = "command_return_fail"
+	EventCommandKill        EventType = "command_kill"
+	EventCommandKillFailure EventType = "command_kill_failure"
+
+	// events related to the memory leak detector
+	EventLeakDetectorEnabled EventType = "memory_leak_detector_enabled"
+	EventLeakOK              EventType = "leak_ok"
+	EventLeakFail            EventType = "leak_fail"
+
+	// events related to authentication and port forwarding
+	EventKeyfinderError          EventType = "error_keyfinder"
+	EventGrantPortForward        EventType = "grant_portforward"
+	EventDenyPortForward         EventType = "deny_portforward"
+	EventGrantReversePortForward EventType = "grant_reverse_portforward"
+	EventDenyReversePortForward  EventType = "deny_reverse_portforward"
+	EventGrantRoute              EventType = "grant_route"
+	EventDenyRoute               EventType = "deny_route"
+	EventGrantAgentForward       EventType = "grant_agent_forward"
+	EventDenyAgentForward        EventType = "deny_agent_forward"
+
+	// events related to the configuration of the server
+	EventLoadHostKey          EventType = "load_hostkey"
+	EventGenerateHostKey      EventType = "generate_hostkey"
+	EventAllowForwardTo       EventType = "allow_forward_to"
+	EventAllowForwardFrom     EventType = "allow_forward_from"
+	EventAcceptEnv            EventType = "accept_env"
+	EventAllowAgentForwarding EventType = "allow_agent_forwarding"
+	EventRecordSessions       EventType = "record_sessions"
+	EventServeMetrics         EventType = "serve_metrics"
+	EventListen               EventType = "listen"
+	EventAcceptProxyProtocol  EventType = "accept_proxy_protocol"
+	EventRestrictAccess       EventType = "restrict_access"
+	EventShowBanner           EventType = "show_banner"
+	EventShowMessageOfTheDay  EventType = "show_motd"
+
+	// events related to incoming connections
+	EventProxyHeaderFail      EventType = "proxy_header_fail"
+	EventBan                  EventType = "ban"
+	EventUnban                EventType = "unban"
+	EventRejectBanned         EventType = "reject_banned"
+	EventRejectMaxStartups    EventType = "reject_max_startups"
+	EventRejectMaxConnections EventType = "reject_max_connections"
+	EventDenyConnection       EventType = "deny_connection"
+	EventRenderMessageFail    EventType = "render_message_fail"
+
+	// events related to the shutdown of the server
+	EventShutdownStart    EventType = "shutdown_start"
+	EventShutdownComplete EventType = "shutdown_complete"
+	EventReload           EventType = "reload"
+	EventReloadFail       EventType = "reload_fail"
+)
+
+// Level returns the slog level events of this type are logged at.
+func (typ EventType) Level() slog.Level {
+	switch typ {
+	case EventSessionCommand, EventCommandReturnFail, EventCommandKillFailure, EventLeakFail, EventKeyfinderError, EventDenyPortForward, EventDenyReversePortForward, EventDenyRoute, EventDenyAgentForward, EventProxyHeaderFail, EventBan, EventRejectBanned, EventRejectMaxStartups, EventRejectMaxConnections, EventDenyConnection, EventRenderMessageFail, EventReloadFail:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// Event represents a single structured log event.
+type Event struct {
+	Type EventType
+
+	// information about the session the event belongs to.
+	// These are empty for events that do not belong to a session.
+	SessionID  string
+	User       string
+	RemoteAddr string
+
+	// ContainerID is the id of the container the session is running in, if any.
+	// Command is the command requested by the client, if any.
+	ContainerID string
+	Command     []string
+
+	// ExitCode is the exit code of the session or process, if any.
+	ExitCode *int
+
+	// Message holds additional free-form information about the event.
+	Message string
+}
+
+// sessionIDer is implemented by ssh.Context
+type sessionIDer interface {
+	SessionID() string
+}
+
+// contexter is implemented by ssh.Session
+type contexter interface {
+	Context() ssh.Context
+}
+
+// commander is implemented by ssh.Session
+type commander interface {
+	Command() []string
+}
+
+// NewEvent creates a new event of the provided type, and fills in information about s.
+// The message is formatted using fmt.Sprintf.
+//
+// s may be nil, in which case the event does not belong to any session.
+func NewEvent(s LogSessionOrContext, typ EventType, message string, args ...interface{}) Event {
+	event := Event{Type: typ}
+	if len(args) > 0 {
+		event.Message = fmt.Sprintf(message, args...)
+	} else {
+		event.Message = message
+	}
+
+	if s == nil {
+		return event
+	}
+
+	event.User = s.User()
+	if addr := s.RemoteAddr(); addr != nil {
+		event.RemoteAddr = addr.String()
+	}
+
+	switch ctx := s.(type) {
+	case sessionIDer:
+		event.SessionID = ctx.SessionID()
+	case contexter:
+		event.SessionID = ctx.Context().SessionID()
+	}
+
+	if cmd, ok := s.(commander); ok {
+		event.Command = cmd.Command()
+	}
+
+	return event
+}
+
+// WithExitCode returns a copy of event with the exit code set to code.
+func (event Event) WithExitCode(code int) Event {
+	event.ExitCode = &code
+	return event
+}
+
+// String formats this event in the same way FmtSSHLog would.
+func (event Event) String() string {
+	var builder strings.Builder
+	if event.User != "" || event.RemoteAddr != "" {
+		fmt.Fprintf(&builder, "[%s@%s] ", event.User, event.RemoteAddr)
+	}
+	builder.WriteString(string(event.Type))
+	if event.Message != "" {
+		builder.WriteString(" ")
+		builder.WriteString(event.Message)
+	}
+	return builder.String()
+}
+
+// Attrs returns the fields of this event as a list of slog attributes.
+// Empty fields are omitted.
+func (event Event) Attrs() []slog.Attr {
+	attrs := []slog.Attr{slog.String("event", string(event.Type))}
+	if event.SessionID != "" {
+		attrs = append(attrs, slog.String("session", event.SessionID))
+	}
+	if event.User != "" {
+		attrs = append(attrs, slog.String("user", event.User))
+	}
+	if event.RemoteAddr != "" {
+		attrs = append(attrs, slog.String("remote", event.RemoteAddr))
+	}
+	if event.ContainerID != "" {
+		attrs = append(attrs, slog.String("container", event.ContainerID))
+	}
+	if len(event.Command) > 0 {
+		attrs = append(attrs, slog.Any("command", event.Command))
+	}
+	if event.ExitCode != nil {
+		attrs = append(attrs, slog.Int("exit_code", *event.ExitCode))
+	}
+	if event.Message != "" {
+		attrs = append(attrs, slog.String("message", event.Message))
+	}
+	return attrs
+}
+
+// EventLogger is a Logger that can log structured events.
+type EventLogger interface {
+	Logger
+
+	// LogEvent logs a single event.
+	LogEvent(event Event)
+}
+
+// LogEvent logs event to logger.
+//
+// When logger implements EventLogger, calls its LogEvent method.
+// Otherwise, prints the result of event.String() to logger.
+func LogEvent(logger Logger, event Event) {
+	if el, ok := logger.(EventLogger); ok {
+		el.LogEvent(event)
+		return
+	}
+	logger.Print(event.String())
+}
+
+// LogSSHEvent creates a new event using NewEvent and logs it to logger.
+//
+// This function is the structured equivalent of FmtSSHLog.
+func LogSSHEvent(logger Logger, s LogSessionOrContext, typ EventType, message string, args ...interface{}) {
+	LogEvent(logger, NewEvent(s, typ, message, args...))
+}
+
+// SlogLogger is an EventLogger that writes to a slog.Logger.
+//
+// Events are logged with their type as message and their fields as attributes.
+// Calls to Print and Printf are logged as informational messages without attributes.
+type SlogLogger struct {
+	Logger *slog.Logger
+}
+
+// SlogLogger fullfills EventLogger
+var _ EventLogger = (*SlogLogger)(nil)
+
+// NewSlogLogger creates a new SlogLogger writing to handler.
+func NewSlogLogger(handler slog.Handler) *SlogLogger {
+	return &SlogLogger{Logger: slog.New(handler)}
+}
+
+// NewJSONLogger creates a new SlogLogger that writes one json object per line to w.
+func NewJSONLogger(w io.Writer) *SlogLogger {
+	return NewSlogLogger(slog.NewJSONHandler(w, nil))
+}
+
+// Print implements Logger.Print.
+func (sl *SlogLogger) Print(v ...interface{}) {
+	sl.Logger.Info(fmt.Sprint(v...))
+}
+
+// Printf implements Logger.Printf.
+func (sl *SlogLogger) Printf(format string, v ...interface{}) {
+	sl.Logger.Info(fmt.Sprintf(format, v...))
+}
+
+// LogEvent implements EventLogger.LogEvent.
+func (sl *SlogLogger) LogEvent(event Event) {
+	sl.Logger.LogAttrs(context.Background(), event.Type.Level(), string(event.Type), event.Attrs()...)
+}
+
+// Log formats supported by NewLogger.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// NewLogger creates a new Logger writing to w in the provided format.
+//
+// FormatText creates a log.Logger writing free-form messages, prefixed with the date and time.
+// FormatJSON creates a logger using NewJSONLogger.
+// Any other format results in an error.
+func NewLogger(w io.Writer, format string) (Logger, error) {
+	switch format {
+	case FormatText:
+		return log.New(w, "", log.LstdFlags), nil
+	case FormatJSON:
+		return NewJSONLogger(w), nil
+	default:
+		return nil, errors.Errorf("NewLogger: Unknown log format %q", format)
+	}
+}
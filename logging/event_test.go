@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// testSessionWithID extends testSessionOrContext with a session id and command
+type testSessionWithID struct {
+	testSessionOrContext
+}
+
+func (testSessionWithID) SessionID() string { return "1234" }
+func (testSessionWithID) Command() []string { return []string{"echo", "hello"} }
+
+func TestLogEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{
+			"session event",
+			NewEvent(testSessionOrContext{}, EventSessionStart, "%s", "user"),
+			"[user@0.0.0.0:0] session_start user",
+		},
+		{
+			"session event without message",
+			NewEvent(testSessionOrContext{}, EventSessionEnd, ""),
+			"[user@0.0.0.0:0] session_end",
+		},
+		{
+			"server event",
+			NewEvent(nil, EventLoadHostKey, "%s %s", "rsa", "hostkey.pem_rsa"),
+			"load_hostkey rsa hostkey.pem_rsa",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &testLoggerObj{}
+			LogEvent(logger, tt.event)
+
+			got := logger.message
+			if got != tt.want {
+				t.Errorf("LogEvent(): Got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewJSONLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewJSONLogger(&buffer)
+
+	event := NewEvent(testSessionWithID{}, EventSessionExit, "%d", 1).WithExitCode(1)
+	event.ContainerID = "container"
+	LogEvent(logger, event)
+
+	var got struct {
+		Level     string   `json:"level"`
+		Msg       string   `json:"msg"`
+		Event     string   `json:"event"`
+		Session   string   `json:"session"`
+		User      string   `json:"user"`
+		Remote    string   `json:"remote"`
+		Container string   `json:"container"`
+		Command   []string `json:"command"`
+		ExitCode  *int     `json:"exit_code"`
+	}
+	if err := json.Unmarshal(buffer.Bytes(), &got); err != nil {
+		t.Fatalf("NewJSONLogger(): Unable to parse output %q: %s", buffer.String(), err)
+	}
+
+	if got.Level != "INFO" || got.Msg != "session_exit" || got.Event != "session_exit" {
+		t.Errorf("NewJSONLogger(): Got level %q, msg %q, event %q", got.Level, got.Msg, got.Event)
+	}
+	if got.Session != "1234" || got.User != "user" || got.Remote != "0.0.0.0:0" || got.Container != "container" {
+		t.Errorf("NewJSONLogger(): Got session %q, user %q, remote %q, container %q", got.Session, got.User, got.Remote, got.Container)
+	}
+	if len(got.Command) != 2 || got.Command[0] != "echo" || got.Command[1] != "hello" {
+		t.Errorf("NewJSONLogger(): Got command %v", got.Command)
+	}
+	if got.ExitCode == nil || *got.ExitCode != 1 {
+		t.Errorf("NewJSONLogger(): Got exit_code %v, want 1", got.ExitCode)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		format  string
+		wantErr bool
+	}{
+		{FormatText, false},
+		{FormatJSON, false},
+		{"xml", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			_, err := NewLogger(&bytes.Buffer{}, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewLogger() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
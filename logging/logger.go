@@ -1,4 +1,4 @@
-// Package logging provides Logger.
+// Package logging provides Logger and structured log events.
 package logging
 
 import (
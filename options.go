@@ -2,6 +2,8 @@ package proxyssh
 
 import (
 	"flag"
+	"net"
+	"net/netip"
 	"time"
 
 	"github.com/gliderlabs/ssh"
@@ -12,8 +14,18 @@ import (
 // Options are options that implement features shared by several server implementations.
 type Options struct {
 	// ListenAddress is the address to listen on.
-	// It should be of the form 'address:port'.
-	ListenAddress string
+	// ListenAddresses are additional addresses to listen on.
+	//
+	// Addresses should be of the form 'address:port', 'unix:path' or 'systemd[:name]'.
+	// See the Listen method for details.
+	ListenAddress   string
+	ListenAddresses []string
+
+	// ProxyProtocol are source addresses that are trusted to send a PROXY protocol header, typically load balancers.
+	// When non-empty, all listeners accept the PROXY protocol from these sources.
+	//
+	// See the ProxyProtocolListener function for details.
+	ProxyProtocol []netip.Prefix
 
 	// HostKeyPath is the path to which the host keys are stored.
 	// HostKeyAlgorithms are the algorithms to use for host keys.
@@ -26,6 +38,24 @@ type Options struct {
 	// This will result in a warning printed to the server
 	DisableAuthentication bool
 
+	// Access restricts the source addresses connections are accepted from.
+	// UserAccess additionally restricts the source addresses of specific users.
+	//
+	// See the RestrictAccess function for details.
+	Access     feature.AccessList
+	UserAccess map[string]feature.AccessList
+
+	// BruteForce configures protection against brute-force authentication attempts.
+	// When all of MaxFailures, FailureDelay and MaxStartups are zero, no protection is applied.
+	//
+	// See the ProtectBruteForce function for details.
+	BruteForce feature.BruteForceProtection
+
+	// Limits limit the number of connections and sessions, and the duration of sessions.
+	//
+	// See the Limits type for details.
+	Limits Limits
+
 	// ForwardAddresses are addresses that port forwarding is allowed for.
 	// ReverseAddresses are addresses that reverse port forwarding is allowed for.
 	//
@@ -33,8 +63,48 @@ type Options struct {
 	ForwardAddresses []feature.NetworkAddress
 	ReverseAddresses []feature.NetworkAddress
 
+	// AcceptEnv are patterns of environment variables that clients may send.
+	// Variables not matching any of these are silently dropped.
+	//
+	// See the AcceptEnvironment function for details.
+	AcceptEnv []string
+
+	// AgentForwarding are patterns of users that may forward their ssh agent into sessions.
+	// Handlers that support agent forwarding make it available to processes using the SSH_AUTH_SOCK environment variable.
+	//
+	// See the AllowAgentForwarding function for details.
+	AgentForwarding []string
+
+	// RecordDirectory is a directory to record all sessions into.
+	// When empty, sessions are not recorded.
+	//
+	// See the RecordSessions function for details.
+	RecordDirectory string
+
+	// BannerPath is the path to a template of a banner shown to clients before they authenticate.
+	// MessageOfTheDayPath is the path to a template of a message shown to clients after they have logged in.
+	// When empty, the respective message is not shown.
+	//
+	// See the ShowBanner and ShowMessageOfTheDay functions for details.
+	BannerPath          string
+	MessageOfTheDayPath string
+
+	// MetricsAddress is an address to serve prometheus metrics on.
+	// It should be of the form 'address:port'.
+	// When empty, metrics are not served.
+	//
+	// See the ServeMetrics function for details.
+	MetricsAddress string
+
 	// IdleTimeout is the timeout after which a connection is considered idle.
 	IdleTimeout time.Duration
+
+	// ShutdownMessage is a message sent to all active sessions when the server is shutting down.
+	// DrainTimeout is the time to wait for clients to disconnect before terminating their sessions.
+	//
+	// See the Shutdown function for details.
+	ShutdownMessage string
+	DrainTimeout    time.Duration
 }
 
 // Apply applies the common options to server.
@@ -49,9 +119,41 @@ func (opts *Options) Apply(logger logging.Logger, sshserver *ssh.Server) error {
 		sshserver.PublicKeyHandler = nil
 	}
 
+	// setup limits
+	opts.Limits.apply(logger, sshserver)
+
 	// setup port-forwarding
 	feature.AllowPortForwarding(logger, sshserver, opts.ForwardAddresses, opts.ReverseAddresses)
 
+	// setup accepted environment variables
+	feature.AcceptEnvironment(logger, sshserver, opts.AcceptEnv)
+
+	// setup agent forwarding
+	feature.AllowAgentForwarding(logger, sshserver, opts.AgentForwarding)
+
+	// setup session recording
+	if opts.RecordDirectory != "" {
+		if err := feature.RecordSessions(logger, sshserver, opts.RecordDirectory); err != nil {
+			return err
+		}
+	}
+
+	// setup banner and message of the day
+	if opts.BannerPath != "" {
+		banner, err := feature.LoadMessage(opts.BannerPath)
+		if err != nil {
+			return err
+		}
+		feature.ShowBanner(logger, sshserver, banner)
+	}
+	if opts.MessageOfTheDayPath != "" {
+		motd, err := feature.LoadMessage(opts.MessageOfTheDayPath)
+		if err != nil {
+			return err
+		}
+		feature.ShowMessageOfTheDay(logger, sshserver, motd)
+	}
+
 	// setup host keys
 	if opts.HostKeyPath != "" {
 		if err := feature.UseOrMakeHostKeys(logger, sshserver, opts.HostKeyPath, opts.HostKeyAlgorithms); err != nil {
@@ -59,9 +161,56 @@ func (opts *Options) Apply(logger logging.Logger, sshserver *ssh.Server) error {
 		}
 	}
 
+	// setup access restrictions, after all authentication handlers have been set up
+	if !opts.Access.IsEmpty() || len(opts.UserAccess) > 0 {
+		feature.RestrictAccess(logger, sshserver, opts.Access, opts.UserAccess)
+	}
+
+	// setup brute force protection, after all authentication handlers have been set up
+	if bf := opts.BruteForce; bf.MaxFailures > 0 || bf.FailureDelay > 0 || bf.MaxStartups > 0 {
+		feature.ProtectBruteForce(logger, sshserver, bf)
+	}
+
+	// serve metrics, after all authentication handlers have been set up
+	if opts.MetricsAddress != "" {
+		if err := feature.ServeMetrics(logger, sshserver, opts.MetricsAddress); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// Listen creates listeners for ListenAddress and all ListenAddresses, see feature.Listen for details.
+// Empty addresses are skipped.
+// When ProxyProtocol is non-empty, listeners accept the PROXY protocol from the sources it contains.
+//
+// When a listener can not be created, all previously created listeners are closed and an error is returned.
+func (opts *Options) Listen(logger logging.Logger) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range append([]string{opts.ListenAddress}, opts.ListenAddresses...) {
+		if address == "" {
+			continue
+		}
+
+		ls, err := feature.Listen(logger, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ls...)
+	}
+
+	if len(opts.ProxyProtocol) > 0 {
+		for i, listener := range listeners {
+			listeners[i] = feature.ProxyProtocolListener(logger, listener, opts.ProxyProtocol)
+		}
+	}
+	return listeners, nil
+}
+
 // RegisterFlags registers flags representing the options to the provided flagset.
 // When flagset is nil, uses flag.CommandLine.
 //
@@ -72,7 +221,22 @@ func (opts *Options) RegisterFlags(flagset *flag.FlagSet, addUnsafeFlags bool) {
 	}
 
 	flagset.StringVar(&opts.ListenAddress, "port", opts.ListenAddress, "Port to listen on")
+
+	if opts.ListenAddresses == nil {
+		opts.ListenAddresses = []string{}
+	}
+	lv := feature.ListenAddressListVar{Addresses: &opts.ListenAddresses}
+	flagset.Var(&lv, "listen", "Additional addresses to listen on, e.g. '[::]:2222', 'unix:/path/to/socket' or 'systemd'")
+
+	if opts.ProxyProtocol == nil {
+		opts.ProxyProtocol = []netip.Prefix{}
+	}
+	pv := feature.NetworkPrefixListVar{Prefixes: &opts.ProxyProtocol}
+	flagset.Var(&pv, "proxyprotocol", "Source addresses trusted to send a PROXY protocol header, e.g. '10.0.0.0/8'")
+
 	flagset.DurationVar(&opts.IdleTimeout, "timeout", opts.IdleTimeout, "Timeout to kill inactive connections after")
+	flagset.StringVar(&opts.ShutdownMessage, "shutdownmessage", opts.ShutdownMessage, "Message to send to active sessions when shutting down")
+	flagset.DurationVar(&opts.DrainTimeout, "drain", opts.DrainTimeout, "Time to wait for active sessions to exit when shutting down")
 
 	if opts.ForwardAddresses == nil {
 		opts.ForwardAddresses = []feature.NetworkAddress{}
@@ -86,6 +250,46 @@ func (opts *Options) RegisterFlags(flagset *flag.FlagSet, addUnsafeFlags bool) {
 	bw := feature.NetworkAddressListVar{Addresses: &opts.ReverseAddresses}
 	flagset.Var(&bw, "R", "Ports to allow reverse forwarding for")
 
+	if opts.AcceptEnv == nil {
+		opts.AcceptEnv = []string{}
+	}
+	ev := feature.PatternListVar{Patterns: &opts.AcceptEnv}
+	flagset.Var(&ev, "acceptenv", "Environment variables clients may send, may contain wildcards")
+
+	if opts.AgentForwarding == nil {
+		opts.AgentForwarding = []string{}
+	}
+	agv := feature.PatternListVar{Patterns: &opts.AgentForwarding}
+	flagset.Var(&agv, "allowagent", "Users that may forward their ssh agent into sessions, may contain wildcards")
+
+	flagset.StringVar(&opts.RecordDirectory, "record", opts.RecordDirectory, "Directory to record sessions into")
+
+	flagset.StringVar(&opts.BannerPath, "banner", opts.BannerPath, "Path to a template of a banner shown before authentication")
+	flagset.StringVar(&opts.MessageOfTheDayPath, "motd", opts.MessageOfTheDayPath, "Path to a template of a message shown to interactive sessions after login")
+
+	flagset.StringVar(&opts.MetricsAddress, "metrics", opts.MetricsAddress, "Address to serve prometheus metrics on, e.g. ':9100'")
+
+	av := feature.NetworkPrefixListVar{Prefixes: &opts.Access.Allow}
+	flagset.Var(&av, "allowfrom", "Source addresses to allow connections from, e.g. '10.0.0.0/8'")
+	dv := feature.NetworkPrefixListVar{Prefixes: &opts.Access.Deny}
+	flagset.Var(&dv, "denyfrom", "Source addresses to deny connections from, e.g. '192.0.2.0/24'")
+	uav := feature.UserAccessListVar{Lists: &opts.UserAccess}
+	flagset.Var(&uav, "userallowfrom", "Source addresses to allow connections of a user from, e.g. 'deploy=10.1.0.0/16'")
+	udv := feature.UserAccessListVar{Lists: &opts.UserAccess, Deny: true}
+	flagset.Var(&udv, "userdenyfrom", "Source addresses to deny connections of a user from, e.g. 'deploy=192.0.2.0/24'")
+
+	flagset.IntVar(&opts.BruteForce.MaxFailures, "maxauthtries", opts.BruteForce.MaxFailures, "Number of failed authentication attempts after which a source address is banned, 0 to disable")
+	flagset.BoolVar(&opts.BruteForce.BanUsers, "banusers", opts.BruteForce.BanUsers, "Also ban users after failed authentication attempts, allows anyone to lock out known users")
+	flagset.DurationVar(&opts.BruteForce.BanTime, "bantime", opts.BruteForce.BanTime, "Duration of the first ban, doubled for every following ban")
+	flagset.DurationVar(&opts.BruteForce.FailureDelay, "authdelay", opts.BruteForce.FailureDelay, "Delay of failed authentication attempts, doubled for every recent failure")
+	flagset.IntVar(&opts.BruteForce.MaxStartups, "maxstartups", opts.BruteForce.MaxStartups, "Maximum number of concurrent unauthenticated connections, 0 for unlimited")
+
+	flagset.IntVar(&opts.Limits.MaxConnections, "maxconns", opts.Limits.MaxConnections, "Maximum number of concurrent authenticated connections, 0 for unlimited")
+	flagset.IntVar(&opts.Limits.MaxConnectionsPerUser, "maxuserconns", opts.Limits.MaxConnectionsPerUser, "Maximum number of concurrent authenticated connections per user, 0 for unlimited")
+	flagset.IntVar(&opts.Limits.MaxSessions, "maxsessions", opts.Limits.MaxSessions, "Maximum number of concurrent sessions, 0 for unlimited")
+	flagset.IntVar(&opts.Limits.MaxSessionsPerUser, "maxusersessions", opts.Limits.MaxSessionsPerUser, "Maximum number of concurrent sessions per user, 0 for unlimited")
+	flagset.DurationVar(&opts.Limits.MaxSessionDuration, "maxduration", opts.Limits.MaxSessionDuration, "Maximum duration of a session, 0 for unlimited")
+
 	flagset.StringVar(&opts.HostKeyPath, "hostkey", opts.HostKeyPath, "Path hostkeys should be loaded from or created at")
 
 	if addUnsafeFlags {
@@ -0,0 +1,226 @@
+package proxyssh
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/tkw1536/proxyssh/logging"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ReloadFunc returns a fresh set of options and configurations.
+// It is typically implemented by re-reading command line flags and a configuration file.
+type ReloadFunc func() (*Options, []Configuration, error)
+
+// ReloadableServer is an ssh.Server whose options and configurations can be replaced while it is running.
+//
+// The embedded server only accepts connections, and delegates everything else to the current configuration.
+// Each connection keeps the configuration that was current when it was accepted.
+// This means that reloading only affects new connections, and existing sessions continue unaffected.
+//
+// The listening address, host keys and whether or not authentication is enabled are fixed when creating the server.
+// All other settings, including forwarding callbacks, authorization sources, handlers and timeouts are reloaded.
+type ReloadableServer struct {
+	*ssh.Server
+
+	logger logging.Logger
+	reload ReloadFunc
+
+	current atomic.Pointer[reloadState]
+}
+
+// reloadState is a single configuration of a ReloadableServer
+type reloadState struct {
+	server  *ssh.Server
+	options *Options
+}
+
+// reloadContextKey is the context key used to store the *reloadState of a connection
+type reloadContextKey struct{}
+
+// NewReloadableServer creates a new ReloadableServer.
+// server and options are the initial configuration of the server, and are typically created using NewServer.
+// reload is called by Reload to create a new configuration.
+func NewReloadableServer(logger logging.Logger, server *ssh.Server, options *Options, reload ReloadFunc) *ReloadableServer {
+	rs := &ReloadableServer{
+		logger: logger,
+		reload: reload,
+	}
+	rs.Server = &ssh.Server{
+		Addr:        server.Addr,
+		HostSigners: server.HostSigners,
+		Version:     server.Version,
+
+		ConnCallback:             rs.connCallback,
+		ConnectionFailedCallback: server.ConnectionFailedCallback,
+		ServerConfigCallback:     rs.serverConfigCallback,
+		BannerHandler:            rs.bannerHandler,
+
+		ChannelHandlers: map[string]ssh.ChannelHandler{"default": rs.handleChannel},
+		RequestHandlers: map[string]ssh.RequestHandler{"default": rs.handleRequest},
+	}
+
+	// authentication handlers have to be set on the listening server.
+	// They can not be added or removed later.
+	if server.PublicKeyHandler != nil {
+		rs.Server.PublicKeyHandler = func(ctx ssh.Context, key ssh.PublicKey) bool {
+			handler := stateOf(ctx).server.PublicKeyHandler
+			return handler != nil && handler(ctx, key)
+		}
+	}
+	if server.PasswordHandler != nil {
+		rs.Server.PasswordHandler = func(ctx ssh.Context, password string) bool {
+			handler := stateOf(ctx).server.PasswordHandler
+			return handler != nil && handler(ctx, password)
+		}
+	}
+	if server.KeyboardInteractiveHandler != nil {
+		rs.Server.KeyboardInteractiveHandler = func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+			handler := stateOf(ctx).server.KeyboardInteractiveHandler
+			return handler != nil && handler(ctx, challenger)
+		}
+	}
+
+	rs.use(server, options)
+	return rs
+}
+
+// use makes server and options the configuration for new connections.
+// Sessions of server count as sessions of the listening server, so that Shutdown reaches them.
+func (rs *ReloadableServer) use(server *ssh.Server, options *Options) {
+	sessionGroups.Store(server, sessionGroupOf(rs.Server))
+	rs.current.Store(&reloadState{server: server, options: options})
+}
+
+// Reload calls the ReloadFunc of this server, and uses the result as the configuration for new connections.
+// When something goes wrong, returns an error and keeps the current configuration.
+func (rs *ReloadableServer) Reload() error {
+	options, configurations, err := rs.reload()
+	if err != nil {
+		return err
+	}
+
+	server, err := NewServer(rs.logger, options, configurations...)
+	if err != nil {
+		return err
+	}
+
+	rs.use(server, options)
+	logging.LogSSHEvent(rs.logger, nil, logging.EventReload, "")
+	return nil
+}
+
+// ListenAndServe is like the ListenAndServe function, but additionally calls Reload when the process receives a hangup signal.
+// When shutting down the server, uses the current options.
+func (rs *ReloadableServer) ListenAndServe() error {
+	return listenAndServe(rs.logger, rs.Server, func() *Options {
+		return rs.current.Load().options
+	}, func() {
+		if err := rs.Reload(); err != nil {
+			logging.LogSSHEvent(rs.logger, nil, logging.EventReloadFail, "%s", err)
+		}
+	})
+}
+
+// stateOf returns the configuration used by the connection of ctx
+func stateOf(ctx ssh.Context) *reloadState {
+	return ctx.Value(reloadContextKey{}).(*reloadState)
+}
+
+// serverOf returns the server that handles the connection of ctx.
+// For connections of a ReloadableServer, this is the server of the configuration used by the connection.
+// For other connections, this is the server that accepted the connection.
+func serverOf(ctx ssh.Context) *ssh.Server {
+	if state, ok := ctx.Value(reloadContextKey{}).(*reloadState); ok {
+		return state.server
+	}
+	server, _ := ctx.Value(ssh.ContextKeyServer).(*ssh.Server)
+	return server
+}
+
+func (rs *ReloadableServer) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	state := rs.current.Load()
+	ctx.SetValue(reloadContextKey{}, state)
+
+	if state.server.ConnCallback != nil {
+		conn = state.server.ConnCallback(ctx, conn)
+		if conn == nil {
+			return nil
+		}
+	}
+
+	if state.server.IdleTimeout > 0 {
+		conn = &idleConn{Conn: conn, timeout: state.server.IdleTimeout}
+	}
+	return conn
+}
+
+func (rs *ReloadableServer) serverConfigCallback(ctx ssh.Context) *gossh.ServerConfig {
+	if callback := stateOf(ctx).server.ServerConfigCallback; callback != nil {
+		return callback(ctx)
+	}
+	return &gossh.ServerConfig{}
+}
+
+func (rs *ReloadableServer) bannerHandler(ctx ssh.Context) string {
+	server := stateOf(ctx).server
+	if server.BannerHandler != nil {
+		return server.BannerHandler(ctx)
+	}
+	return server.Banner
+}
+
+func (rs *ReloadableServer) handleChannel(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	server := stateOf(ctx).server
+
+	handlers := server.ChannelHandlers
+	if handlers == nil {
+		handlers = ssh.DefaultChannelHandlers
+	}
+
+	handler := handlers[newChan.ChannelType()]
+	if handler == nil {
+		handler = handlers["default"]
+	}
+	if handler == nil {
+		newChan.Reject(gossh.UnknownChannelType, "unsupported channel type")
+		return
+	}
+	handler(server, conn, newChan, ctx)
+}
+
+func (rs *ReloadableServer) handleRequest(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	server := stateOf(ctx).server
+
+	handlers := server.RequestHandlers
+	if handlers == nil {
+		handlers = ssh.DefaultRequestHandlers
+	}
+
+	handler := handlers[req.Type]
+	if handler == nil {
+		handler = handlers["default"]
+	}
+	if handler == nil {
+		return false, nil
+	}
+	return handler(ctx, server, req)
+}
+
+// idleConn is a net.Conn that is closed after timeout has passed without reading or writing
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (ic *idleConn) Read(p []byte) (int, error) {
+	ic.Conn.SetDeadline(time.Now().Add(ic.timeout))
+	return ic.Conn.Read(p)
+}
+
+func (ic *idleConn) Write(p []byte) (int, error) {
+	ic.Conn.SetDeadline(time.Now().Add(ic.timeout))
+	return ic.Conn.Write(p)
+}
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/feature"
 	"github.com/tkw1536/proxyssh/internal/asyncio"
 	"github.com/tkw1536/proxyssh/internal/lock"
 	"github.com/tkw1536/proxyssh/internal/term"
@@ -18,11 +21,18 @@ import (
 type Session struct {
 	ssh.Session                // the underlying ssh.session
 	Logger      logging.Logger // for logging
+	Backend     string         // name of the backend, for metrics
 
 	detector logging.MemoryLeakDetector // for keeping track of memory leak
 
 	Process Process // the process that this session should execute
 
+	recorder feature.Recorder // records the session, nil if not enabled
+	observed func(code int)   // records the exit code in metrics
+	sessions *sessionGroup    // group of active sessions, may be nil
+
+	maxDuration time.Duration // maximum duration of the session, zero if unlimited
+
 	// for finalization
 	started  lock.OneTime
 	finished lock.OneTime
@@ -50,6 +60,17 @@ type Process interface {
 	Cleanup() (killed bool)
 }
 
+// ContainerProcess is a Process that runs inside of a container.
+//
+// When the Process of a Session implements ContainerProcess, the container id is included in all log events of the session.
+type ContainerProcess interface {
+	Process
+
+	// ContainerID returns the id of the container the process runs in.
+	// It may return the empty string when the container has not yet been created.
+	ContainerID() string
+}
+
 // WindowSize represents the size of the window
 type WindowSize = term.Size
 
@@ -65,9 +86,10 @@ func (c *Session) Run() error {
 		return errAlreadyStarted
 	}
 
+	c.observed = feature.ObserveSession(c.Backend)
 	c.detector = logging.NewLeakDetector()
 	if logging.MemoryLeakEnabled {
-		c.fmtLog("memory_leak_detector_enabled")
+		c.logEvent(logging.EventLeakDetectorEnabled, "")
 	}
 
 	if err := c.start(); err != nil {
@@ -76,6 +98,19 @@ func (c *Session) Run() error {
 		return err
 	}
 
+	// the session is active until the process has been cleaned up
+	if c.sessions != nil {
+		c.sessions.add(c)
+	}
+
+	// terminate the session once it exceeds its maximum duration
+	if c.maxDuration > 0 {
+		timer := time.AfterFunc(c.maxDuration, func() {
+			c.finalize(255, errors.Errorf("Session exceeded maximum duration of %s", c.maxDuration))
+		})
+		defer timer.Stop()
+	}
+
 	// if the user session disconnects, exit immediatly
 	c.detector.Add("session: context cancel")
 	go func() {
@@ -101,6 +136,18 @@ func (c *Session) start() error {
 		return errors.Wrap(err, "Failed to initialize process")
 	}
 
+	// start recording (if enabled)
+	recorder, err := feature.NewRecorder(c.Session, isPty)
+	if err != nil {
+		return err
+	}
+	c.recorder = recorder
+
+	// show the message of the day to interactive sessions
+	if isPty {
+		c.writeMessageOfTheDay()
+	}
+
 	// start either a regular or pty session
 	if isPty {
 		return c.startPty()
@@ -121,7 +168,7 @@ func (c *Session) startRegular() error {
 	go func() {
 		defer c.detector.Done("session: stdout")
 		defer stdout.Close()
-		asyncio.CopyLeak(c.Context(), c, stdout)
+		asyncio.CopyLeak(c.Context(), c.record(c, feature.Recorder.Stdout), stdout)
 	}()
 
 	// create a pipe for stderr
@@ -133,7 +180,7 @@ func (c *Session) startRegular() error {
 	go func() {
 		defer c.detector.Done("session: stderr")
 		defer stderr.Close()
-		asyncio.CopyLeak(c.Context(), c.Stderr(), stderr)
+		asyncio.CopyLeak(c.Context(), c.record(c.Stderr(), feature.Recorder.Stderr), stderr)
 	}()
 
 	// create a pipe for stdin
@@ -146,7 +193,7 @@ func (c *Session) startRegular() error {
 	go func() {
 		defer c.detector.Done("session: stdin")
 		defer stdin.Close()
-		asyncio.CopyLeak(c.Context(), stdin, c)
+		asyncio.CopyLeak(c.Context(), c.record(stdin, feature.Recorder.Stdin), c)
 	}()
 
 	// and start the command
@@ -165,7 +212,10 @@ func (c *Session) startPty() error {
 	go func() {
 		defer c.detector.Done("session: winCh")
 		for win := range winCh {
-			// c.fmtLog("term_resize %d %d", win.Height, win.Width)
+			// c.logEvent("term_resize", "%d %d", win.Height, win.Width)
+			if c.recorder != nil {
+				c.recorder.Resize(win.Width, win.Height)
+			}
 			resizeChan <- WindowSize{
 				Height: uint16(win.Height),
 				Width:  uint16(win.Width),
@@ -178,30 +228,56 @@ func (c *Session) startPty() error {
 	if err != nil {
 		return err
 	}
-	c.fmtLog("pty_start_success")
+	c.logEvent(logging.EventPtyStart, "")
 
 	c.detector.Add("session: input")
 	go func() {
 		defer c.detector.Done("session: input")
-		asyncio.CopyLeak(c.Context(), f, c)
+		asyncio.CopyLeak(c.Context(), c.record(f, feature.Recorder.Stdin), c)
 	}()
 
 	c.detector.Add("session: output")
 	go func() {
 		defer c.detector.Done("session: output")
-		asyncio.CopyLeak(c.Context(), c, f)
+		asyncio.CopyLeak(c.Context(), c.record(c, feature.Recorder.Stdout), f)
 	}()
 
 	return nil
 }
 
+// writeMessageOfTheDay writes the message of the day, if any, to the session.
+// When the process runs inside a container, the container is made available to the message.
+func (c *Session) writeMessageOfTheDay() {
+	if cp, ok := c.Process.(ContainerProcess); ok && cp.ContainerID() != "" {
+		feature.SetContainer(c.Context(), cp.ContainerID())
+	}
+
+	motd := feature.MessageOfTheDay(c.Session)
+	if motd == "" {
+		return
+	}
+
+	// the terminal of the client is in raw mode, so line endings have to be translated
+	motd = strings.ReplaceAll(strings.ReplaceAll(motd, "\r\n", "\n"), "\n", "\r\n")
+	io.WriteString(c.record(c, feature.Recorder.Stdout), motd)
+}
+
+// record returns a writer that records into the stream of the recorder selected by stream, and then writes to w.
+// When the session is not being recorded, returns w.
+func (c *Session) record(w io.Writer, stream func(feature.Recorder) io.Writer) io.Writer {
+	if c.recorder == nil {
+		return w
+	}
+	return io.MultiWriter(stream(c.recorder), w)
+}
+
 // wait waits for this session to finish
 func (c *Session) wait() (code int, err error) {
 	code, err = c.Process.Wait(c.detector)
 	if err == nil {
-		c.fmtLog("command_return %d", code)
+		c.log(c.event(logging.EventCommandReturn, "%d", code).WithExitCode(code))
 	} else {
-		c.fmtLog("command_return_fail %s", err)
+		c.logEvent(logging.EventCommandReturnFail, "%s", err)
 	}
 	return
 }
@@ -220,14 +296,20 @@ func (c *Session) finalize(status int, err error) {
 		io.WriteString(c.Stderr(), err.Error()+"\n")
 	}
 
-	// trigger the leak detector
+	// finish the recording
+	if c.recorder != nil {
+		c.recorder.Close()
+	}
+
+	// trigger the leak detector and record metrics
 	c.detector.Finish(c.Logger, c.Session)
+	c.observed(status)
 
 	// mark that we are finalized, and return
 	if err == nil {
-		c.fmtLog("session_exit %d", status)
+		c.log(c.event(logging.EventSessionExit, "%d", status).WithExitCode(status))
 	} else {
-		c.fmtLog("session_exit %d %s", status, err.Error())
+		c.log(c.event(logging.EventSessionExit, "%d %s", status, err.Error()).WithExitCode(status))
 	}
 	c.Exit(status)
 
@@ -239,13 +321,32 @@ func (c *Session) finalize(status int, err error) {
 func (c *Session) killProcess() {
 	res := c.Process.Cleanup()
 	if res {
-		c.fmtLog("command_kill")
+		c.logEvent(logging.EventCommandKill, "")
 	} else {
-		c.fmtLog("command_kill_failure")
+		c.logEvent(logging.EventCommandKillFailure, "")
 	}
+
+	if c.sessions != nil {
+		c.sessions.remove(c)
+	}
+}
+
+// event creates a new log event for this session.
+// When the process runs inside a container, includes the container id.
+func (c *Session) event(typ logging.EventType, message string, args ...interface{}) logging.Event {
+	event := logging.NewEvent(c.Session, typ, message, args...)
+	if cp, ok := c.Process.(ContainerProcess); ok {
+		event.ContainerID = cp.ContainerID()
+	}
+	return event
+}
+
+// log logs event to the logger of this session.
+func (c *Session) log(event logging.Event) {
+	logging.LogEvent(c.Logger, event)
 }
 
-// fmtLog is like FmtSSHLog, but for this session
-func (c *Session) fmtLog(message string, args ...interface{}) {
-	logging.FmtSSHLog(c.Logger, c, message, args...)
+// logEvent is like LogSSHEvent, but for this session
+func (c *Session) logEvent(typ logging.EventType, message string, args ...interface{}) {
+	c.log(c.event(typ, message, args...))
 }
@@ -0,0 +1,253 @@
+package proxyssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/errors"
+	"github.com/tkw1536/proxyssh/feature"
+	"github.com/tkw1536/proxyssh/logging"
+)
+
+// sessionGroups holds the active sessions of all servers.
+// It maps an *ssh.Server to a *sessionGroup, which may be shared between the servers of a ReloadableServer.
+var sessionGroups sync.Map
+
+// sessionGroupOf returns the group of active sessions of server.
+func sessionGroupOf(server *ssh.Server) *sessionGroup {
+	group, _ := sessionGroups.LoadOrStore(server, &sessionGroup{})
+	return group.(*sessionGroup)
+}
+
+// forgetSessionGroup removes group from all servers using it.
+func forgetSessionGroup(group *sessionGroup) {
+	sessionGroups.Range(func(server, g any) bool {
+		if g == group {
+			sessionGroups.Delete(server)
+		}
+		return true
+	})
+}
+
+// sessionGroup keeps track of a set of active sessions.
+// A session is active from when its process was started until its process has been cleaned up.
+//
+// The zero value is ready to use.
+type sessionGroup struct {
+	m        sync.Mutex
+	sessions map[*Session]struct{}
+	empty    chan struct{} // closed once sessions becomes empty, nil unless someone is waiting
+}
+
+// add adds session to this group
+func (group *sessionGroup) add(session *Session) {
+	group.m.Lock()
+	defer group.m.Unlock()
+
+	if group.sessions == nil {
+		group.sessions = make(map[*Session]struct{})
+	}
+	group.sessions[session] = struct{}{}
+}
+
+// remove removes session from this group.
+// When session is not part of this group, does nothing.
+func (group *sessionGroup) remove(session *Session) {
+	group.m.Lock()
+	defer group.m.Unlock()
+
+	if _, ok := group.sessions[session]; !ok {
+		return
+	}
+	delete(group.sessions, session)
+
+	if len(group.sessions) == 0 && group.empty != nil {
+		close(group.empty)
+		group.empty = nil
+	}
+}
+
+// each calls f for every session in this group.
+// f may add or remove sessions.
+func (group *sessionGroup) each(f func(session *Session)) {
+	group.m.Lock()
+	sessions := make([]*Session, 0, len(group.sessions))
+	for session := range group.sessions {
+		sessions = append(sessions, session)
+	}
+	group.m.Unlock()
+
+	for _, session := range sessions {
+		f(session)
+	}
+}
+
+// wait blocks until this group contains no more sessions, or ctx is done.
+// Sessions may be added concurrently.
+// Returns the error of ctx if it is done first.
+func (group *sessionGroup) wait(ctx context.Context) error {
+	group.m.Lock()
+	if len(group.sessions) == 0 {
+		group.m.Unlock()
+		return nil
+	}
+	if group.empty == nil {
+		group.empty = make(chan struct{})
+	}
+	empty := group.empty
+	group.m.Unlock()
+
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var errShutdown = errors.New("Server is shutting down")
+
+// ShutdownCleanupTimeout is the maximal time Shutdown waits for the processes of sessions to be cleaned up.
+var ShutdownCleanupTimeout = 10 * time.Second
+
+// Shutdown gracefully shuts down server.
+//
+// It first stops accepting new connections and, unless message is empty, writes message to the standard error of all active sessions.
+// It then waits up to drain for all connections to be closed by their clients.
+// Afterwards, all remaining connections are closed, and the processes of their sessions are cleaned up using Process.Cleanup.
+//
+// Shutdown waits up to ShutdownCleanupTimeout for the processes of all sessions handled by this package to be cleaned up.
+// If they are not cleaned up in time, returns an error.
+func Shutdown(logger logging.Logger, server *ssh.Server, message string, drain time.Duration) error {
+	logging.LogSSHEvent(logger, nil, logging.EventShutdownStart, "%s", drain)
+
+	group := sessionGroupOf(server)
+	defer forgetSessionGroup(group)
+
+	// warn all the active sessions
+	if message != "" {
+		group.each(func(session *Session) {
+			io.WriteString(session.Stderr(), message+"\n")
+		})
+	}
+
+	// wait for clients to disconnect on their own
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if ctx.Err() != nil {
+		// close all remaining connections, so that no new sessions can be started.
+		// then terminate all remaining sessions.
+		err = server.Close()
+		group.each(func(session *Session) {
+			session.finalize(255, errShutdown)
+		})
+	}
+
+	// wait for the processes to be cleaned up
+	cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), ShutdownCleanupTimeout)
+	defer cleanupCancel()
+
+	if werr := group.wait(cleanupCtx); werr != nil && err == nil {
+		err = errors.Wrap(werr, "Unable to clean up sessions")
+	}
+
+	logging.LogSSHEvent(logger, nil, logging.EventShutdownComplete, "")
+	return err
+}
+
+// ListenAndServe listens on all addresses of options and serves connections until the process receives an interrupt or terminate signal.
+// Once a signal is received, server is shut down using Shutdown with options.ShutdownMessage and options.DrainTimeout.
+//
+// Listeners are created using options.Listen.
+// When options does not contain any addresses, listens on server.Addr instead, or ':22' if it is empty.
+//
+// To listen on different addresses with different options, create a separate server for each set of options.
+// Then call ListenAndServe for each of them on a separate goroutine.
+//
+// When the server is shut down, returns the error returned by Shutdown.
+// Otherwise returns the error that caused the server to stop.
+func ListenAndServe(logger logging.Logger, server *ssh.Server, options *Options) error {
+	return listenAndServe(logger, server, func() *Options { return options }, nil)
+}
+
+// listenAndServe implements ListenAndServe.
+// options is called to get the options to listen and shut down with.
+// When reload is not nil, it is called whenever the process receives a hangup signal.
+func listenAndServe(logger logging.Logger, server *ssh.Server, options func() *Options, reload func()) error {
+	listeners, err := listen(logger, server, options())
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	hangups := make(chan os.Signal, 1)
+	if reload != nil {
+		signal.Notify(hangups, syscall.SIGHUP)
+		defer signal.Stop(hangups)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-hangups:
+				reload()
+			case <-signals:
+				opts := options()
+				shutdown <- Shutdown(logger, server, opts.ShutdownMessage, opts.DrainTimeout)
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// serve all the listeners, and stop all of them when one fails
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+
+	err = nil
+	for range listeners {
+		if e := <-errs; e != ssh.ErrServerClosed && err == nil {
+			err = e
+			server.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return <-shutdown
+}
+
+// listen creates the listeners for server using options, see ListenAndServe.
+func listen(logger logging.Logger, server *ssh.Server, options *Options) ([]net.Listener, error) {
+	listeners, err := options.Listen(logger)
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+
+	address := server.Addr
+	if address == "" {
+		address = ":22"
+	}
+	return feature.Listen(logger, address)
+}